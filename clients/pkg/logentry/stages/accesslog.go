@@ -0,0 +1,277 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyAccessLogStageConfig = "empty accesslog stage configuration"
+	ErrEmptyAccessLogStageSource = "empty source"
+	ErrAccessLogFormatRequired   = "accesslog stage format is required"
+	ErrAccessLogInvalidDirective = "accesslog stage format has an unsupported directive %q"
+)
+
+const (
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatCombined = "combined"
+)
+
+// accessLogFormats are the LogFormat strings of the predefined formats.
+var accessLogFormats = map[string]string{
+	AccessLogFormatCommon:   `%h %l %u %t "%r" %>s %b`,
+	AccessLogFormatCombined: `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`,
+}
+
+// accessLogDirectives are the extracted key and the expression of the value of
+// the supported LogFormat directives.
+var accessLogDirectives = map[byte]struct {
+	key     string
+	pattern string
+}{
+	'a': {"remote_addr", `\S+`},
+	'A': {"local_addr", `\S+`},
+	'b': {"bytes", `\d+|-`},
+	'B': {"bytes", `\d+`},
+	'D': {"duration_us", `\d+`},
+	'h': {"remote_host", `\S+`},
+	'H': {"protocol", `\S+`},
+	'I': {"bytes_received", `\d+`},
+	'k': {"keepalive", `\d+`},
+	'l': {"ident", `\S+`},
+	'm': {"method", `\S+`},
+	'O': {"bytes_sent", `\d+`},
+	'p': {"port", `\d+`},
+	'P': {"pid", `\d+`},
+	'q': {"query", `\S*`},
+	'r': {"request", `[^"]*`},
+	's': {"status", `\d{3}|-`},
+	't': {"time", `[^\]]*`},
+	'T': {"duration_s", `\d+`},
+	'u': {"user", `\S+`},
+	'U': {"path", `[^\s?]+`},
+	'v': {"virtual_host", `\S+`},
+	'V': {"server_name", `\S+`},
+	'X': {"connection_status", `[X+-]`},
+}
+
+// AccessLogConfig represents an AccessLog Stage configuration
+type AccessLogConfig struct {
+	// Format is `common`, `combined` or an Apache LogFormat string, e.g.
+	// `%h %l %u %t "%r" %>s %b %D`.
+	Format string  `mapstructure:"format"`
+	Source *string `mapstructure:"source"`
+}
+
+// validateAccessLogConfig validates an accesslog stage config and returns the
+// expression equivalent to its format.
+func validateAccessLogConfig(c *AccessLogConfig) (*regexp.Regexp, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyAccessLogStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return nil, errors.New(ErrEmptyAccessLogStageSource)
+	}
+	if c.Format == "" {
+		return nil, errors.New(ErrAccessLogFormatRequired)
+	}
+	format, ok := accessLogFormats[c.Format]
+	if !ok {
+		format = c.Format
+	}
+	expression, err := accessLogExpression(format)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	return expr, nil
+}
+
+// accessLogExpression converts a LogFormat string into a regular expression
+// capturing each directive in a group named after its extracted key. The
+// headers, environment variables and cookies, e.g. `%{User-agent}i`, are named
+// after their snake cased name, `user_agent`.
+func accessLogExpression(format string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			j := strings.IndexByte(format[i:], '%')
+			if j == -1 {
+				j = len(format) - i
+			}
+			sb.WriteString(regexp.QuoteMeta(format[i : i+j]))
+			i += j - 1
+			continue
+		}
+
+		start := i
+		i++
+		if i < len(format) && format[i] == '%' {
+			sb.WriteString("%")
+			continue
+		}
+		// The final or original status of redirected requests.
+		if i < len(format) && (format[i] == '>' || format[i] == '<') {
+			i++
+		}
+		var name string
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end == -1 {
+				return "", errors.Errorf(ErrAccessLogInvalidDirective, format[start:])
+			}
+			name = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(format) {
+			return "", errors.Errorf(ErrAccessLogInvalidDirective, format[start:])
+		}
+
+		if name != "" {
+			switch format[i] {
+			case 'i', 'o', 'e', 'C', 'n':
+				fmt.Fprintf(&sb, `(?P<%s>[^"]*)`, accessLogKey(name))
+				continue
+			}
+		}
+		d, ok := accessLogDirectives[format[i]]
+		if !ok || name != "" {
+			return "", errors.Errorf(ErrAccessLogInvalidDirective, format[start:i+1])
+		}
+		if format[i] == 't' {
+			// The brackets are not part of the time.
+			fmt.Fprintf(&sb, `\[(?P<%s>%s)\]`, d.key, d.pattern)
+			continue
+		}
+		fmt.Fprintf(&sb, `(?P<%s>%s)`, d.key, d.pattern)
+	}
+	sb.WriteString("$")
+	return sb.String(), nil
+}
+
+// accessLogKey returns the snake cased name of a header, e.g. `user_agent` for
+// `User-Agent`.
+func accessLogKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, name)
+}
+
+// accessLogStage extracts the fields of access logs. The `-` placeholder of the
+// missing values is not extracted, and the request is additionally extracted as
+// `method`, `path` and `protocol`.
+type accessLogStage struct {
+	cfg        *AccessLogConfig
+	expression *regexp.Regexp
+	logger     log.Logger
+}
+
+// newAccessLogStage creates a new accesslog pipeline stage from a config.
+func newAccessLogStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseAccessLogConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := validateAccessLogConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&accessLogStage{
+		cfg:        cfg,
+		expression: expression,
+		logger:     log.With(logger, "component", "stage", "type", "accesslog"),
+	}), nil
+}
+
+func parseAccessLogConfig(config interface{}) (*AccessLogConfig, error) {
+	cfg := &AccessLogConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (a *accessLogStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the accesslog stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if a.cfg.Source != nil {
+		if _, ok := extracted[*a.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(a.logger).Log("msg", "source does not exist in the set of extracted values", "source", *a.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*a.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(a.logger).Log("msg", "failed to convert source value to string", "source", *a.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*a.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(a.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	match := a.expression.FindStringSubmatch(*input)
+	if match == nil {
+		if Debug {
+			level.Debug(a.logger).Log("msg", "access log did not match the format", "format", a.cfg.Format)
+		}
+		return
+	}
+
+	for i, name := range a.expression.SubexpNames() {
+		if i == 0 || name == "" || match[i] == "-" || match[i] == "" {
+			continue
+		}
+		extracted[name] = match[i]
+		if name != "request" {
+			continue
+		}
+		if parts := strings.Split(match[i], " "); len(parts) == 3 {
+			extracted["method"] = parts[0]
+			extracted["path"] = parts[1]
+			extracted["protocol"] = parts[2]
+		}
+	}
+	if Debug {
+		level.Debug(a.logger).Log("msg", "extracted data debug in accesslog stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (a *accessLogStage) Name() string {
+	return StageTypeAccessLog
+}
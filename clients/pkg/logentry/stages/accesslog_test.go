@@ -0,0 +1,191 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testAccessLogYamlCommon = `
+pipeline_stages:
+- accesslog:
+    format: common
+`
+
+var testAccessLogYamlCombined = `
+pipeline_stages:
+- accesslog:
+    format: combined
+`
+
+var testAccessLogYamlCustom = `
+pipeline_stages:
+- json:
+    expressions:
+      log:
+- accesslog:
+    source: log
+    format: '%a %{X-Request-ID}i %m %U%q %>s %D'
+`
+
+func TestPipeline_AccessLog(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"common": {
+			testAccessLogYamlCommon,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			map[string]interface{}{
+				"remote_host": "127.0.0.1",
+				"user":        "frank",
+				"time":        "10/Oct/2000:13:55:36 -0700",
+				"request":     "GET /apache_pb.gif HTTP/1.0",
+				"method":      "GET",
+				"path":        "/apache_pb.gif",
+				"protocol":    "HTTP/1.0",
+				"status":      "200",
+				"bytes":       "2326",
+			},
+		},
+		"common missing fields": {
+			testAccessLogYamlCommon,
+			`10.0.0.2 - - [10/Oct/2000:13:55:36 -0700] "-" 408 -`,
+			map[string]interface{}{
+				"remote_host": "10.0.0.2",
+				"time":        "10/Oct/2000:13:55:36 -0700",
+				"status":      "408",
+			},
+		},
+		"combined": {
+			testAccessLogYamlCombined,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+			map[string]interface{}{
+				"remote_host": "127.0.0.1",
+				"user":        "frank",
+				"time":        "10/Oct/2000:13:55:36 -0700",
+				"request":     "GET /apache_pb.gif HTTP/1.0",
+				"method":      "GET",
+				"path":        "/apache_pb.gif",
+				"protocol":    "HTTP/1.0",
+				"status":      "200",
+				"bytes":       "2326",
+				"referer":     "http://www.example.com/start.html",
+				"user_agent":  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+			},
+		},
+		"combined missing referer and user agent": {
+			testAccessLogYamlCombined,
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "POST /login HTTP/1.1" 302 0 "-" ""`,
+			map[string]interface{}{
+				"remote_host": "127.0.0.1",
+				"time":        "10/Oct/2000:13:55:36 -0700",
+				"request":     "POST /login HTTP/1.1",
+				"method":      "POST",
+				"path":        "/login",
+				"protocol":    "HTTP/1.1",
+				"status":      "302",
+				"bytes":       "0",
+			},
+		},
+		"common line with combined format": {
+			testAccessLogYamlCombined,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			map[string]interface{}{},
+		},
+		"custom": {
+			testAccessLogYamlCustom,
+			`{"log":"10.1.1.1 abc-123 GET /search?q=loki 200 1534"}`,
+			map[string]interface{}{
+				"log":          "10.1.1.1 abc-123 GET /search?q=loki 200 1534",
+				"remote_addr":  "10.1.1.1",
+				"x_request_id": "abc-123",
+				"method":       "GET",
+				"path":         "/search",
+				"query":        "?q=loki",
+				"status":       "200",
+				"duration_us":  "1534",
+			},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestAccessLogConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrAccessLogFormatRequired),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+				"format": "common",
+			},
+			errors.New(ErrEmptyAccessLogStageSource),
+		},
+		"unsupported directive": {
+			map[string]interface{}{
+				"format": "%h %Z",
+			},
+			errors.Errorf(ErrAccessLogInvalidDirective, "%Z"),
+		},
+		"unterminated header": {
+			map[string]interface{}{
+				"format": "%h %{Referer",
+			},
+			errors.Errorf(ErrAccessLogInvalidDirective, "%{Referer"),
+		},
+		"name on a directive without one": {
+			map[string]interface{}{
+				"format": "%{foo}h",
+			},
+			errors.Errorf(ErrAccessLogInvalidDirective, "%{foo}h"),
+		},
+		"custom": {
+			map[string]interface{}{
+				"format": `%v %h [100%%] "%r" %<s`,
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseAccessLogConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateAccessLogConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("AccessLogConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
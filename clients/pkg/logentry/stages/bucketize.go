@@ -0,0 +1,168 @@
+package stages
+
+import (
+	"math"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyBucketizeStageConfig = "empty bucketize stage configuration"
+	ErrBucketizeSourceRequired   = "bucketize stage source value is required"
+	ErrEmptyBucketizeDestination = "empty destination in bucketize stage"
+	ErrBucketizeBucketsRequired  = "bucketize stage requires at least one bucket"
+	ErrBucketizeEmptyName        = "bucketize stage bucket %d has no name"
+	ErrBucketizeUnsortedBuckets  = "bucketize stage bucket %q max must be greater than the max of the previous bucket"
+	ErrBucketizeUnboundedBucket  = "bucketize stage bucket %q without max must be the last bucket"
+)
+
+// BucketizeBucket is a bucket of a Bucketize Stage.
+type BucketizeBucket struct {
+	Name string `mapstructure:"name"`
+	// Max is the upper edge of the bucket, the lower edge being the upper edge
+	// of the previous bucket. The last bucket may have no max to hold all the
+	// greater values.
+	Max *float64 `mapstructure:"max"`
+}
+
+// BucketizeConfig represents a Bucketize Stage configuration
+type BucketizeConfig struct {
+	// Source is the extracted numeric value to bucketize. Durations, e.g.
+	// `250ms`, are read in seconds.
+	Source string `mapstructure:"source"`
+	// Destination is the extracted key the bucket name is written to, the
+	// source by default.
+	Destination *string `mapstructure:"destination"`
+	// Buckets are the buckets ordered by increasing max.
+	Buckets []BucketizeBucket `mapstructure:"buckets"`
+	// Inclusive makes the max of a bucket part of it, which is the default, e.g.
+	// 100 is in the bucket with `max: 100`. When false, the max is part of the
+	// next bucket.
+	Inclusive *bool `mapstructure:"inclusive"`
+	// Default is written to the destination for the values greater than the max
+	// of the last bucket, which are left unchanged when unset.
+	Default *string `mapstructure:"default"`
+}
+
+// validateBucketizeConfig validates a bucketize stage config.
+func validateBucketizeConfig(c *BucketizeConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyBucketizeStageConfig)
+	}
+	if c.Source == "" {
+		return errors.New(ErrBucketizeSourceRequired)
+	}
+	if c.Destination == nil {
+		c.Destination = &c.Source
+	}
+	if *c.Destination == "" {
+		return errors.New(ErrEmptyBucketizeDestination)
+	}
+	if len(c.Buckets) == 0 {
+		return errors.New(ErrBucketizeBucketsRequired)
+	}
+	for i, b := range c.Buckets {
+		if b.Name == "" {
+			return errors.Errorf(ErrBucketizeEmptyName, i)
+		}
+		if b.Max == nil {
+			if i != len(c.Buckets)-1 {
+				return errors.Errorf(ErrBucketizeUnboundedBucket, b.Name)
+			}
+			continue
+		}
+		if i > 0 && *b.Max <= *c.Buckets[i-1].Max {
+			return errors.Errorf(ErrBucketizeUnsortedBuckets, b.Name)
+		}
+	}
+	if c.Inclusive == nil {
+		inclusive := true
+		c.Inclusive = &inclusive
+	}
+	return nil
+}
+
+// bucketizeStage writes the name of the bucket a numeric extracted value falls
+// into, bounding the cardinality of the labels made from it.
+type bucketizeStage struct {
+	cfg    *BucketizeConfig
+	logger log.Logger
+}
+
+// newBucketizeStage creates a new bucketize pipeline stage from a config.
+func newBucketizeStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseBucketizeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBucketizeConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&bucketizeStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "bucketize"),
+	}), nil
+}
+
+func parseBucketizeConfig(config interface{}) (*BucketizeConfig, error) {
+	cfg := &BucketizeConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (b *bucketizeStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	v, ok := extracted[b.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(b.logger).Log("msg", "source does not exist in the set of extracted values", "source", b.cfg.Source)
+		}
+		return
+	}
+	f, err := getFloat(v)
+	if err == nil && math.IsNaN(f) {
+		err = errors.New("value is NaN")
+	}
+	if err != nil {
+		if Debug {
+			level.Debug(b.logger).Log("msg", "failed to convert source value to a number", "source", b.cfg.Source, "err", err)
+		}
+		return
+	}
+	if bucket, ok := b.bucket(f); ok {
+		extracted[*b.cfg.Destination] = bucket
+		return
+	}
+	if b.cfg.Default != nil {
+		extracted[*b.cfg.Destination] = *b.cfg.Default
+		return
+	}
+	if Debug {
+		level.Debug(b.logger).Log("msg", "value is greater than the last bucket", "source", b.cfg.Source, "value", f)
+	}
+}
+
+// bucket returns the name of the bucket of the value, false when it is greater
+// than the max of the last bucket.
+func (b *bucketizeStage) bucket(f float64) (string, bool) {
+	for _, bucket := range b.cfg.Buckets {
+		if bucket.Max == nil || f < *bucket.Max || (*b.cfg.Inclusive && f == *bucket.Max) {
+			return bucket.Name, true
+		}
+	}
+	return "", false
+}
+
+// Name implements Stage
+func (b *bucketizeStage) Name() string {
+	return StageTypeBucketize
+}
@@ -0,0 +1,218 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testBucketizeYaml = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      duration:
+- bucketize:
+    source: duration
+    destination: latency
+    buckets:
+    - name: fast
+      max: 0.1
+    - name: medium
+      max: 1
+    - name: slow
+- labels:
+    latency:
+`
+
+func TestPipeline_Bucketize(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testBucketizeYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry, expected := range map[string]string{
+		"duration=45ms":  "fast",
+		"duration=0.25":  "medium",
+		"duration=1.5s":  "slow",
+		"duration=10m0s": "slow",
+	} {
+		out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+		assert.Equal(t, model.LabelValue(expected), out.Labels["latency"], entry)
+	}
+}
+
+func TestBucketizeStage_Process(t *testing.T) {
+	t.Parallel()
+
+	buckets := []interface{}{
+		map[string]interface{}{"name": "fast", "max": 100},
+		map[string]interface{}{"name": "medium", "max": 500},
+	}
+	tests := map[string]struct {
+		config   map[string]interface{}
+		value    interface{}
+		expected interface{}
+	}{
+		"first bucket": {
+			map[string]interface{}{},
+			"12",
+			"fast",
+		},
+		"negative": {
+			map[string]interface{}{},
+			-3,
+			"fast",
+		},
+		"inclusive edge": {
+			map[string]interface{}{},
+			"100",
+			"fast",
+		},
+		"exclusive edge": {
+			map[string]interface{}{"inclusive": false},
+			"100",
+			"medium",
+		},
+		"last edge inclusive": {
+			map[string]interface{}{},
+			float64(500),
+			"medium",
+		},
+		"last edge exclusive": {
+			map[string]interface{}{"inclusive": false},
+			float64(500),
+			nil,
+		},
+		"out of range": {
+			map[string]interface{}{},
+			"501",
+			nil,
+		},
+		"out of range with default": {
+			map[string]interface{}{"default": "slow"},
+			"1e9",
+			"slow",
+		},
+		"catch-all bucket": {
+			map[string]interface{}{"buckets": append(buckets[:2:2], map[string]interface{}{"name": "slow"})},
+			"1e9",
+			"slow",
+		},
+		"not numeric": {
+			map[string]interface{}{"default": "slow"},
+			"n/a",
+			nil,
+		},
+		"NaN": {
+			map[string]interface{}{"default": "slow"},
+			"NaN",
+			nil,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{"source": "duration", "destination": "bucket", "buckets": buckets}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			st, err := newBucketizeStage(util_log.Logger, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{"duration": tt.value}, nil, "line", time.Now()))[0]
+			bucket, ok := out.Extracted["bucket"]
+			if tt.expected == nil {
+				assert.False(t, ok, "unexpected bucket %v", bucket)
+				return
+			}
+			assert.Equal(t, tt.expected, bucket)
+		})
+	}
+}
+
+func TestBucketizeConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrBucketizeSourceRequired),
+		},
+		"empty destination": {
+			map[string]interface{}{
+				"source":      "duration",
+				"destination": "",
+			},
+			errors.New(ErrEmptyBucketizeDestination),
+		},
+		"no buckets": {
+			map[string]interface{}{
+				"source": "duration",
+			},
+			errors.New(ErrBucketizeBucketsRequired),
+		},
+		"bucket without name": {
+			map[string]interface{}{
+				"source":  "duration",
+				"buckets": []interface{}{map[string]interface{}{"max": 1}},
+			},
+			errors.Errorf(ErrBucketizeEmptyName, 0),
+		},
+		"unsorted buckets": {
+			map[string]interface{}{
+				"source": "duration",
+				"buckets": []interface{}{
+					map[string]interface{}{"name": "slow", "max": 10},
+					map[string]interface{}{"name": "fast", "max": 1},
+				},
+			},
+			errors.Errorf(ErrBucketizeUnsortedBuckets, "fast"),
+		},
+		"unbounded bucket not last": {
+			map[string]interface{}{
+				"source": "duration",
+				"buckets": []interface{}{
+					map[string]interface{}{"name": "any"},
+					map[string]interface{}{"name": "fast", "max": 1},
+				},
+			},
+			errors.Errorf(ErrBucketizeUnboundedBucket, "any"),
+		},
+		"valid": {
+			map[string]interface{}{
+				"source": "duration",
+				"buckets": []interface{}{
+					map[string]interface{}{"name": "fast", "max": 0.5},
+					map[string]interface{}{"name": "slow"},
+				},
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseBucketizeConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateBucketizeConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("BucketizeConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
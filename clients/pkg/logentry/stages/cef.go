@@ -0,0 +1,204 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyCEFStageConfig = "empty cef stage configuration"
+	ErrEmptyCEFStageSource = "empty source"
+)
+
+// cefHeaderKeys are the extracted keys of the header fields, in order.
+var cefHeaderKeys = []string{
+	"cef_version",
+	"cef_device_vendor",
+	"cef_device_product",
+	"cef_device_version",
+	"cef_signature_id",
+	"cef_name",
+	"cef_severity",
+}
+
+// CEFConfig represents a CEF Stage configuration
+type CEFConfig struct {
+	Source *string `mapstructure:"source"`
+}
+
+// validateCEFConfig validates a cef stage config.
+func validateCEFConfig(c *CEFConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyCEFStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyCEFStageSource)
+	}
+	return nil
+}
+
+// cefStage extracts the fields of Common Event Format messages, e.g. from
+// `CEF:0|Vendor|Product|1.0|100|Blocked|5|src=10.0.0.1 act=blocked`. The
+// header fields are extracted as `cef_version`, `cef_device_vendor`,
+// `cef_device_product`, `cef_device_version`, `cef_signature_id`, `cef_name`
+// and `cef_severity`, and the extensions as `cef_ext_<key>`. Anything before
+// `CEF:`, such as a syslog header, is ignored.
+type cefStage struct {
+	cfg    *CEFConfig
+	logger log.Logger
+}
+
+// newCEFStage creates a new cef pipeline stage from a config.
+func newCEFStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseCEFConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCEFConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&cefStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "cef"),
+	}), nil
+}
+
+func parseCEFConfig(config interface{}) (*CEFConfig, error) {
+	cfg := &CEFConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (c *cefStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the cef stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if c.cfg.Source != nil {
+		if _, ok := extracted[*c.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(c.logger).Log("msg", "source does not exist in the set of extracted values", "source", *c.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*c.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(c.logger).Log("msg", "failed to convert source value to string", "source", *c.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*c.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(c.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	header, extension, err := parseCEFHeader(*input)
+	if err != nil {
+		if Debug {
+			level.Debug(c.logger).Log("msg", "failed to parse cef message", "err", err)
+		}
+		return
+	}
+	for i, key := range cefHeaderKeys {
+		extracted[key] = header[i]
+	}
+	parseCEFExtension(extension, func(key, value string) {
+		extracted["cef_ext_"+key] = value
+	})
+	if Debug {
+		level.Debug(c.logger).Log("msg", "extracted data debug in cef stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// parseCEFHeader returns the unescaped header fields of the message and its
+// raw extension. The pipes and backslashes of the header are escaped with a
+// backslash.
+func parseCEFHeader(s string) ([]string, string, error) {
+	start := strings.Index(s, "CEF:")
+	if start == -1 {
+		return nil, "", errors.New("missing CEF: prefix")
+	}
+	s = s[start+len("CEF:"):]
+
+	header := make([]string, 0, len(cefHeaderKeys))
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\'):
+			i++
+			sb.WriteByte(s[i])
+		case s[i] == '|':
+			header = append(header, sb.String())
+			sb.Reset()
+			if len(header) == len(cefHeaderKeys) {
+				return header, s[i+1:], nil
+			}
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return nil, "", errors.Errorf("expected %d header fields, got %d", len(cefHeaderKeys), len(header))
+}
+
+// parseCEFExtension calls fn with the unescaped key value pairs of the
+// extension. Values may contain spaces, a value ends at the last space before
+// the next unescaped `=`.
+func parseCEFExtension(s string, fn func(key, value string)) {
+	key, valueStart := "", -1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			keyStart := strings.LastIndexByte(s[:i], ' ') + 1
+			if keyStart <= valueStart {
+				// The previous value is the only one without a space, e.g. `a=b=c`.
+				continue
+			}
+			if key != "" {
+				fn(key, unescapeCEFValue(strings.TrimRight(s[valueStart:keyStart], " ")))
+			}
+			key, valueStart = s[keyStart:i], i+1
+		}
+	}
+	if key != "" {
+		fn(key, unescapeCEFValue(strings.TrimRight(s[valueStart:], " ")))
+	}
+}
+
+var cefValueReplacer = strings.NewReplacer(`\\`, `\`, `\=`, `=`, `\|`, `|`, `\n`, "\n", `\r`, "\r")
+
+// unescapeCEFValue unescapes backslashes, equal signs and newlines of extension
+// values.
+func unescapeCEFValue(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	return cefValueReplacer.Replace(s)
+}
+
+// Name implements Stage
+func (c *cefStage) Name() string {
+	return StageTypeCEF
+}
@@ -0,0 +1,161 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testCEFYaml = `
+pipeline_stages:
+- cef:
+`
+
+var testCEFYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      raw:
+- cef:
+    source: raw
+`
+
+func TestPipeline_CEF(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"minimal header": {
+			testCEFYaml,
+			`CEF:0|Vendor|Product|1.0|100|Blocked|5|`,
+			map[string]interface{}{
+				"cef_version":        "0",
+				"cef_device_vendor":  "Vendor",
+				"cef_device_product": "Product",
+				"cef_device_version": "1.0",
+				"cef_signature_id":   "100",
+				"cef_name":           "Blocked",
+				"cef_severity":       "5",
+			},
+		},
+		"syslog prefix and extension": {
+			testCEFYaml,
+			`Sep 19 08:26:10 host CEF:0|Security|threatmanager|1.0|100|worm successfully stopped|10|src=10.0.0.1 dst=2.1.2.2 spt=1232 msg=detected a worm`,
+			map[string]interface{}{
+				"cef_version":        "0",
+				"cef_device_vendor":  "Security",
+				"cef_device_product": "threatmanager",
+				"cef_device_version": "1.0",
+				"cef_signature_id":   "100",
+				"cef_name":           "worm successfully stopped",
+				"cef_severity":       "10",
+				"cef_ext_src":        "10.0.0.1",
+				"cef_ext_dst":        "2.1.2.2",
+				"cef_ext_spt":        "1232",
+				"cef_ext_msg":        "detected a worm",
+			},
+		},
+		"escaped header and extension": {
+			testCEFYaml,
+			`CEF:1|Ven\|dor|Pro\\duct|2|sig|name|Low|msg=a\=b c\\d | e\nf fname=C:\\dir\\file.txt cs1Label=pipe\|test`,
+			map[string]interface{}{
+				"cef_version":        "1",
+				"cef_device_vendor":  "Ven|dor",
+				"cef_device_product": `Pro\duct`,
+				"cef_device_version": "2",
+				"cef_signature_id":   "sig",
+				"cef_name":           "name",
+				"cef_severity":       "Low",
+				"cef_ext_msg":        "a=b c\\d | e\nf",
+				"cef_ext_fname":      `C:\dir\file.txt`,
+				"cef_ext_cs1Label":   "pipe|test",
+			},
+		},
+		"source": {
+			testCEFYamlWithSource,
+			`{"raw":"CEF:0|V|P|1|2|N|3|act=blocked"}`,
+			map[string]interface{}{
+				"raw":                "CEF:0|V|P|1|2|N|3|act=blocked",
+				"cef_version":        "0",
+				"cef_device_vendor":  "V",
+				"cef_device_product": "P",
+				"cef_device_version": "1",
+				"cef_signature_id":   "2",
+				"cef_name":           "N",
+				"cef_severity":       "3",
+				"cef_ext_act":        "blocked",
+			},
+		},
+		"malformed header": {
+			testCEFYaml,
+			`CEF:0|Vendor|Product|1.0|100\|Blocked|5`,
+			map[string]interface{}{},
+		},
+		"not cef": {
+			testCEFYaml,
+			`level=info msg=hello`,
+			map[string]interface{}{},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestCEFConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyCEFStageSource),
+		},
+		"entry": {
+			nil,
+			nil,
+		},
+		"valid": {
+			map[string]interface{}{
+				"source": "raw",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseCEFConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateCEFConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("CEFConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package stages
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyCoerceStageConfig = "empty coerce stage configuration"
+	ErrCoerceKeysRequired     = "coerce stage requires at least one key"
+	ErrCoerceInvalidType      = "coerce stage type of %q must be one of `string`, `int`, `float` or `bool`, got %q"
+	ErrCoerceInvalidRounding  = "coerce stage rounding must be one of `truncate`, `round`, `floor` or `ceil`, got %q"
+	ErrCoerceInvalidPrecision = "coerce stage precision cannot be negative"
+)
+
+const (
+	CoerceTypeString = "string"
+	CoerceTypeInt    = "int"
+	CoerceTypeFloat  = "float"
+	CoerceTypeBool   = "bool"
+
+	CoerceRoundingTruncate = "truncate"
+	CoerceRoundingRound    = "round"
+	CoerceRoundingFloor    = "floor"
+	CoerceRoundingCeil     = "ceil"
+)
+
+// CoerceConfig represents a Coerce Stage configuration
+type CoerceConfig struct {
+	// Keys maps the extracted keys to the type they are converted to, one of
+	// `string`, `int`, `float` or `bool`.
+	Keys map[string]string `mapstructure:"keys"`
+	// Rounding is how floats are converted to ints, `truncate` by default.
+	Rounding string `mapstructure:"rounding"`
+	// Precision is the number of decimals of floats converted to strings, the
+	// shortest representation is used when unset.
+	Precision *int `mapstructure:"precision"`
+}
+
+// validateCoerceConfig validates a coerce stage config.
+func validateCoerceConfig(c *CoerceConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyCoerceStageConfig)
+	}
+	if len(c.Keys) == 0 {
+		return errors.New(ErrCoerceKeysRequired)
+	}
+	for key, typ := range c.Keys {
+		typ = strings.ToLower(typ)
+		switch typ {
+		case CoerceTypeString, CoerceTypeInt, CoerceTypeFloat, CoerceTypeBool:
+			c.Keys[key] = typ
+		default:
+			return errors.Errorf(ErrCoerceInvalidType, key, typ)
+		}
+	}
+	switch c.Rounding {
+	case "":
+		c.Rounding = CoerceRoundingTruncate
+	case CoerceRoundingTruncate, CoerceRoundingRound, CoerceRoundingFloor, CoerceRoundingCeil:
+	default:
+		return errors.Errorf(ErrCoerceInvalidRounding, c.Rounding)
+	}
+	if c.Precision != nil && *c.Precision < 0 {
+		return errors.New(ErrCoerceInvalidPrecision)
+	}
+	return nil
+}
+
+// coerceStage converts extracted values to a type. The converted values are
+// written back as string, int64, float64 or bool.
+type coerceStage struct {
+	cfg    *CoerceConfig
+	logger log.Logger
+}
+
+// newCoerceStage creates a new coerce pipeline stage from a config.
+func newCoerceStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseCoerceConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCoerceConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&coerceStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "coerce"),
+	}), nil
+}
+
+func parseCoerceConfig(config interface{}) (*CoerceConfig, error) {
+	cfg := &CoerceConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (c *coerceStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	for key, typ := range c.cfg.Keys {
+		v, ok := extracted[key]
+		if !ok {
+			continue
+		}
+		var (
+			converted interface{}
+			err       error
+		)
+		switch typ {
+		case CoerceTypeString:
+			converted, err = c.toString(v)
+		case CoerceTypeInt:
+			converted, err = c.toInt(v)
+		case CoerceTypeFloat:
+			converted, err = toFloat(v)
+		case CoerceTypeBool:
+			converted, err = toBool(v)
+		}
+		if err != nil {
+			if Debug {
+				level.Debug(c.logger).Log("msg", "failed to coerce extracted value", "key", key, "to", typ, "err", err, "type", reflect.TypeOf(v))
+			}
+			continue
+		}
+		extracted[key] = converted
+	}
+}
+
+func (c *coerceStage) toString(v interface{}) (string, error) {
+	if c.cfg.Precision != nil {
+		switch f := v.(type) {
+		case float64:
+			return strconv.FormatFloat(f, 'f', *c.cfg.Precision, 64), nil
+		case float32:
+			return strconv.FormatFloat(float64(f), 'f', *c.cfg.Precision, 32), nil
+		}
+	}
+	return getString(v)
+}
+
+func (c *coerceStage) toInt(v interface{}) (int64, error) {
+	switch i := v.(type) {
+	case int64:
+		return i, nil
+	case int32:
+		return int64(i), nil
+	case int:
+		return int64(i), nil
+	case uint64:
+		if i > math.MaxInt64 {
+			return 0, fmt.Errorf("%d overflows int64", i)
+		}
+		return int64(i), nil
+	case uint32:
+		return int64(i), nil
+	case uint:
+		if uint64(i) > math.MaxInt64 {
+			return 0, fmt.Errorf("%d overflows int64", i)
+		}
+		return int64(i), nil
+	case string:
+		// Ints are parsed as is so that they do not lose precision as floats.
+		if n, err := strconv.ParseInt(strings.TrimSpace(i), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	switch c.cfg.Rounding {
+	case CoerceRoundingRound:
+		f = math.Round(f)
+	case CoerceRoundingFloor:
+		f = math.Floor(f)
+	case CoerceRoundingCeil:
+		f = math.Ceil(f)
+	default:
+		f = math.Trunc(f)
+	}
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v overflows int64", v)
+	}
+	return int64(f), nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	if s, ok := v.(string); ok {
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	}
+	return getFloat(v)
+}
+
+func toBool(v interface{}) (bool, error) {
+	if s, ok := v.(string); ok {
+		return strconv.ParseBool(strings.TrimSpace(s))
+	}
+	f, err := getFloat(v)
+	if err != nil {
+		return false, err
+	}
+	return f != 0, nil
+}
+
+// Name implements Stage
+func (c *coerceStage) Name() string {
+	return StageTypeCoerce
+}
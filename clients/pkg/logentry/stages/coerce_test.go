@@ -0,0 +1,203 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testCoerceYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      status:
+      duration:
+      ok:
+      user:
+- coerce:
+    keys:
+      status: string
+      duration: int
+      ok: bool
+      user: int
+`
+
+func TestPipeline_Coerce(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testCoerceYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, `{"status":200,"duration":"1.9","ok":"true","user":"frank"}`, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"status":   "200",
+		"duration": int64(1),
+		"ok":       true,
+		// Values which cannot be converted are left unchanged.
+		"user": "frank",
+	}, out.Extracted)
+}
+
+func TestCoerceStage_Conversions(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		value    interface{}
+		expected interface{}
+	}{
+		"float to string": {
+			map[string]interface{}{"keys": map[string]string{"v": "string"}},
+			1.50,
+			"1.5",
+		},
+		"float to string with precision": {
+			map[string]interface{}{"keys": map[string]string{"v": "string"}, "precision": 2},
+			1.5,
+			"1.50",
+		},
+		"bool to string": {
+			map[string]interface{}{"keys": map[string]string{"v": "string"}},
+			false,
+			"false",
+		},
+		"string to int": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}},
+			" 9007199254740993",
+			int64(9007199254740993),
+		},
+		"float to int truncated": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}},
+			-2.7,
+			int64(-2),
+		},
+		"float to int rounded": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}, "rounding": "round"},
+			2.5,
+			int64(3),
+		},
+		"float to int floor": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}, "rounding": "floor"},
+			-2.2,
+			int64(-3),
+		},
+		"float string to int ceil": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}, "rounding": "ceil"},
+			"2.2",
+			int64(3),
+		},
+		"bool to int": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}},
+			true,
+			int64(1),
+		},
+		"int overflow": {
+			map[string]interface{}{"keys": map[string]string{"v": "int"}},
+			1e20,
+			1e20,
+		},
+		"string to float": {
+			map[string]interface{}{"keys": map[string]string{"v": "float"}},
+			"0.25",
+			0.25,
+		},
+		"int to float": {
+			map[string]interface{}{"keys": map[string]string{"v": "FLOAT"}},
+			3,
+			float64(3),
+		},
+		"duration is not a float": {
+			map[string]interface{}{"keys": map[string]string{"v": "float"}},
+			"1s",
+			"1s",
+		},
+		"string to bool": {
+			map[string]interface{}{"keys": map[string]string{"v": "bool"}},
+			"F",
+			false,
+		},
+		"number to bool": {
+			map[string]interface{}{"keys": map[string]string{"v": "bool"}},
+			0.5,
+			true,
+		},
+		"invalid bool": {
+			map[string]interface{}{"keys": map[string]string{"v": "bool"}},
+			"yes",
+			"yes",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newCoerceStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{"v": tt.value}, nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted["v"])
+		})
+	}
+}
+
+func TestCoerceConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrCoerceKeysRequired),
+		},
+		"invalid type": {
+			map[string]interface{}{
+				"keys": map[string]string{"status": "number"},
+			},
+			errors.Errorf(ErrCoerceInvalidType, "status", "number"),
+		},
+		"invalid rounding": {
+			map[string]interface{}{
+				"keys":     map[string]string{"status": "int"},
+				"rounding": "up",
+			},
+			errors.Errorf(ErrCoerceInvalidRounding, "up"),
+		},
+		"negative precision": {
+			map[string]interface{}{
+				"keys":      map[string]string{"status": "string"},
+				"precision": -1,
+			},
+			errors.New(ErrCoerceInvalidPrecision),
+		},
+		"valid": {
+			map[string]interface{}{
+				"keys":     map[string]string{"status": "int", "ok": "Bool"},
+				"rounding": "round",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseCoerceConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateCoerceConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("CoerceConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
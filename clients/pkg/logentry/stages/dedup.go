@@ -0,0 +1,204 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyDedupStageConfig = "empty dedup stage configuration"
+	ErrDedupInvalidWindow    = "dedup stage invalid window, %v cannot be converted to a positive duration: %v"
+	ErrEmptyDedupKey         = "empty key in dedup stage"
+	ErrEmptyDedupRepeatCount = "empty repeat_count_key in dedup stage"
+	ErrDedupInvalidMaxStream = "dedup stage max_streams must be greater than 0, got %d"
+)
+
+const (
+	defaultDedupWindow     = 10 * time.Second
+	defaultDedupMaxStreams = 10000
+)
+
+var defaultDedupReason = "dedup_stage"
+
+// DedupConfig represents a Dedup Stage configuration
+type DedupConfig struct {
+	DropReason *string `mapstructure:"drop_counter_reason"`
+	// Keys are the extracted values compared to tell whether two lines are
+	// identical, the lines themselves being compared when empty. A missing key
+	// compares as an empty value.
+	Keys []string `mapstructure:"keys"`
+	// Window is the duration, 10s by default, after the timestamp of the last
+	// line sent during which the identical lines of the stream are dropped. The
+	// first identical line past it is sent and starts a new window.
+	Window *string `mapstructure:"window"`
+	window time.Duration
+	// RepeatCountKey is the extracted key the number of lines dropped since the
+	// previous line sent is written to, on the next line of the stream sent.
+	RepeatCountKey *string `mapstructure:"repeat_count_key"`
+	// MaxStreams bounds the number of streams whose last line is kept, the least
+	// recently seen stream being evicted past it.
+	MaxStreams int `mapstructure:"max_streams"`
+}
+
+// validateDedupConfig validates a dedup stage config.
+func validateDedupConfig(c *DedupConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyDedupStageConfig)
+	}
+	if c.DropReason == nil || *c.DropReason == "" {
+		c.DropReason = &defaultDedupReason
+	}
+	for _, key := range c.Keys {
+		if key == "" {
+			return errors.New(ErrEmptyDedupKey)
+		}
+	}
+	c.window = defaultDedupWindow
+	if c.Window != nil {
+		window, err := time.ParseDuration(*c.Window)
+		if err == nil && window <= 0 {
+			err = errors.New("duration must be positive")
+		}
+		if err != nil {
+			return errors.Errorf(ErrDedupInvalidWindow, *c.Window, err)
+		}
+		c.window = window
+	}
+	if c.RepeatCountKey != nil && *c.RepeatCountKey == "" {
+		return errors.New(ErrEmptyDedupRepeatCount)
+	}
+	if c.MaxStreams == 0 {
+		c.MaxStreams = defaultDedupMaxStreams
+	}
+	if c.MaxStreams < 0 {
+		return errors.Errorf(ErrDedupInvalidMaxStream, c.MaxStreams)
+	}
+	return nil
+}
+
+// dedupLine is the last line sent of a stream.
+type dedupLine struct {
+	hash      uint64
+	timestamp time.Time
+	// repeats is the number of identical lines dropped since.
+	repeats int
+}
+
+// dedupStage drops the lines identical to the previous line of their stream,
+// i.e. of their set of labels, within a window of time, e.g. a connection
+// error logged in a retry loop.
+type dedupStage struct {
+	cfg       *DedupConfig
+	logger    log.Logger
+	dropCount *prometheus.CounterVec
+
+	// mtx makes comparing and updating the last line of a stream atomic.
+	mtx sync.Mutex
+	// lines are the last line sent of each stream, by label set fingerprint.
+	lines *lru.Cache[model.Fingerprint, *dedupLine]
+}
+
+// newDedupStage creates a new dedup pipeline stage from a config.
+func newDedupStage(logger log.Logger, config interface{}, registerer prometheus.Registerer) (Stage, error) {
+	cfg, err := parseDedupConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateDedupConfig(cfg); err != nil {
+		return nil, err
+	}
+	lines, err := lru.New[model.Fingerprint, *dedupLine](cfg.MaxStreams)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupStage{
+		cfg:       cfg,
+		logger:    log.With(logger, "component", "stage", "type", "dedup"),
+		dropCount: getDropCountMetric(registerer),
+		lines:     lines,
+	}, nil
+}
+
+func parseDedupConfig(config interface{}) (*DedupConfig, error) {
+	cfg := &DedupConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Run implements Stage
+func (d *dedupStage) Run(in chan Entry) chan Entry {
+	return RunWithSkip(in, func(e Entry) (Entry, bool) {
+		if d.duplicate(e) {
+			d.dropCount.WithLabelValues(*d.cfg.DropReason).Inc()
+			return e, true
+		}
+		return e, false
+	})
+}
+
+// duplicate returns whether the entry is identical to the last line sent of
+// its stream within the window, and otherwise records it as the last line.
+func (d *dedupStage) duplicate(e Entry) bool {
+	fp := e.Labels.Fingerprint()
+	hash := d.hash(e)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	last, ok := d.lines.Get(fp)
+	if ok && last.hash == hash && e.Timestamp.Sub(last.timestamp) < d.cfg.window {
+		last.repeats++
+		if Debug {
+			level.Debug(d.logger).Log("msg", "dropping duplicate line", "labels", e.Labels, "repeats", last.repeats)
+		}
+		return true
+	}
+	if ok && last.repeats > 0 && d.cfg.RepeatCountKey != nil {
+		e.Extracted[*d.cfg.RepeatCountKey] = last.repeats
+	}
+	d.lines.Add(fp, &dedupLine{hash: hash, timestamp: e.Timestamp})
+	return false
+}
+
+// hash returns the hash of the compared values of the entry.
+func (d *dedupStage) hash(e Entry) uint64 {
+	if len(d.cfg.Keys) == 0 {
+		return xxhash.Sum64String(e.Line)
+	}
+	h := xxhash.New()
+	for _, key := range d.cfg.Keys {
+		if v, ok := e.Extracted[key]; ok {
+			s, err := getString(v)
+			if err != nil && Debug {
+				level.Debug(d.logger).Log("msg", "failed to convert extracted value to string", "key", key, "err", err)
+			}
+			_, _ = h.WriteString(s)
+		}
+		// Separates the values so that `ab`, `c` and `a`, `bc` differ.
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// Name implements Stage
+func (d *dedupStage) Name() string {
+	return StageTypeDedup
+}
+
+// Cleanup implements Stage.
+func (*dedupStage) Cleanup() {
+	// no-op
+}
@@ -0,0 +1,217 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testDedupYaml = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      msg:
+- dedup:
+    keys: [msg]
+    window: 1m
+    repeat_count_key: repeats
+- template:
+    source: repeats
+    template: '{{ if .Value }} (repeated {{ .Value }} times){{ end }}'
+- output:
+    source: repeats
+`
+
+func TestPipeline_Dedup(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testDedupYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now()
+	lbs := model.LabelSet{"job": "app"}
+	out := processEntries(pl,
+		newEntry(nil, lbs, `ts=1 msg="connection refused"`, ts),
+		newEntry(nil, lbs, `ts=2 msg="connection refused"`, ts.Add(time.Second)),
+		newEntry(nil, lbs, `ts=3 msg="connection refused"`, ts.Add(2*time.Second)),
+		newEntry(nil, lbs, `ts=4 msg=connected`, ts.Add(3*time.Second)),
+	)
+	assert.Len(t, out, 2)
+	assert.Equal(t, " (repeated 2 times)", out[1].Line)
+}
+
+func TestDedupStage_Run(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	web1 := model.LabelSet{"host": "web-1"}
+	web2 := model.LabelSet{"host": "web-2"}
+	type line struct {
+		labels model.LabelSet
+		line   string
+		offset time.Duration
+	}
+	tests := map[string]struct {
+		config   map[string]interface{}
+		lines    []line
+		expected []string
+		repeats  []interface{}
+		dropped  float64
+	}{
+		"repeated lines collapsed": {
+			map[string]interface{}{},
+			[]line{
+				{web1, "retrying", 0},
+				{web1, "retrying", time.Second},
+				{web1, "retrying", 2 * time.Second},
+				{web1, "done", 3 * time.Second},
+				{web1, "done", 4 * time.Second},
+			},
+			[]string{"retrying", "done"},
+			[]interface{}{nil, 2},
+			3,
+		},
+		"window expired": {
+			map[string]interface{}{"window": "5s"},
+			[]line{
+				{web1, "retrying", 0},
+				{web1, "retrying", 4 * time.Second},
+				{web1, "retrying", 5 * time.Second},
+				{web1, "retrying", 6 * time.Second},
+				{web1, "retrying", 11 * time.Second},
+			},
+			[]string{"retrying", "retrying", "retrying"},
+			[]interface{}{nil, 1, 1},
+			2,
+		},
+		"identical lines not consecutive": {
+			map[string]interface{}{},
+			[]line{
+				{web1, "retrying", 0},
+				{web1, "failed", time.Second},
+				{web1, "retrying", 2 * time.Second},
+			},
+			[]string{"retrying", "failed", "retrying"},
+			[]interface{}{nil, nil, nil},
+			0,
+		},
+		"independent streams": {
+			map[string]interface{}{},
+			[]line{
+				{web1, "retrying", 0},
+				{web2, "retrying", time.Second},
+				{web1, "retrying", 2 * time.Second},
+				{web2, "done", 3 * time.Second},
+			},
+			[]string{"retrying", "retrying", "done"},
+			[]interface{}{nil, nil, nil},
+			1,
+		},
+		"least recently seen stream evicted": {
+			map[string]interface{}{"max_streams": 1},
+			[]line{
+				{web1, "retrying", 0},
+				{web2, "retrying", time.Second},
+				{web1, "retrying", 2 * time.Second},
+			},
+			[]string{"retrying", "retrying", "retrying"},
+			[]interface{}{nil, nil, nil},
+			0,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			registry := prometheus.NewRegistry()
+			config := map[string]interface{}{"repeat_count_key": "repeats"}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			st, err := newDedupStage(util_log.Logger, config, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := make([]Entry, 0, len(tt.lines))
+			for _, l := range tt.lines {
+				entries = append(entries, newEntry(nil, l.labels.Clone(), l.line, ts.Add(l.offset)))
+			}
+			out := processEntries(st, entries...)
+			lines := make([]string, 0, len(out))
+			repeats := make([]interface{}, 0, len(out))
+			for _, e := range out {
+				lines = append(lines, e.Line)
+				repeats = append(repeats, e.Extracted["repeats"])
+			}
+			assert.Equal(t, tt.expected, lines)
+			assert.Equal(t, tt.repeats, repeats)
+			assert.Equal(t, tt.dropped, testutil.ToFloat64(getDropCountMetric(registry).WithLabelValues(defaultDedupReason)))
+		})
+	}
+}
+
+func TestDedupConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"invalid window": {
+			map[string]interface{}{
+				"window": "often",
+			},
+			errors.Errorf(ErrDedupInvalidWindow, "often", `time: invalid duration "often"`),
+		},
+		"negative window": {
+			map[string]interface{}{
+				"window": "-1s",
+			},
+			errors.Errorf(ErrDedupInvalidWindow, "-1s", "duration must be positive"),
+		},
+		"empty key": {
+			map[string]interface{}{
+				"keys": []string{"msg", ""},
+			},
+			errors.New(ErrEmptyDedupKey),
+		},
+		"empty repeat_count_key": {
+			map[string]interface{}{
+				"repeat_count_key": "",
+			},
+			errors.New(ErrEmptyDedupRepeatCount),
+		},
+		"negative max_streams": {
+			map[string]interface{}{
+				"max_streams": -1,
+			},
+			errors.Errorf(ErrDedupInvalidMaxStream, -1),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseDedupConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateDedupConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("DedupConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package stages
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyDropKeysStageConfig = "empty drop_keys stage configuration"
+	ErrDropKeysRequired         = "drop_keys stage requires `keys` or an `expression`"
+	ErrDropKeysEmptyKey         = "drop_keys stage cannot drop an empty key"
+)
+
+// DropKeysConfig represents a DropKeys Stage configuration
+type DropKeysConfig struct {
+	// Keys are the extracted keys dropped.
+	Keys []string `mapstructure:"keys"`
+	// Expression drops the extracted keys it matches, e.g. `^tmp_`.
+	Expression *string `mapstructure:"expression"`
+}
+
+// validateDropKeysConfig validates a drop_keys stage config and returns the
+// compiled expression, if any.
+func validateDropKeysConfig(c *DropKeysConfig) (*regexp.Regexp, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyDropKeysStageConfig)
+	}
+	if len(c.Keys) == 0 && c.Expression == nil {
+		return nil, errors.New(ErrDropKeysRequired)
+	}
+	for _, key := range c.Keys {
+		if key == "" {
+			return nil, errors.New(ErrDropKeysEmptyKey)
+		}
+	}
+	if c.Expression == nil {
+		return nil, nil
+	}
+	expr, err := regexp.Compile(*c.Expression)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	return expr, nil
+}
+
+// dropKeysStage removes extracted keys, e.g. the intermediate values which must
+// not be promoted to labels by the following stages.
+type dropKeysStage struct {
+	cfg        *DropKeysConfig
+	expression *regexp.Regexp
+	logger     log.Logger
+}
+
+// newDropKeysStage creates a new drop_keys pipeline stage from a config.
+func newDropKeysStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseDropKeysConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := validateDropKeysConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&dropKeysStage{
+		cfg:        cfg,
+		expression: expression,
+		logger:     log.With(logger, "component", "stage", "type", "drop_keys"),
+	}), nil
+}
+
+func parseDropKeysConfig(config interface{}) (*DropKeysConfig, error) {
+	cfg := &DropKeysConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (d *dropKeysStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	for _, key := range d.cfg.Keys {
+		delete(extracted, key)
+	}
+	if d.expression != nil {
+		for key := range extracted {
+			if d.expression.MatchString(key) {
+				delete(extracted, key)
+			}
+		}
+	}
+	if Debug {
+		level.Debug(d.logger).Log("msg", "extracted data debug in drop_keys stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (d *dropKeysStage) Name() string {
+	return StageTypeDropKeys
+}
@@ -0,0 +1,130 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testDropKeysYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      user:
+      token:
+      level:
+- drop_keys:
+    keys:
+    - token
+- labels:
+    level:
+    token:
+`
+
+func TestPipeline_DropKeys(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testDropKeysYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, model.LabelSet{}, `{"user":"frank","token":"s3cr3t","level":"info"}`, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{"user": "frank", "level": "info"}, out.Extracted)
+	// The dropped key is not promoted to a label.
+	assert.Equal(t, model.LabelSet{"level": "info"}, out.Labels)
+}
+
+func TestDropKeysStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"keys": {
+			map[string]interface{}{
+				"keys": []string{"password", "missing"},
+			},
+			map[string]interface{}{"user": "frank", "tmp_id": "1", "tmp_session": "abc"},
+		},
+		"expression": {
+			map[string]interface{}{
+				"expression": "^tmp_",
+			},
+			map[string]interface{}{"user": "frank", "password": "hunter2"},
+		},
+		"keys and expression": {
+			map[string]interface{}{
+				"keys":       []string{"password"},
+				"expression": "^tmp_",
+			},
+			map[string]interface{}{"user": "frank"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newDropKeysStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted := map[string]interface{}{"user": "frank", "password": "hunter2", "tmp_id": "1", "tmp_session": "abc"}
+			out := processEntries(st, newEntry(extracted, nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+		})
+	}
+}
+
+func TestDropKeysConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrDropKeysRequired),
+		},
+		"empty key": {
+			map[string]interface{}{
+				"keys": []string{"token", ""},
+			},
+			errors.New(ErrDropKeysEmptyKey),
+		},
+		"invalid expression": {
+			map[string]interface{}{
+				"expression": "(",
+			},
+			errors.Wrap(errors.New("error parsing regexp: missing closing ): `(`"), ErrCouldNotCompileRegex),
+		},
+		"valid": {
+			map[string]interface{}{
+				"keys":       []string{"token"},
+				"expression": "^tmp_",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseDropKeysConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateDropKeysConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("DropKeysConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package stages
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyFingerprintStageConfig = "empty fingerprint stage configuration"
+	ErrFingerprintTargetRequired   = "fingerprint stage target is required"
+	ErrFingerprintInvalidAlgorithm = "fingerprint stage algorithm must be one of `xxhash` or `fnv`, got %q"
+	ErrFingerprintEmptySource      = "fingerprint stage sources cannot contain an empty key"
+)
+
+const (
+	FingerprintAlgorithmXXHash = "xxhash"
+	FingerprintAlgorithmFNV    = "fnv"
+)
+
+// FingerprintConfig represents a Fingerprint Stage configuration
+type FingerprintConfig struct {
+	// Sources are the extracted keys hashed together, the entry is hashed when empty.
+	Sources []string `mapstructure:"sources"`
+	// Target is the extracted key the fingerprint is stored under.
+	Target string `mapstructure:"target"`
+	// Algorithm is either `xxhash` (default) or `fnv` (64-bit FNV-1a).
+	Algorithm string `mapstructure:"algorithm"`
+	// Lowercase lowercases the values before hashing.
+	Lowercase bool `mapstructure:"lowercase"`
+	// CollapseDigits replaces every run of digits with a single `0` before
+	// hashing, so that lines only differing by numbers share a fingerprint.
+	CollapseDigits bool `mapstructure:"collapse_digits"`
+}
+
+// validateFingerprintConfig validates a fingerprint stage config.
+func validateFingerprintConfig(c *FingerprintConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyFingerprintStageConfig)
+	}
+	if c.Target == "" {
+		return errors.New(ErrFingerprintTargetRequired)
+	}
+	switch c.Algorithm {
+	case "":
+		c.Algorithm = FingerprintAlgorithmXXHash
+	case FingerprintAlgorithmXXHash, FingerprintAlgorithmFNV:
+	default:
+		return errors.Errorf(ErrFingerprintInvalidAlgorithm, c.Algorithm)
+	}
+	for _, s := range c.Sources {
+		if s == "" {
+			return errors.New(ErrFingerprintEmptySource)
+		}
+	}
+	return nil
+}
+
+// fingerprintStage stores a hash of the entry or of extracted values
+type fingerprintStage struct {
+	cfg    *FingerprintConfig
+	logger log.Logger
+}
+
+// newFingerprintStage creates a new fingerprint pipeline stage from a config.
+func newFingerprintStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseFingerprintConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFingerprintConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&fingerprintStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "fingerprint"),
+	}), nil
+}
+
+func parseFingerprintConfig(config interface{}) (*FingerprintConfig, error) {
+	cfg := &FingerprintConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (f *fingerprintStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	var h hash.Hash64
+	if f.cfg.Algorithm == FingerprintAlgorithmFNV {
+		h = fnv.New64a()
+	} else {
+		h = xxhash.New()
+	}
+
+	if len(f.cfg.Sources) == 0 {
+		if entry == nil {
+			if Debug {
+				level.Debug(f.logger).Log("msg", "cannot fingerprint a nil entry")
+			}
+			return
+		}
+		_, _ = h.Write([]byte(f.normalize(*entry)))
+	}
+	for _, source := range f.cfg.Sources {
+		// Missing values are hashed as empty strings, the separator keeps the
+		// fingerprint of `a`,`bc` apart from the one of `ab`,`c`.
+		if v, ok := extracted[source]; ok {
+			value, err := getString(v)
+			if err != nil {
+				if Debug {
+					level.Debug(f.logger).Log("msg", "failed to convert source value to string", "source", source, "err", err, "type", reflect.TypeOf(v))
+				}
+				return
+			}
+			_, _ = h.Write([]byte(f.normalize(value)))
+		}
+		_, _ = h.Write([]byte{0})
+	}
+
+	extracted[f.cfg.Target] = fmt.Sprintf("%016x", h.Sum64())
+}
+
+// normalize applies the configured normalizations to a value before hashing.
+func (f *fingerprintStage) normalize(s string) string {
+	if f.cfg.Lowercase {
+		s = strings.ToLower(s)
+	}
+	if !f.cfg.CollapseDigits {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	inDigits := false
+	for _, r := range s {
+		if unicode.IsDigit(r) {
+			if !inDigits {
+				b.WriteByte('0')
+			}
+			inDigits = true
+			continue
+		}
+		inDigits = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Name implements Stage
+func (f *fingerprintStage) Name() string {
+	return StageTypeFingerprint
+}
@@ -0,0 +1,134 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testFingerprintYamlCollapseDigits = `
+pipeline_stages:
+- fingerprint:
+    target: fingerprint
+    lowercase: true
+    collapse_digits: true
+`
+
+var testFingerprintYamlRaw = `
+pipeline_stages:
+- fingerprint:
+    target: fingerprint
+`
+
+var testFingerprintYamlSources = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      level:
+      msg:
+- fingerprint:
+    sources: [level, msg]
+    target: fingerprint
+    algorithm: fnv
+    collapse_digits: true
+`
+
+func fingerprintOf(t *testing.T, config string, line string) interface{} {
+	pl, err := NewPipeline(util_log.Logger, loadConfig(config), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return processEntries(pl, newEntry(nil, nil, line, time.Now()))[0].Extracted["fingerprint"]
+}
+
+func TestPipeline_Fingerprint(t *testing.T) {
+	t.Parallel()
+
+	first := `Flushed chunk 1234 for stream 42 in 12ms`
+	second := `flushed chunk 98 for stream 7 in 3ms`
+	other := `Failed to flush chunk 98 for stream 7`
+
+	fp := fingerprintOf(t, testFingerprintYamlCollapseDigits, first)
+	assert.Len(t, fp, 16)
+	assert.Equal(t, fp, fingerprintOf(t, testFingerprintYamlCollapseDigits, second))
+	assert.NotEqual(t, fp, fingerprintOf(t, testFingerprintYamlCollapseDigits, other))
+
+	// Without normalization the numbers are part of the fingerprint.
+	assert.NotEqual(t, fingerprintOf(t, testFingerprintYamlRaw, first), fingerprintOf(t, testFingerprintYamlRaw, second))
+	assert.Equal(t, fingerprintOf(t, testFingerprintYamlRaw, first), fingerprintOf(t, testFingerprintYamlRaw, first))
+
+	// Only the sources are hashed.
+	assert.Equal(t,
+		fingerprintOf(t, testFingerprintYamlSources, `level=info msg="flushed chunk 1234" ts=1`),
+		fingerprintOf(t, testFingerprintYamlSources, `level=info msg="flushed chunk 56" ts=2 caller=flush.go`),
+	)
+	assert.NotEqual(t,
+		fingerprintOf(t, testFingerprintYamlSources, `level=info msg="flushed chunk 1234"`),
+		fingerprintOf(t, testFingerprintYamlSources, `level=warn msg="flushed chunk 1234"`),
+	)
+}
+
+func TestFingerprintStage_Normalize(t *testing.T) {
+	t.Parallel()
+
+	f := &fingerprintStage{cfg: &FingerprintConfig{Lowercase: true, CollapseDigits: true}}
+	assert.Equal(t, "ingester-0 took 0.0s for 0 chunks", f.normalize("Ingester-3 took 1.25s for 1024 chunks"))
+	assert.Equal(t, "", f.normalize(""))
+}
+
+func TestFingerprintConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrFingerprintTargetRequired),
+		},
+		"invalid algorithm": {
+			map[string]interface{}{
+				"target":    "fingerprint",
+				"algorithm": "md5",
+			},
+			errors.Errorf(ErrFingerprintInvalidAlgorithm, "md5"),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"target":  "fingerprint",
+				"sources": []string{"msg", ""},
+			},
+			errors.New(ErrFingerprintEmptySource),
+		},
+		"valid": {
+			map[string]interface{}{
+				"target":          "fingerprint",
+				"algorithm":       "fnv",
+				"sources":         []string{"msg"},
+				"collapse_digits": true,
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseFingerprintConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateFingerprintConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("FingerprintConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
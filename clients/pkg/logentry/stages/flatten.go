@@ -0,0 +1,211 @@
+package stages
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	json "github.com/json-iterator/go"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyFlattenStageConfig = "empty flatten stage configuration"
+	ErrEmptyFlattenStageSource = "empty source"
+	ErrFlattenInvalidMaxDepth  = "flatten stage max_depth cannot be negative"
+	ErrFlattenInvalidArrays    = "flatten stage arrays must be one of `index` or `join`, got %q"
+)
+
+const (
+	FlattenArraysIndex = "index"
+	FlattenArraysJoin  = "join"
+)
+
+var (
+	defaultFlattenSeparator     = "."
+	defaultFlattenJoinSeparator = ","
+)
+
+// FlattenConfig represents a Flatten Stage configuration
+type FlattenConfig struct {
+	// Source is the only extracted value flattened, all of them by default.
+	Source *string `mapstructure:"source"`
+	// Separator joins the keys of the nested values, `.` by default.
+	Separator *string `mapstructure:"separator"`
+	// MaxDepth is the number of nested levels flattened, the values nested
+	// deeper are kept as JSON. All levels are flattened when 0.
+	MaxDepth int `mapstructure:"max_depth"`
+	// Arrays are either flattened by `index`, e.g. `tags.0`, which is the
+	// default, or their elements are `join`ed with JoinSeparator.
+	Arrays        string  `mapstructure:"arrays"`
+	JoinSeparator *string `mapstructure:"join_separator"`
+}
+
+// validateFlattenConfig validates a flatten stage config.
+func validateFlattenConfig(c *FlattenConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyFlattenStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyFlattenStageSource)
+	}
+	if c.MaxDepth < 0 {
+		return errors.New(ErrFlattenInvalidMaxDepth)
+	}
+	switch c.Arrays {
+	case "":
+		c.Arrays = FlattenArraysIndex
+	case FlattenArraysIndex, FlattenArraysJoin:
+	default:
+		return errors.Errorf(ErrFlattenInvalidArrays, c.Arrays)
+	}
+	if c.Separator == nil {
+		c.Separator = &defaultFlattenSeparator
+	}
+	if c.JoinSeparator == nil {
+		c.JoinSeparator = &defaultFlattenJoinSeparator
+	}
+	return nil
+}
+
+// flattenStage rewrites the nested extracted values, maps and arrays or their
+// JSON encoding as extracted by the json stage, into a key per leaf value, e.g.
+// `{"a": {"b": 1}}` into `a.b`.
+type flattenStage struct {
+	cfg    *FlattenConfig
+	logger log.Logger
+}
+
+// newFlattenStage creates a new flatten pipeline stage from a config.
+func newFlattenStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseFlattenConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFlattenConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&flattenStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "flatten"),
+	}), nil
+}
+
+func parseFlattenConfig(config interface{}) (*FlattenConfig, error) {
+	cfg := &FlattenConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (f *flattenStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	if f.cfg.Source != nil {
+		v, ok := extracted[*f.cfg.Source]
+		if !ok {
+			if Debug {
+				level.Debug(f.logger).Log("msg", "source does not exist in the set of extracted values", "source", *f.cfg.Source)
+			}
+			return
+		}
+		if nested, ok := parseNested(v); ok {
+			delete(extracted, *f.cfg.Source)
+			f.flatten(extracted, *f.cfg.Source, nested, 1)
+		}
+	} else {
+		// The values are collected first as the map is written to while flattening.
+		values := make(map[string]interface{})
+		for k, v := range extracted {
+			if nested, ok := parseNested(v); ok {
+				values[k] = nested
+			}
+		}
+		for k, nested := range values {
+			delete(extracted, k)
+			f.flatten(extracted, k, nested, 1)
+		}
+	}
+	if Debug {
+		level.Debug(f.logger).Log("msg", "extracted data debug in flatten stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// flatten sets the leaf values of v, nested depth levels deep, under the key.
+func (f *flattenStage) flatten(extracted map[string]interface{}, key string, v interface{}, depth int) {
+	if f.cfg.MaxDepth > 0 && depth > f.cfg.MaxDepth && isNested(v) {
+		extracted[key] = marshalFlattened(v)
+		return
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			f.flatten(extracted, key+*f.cfg.Separator+k, e, depth+1)
+		}
+	case []interface{}:
+		if f.cfg.Arrays == FlattenArraysJoin {
+			elements := make([]string, 0, len(t))
+			for _, e := range t {
+				s, err := getString(e)
+				if err != nil {
+					// Nil and nested elements are joined as JSON.
+					s = marshalFlattened(e)
+				}
+				elements = append(elements, s)
+			}
+			extracted[key] = strings.Join(elements, *f.cfg.JoinSeparator)
+			return
+		}
+		for i, e := range t {
+			f.flatten(extracted, key+*f.cfg.Separator+strconv.Itoa(i), e, depth+1)
+		}
+	default:
+		extracted[key] = v
+	}
+}
+
+// parseNested returns the nested value, which is either a map or an array, or
+// their JSON encoding as extracted by the json stage.
+func parseNested(v interface{}) (interface{}, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return v, isNested(v)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" || (s[0] != '{' && s[0] != '[') {
+		return nil, false
+	}
+	var nested interface{}
+	if err := json.UnmarshalFromString(s, &nested); err != nil {
+		return nil, false
+	}
+	return nested, isNested(nested)
+}
+
+func isNested(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+func marshalFlattened(v interface{}) string {
+	s, err := json.MarshalToString(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return s
+}
+
+// Name implements Stage
+func (f *flattenStage) Name() string {
+	return StageTypeFlatten
+}
@@ -0,0 +1,195 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testFlattenYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      user:
+      tags:
+- flatten:
+`
+
+func TestPipeline_Flatten(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testFlattenYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := `{"user":{"name":"frank","address":{"city":"Paris"}},"tags":["a","b"]}`
+	out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"user.name":         "frank",
+		"user.address.city": "Paris",
+		"tags.0":            "a",
+		"tags.1":            "b",
+	}, out.Extracted)
+}
+
+func TestFlattenStage_Process(t *testing.T) {
+	t.Parallel()
+
+	nested := func() map[string]interface{} {
+		return map[string]interface{}{
+			"level": "info",
+			"http": map[string]interface{}{
+				"status": float64(200),
+				"request": map[string]interface{}{
+					"method": "GET",
+					"headers": map[string]interface{}{
+						"host": "example.com",
+					},
+				},
+			},
+			"ips": []interface{}{"10.0.0.1", "10.0.0.2", map[string]interface{}{"v6": "::1"}},
+		}
+	}
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"nested objects and arrays": {
+			nil,
+			map[string]interface{}{
+				"level":                     "info",
+				"http.status":               float64(200),
+				"http.request.method":       "GET",
+				"http.request.headers.host": "example.com",
+				"ips.0":                     "10.0.0.1",
+				"ips.1":                     "10.0.0.2",
+				"ips.2.v6":                  "::1",
+			},
+		},
+		"separator": {
+			map[string]interface{}{"separator": "_"},
+			map[string]interface{}{
+				"level":                     "info",
+				"http_status":               float64(200),
+				"http_request_method":       "GET",
+				"http_request_headers_host": "example.com",
+				"ips_0":                     "10.0.0.1",
+				"ips_1":                     "10.0.0.2",
+				"ips_2_v6":                  "::1",
+			},
+		},
+		"max depth": {
+			map[string]interface{}{"max_depth": 2},
+			map[string]interface{}{
+				"level":                "info",
+				"http.status":          float64(200),
+				"http.request.method":  "GET",
+				"http.request.headers": `{"host":"example.com"}`,
+				"ips.0":                "10.0.0.1",
+				"ips.1":                "10.0.0.2",
+				"ips.2.v6":             "::1",
+			},
+		},
+		"joined arrays": {
+			map[string]interface{}{"arrays": "join", "join_separator": " "},
+			map[string]interface{}{
+				"level":                     "info",
+				"http.status":               float64(200),
+				"http.request.method":       "GET",
+				"http.request.headers.host": "example.com",
+				"ips":                       `10.0.0.1 10.0.0.2 {"v6":"::1"}`,
+			},
+		},
+		"source": {
+			map[string]interface{}{"source": "ips"},
+			map[string]interface{}{
+				"level": "info",
+				"http": map[string]interface{}{
+					"status": float64(200),
+					"request": map[string]interface{}{
+						"method": "GET",
+						"headers": map[string]interface{}{
+							"host": "example.com",
+						},
+					},
+				},
+				"ips.0":    "10.0.0.1",
+				"ips.1":    "10.0.0.2",
+				"ips.2.v6": "::1",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newFlattenStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nested(), nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+		})
+	}
+
+	// Strings which are not JSON objects or arrays are left unchanged, empty
+	// objects have no leaf value.
+	st, err := newFlattenStage(util_log.Logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted := map[string]interface{}{"msg": "[INFO] started", "empty": "{}", "obj": `{"a":[1,{"b":true}]}`}
+	out := processEntries(st, newEntry(extracted, nil, "", time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{"msg": "[INFO] started", "obj.a.0": float64(1), "obj.a.1.b": true}, out.Extracted)
+}
+
+func TestFlattenConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyFlattenStageSource),
+		},
+		"negative max depth": {
+			map[string]interface{}{
+				"max_depth": -1,
+			},
+			errors.New(ErrFlattenInvalidMaxDepth),
+		},
+		"invalid arrays": {
+			map[string]interface{}{
+				"arrays": "drop",
+			},
+			errors.Errorf(ErrFlattenInvalidArrays, "drop"),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseFlattenConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateFlattenConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("FlattenConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
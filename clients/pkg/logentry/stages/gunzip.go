@@ -0,0 +1,176 @@
+package stages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyGunzipStageConfig = "empty gunzip stage configuration"
+	ErrGunzipSourceRequired   = "gunzip stage source value is required"
+	ErrEmptyGunzipDestination = "empty destination in gunzip stage"
+	ErrGunzipInvalidEncoding  = "gunzip stage encoding must be empty or `base64`, got %q"
+	ErrGunzipInvalidMaxBytes  = "gunzip stage max_bytes cannot be negative"
+)
+
+const (
+	GunzipEncodingBase64 = "base64"
+
+	defaultGunzipMaxBytes = 1 << 20
+)
+
+// GunzipConfig represents a Gunzip Stage configuration
+type GunzipConfig struct {
+	// Source is the extracted value holding the compressed payload.
+	Source string `mapstructure:"source"`
+	// Destination is the extracted key the decompressed value is written to,
+	// the source by default.
+	Destination *string `mapstructure:"destination"`
+	// Encoding of the payload, `base64` to decode it before decompressing.
+	Encoding string `mapstructure:"encoding"`
+	// MaxBytes limits the size of the decompressed value, longer values are cut.
+	// It defaults to 1MiB.
+	MaxBytes int `mapstructure:"max_bytes"`
+}
+
+// validateGunzipConfig validates a gunzip stage config.
+func validateGunzipConfig(c *GunzipConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyGunzipStageConfig)
+	}
+	if c.Source == "" {
+		return errors.New(ErrGunzipSourceRequired)
+	}
+	if c.Destination == nil {
+		c.Destination = &c.Source
+	}
+	if *c.Destination == "" {
+		return errors.New(ErrEmptyGunzipDestination)
+	}
+	switch c.Encoding {
+	case "", GunzipEncodingBase64:
+	default:
+		return errors.Errorf(ErrGunzipInvalidEncoding, c.Encoding)
+	}
+	if c.MaxBytes < 0 {
+		return errors.New(ErrGunzipInvalidMaxBytes)
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = defaultGunzipMaxBytes
+	}
+	return nil
+}
+
+// gunzipStage decompresses a gzip compressed extracted value
+type gunzipStage struct {
+	cfg    *GunzipConfig
+	logger log.Logger
+}
+
+// newGunzipStage creates a new gunzip pipeline stage from a config.
+func newGunzipStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseGunzipConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGunzipConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&gunzipStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "gunzip"),
+	}), nil
+}
+
+func parseGunzipConfig(config interface{}) (*GunzipConfig, error) {
+	cfg := &GunzipConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (g *gunzipStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	v, ok := extracted[g.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(g.logger).Log("msg", "source does not exist in the set of extracted values", "source", g.cfg.Source)
+		}
+		return
+	}
+
+	var payload []byte
+	switch value := v.(type) {
+	case []byte:
+		payload = value
+	case string:
+		payload = []byte(value)
+	default:
+		if Debug {
+			level.Debug(g.logger).Log("msg", "source value is neither bytes nor a string", "source", g.cfg.Source, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+
+	if g.cfg.Encoding == GunzipEncodingBase64 {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, payload)
+		if err != nil {
+			if Debug {
+				level.Debug(g.logger).Log("msg", "failed to base64 decode source", "source", g.cfg.Source, "err", err)
+			}
+			return
+		}
+		payload = decoded[:n]
+	}
+
+	result, truncated, err := g.gunzip(payload)
+	if err != nil {
+		if Debug {
+			level.Debug(g.logger).Log("msg", "failed to decompress source", "source", g.cfg.Source, "err", err)
+		}
+		return
+	}
+	if truncated && Debug {
+		level.Debug(g.logger).Log("msg", "decompressed value truncated to max_bytes", "source", g.cfg.Source, "max_bytes", g.cfg.MaxBytes)
+	}
+	extracted[*g.cfg.Destination] = result
+}
+
+// gunzip decompresses the payload, reading at most MaxBytes so that a small
+// payload cannot expand into an arbitrarily large value.
+func (g *gunzipStage) gunzip(payload []byte) (string, bool, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return "", false, err
+	}
+	defer r.Close()
+
+	// One more byte than the limit is read to know whether the value was cut.
+	b, err := io.ReadAll(io.LimitReader(r, int64(g.cfg.MaxBytes)+1))
+	if err != nil {
+		return "", false, err
+	}
+	if len(b) > g.cfg.MaxBytes {
+		return string(b[:g.cfg.MaxBytes]), true, nil
+	}
+	return string(b), false, nil
+}
+
+// Name implements Stage
+func (g *gunzipStage) Name() string {
+	return StageTypeGunzip
+}
@@ -0,0 +1,146 @@
+package stages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGunzipStage_Process(t *testing.T) {
+	t.Parallel()
+
+	payload := `{"level":"info","msg":"flushed chunk"}`
+	compressed := gzipped(t, payload)
+	bomb := gzipped(t, strings.Repeat("a", 1<<16))
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		source   interface{}
+		expected interface{}
+	}{
+		"bytes": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			compressed,
+			payload,
+		},
+		"base64": {
+			map[string]interface{}{"source": "payload", "destination": "decoded", "encoding": "base64"},
+			base64.StdEncoding.EncodeToString(compressed),
+			payload,
+		},
+		"truncated gzip": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			compressed[:len(compressed)-10],
+			nil,
+		},
+		"not gzip": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			payload,
+			nil,
+		},
+		"invalid base64": {
+			map[string]interface{}{"source": "payload", "destination": "decoded", "encoding": "base64"},
+			"not base64!",
+			nil,
+		},
+		"size limit": {
+			map[string]interface{}{"source": "payload", "destination": "decoded", "max_bytes": 10},
+			bomb,
+			"aaaaaaaaaa",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newGunzipStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{"payload": tt.source}, nil, "line", time.Now()))[0]
+			decoded, ok := out.Extracted["decoded"]
+			if tt.expected == nil {
+				assert.False(t, ok, "unexpected decoded value %v", decoded)
+				return
+			}
+			assert.Equal(t, tt.expected, decoded)
+			assert.Equal(t, "line", out.Line)
+		})
+	}
+}
+
+func TestGunzipConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrGunzipSourceRequired),
+		},
+		"empty destination": {
+			map[string]interface{}{
+				"source":      "payload",
+				"destination": "",
+			},
+			errors.New(ErrEmptyGunzipDestination),
+		},
+		"invalid encoding": {
+			map[string]interface{}{
+				"source":   "payload",
+				"encoding": "hex",
+			},
+			errors.Errorf(ErrGunzipInvalidEncoding, "hex"),
+		},
+		"negative max_bytes": {
+			map[string]interface{}{
+				"source":    "payload",
+				"max_bytes": -1,
+			},
+			errors.New(ErrGunzipInvalidMaxBytes),
+		},
+		"valid": {
+			map[string]interface{}{
+				"source":   "payload",
+				"encoding": "base64",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseGunzipConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateGunzipConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("GunzipConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
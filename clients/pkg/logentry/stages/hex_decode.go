@@ -0,0 +1,141 @@
+package stages
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyHexDecodeStageConfig = "empty hex_decode stage configuration"
+	ErrHexDecodeSourceRequired   = "hex_decode stage source value is required"
+	ErrEmptyHexDecodeDestination = "empty destination in hex_decode stage"
+	ErrHexDecodeInvalidOutput    = "hex_decode stage output must be one of `string` or `bytes`, got %q"
+)
+
+const (
+	HexDecodeOutputString = "string"
+	HexDecodeOutputBytes  = "bytes"
+)
+
+// HexDecodeConfig represents a HexDecode Stage configuration
+type HexDecodeConfig struct {
+	// Source is the extracted value holding the hex encoded value, in upper or
+	// lower case and optionally prefixed with `0x`.
+	Source string `mapstructure:"source"`
+	// Destination is the extracted key the decoded value is written to, the
+	// source by default.
+	Destination *string `mapstructure:"destination"`
+	// Output is the type of the decoded value, a `string`, which is the default,
+	// or raw `bytes`, e.g. for the replace stage with `binary`.
+	Output string `mapstructure:"output"`
+}
+
+// validateHexDecodeConfig validates a hex_decode stage config.
+func validateHexDecodeConfig(c *HexDecodeConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyHexDecodeStageConfig)
+	}
+	if c.Source == "" {
+		return errors.New(ErrHexDecodeSourceRequired)
+	}
+	if c.Destination == nil {
+		c.Destination = &c.Source
+	}
+	if *c.Destination == "" {
+		return errors.New(ErrEmptyHexDecodeDestination)
+	}
+	switch c.Output {
+	case "":
+		c.Output = HexDecodeOutputString
+	case HexDecodeOutputString, HexDecodeOutputBytes:
+	default:
+		return errors.Errorf(ErrHexDecodeInvalidOutput, c.Output)
+	}
+	return nil
+}
+
+// hexDecodeStage decodes a hex encoded extracted value
+type hexDecodeStage struct {
+	cfg    *HexDecodeConfig
+	logger log.Logger
+}
+
+// newHexDecodeStage creates a new hex_decode pipeline stage from a config.
+func newHexDecodeStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseHexDecodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateHexDecodeConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&hexDecodeStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "hex_decode"),
+	}), nil
+}
+
+func parseHexDecodeConfig(config interface{}) (*HexDecodeConfig, error) {
+	cfg := &HexDecodeConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (h *hexDecodeStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	v, ok := extracted[h.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(h.logger).Log("msg", "source does not exist in the set of extracted values", "source", h.cfg.Source)
+		}
+		return
+	}
+
+	var encoded string
+	switch value := v.(type) {
+	case []byte:
+		encoded = string(value)
+	case string:
+		encoded = value
+	default:
+		if Debug {
+			level.Debug(h.logger).Log("msg", "source value is neither bytes nor a string", "source", h.cfg.Source, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+	if strings.HasPrefix(encoded, "0x") || strings.HasPrefix(encoded, "0X") {
+		encoded = encoded[2:]
+	}
+
+	// DecodeString accepts both cases and fails on odd lengths and other
+	// characters than hex digits.
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		if Debug {
+			level.Debug(h.logger).Log("msg", "failed to hex decode source", "source", h.cfg.Source, "err", err)
+		}
+		return
+	}
+	if h.cfg.Output == HexDecodeOutputBytes {
+		extracted[*h.cfg.Destination] = decoded
+		return
+	}
+	extracted[*h.cfg.Destination] = string(decoded)
+}
+
+// Name implements Stage
+func (h *hexDecodeStage) Name() string {
+	return StageTypeHexDecode
+}
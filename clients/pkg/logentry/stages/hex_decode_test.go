@@ -0,0 +1,141 @@
+package stages
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+func TestHexDecodeStage_Process(t *testing.T) {
+	t.Parallel()
+
+	traceID := []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		source   interface{}
+		expected interface{}
+	}{
+		"round trip string": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			hex.EncodeToString([]byte("user=frank")),
+			"user=frank",
+		},
+		"round trip bytes": {
+			map[string]interface{}{"source": "payload", "destination": "decoded", "output": "bytes"},
+			hex.EncodeToString(traceID),
+			traceID,
+		},
+		"upper case": {
+			map[string]interface{}{"source": "payload", "destination": "decoded", "output": "bytes"},
+			strings.ToUpper(hex.EncodeToString(traceID)),
+			traceID,
+		},
+		"0x prefix": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			"0x6c6F6b69",
+			"loki",
+		},
+		"bytes source": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			[]byte("6c6f6b69"),
+			"loki",
+		},
+		"odd length": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			"6c6f6b6",
+			nil,
+		},
+		"not hex": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			"6c6f6bzz",
+			nil,
+		},
+		"not a string": {
+			map[string]interface{}{"source": "payload", "destination": "decoded"},
+			42,
+			nil,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newHexDecodeStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{"payload": tt.source}, nil, "line", time.Now()))[0]
+			decoded, ok := out.Extracted["decoded"]
+			if tt.expected == nil {
+				assert.False(t, ok, "unexpected decoded value %v", decoded)
+				return
+			}
+			assert.Equal(t, tt.expected, decoded)
+			assert.Equal(t, "line", out.Line)
+		})
+	}
+
+	// The source is replaced when there is no destination.
+	st, err := newHexDecodeStage(util_log.Logger, map[string]interface{}{"source": "payload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"payload": "6c6f6b69"}, nil, "line", time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{"payload": "loki"}, out.Extracted)
+}
+
+func TestHexDecodeConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrHexDecodeSourceRequired),
+		},
+		"empty destination": {
+			map[string]interface{}{
+				"source":      "payload",
+				"destination": "",
+			},
+			errors.New(ErrEmptyHexDecodeDestination),
+		},
+		"invalid output": {
+			map[string]interface{}{
+				"source": "payload",
+				"output": "base64",
+			},
+			errors.Errorf(ErrHexDecodeInvalidOutput, "base64"),
+		},
+		"valid": {
+			map[string]interface{}{
+				"source": "payload",
+				"output": "bytes",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseHexDecodeConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateHexDecodeConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("HexDecodeConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyKeyValueStageConfig = "empty keyvalue stage configuration"
+	ErrEmptyKeyValueStageSource = "empty source"
+	ErrKeyValueSameSeparators   = "keyvalue stage pair_separator and delimiter cannot be the same"
+)
+
+var (
+	defaultKeyValuePairSeparator = " "
+	defaultKeyValueDelimiter     = "="
+)
+
+// KeyValueConfig represents a KeyValue Stage configuration
+type KeyValueConfig struct {
+	Source *string `mapstructure:"source"`
+	// PairSeparator separates the pairs, a space by default.
+	PairSeparator string `mapstructure:"pair_separator"`
+	// Delimiter separates the key from the value of a pair, `=` by default.
+	Delimiter string `mapstructure:"delimiter"`
+	// Prefix is prepended to every extracted key.
+	Prefix string `mapstructure:"prefix"`
+}
+
+// validateKeyValueConfig validates a keyvalue stage config.
+func validateKeyValueConfig(c *KeyValueConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyKeyValueStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyKeyValueStageSource)
+	}
+	if c.PairSeparator == "" {
+		c.PairSeparator = defaultKeyValuePairSeparator
+	}
+	if c.Delimiter == "" {
+		c.Delimiter = defaultKeyValueDelimiter
+	}
+	if c.PairSeparator == c.Delimiter {
+		return errors.New(ErrKeyValueSameSeparators)
+	}
+	return nil
+}
+
+// keyValueStage extracts key/value pairs using custom separators
+type keyValueStage struct {
+	cfg    *KeyValueConfig
+	logger log.Logger
+}
+
+// newKeyValueStage creates a new keyvalue pipeline stage from a config.
+func newKeyValueStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseKeyValueConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateKeyValueConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&keyValueStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "keyvalue"),
+	}), nil
+}
+
+func parseKeyValueConfig(config interface{}) (*KeyValueConfig, error) {
+	cfg := &KeyValueConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (k *keyValueStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the keyvalue stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if k.cfg.Source != nil {
+		if _, ok := extracted[*k.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(k.logger).Log("msg", "source does not exist in the set of extracted values", "source", *k.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*k.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(k.logger).Log("msg", "failed to convert source value to string", "source", *k.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*k.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(k.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	for _, pair := range strings.Split(*input, k.cfg.PairSeparator) {
+		// Empty tokens come from repeated or trailing separators.
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, k.cfg.Delimiter)
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			if Debug {
+				level.Debug(k.logger).Log("msg", "skipping token without a key", "token", pair)
+			}
+			continue
+		}
+		extracted[k.cfg.Prefix+key] = strings.TrimSpace(value)
+	}
+	if Debug {
+		level.Debug(k.logger).Log("msg", "extracted data debug in keyvalue stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (k *keyValueStage) Name() string {
+	return StageTypeKeyValue
+}
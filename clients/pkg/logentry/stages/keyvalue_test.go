@@ -0,0 +1,149 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testKeyValueYamlCustom = `
+pipeline_stages:
+- keyvalue:
+    pair_separator: ";"
+    delimiter: ":"
+    prefix: kv_
+`
+
+var testKeyValueYamlDefault = `
+pipeline_stages:
+- keyvalue:
+`
+
+var testKeyValueYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      attrs:
+- keyvalue:
+    source: attrs
+    pair_separator: ","
+`
+
+func TestPipeline_KeyValue(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"custom delimiters": {
+			testKeyValueYamlCustom,
+			"user:frank; status:200;duration:12ms;",
+			map[string]interface{}{
+				"kv_user":     "frank",
+				"kv_status":   "200",
+				"kv_duration": "12ms",
+			},
+		},
+		"empty values": {
+			testKeyValueYamlCustom,
+			"user:;status:",
+			map[string]interface{}{
+				"kv_user":   "",
+				"kv_status": "",
+			},
+		},
+		"missing delimiters": {
+			testKeyValueYamlCustom,
+			"user:frank;garbage;:nokey;;",
+			map[string]interface{}{
+				"kv_user": "frank",
+			},
+		},
+		"default delimiters": {
+			testKeyValueYamlDefault,
+			"level=info  msg=flushed caller=",
+			map[string]interface{}{
+				"level":  "info",
+				"msg":    "flushed",
+				"caller": "",
+			},
+		},
+		"source": {
+			testKeyValueYamlWithSource,
+			`{"attrs":"a=1,b=2,"}`,
+			map[string]interface{}{
+				"attrs": "a=1,b=2,",
+				"a":     "1",
+				"b":     "2",
+			},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestKeyValueConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyKeyValueStageSource),
+		},
+		"same separators": {
+			map[string]interface{}{
+				"pair_separator": "=",
+			},
+			errors.New(ErrKeyValueSameSeparators),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+		"valid": {
+			map[string]interface{}{
+				"pair_separator": ";",
+				"delimiter":      ":",
+				"prefix":         "kv_",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseKeyValueConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateKeyValueConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("KeyValueConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
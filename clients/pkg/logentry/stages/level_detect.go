@@ -0,0 +1,205 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyLevelDetectStageConfig = "empty level_detect stage configuration"
+	ErrEmptyLevelDetectStageSource = "empty source"
+	ErrLevelDetectUnknownLevel     = "level_detect stage priority references unknown level %q, must be one of `fatal`, `error`, `warn`, `info`, `debug` or `trace`"
+	ErrLevelDetectDuplicateLevel   = "level_detect stage priority lists level %q more than once"
+)
+
+// levelDetectKey is the extracted key the detected level is written to.
+const levelDetectKey = "level"
+
+// levelTokens maps the normalized levels to the tokens detected for them.
+var levelTokens = map[string][]string{
+	"fatal": {"fatal", "critical", "crit", "emerg", "emergency", "alert", "panic"},
+	"error": {"error", "err"},
+	"warn":  {"warn", "warning"},
+	"info":  {"info", "information", "notice"},
+	"debug": {"debug", "dbg"},
+	"trace": {"trace"},
+}
+
+// defaultLevelPriority detects the most severe level when multiple levels are
+// found in an entry.
+var defaultLevelPriority = []string{"fatal", "error", "warn", "info", "debug", "trace"}
+
+// syslogSeverityLevels maps the syslog severities to the normalized levels.
+var syslogSeverityLevels = [8]string{"fatal", "fatal", "fatal", "error", "warn", "info", "info", "debug"}
+
+// syslogPriorityRegexp matches the priority prefix of syslog and kernel messages,
+// e.g. `<11>`, whose severity is the priority modulo 8.
+var syslogPriorityRegexp = regexp.MustCompile(`^<(\d{1,3})>`)
+
+// LevelDetectConfig represents a LevelDetect Stage configuration
+type LevelDetectConfig struct {
+	Source *string `mapstructure:"source"`
+	// Priority is the order in which the levels are detected, the first level
+	// found wins. It defaults to the most severe level first.
+	Priority []string `mapstructure:"priority"`
+	// Default is the level set when none is detected, no level is set when
+	// empty.
+	Default string `mapstructure:"default"`
+}
+
+// validateLevelDetectConfig validates a level_detect stage config and returns
+// the expressions detecting the levels, in priority order.
+func validateLevelDetectConfig(c *LevelDetectConfig) ([]levelExpression, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyLevelDetectStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return nil, errors.New(ErrEmptyLevelDetectStageSource)
+	}
+	if len(c.Priority) == 0 {
+		c.Priority = defaultLevelPriority
+	}
+	expressions := make([]levelExpression, 0, len(c.Priority))
+	seen := make(map[string]struct{}, len(c.Priority))
+	for _, lvl := range c.Priority {
+		lvl = strings.ToLower(lvl)
+		tokens, ok := levelTokens[lvl]
+		if !ok {
+			return nil, errors.Errorf(ErrLevelDetectUnknownLevel, lvl)
+		}
+		if _, ok := seen[lvl]; ok {
+			return nil, errors.Errorf(ErrLevelDetectDuplicateLevel, lvl)
+		}
+		seen[lvl] = struct{}{}
+		expressions = append(expressions, levelExpression{
+			level:      lvl,
+			expression: regexp.MustCompile(`(?i)\b(?:` + strings.Join(tokens, "|") + `)\b`),
+		})
+	}
+	return expressions, nil
+}
+
+// levelExpression matches the tokens of a level.
+type levelExpression struct {
+	level      string
+	expression *regexp.Regexp
+}
+
+// levelDetectStage sets the `level` extracted value, when it is not extracted
+// yet, to the level normalized from the tokens found in the entry, e.g. `warn`
+// for `WARNING`, or from the severity of a syslog priority prefix.
+type levelDetectStage struct {
+	cfg         *LevelDetectConfig
+	expressions []levelExpression
+	logger      log.Logger
+}
+
+// newLevelDetectStage creates a new level_detect pipeline stage from a config.
+func newLevelDetectStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseLevelDetectConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expressions, err := validateLevelDetectConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&levelDetectStage{
+		cfg:         cfg,
+		expressions: expressions,
+		logger:      log.With(logger, "component", "stage", "type", "level_detect"),
+	}), nil
+}
+
+func parseLevelDetectConfig(config interface{}) (*LevelDetectConfig, error) {
+	cfg := &LevelDetectConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (l *levelDetectStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	if _, ok := extracted[levelDetectKey]; ok {
+		return
+	}
+
+	// If a source key is provided, the level_detect stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if l.cfg.Source != nil {
+		if _, ok := extracted[*l.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(l.logger).Log("msg", "source does not exist in the set of extracted values", "source", *l.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*l.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(l.logger).Log("msg", "failed to convert source value to string", "source", *l.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*l.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(l.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	lvl := l.detect(*input)
+	if lvl == "" {
+		lvl = l.cfg.Default
+	}
+	if lvl == "" {
+		if Debug {
+			level.Debug(l.logger).Log("msg", "no level detected")
+		}
+		return
+	}
+	extracted[levelDetectKey] = lvl
+	if Debug {
+		level.Debug(l.logger).Log("msg", "extracted data debug in level_detect stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// detect returns the level of the input, or an empty string when no level is
+// found. The syslog priority prefix is explicit and so wins over the tokens.
+func (l *levelDetectStage) detect(input string) string {
+	if m := syslogPriorityRegexp.FindStringSubmatch(input); m != nil {
+		if pri, err := strconv.Atoi(m[1]); err == nil && pri <= 191 {
+			return syslogSeverityLevels[pri%8]
+		}
+	}
+	for _, e := range l.expressions {
+		if e.expression.MatchString(input) {
+			return e.level
+		}
+	}
+	return ""
+}
+
+// Name implements Stage
+func (l *levelDetectStage) Name() string {
+	return StageTypeLevelDetect
+}
@@ -0,0 +1,188 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testLevelDetectYaml = `
+pipeline_stages:
+- level_detect:
+    default: unknown
+- labels:
+    level:
+`
+
+func TestPipeline_LevelDetect(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testLevelDetectYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl,
+		newEntry(nil, model.LabelSet{}, "2024-05-01T12:00:00Z WARNING disk almost full", time.Now()),
+		newEntry(nil, model.LabelSet{}, "GET /healthz 200", time.Now()),
+	)
+	assert.Equal(t, model.LabelSet{"level": "warn"}, out[0].Labels)
+	assert.Equal(t, model.LabelSet{"level": "unknown"}, out[1].Labels)
+}
+
+func TestLevelDetectStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config    map[string]interface{}
+		extracted map[string]interface{}
+		entry     string
+		expected  interface{}
+	}{
+		"uppercase token": {
+			nil,
+			nil,
+			"2024-05-01 12:00:00 ERROR failed to connect",
+			"error",
+		},
+		"lowercase token": {
+			nil,
+			nil,
+			"ts=2024-05-01T12:00:00Z level=info msg=started",
+			"info",
+		},
+		"bracketed token": {
+			nil,
+			nil,
+			"[WARN] retrying in 5s",
+			"warn",
+		},
+		"alias": {
+			nil,
+			nil,
+			"CRITICAL: out of memory",
+			"fatal",
+		},
+		"most severe by default": {
+			nil,
+			nil,
+			"INFO request failed with error",
+			"error",
+		},
+		"priority": {
+			map[string]interface{}{"priority": []string{"info", "error"}},
+			nil,
+			"INFO request failed with error",
+			"info",
+		},
+		"syslog priority": {
+			nil,
+			nil,
+			"<11>Jan  1 00:00:00 host app: connection reset",
+			"error",
+		},
+		"syslog priority wins over tokens": {
+			nil,
+			nil,
+			"<14>Jan  1 00:00:00 host app: error count is 0",
+			"info",
+		},
+		"tokens are whole words": {
+			nil,
+			nil,
+			"writing to stderr",
+			nil,
+		},
+		"no detection": {
+			nil,
+			nil,
+			"GET /healthz 200",
+			nil,
+		},
+		"default": {
+			map[string]interface{}{"default": "info"},
+			nil,
+			"GET /healthz 200",
+			"info",
+		},
+		"already extracted": {
+			nil,
+			map[string]interface{}{"level": "debug"},
+			"ERROR failed to connect",
+			"debug",
+		},
+		"source": {
+			map[string]interface{}{"source": "msg"},
+			map[string]interface{}{"msg": "Warning: deprecated flag"},
+			"ERROR failed to connect",
+			"warn",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newLevelDetectStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted := map[string]interface{}{}
+			for k, v := range tt.extracted {
+				extracted[k] = v
+			}
+			out := processEntries(st, newEntry(extracted, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted["level"])
+		})
+	}
+}
+
+func TestLevelDetectConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyLevelDetectStageSource),
+		},
+		"unknown level": {
+			map[string]interface{}{
+				"priority": []string{"error", "verbose"},
+			},
+			errors.Errorf(ErrLevelDetectUnknownLevel, "verbose"),
+		},
+		"duplicate level": {
+			map[string]interface{}{
+				"priority": []string{"error", "ERROR"},
+			},
+			errors.Errorf(ErrLevelDetectDuplicateLevel, "error"),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseLevelDetectConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateLevelDetectConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("LevelDetectConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package stages
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config Errors
+const (
+	ErrEmptyLookupStageConfig = "empty lookup stage configuration"
+	ErrLookupSourceRequired   = "lookup stage source value is required"
+	ErrEmptyLookupDestination = "empty destination in lookup stage"
+	ErrLookupMappingRequired  = "lookup stage requires a `mapping` or a `file`"
+	ErrCouldNotLoadLookupFile = "could not load lookup file"
+)
+
+// LookupConfig represents a Lookup Stage configuration
+type LookupConfig struct {
+	Source string `mapstructure:"source"`
+	// Destination is the extracted key the mapped value is written to, the
+	// source by default.
+	Destination *string `mapstructure:"destination"`
+	// Mapping is the dictionary the values are looked up in.
+	Mapping map[string]string `mapstructure:"mapping"`
+	// Default is written to the destination for values missing from the
+	// dictionary, which are left unchanged when unset.
+	Default *string `mapstructure:"default"`
+	// File is a YAML file holding a dictionary merged over Mapping. It is
+	// reloaded when it changes.
+	File *string `mapstructure:"file"`
+}
+
+// validateLookupConfig validates a lookup stage config.
+func validateLookupConfig(c *LookupConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyLookupStageConfig)
+	}
+	if c.Source == "" {
+		return errors.New(ErrLookupSourceRequired)
+	}
+	if c.Destination == nil {
+		c.Destination = &c.Source
+	}
+	if *c.Destination == "" {
+		return errors.New(ErrEmptyLookupDestination)
+	}
+	if len(c.Mapping) == 0 && (c.File == nil || *c.File == "") {
+		return errors.New(ErrLookupMappingRequired)
+	}
+	return nil
+}
+
+// lookupStage maps extracted values through a dictionary
+type lookupStage struct {
+	cfg    *LookupConfig
+	logger log.Logger
+
+	mtx     sync.RWMutex
+	mapping map[string]string
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// newLookupStage creates a new lookup pipeline stage from a config.
+func newLookupStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseLookupConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateLookupConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	l := &lookupStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "lookup"),
+	}
+	mapping, err := l.load()
+	if err != nil {
+		return nil, errors.Wrap(err, ErrCouldNotLoadLookupFile)
+	}
+	l.mapping = mapping
+
+	if cfg.File != nil {
+		if err := l.watch(); err != nil {
+			return nil, errors.Wrap(err, ErrCouldNotLoadLookupFile)
+		}
+	}
+	return toStage(l), nil
+}
+
+func parseLookupConfig(config interface{}) (*LookupConfig, error) {
+	cfg := &LookupConfig{}
+	// The mapping is decoded weakly, so that unquoted numeric keys such as
+	// HTTP status codes are accepted as strings.
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           cfg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// load builds the dictionary from the configured mapping and file.
+func (l *lookupStage) load() (map[string]string, error) {
+	mapping := make(map[string]string, len(l.cfg.Mapping))
+	for k, v := range l.cfg.Mapping {
+		mapping[k] = v
+	}
+	if l.cfg.File == nil {
+		return mapping, nil
+	}
+	b, err := os.ReadFile(*l.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	var fromFile map[string]string
+	if err := yaml.Unmarshal(b, &fromFile); err != nil {
+		return nil, err
+	}
+	for k, v := range fromFile {
+		mapping[k] = v
+	}
+	return mapping, nil
+}
+
+// watch reloads the dictionary when the file changes. The directory is watched
+// rather than the file, as files are usually replaced rather than written to.
+func (l *lookupStage) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	file := filepath.Clean(*l.cfg.File)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+	l.watcher = watcher
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != file || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				mapping, err := l.load()
+				if err != nil {
+					level.Warn(l.logger).Log("msg", "failed to reload lookup file, keeping the previous dictionary", "file", file, "err", err)
+					continue
+				}
+				l.mtx.Lock()
+				l.mapping = mapping
+				l.mtx.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				level.Warn(l.logger).Log("msg", "error watching lookup file", "file", file, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Process implements Stage
+func (l *lookupStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	v, ok := extracted[l.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(l.logger).Log("msg", "source does not exist in the set of extracted values", "source", l.cfg.Source)
+		}
+		return
+	}
+	value, err := getString(v)
+	if err != nil {
+		if Debug {
+			level.Debug(l.logger).Log("msg", "failed to convert source value to string", "source", l.cfg.Source, "err", err, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+
+	l.mtx.RLock()
+	mapped, ok := l.mapping[value]
+	l.mtx.RUnlock()
+	switch {
+	case ok:
+		extracted[*l.cfg.Destination] = mapped
+	case l.cfg.Default != nil:
+		extracted[*l.cfg.Destination] = *l.cfg.Default
+	}
+}
+
+// Name implements Stage
+func (l *lookupStage) Name() string {
+	return StageTypeLookup
+}
+
+// Cleanup stops watching the file.
+func (l *lookupStage) Cleanup() {
+	if l.watcher == nil {
+		return
+	}
+	l.watcher.Close()
+	<-l.done
+}
@@ -0,0 +1,183 @@
+package stages
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testLookupYaml = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      status:
+- lookup:
+    source: status
+    destination: status_text
+    mapping:
+      "200": OK
+      "404": Not Found
+      "500": Internal Server Error
+`
+
+var testLookupYamlWithDefault = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      status:
+- lookup:
+    source: status
+    default: unknown
+    mapping:
+      "200": OK
+`
+
+var testLookupYamlWithNumericKeys = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      status:
+- lookup:
+    source: status
+    mapping:
+      200: OK
+      404: Not Found
+`
+
+func TestPipeline_Lookup(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"hit": {
+			testLookupYaml,
+			"status=404",
+			map[string]interface{}{"status": "404", "status_text": "Not Found"},
+		},
+		"miss without default": {
+			testLookupYaml,
+			"status=418",
+			map[string]interface{}{"status": "418"},
+		},
+		"miss with default": {
+			testLookupYamlWithDefault,
+			"status=418",
+			map[string]interface{}{"status": "unknown"},
+		},
+		"unquoted numeric keys": {
+			testLookupYamlWithNumericKeys,
+			"status=404",
+			map[string]interface{}{"status": "Not Found"},
+		},
+		"missing source": {
+			testLookupYamlWithDefault,
+			"level=info",
+			map[string]interface{}{},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+}
+
+func TestLookupStage_File(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "codes.yaml")
+	if err := os.WriteFile(file, []byte(`E1: disk full`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newLookupStage(util_log.Logger, map[string]interface{}{
+		"source":      "code",
+		"destination": "reason",
+		"mapping":     map[string]string{"E1": "overridden", "E2": "timeout"},
+		"file":        file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Cleanup()
+
+	lookup := func(code string) interface{} {
+		return processEntries(st, newEntry(map[string]interface{}{"code": code}, nil, "", time.Now()))[0].Extracted["reason"]
+	}
+	// The file takes precedence over the mapping.
+	assert.Equal(t, "disk full", lookup("E1"))
+	assert.Equal(t, "timeout", lookup("E2"))
+	assert.Nil(t, lookup("E3"))
+
+	if err := os.WriteFile(file, []byte("E1: disk full\nE3: out of memory"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return lookup("E3") == "out of memory"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLookupConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrLookupSourceRequired),
+		},
+		"empty destination": {
+			map[string]interface{}{
+				"source":      "status",
+				"destination": "",
+				"mapping":     map[string]string{"200": "OK"},
+			},
+			errors.New(ErrEmptyLookupDestination),
+		},
+		"no dictionary": {
+			map[string]interface{}{
+				"source": "status",
+			},
+			errors.New(ErrLookupMappingRequired),
+		},
+		"valid": {
+			map[string]interface{}{
+				"source":  "status",
+				"mapping": map[string]string{"200": "OK"},
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseLookupConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateLookupConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("LookupConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package stages
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyMathStageConfig    = "empty math stage configuration"
+	ErrMathExpressionRequired  = "math stage requires an `expression`"
+	ErrMathDestinationRequired = "math stage requires a `destination`"
+	ErrMathInvalidExpression   = "invalid math stage expression"
+)
+
+// MathConfig represents a Math Stage configuration
+type MathConfig struct {
+	// Expression is the arithmetic expression evaluated over the extracted
+	// numeric keys, e.g. `(end - start) * 1000`. It supports `+`, `-`, `*`, `/`
+	// and parentheses.
+	Expression string `mapstructure:"expression"`
+	// Destination is the extracted key the result is written to.
+	Destination string `mapstructure:"destination"`
+}
+
+// validateMathConfig validates a math stage config and returns the parsed
+// expression.
+func validateMathConfig(c *MathConfig) (mathNode, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyMathStageConfig)
+	}
+	if c.Expression == "" {
+		return nil, errors.New(ErrMathExpressionRequired)
+	}
+	if c.Destination == "" {
+		return nil, errors.New(ErrMathDestinationRequired)
+	}
+	expr, err := parseMathExpression(c.Expression)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrMathInvalidExpression)
+	}
+	return expr, nil
+}
+
+// mathStage evaluates an arithmetic expression over extracted values and sets
+// the result, as a float64, in the destination. The entries whose values are
+// missing or not numeric, or for which the result is not a finite number, e.g.
+// when dividing by zero, are left unchanged.
+type mathStage struct {
+	cfg        *MathConfig
+	expression mathNode
+	logger     log.Logger
+}
+
+// newMathStage creates a new math pipeline stage from a config.
+func newMathStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseMathConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := validateMathConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&mathStage{
+		cfg:        cfg,
+		expression: expression,
+		logger:     log.With(logger, "component", "stage", "type", "math"),
+	}), nil
+}
+
+func parseMathConfig(config interface{}) (*MathConfig, error) {
+	cfg := &MathConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (m *mathStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	result, err := m.expression.eval(extracted)
+	if err == nil && (math.IsInf(result, 0) || math.IsNaN(result)) {
+		err = errors.Errorf("result %v is not a finite number", result)
+	}
+	if err != nil {
+		if Debug {
+			level.Debug(m.logger).Log("msg", "failed to evaluate math expression", "expression", m.cfg.Expression, "err", err)
+		}
+		return
+	}
+	extracted[m.cfg.Destination] = result
+	if Debug {
+		level.Debug(m.logger).Log("msg", "extracted data debug in math stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (m *mathStage) Name() string {
+	return StageTypeMath
+}
+
+// mathNode is a node of a parsed math expression.
+type mathNode interface {
+	eval(extracted map[string]interface{}) (float64, error)
+}
+
+type mathNumber float64
+
+func (n mathNumber) eval(map[string]interface{}) (float64, error) {
+	return float64(n), nil
+}
+
+// mathKey is the value of an extracted key.
+type mathKey string
+
+func (k mathKey) eval(extracted map[string]interface{}) (float64, error) {
+	v, ok := extracted[string(k)]
+	if !ok {
+		return 0, errors.Errorf("key %q is not extracted", string(k))
+	}
+	var f float64
+	switch t := v.(type) {
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(t, 64); err != nil {
+			return 0, errors.Errorf("value %q of key %q is not numeric", t, string(k))
+		}
+	case bool:
+		return 0, errors.Errorf("value of key %q is not numeric", string(k))
+	default:
+		var err error
+		if f, err = getFloat(v); err != nil {
+			return 0, errors.Errorf("value of key %q is not numeric", string(k))
+		}
+	}
+	return f, nil
+}
+
+type mathNegate struct {
+	operand mathNode
+}
+
+func (n mathNegate) eval(extracted map[string]interface{}) (float64, error) {
+	v, err := n.operand.eval(extracted)
+	return -v, err
+}
+
+type mathBinary struct {
+	op          byte
+	left, right mathNode
+}
+
+func (b mathBinary) eval(extracted map[string]interface{}) (float64, error) {
+	l, err := b.left.eval(extracted)
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.right.eval(extracted)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	}
+}
+
+// parseMathExpression parses an expression of numbers, extracted keys, the `+`,
+// `-`, `*` and `/` operators with their usual precedence, and parentheses. The
+// keys are made of letters, digits, `_` and `.`, and do not start with a digit.
+func parseMathExpression(s string) (mathNode, error) {
+	p := &mathParser{s: s}
+	n, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos < len(p.s) {
+		return nil, errors.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+	}
+	return n, nil
+}
+
+type mathParser struct {
+	s   string
+	pos int
+}
+
+func (p *mathParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// next returns the next non space character, 0 at the end of the expression.
+func (p *mathParser) next() byte {
+	p.skipSpaces()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// parseSum parses `term (('+'|'-') term)*`.
+func (p *mathParser) parseSum() (mathNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == '+' || op == '-'; op = p.next() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = mathBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseProduct parses `unary (('*'|'/') unary)*`.
+func (p *mathParser) parseProduct() (mathNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == '*' || op == '/'; op = p.next() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = mathBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseUnary parses `('-'|'+') unary | number | key | '(' sum ')'`.
+func (p *mathParser) parseUnary() (mathNode, error) {
+	c := p.next()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '-' || c == '+':
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if c == '+' {
+			return operand, nil
+		}
+		return mathNegate{operand: operand}, nil
+	case c == '(':
+		start := p.pos
+		p.pos++
+		n, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ')' {
+			return nil, errors.Errorf("missing closing parenthesis for offset %d", start)
+		}
+		p.pos++
+		return n, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && isMathNumberChar(p.s, p.pos) {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %q at offset %d", p.s[start:p.pos], start)
+		}
+		return mathNumber(f), nil
+	case isMathKeyChar(c):
+		start := p.pos
+		for p.pos < len(p.s) && isMathKeyChar(p.s[p.pos]) {
+			p.pos++
+		}
+		return mathKey(p.s[start:p.pos]), nil
+	}
+	return nil, errors.Errorf("unexpected %q at offset %d", c, p.pos)
+}
+
+func isMathKeyChar(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// isMathNumberChar reports whether the character at i continues a number,
+// including the sign of an exponent, e.g. `1.5e-3`.
+func isMathNumberChar(s string, i int) bool {
+	c := s[i]
+	switch {
+	case c >= '0' && c <= '9', c == '.', c == 'e', c == 'E':
+		return true
+	case c == '-' || c == '+':
+		return i > 0 && (s[i-1] == 'e' || s[i-1] == 'E')
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testMathYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      start:
+      end:
+- math:
+    expression: (end - start) * 1000
+    destination: duration_ms
+`
+
+func TestPipeline_Math(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testMathYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, `{"start":1714564800.25,"end":1714564801.5}`, time.Now()))[0]
+	assert.Equal(t, float64(1250), out.Extracted["duration_ms"])
+}
+
+func TestMathStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expression string
+		extracted  map[string]interface{}
+		expected   interface{}
+	}{
+		"subtraction": {
+			"end - start",
+			map[string]interface{}{"start": "100", "end": "350"},
+			float64(250),
+		},
+		"precedence": {
+			"a + b * c - d / e",
+			map[string]interface{}{"a": 1, "b": int64(2), "c": float32(3), "d": uint(8), "e": 4.0},
+			float64(5),
+		},
+		"parentheses": {
+			"(a + b) * c",
+			map[string]interface{}{"a": 1, "b": 2, "c": 3},
+			float64(9),
+		},
+		"left associativity": {
+			"a - b - c",
+			map[string]interface{}{"a": 10, "b": 3, "c": 2},
+			float64(5),
+		},
+		"unary minus and number literals": {
+			"-a * 1.5e2 + -(b)",
+			map[string]interface{}{"a": 2, "b": "0.5"},
+			float64(-300.5),
+		},
+		"dotted keys": {
+			"http.response_bytes / 1024",
+			map[string]interface{}{"http.response_bytes": "2048"},
+			float64(2),
+		},
+		"division by zero": {
+			"bytes / duration",
+			map[string]interface{}{"bytes": 100, "duration": "0"},
+			nil,
+		},
+		"missing key": {
+			"end - start",
+			map[string]interface{}{"end": 1},
+			nil,
+		},
+		"non numeric value": {
+			"end - start",
+			map[string]interface{}{"end": "1", "start": "yesterday"},
+			nil,
+		},
+		"boolean value": {
+			"a + 1",
+			map[string]interface{}{"a": true},
+			nil,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newMathStage(util_log.Logger, map[string]interface{}{
+				"expression":  tt.expression,
+				"destination": "result",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(tt.extracted, nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted["result"])
+		})
+	}
+}
+
+func TestMathConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"missing expression": {
+			map[string]interface{}{
+				"destination": "result",
+			},
+			errors.New(ErrMathExpressionRequired),
+		},
+		"missing destination": {
+			map[string]interface{}{
+				"expression": "a + b",
+			},
+			errors.New(ErrMathDestinationRequired),
+		},
+		"unclosed parenthesis": {
+			map[string]interface{}{
+				"expression":  "(a + b",
+				"destination": "result",
+			},
+			errors.Wrap(errors.New("missing closing parenthesis for offset 0"), ErrMathInvalidExpression),
+		},
+		"missing operand": {
+			map[string]interface{}{
+				"expression":  "a +",
+				"destination": "result",
+			},
+			errors.Wrap(errors.New("unexpected end of expression"), ErrMathInvalidExpression),
+		},
+		"unsupported operator": {
+			map[string]interface{}{
+				"expression":  "a % b",
+				"destination": "result",
+			},
+			errors.Wrap(errors.New(`unexpected '%' at offset 2`), ErrMathInvalidExpression),
+		},
+		"invalid number": {
+			map[string]interface{}{
+				"expression":  "1.2.3 * a",
+				"destination": "result",
+			},
+			errors.Wrap(errors.New(`invalid number "1.2.3" at offset 0`), ErrMathInvalidExpression),
+		},
+		"valid": {
+			map[string]interface{}{
+				"expression":  "(end - start) / 2",
+				"destination": "result",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseMathConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateMathConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("MathConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
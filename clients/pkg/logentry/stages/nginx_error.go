@@ -0,0 +1,172 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyNginxErrorStageSource = "empty source in nginx_error stage"
+)
+
+// nginxErrorExpression matches the lines of the nginx error log, e.g.
+// `2024/05/01 12:00:00 [error] 1234#5678: *91 connect() failed`, the
+// connection id, `*91`, being missing for the messages out of a connection.
+var nginxErrorExpression = regexp.MustCompile(`^(?P<time>\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(?P<level>[a-z]+)\] (?P<pid>\d+)#(?P<tid>\d+): (?:\*(?P<connection_id>\d+) )?(?P<message>.*)$`)
+
+// nginxErrorContext matches each field of the context nginx appends to the
+// messages of a connection, e.g. `client: 10.0.0.1, server: example.com`. The
+// values of the request, upstream, host and referrer are quoted.
+var nginxErrorContext = regexp.MustCompile(`^(client|server|request|subrequest|upstream|host|referrer): ("[^"]*"|[^,]*)(?:, |$)`)
+
+// nginxErrorContextStart is the separator between a message and its context,
+// which starts with the client.
+const nginxErrorContextStart = ", client: "
+
+// NginxErrorConfig represents a NginxError Stage configuration
+type NginxErrorConfig struct {
+	Source *string `mapstructure:"source"`
+}
+
+// validateNginxErrorConfig validates a nginx_error stage config.
+func validateNginxErrorConfig(c *NginxErrorConfig) error {
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyNginxErrorStageSource)
+	}
+	return nil
+}
+
+// nginxErrorStage extracts the fields of the nginx error log: the `time`,
+// `level`, `pid`, `tid`, `connection_id` and `message`, as well as the fields
+// of the context of the connection, e.g. `client` and `upstream`. The request
+// is additionally extracted as `method`, `path` and `protocol`.
+type nginxErrorStage struct {
+	cfg    *NginxErrorConfig
+	logger log.Logger
+}
+
+// newNginxErrorStage creates a new nginx_error pipeline stage from a config.
+func newNginxErrorStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseNginxErrorConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNginxErrorConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&nginxErrorStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "nginx_error"),
+	}), nil
+}
+
+func parseNginxErrorConfig(config interface{}) (*NginxErrorConfig, error) {
+	cfg := &NginxErrorConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (n *nginxErrorStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the nginx_error stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if n.cfg.Source != nil {
+		if _, ok := extracted[*n.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(n.logger).Log("msg", "source does not exist in the set of extracted values", "source", *n.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*n.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(n.logger).Log("msg", "failed to convert source value to string", "source", *n.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*n.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(n.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	match := nginxErrorExpression.FindStringSubmatch(*input)
+	if match == nil {
+		if Debug {
+			level.Debug(n.logger).Log("msg", "line is not an nginx error log line")
+		}
+		return
+	}
+
+	for i, name := range nginxErrorExpression.SubexpNames() {
+		if i == 0 || name == "" || match[i] == "" {
+			continue
+		}
+		if name == "message" {
+			n.extractMessage(extracted, match[i])
+			continue
+		}
+		extracted[name] = match[i]
+	}
+	if Debug {
+		level.Debug(n.logger).Log("msg", "extracted data debug in nginx_error stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// extractMessage extracts the message and the fields of its context, if any.
+func (n *nginxErrorStage) extractMessage(extracted map[string]interface{}, message string) {
+	i := strings.Index(message, nginxErrorContextStart)
+	if i < 0 {
+		extracted["message"] = message
+		return
+	}
+	extracted["message"] = message[:i]
+
+	context := strings.TrimPrefix(message[i:], ", ")
+	for context != "" {
+		field := nginxErrorContext.FindStringSubmatch(context)
+		if field == nil {
+			if Debug {
+				level.Debug(n.logger).Log("msg", "unexpected field in the context of the message", "context", context)
+			}
+			return
+		}
+		context = context[len(field[0]):]
+		value := strings.Trim(field[2], `"`)
+		extracted[field[1]] = value
+		if field[1] != "request" {
+			continue
+		}
+		if parts := strings.Split(value, " "); len(parts) == 3 {
+			extracted["method"] = parts[0]
+			extracted["path"] = parts[1]
+			extracted["protocol"] = parts[2]
+		}
+	}
+}
+
+// Name implements Stage
+func (n *nginxErrorStage) Name() string {
+	return StageTypeNginxError
+}
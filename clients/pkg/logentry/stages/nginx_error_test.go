@@ -0,0 +1,156 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testNginxErrorYaml = `
+pipeline_stages:
+- nginx_error:
+- timestamp:
+    source: time
+    format: 2006/01/02 15:04:05
+- labels:
+    level:
+`
+
+func TestPipeline_NginxError(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testNginxErrorYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, `2024/05/01 12:00:00 [warn] 12#12: *3 an upstream response is buffered to a temporary file, client: 10.0.0.1, server: example.com`, time.Now()))[0]
+	assert.Equal(t, model.LabelValue("warn"), out.Labels["level"])
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), out.Timestamp.UTC())
+	assert.Equal(t, "10.0.0.1", out.Extracted["client"])
+}
+
+func TestNginxErrorStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry    string
+		expected map[string]interface{}
+	}{
+		"without connection id": {
+			`2024/05/01 12:00:00 [notice] 1#1: start worker processes`,
+			map[string]interface{}{
+				"time":    "2024/05/01 12:00:00",
+				"level":   "notice",
+				"pid":     "1",
+				"tid":     "1",
+				"message": "start worker processes",
+			},
+		},
+		"with connection id": {
+			`2024/05/01 12:00:01 [error] 1234#5678: *91 open() "/usr/share/nginx/html/favicon.ico" failed (2: No such file or directory), client: 10.0.0.1, server: example.com, request: "GET /favicon.ico HTTP/1.1", host: "example.com", referrer: "https://example.com/"`,
+			map[string]interface{}{
+				"time":          "2024/05/01 12:00:01",
+				"level":         "error",
+				"pid":           "1234",
+				"tid":           "5678",
+				"connection_id": "91",
+				"message":       `open() "/usr/share/nginx/html/favicon.ico" failed (2: No such file or directory)`,
+				"client":        "10.0.0.1",
+				"server":        "example.com",
+				"request":       "GET /favicon.ico HTTP/1.1",
+				"method":        "GET",
+				"path":          "/favicon.ico",
+				"protocol":      "HTTP/1.1",
+				"host":          "example.com",
+				"referrer":      "https://example.com/",
+			},
+		},
+		"upstream context": {
+			`2024/05/01 12:00:02 [error] 31#31: *7 connect() failed (111: Connection refused) while connecting to upstream, client: 172.17.0.1, server: _, request: "POST /api/v1/push HTTP/1.1", upstream: "http://127.0.0.1:3100/api/v1/push", host: "localhost:8080"`,
+			map[string]interface{}{
+				"time":          "2024/05/01 12:00:02",
+				"level":         "error",
+				"pid":           "31",
+				"tid":           "31",
+				"connection_id": "7",
+				"message":       "connect() failed (111: Connection refused) while connecting to upstream",
+				"client":        "172.17.0.1",
+				"server":        "_",
+				"request":       "POST /api/v1/push HTTP/1.1",
+				"method":        "POST",
+				"path":          "/api/v1/push",
+				"protocol":      "HTTP/1.1",
+				"upstream":      "http://127.0.0.1:3100/api/v1/push",
+				"host":          "localhost:8080",
+			},
+		},
+		"connection id without context": {
+			`2024/05/01 12:00:03 [info] 31#31: *8 client closed connection while waiting for request`,
+			map[string]interface{}{
+				"time":          "2024/05/01 12:00:03",
+				"level":         "info",
+				"pid":           "31",
+				"tid":           "31",
+				"connection_id": "8",
+				"message":       "client closed connection while waiting for request",
+			},
+		},
+		"access log": {
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			map[string]interface{}{},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newNginxErrorStage(util_log.Logger, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestNginxErrorConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyNginxErrorStageSource),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseNginxErrorConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateNginxErrorConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("NginxErrorConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
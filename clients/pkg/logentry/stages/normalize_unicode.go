@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Config Errors
+const (
+	ErrEmptyNormalizeUnicodeStageConfig = "empty normalize_unicode stage configuration"
+	ErrEmptyNormalizeUnicodeStageSource = "empty source"
+	ErrNormalizeUnicodeInvalidForm      = "normalize_unicode stage form must be one of `NFC`, `NFD`, `NFKC` or `NFKD`, got %q"
+)
+
+var normalizationForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// NormalizeUnicodeConfig represents a NormalizeUnicode Stage configuration
+type NormalizeUnicodeConfig struct {
+	// Form is the Unicode normalization form, `NFC` by default.
+	Form   string  `mapstructure:"form"`
+	Source *string `mapstructure:"source"`
+}
+
+// validateNormalizeUnicodeConfig validates a normalize_unicode stage config and
+// returns the normalization form.
+func validateNormalizeUnicodeConfig(c *NormalizeUnicodeConfig) (norm.Form, error) {
+	if c == nil {
+		return 0, errors.New(ErrEmptyNormalizeUnicodeStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return 0, errors.New(ErrEmptyNormalizeUnicodeStageSource)
+	}
+	if c.Form == "" {
+		return norm.NFC, nil
+	}
+	form, ok := normalizationForms[strings.ToUpper(c.Form)]
+	if !ok {
+		return 0, errors.Errorf(ErrNormalizeUnicodeInvalidForm, c.Form)
+	}
+	return form, nil
+}
+
+// normalizeUnicodeStage normalizes the entry or an extracted value to a Unicode
+// normalization form
+type normalizeUnicodeStage struct {
+	cfg    *NormalizeUnicodeConfig
+	form   norm.Form
+	logger log.Logger
+}
+
+// newNormalizeUnicodeStage creates a new normalize_unicode pipeline stage from a config.
+func newNormalizeUnicodeStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseNormalizeUnicodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	form, err := validateNormalizeUnicodeConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&normalizeUnicodeStage{
+		cfg:    cfg,
+		form:   form,
+		logger: log.With(logger, "component", "stage", "type", "normalize_unicode"),
+	}), nil
+}
+
+func parseNormalizeUnicodeConfig(config interface{}) (*NormalizeUnicodeConfig, error) {
+	cfg := &NormalizeUnicodeConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (n *normalizeUnicodeStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	if n.cfg.Source == nil {
+		if entry == nil {
+			if Debug {
+				level.Debug(n.logger).Log("msg", "cannot normalize a nil entry")
+			}
+			return
+		}
+		*entry = n.form.String(*entry)
+		return
+	}
+
+	v, ok := extracted[*n.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(n.logger).Log("msg", "source does not exist in the set of extracted values", "source", *n.cfg.Source)
+		}
+		return
+	}
+	value, err := getString(v)
+	if err != nil {
+		if Debug {
+			level.Debug(n.logger).Log("msg", "failed to convert source value to string", "source", *n.cfg.Source, "err", err, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+	extracted[*n.cfg.Source] = n.form.String(value)
+}
+
+// Name implements Stage
+func (n *normalizeUnicodeStage) Name() string {
+	return StageTypeNormalizeUnicode
+}
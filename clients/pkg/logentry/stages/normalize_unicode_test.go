@@ -0,0 +1,133 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testNormalizeUnicodeYaml = `
+pipeline_stages:
+- normalize_unicode:
+`
+
+var testNormalizeUnicodeYamlNFKC = `
+pipeline_stages:
+- normalize_unicode:
+    form: nfkc
+`
+
+var testNormalizeUnicodeYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      user:
+- normalize_unicode:
+    source: user
+    form: NFD
+`
+
+func TestPipeline_NormalizeUnicode(t *testing.T) {
+	t.Parallel()
+
+	// "é" precomposed and decomposed as "e" followed by a combining acute accent.
+	composed := "caf\u00e9 r\u00e9sum\u00e9"
+	decomposed := "cafe\u0301 re\u0301sume\u0301"
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedEntry     string
+		expectedExtracted map[string]interface{}
+	}{
+		"nfc composed": {
+			testNormalizeUnicodeYaml,
+			composed,
+			composed,
+			map[string]interface{}{},
+		},
+		"nfc decomposed": {
+			testNormalizeUnicodeYaml,
+			decomposed,
+			composed,
+			map[string]interface{}{},
+		},
+		"nfkc compatibility characters": {
+			testNormalizeUnicodeYamlNFKC,
+			"ﬁle ① Ａ",
+			"file 1 A",
+			map[string]interface{}{},
+		},
+		"nfd source": {
+			testNormalizeUnicodeYamlWithSource,
+			`{"user":"` + composed + `"}`,
+			`{"user":"` + composed + `"}`,
+			map[string]interface{}{"user": decomposed},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedEntry, out.Line)
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+}
+
+func TestNormalizeUnicodeConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyNormalizeUnicodeStageSource),
+		},
+		"invalid form": {
+			map[string]interface{}{
+				"form": "NFX",
+			},
+			errors.Errorf(ErrNormalizeUnicodeInvalidForm, "NFX"),
+		},
+		"default form": {
+			nil,
+			nil,
+		},
+		"valid": {
+			map[string]interface{}{
+				"form":   "NFKD",
+				"source": "msg",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseNormalizeUnicodeConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateNormalizeUnicodeConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("NormalizeUnicodeConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package stages
+
+import (
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyPIIScrubStageConfig = "empty pii_scrub stage configuration"
+	ErrEmptyPIIScrubStageSource = "empty source"
+	ErrPIIScrubUnknownDetector  = "pii_scrub stage unknown detector %q"
+	ErrPIIScrubNoDetector       = "pii_scrub stage has no detector enabled"
+)
+
+const (
+	PIIDetectorJWT        = "jwt"
+	PIIDetectorEmail      = "email"
+	PIIDetectorCreditCard = "credit_card"
+	PIIDetectorSSN        = "ssn"
+	PIIDetectorPhone      = "phone"
+)
+
+var defaultPIIMask = "<redacted>"
+
+// piiDetectors are the built-in detectors in the order they are applied, longer
+// and more specific patterns first so that, e.g., the digits of a credit card
+// are not partially masked as a phone number.
+var piiDetectors = []struct {
+	name    string
+	pattern string
+	// valid filters out the matches which are not actual PII, nil keeps them all.
+	valid func(string) bool
+}{
+	{PIIDetectorJWT, `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`, nil},
+	{PIIDetectorEmail, emailRegexp.String(), nil},
+	{PIIDetectorCreditCard, `\b(?:\d[ -]?){12,18}\d\b`, luhnValid},
+	{PIIDetectorSSN, `\b\d{3}-\d{2}-\d{4}\b`, nil},
+	{PIIDetectorPhone, `(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\) ?|\b\d{3}[ .-])\d{3}[ .-]\d{4}\b`, nil},
+}
+
+// PIIScrubConfig represents a PIIScrub Stage configuration
+type PIIScrubConfig struct {
+	Source *string `mapstructure:"source"`
+	// Detectors are the built-in detectors enabled, all of them by default.
+	Detectors []string `mapstructure:"detectors"`
+	// DisabledDetectors are removed from the enabled detectors.
+	DisabledDetectors []string `mapstructure:"disabled_detectors"`
+	// Mask replaces the detected values, `<redacted>` by default.
+	Mask *string `mapstructure:"mask"`
+}
+
+// validatePIIScrubConfig validates a pii_scrub stage config.
+func validatePIIScrubConfig(c *PIIScrubConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyPIIScrubStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyPIIScrubStageSource)
+	}
+	for _, names := range [][]string{c.Detectors, c.DisabledDetectors} {
+		for _, name := range names {
+			if !isPIIDetector(name) {
+				return errors.Errorf(ErrPIIScrubUnknownDetector, name)
+			}
+		}
+	}
+	if c.Mask == nil {
+		c.Mask = &defaultPIIMask
+	}
+	return nil
+}
+
+func isPIIDetector(name string) bool {
+	for _, d := range piiDetectors {
+		if d.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type piiDetector struct {
+	name  string
+	regex *regexp.Regexp
+	valid func(string) bool
+}
+
+// piiScrubStage masks personal data detected by built-in patterns
+type piiScrubStage struct {
+	cfg       *PIIScrubConfig
+	detectors []piiDetector
+	logger    log.Logger
+}
+
+// newPIIScrubStage creates a new pii_scrub pipeline stage from a config.
+func newPIIScrubStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parsePIIScrubConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePIIScrubConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	enabled := make(map[string]bool, len(piiDetectors))
+	for _, d := range piiDetectors {
+		enabled[d.name] = len(cfg.Detectors) == 0
+	}
+	for _, name := range cfg.Detectors {
+		enabled[name] = true
+	}
+	for _, name := range cfg.DisabledDetectors {
+		enabled[name] = false
+	}
+	var detectors []piiDetector
+	for _, d := range piiDetectors {
+		if enabled[d.name] {
+			detectors = append(detectors, piiDetector{name: d.name, regex: regexp.MustCompile(d.pattern), valid: d.valid})
+		}
+	}
+	if len(detectors) == 0 {
+		return nil, errors.New(ErrPIIScrubNoDetector)
+	}
+
+	return toStage(&piiScrubStage{
+		cfg:       cfg,
+		detectors: detectors,
+		logger:    log.With(logger, "component", "stage", "type", "pii_scrub"),
+	}), nil
+}
+
+func parsePIIScrubConfig(config interface{}) (*PIIScrubConfig, error) {
+	cfg := &PIIScrubConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (p *piiScrubStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	if p.cfg.Source == nil {
+		if entry == nil {
+			if Debug {
+				level.Debug(p.logger).Log("msg", "cannot scrub a nil entry")
+			}
+			return
+		}
+		*entry = p.scrub(*entry)
+		return
+	}
+
+	v, ok := extracted[*p.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(p.logger).Log("msg", "source does not exist in the set of extracted values", "source", *p.cfg.Source)
+		}
+		return
+	}
+	value, err := getString(v)
+	if err != nil {
+		if Debug {
+			level.Debug(p.logger).Log("msg", "failed to convert source value to string", "source", *p.cfg.Source, "err", err, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+	extracted[*p.cfg.Source] = p.scrub(value)
+}
+
+// scrub applies every enabled detector in turn.
+func (p *piiScrubStage) scrub(s string) string {
+	for _, d := range p.detectors {
+		if d.valid == nil {
+			s = d.regex.ReplaceAllLiteralString(s, *p.cfg.Mask)
+			continue
+		}
+		s = d.regex.ReplaceAllStringFunc(s, func(match string) string {
+			if d.valid(match) {
+				return *p.cfg.Mask
+			}
+			return match
+		})
+	}
+	return s
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum used by
+// credit card numbers, separators are ignored.
+func luhnValid(s string) bool {
+	sum, digits := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// Name implements Stage
+func (p *piiScrubStage) Name() string {
+	return StageTypePIIScrub
+}
@@ -0,0 +1,171 @@
+package stages
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyQuerystringStageConfig = "empty querystring stage configuration"
+	ErrEmptyQuerystringStageSource = "empty source"
+	ErrQuerystringInvalidRepeated  = "querystring stage repeated must be one of `first`, `last` or `list`, got %q"
+)
+
+const (
+	QuerystringRepeatedFirst = "first"
+	QuerystringRepeatedLast  = "last"
+	QuerystringRepeatedList  = "list"
+)
+
+// querystringKeyPrefix prefixes the name of the parameters in the extracted map.
+const querystringKeyPrefix = "query_"
+
+// QuerystringConfig represents a Querystring Stage configuration
+type QuerystringConfig struct {
+	// Source is either a raw query string, with or without the leading `?`, or
+	// a full URL.
+	Source *string `mapstructure:"source"`
+	// Repeated decides which value of a parameter repeated in the query string
+	// is extracted, the `first`, which is the default, the `last`, or the `list`
+	// of all of them.
+	Repeated string `mapstructure:"repeated"`
+}
+
+// validateQuerystringConfig validates a querystring stage config.
+func validateQuerystringConfig(c *QuerystringConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyQuerystringStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyQuerystringStageSource)
+	}
+	switch c.Repeated {
+	case "":
+		c.Repeated = QuerystringRepeatedFirst
+	case QuerystringRepeatedFirst, QuerystringRepeatedLast, QuerystringRepeatedList:
+	default:
+		return errors.Errorf(ErrQuerystringInvalidRepeated, c.Repeated)
+	}
+	return nil
+}
+
+// querystringStage sets each parameter of a query string, decoded, as
+// `query_<name>` in the extracted map.
+type querystringStage struct {
+	cfg    *QuerystringConfig
+	logger log.Logger
+}
+
+// newQuerystringStage creates a new querystring pipeline stage from a config.
+func newQuerystringStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseQuerystringConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateQuerystringConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&querystringStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "querystring"),
+	}), nil
+}
+
+func parseQuerystringConfig(config interface{}) (*QuerystringConfig, error) {
+	cfg := &QuerystringConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (q *querystringStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the querystring stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if q.cfg.Source != nil {
+		if _, ok := extracted[*q.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(q.logger).Log("msg", "source does not exist in the set of extracted values", "source", *q.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*q.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(q.logger).Log("msg", "failed to convert source value to string", "source", *q.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*q.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(q.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	params, err := url.ParseQuery(rawQuery(*input))
+	if err != nil {
+		if Debug {
+			level.Debug(q.logger).Log("msg", "failed to parse query string", "err", err)
+		}
+		return
+	}
+	for name, values := range params {
+		if name == "" {
+			continue
+		}
+		key := querystringKeyPrefix + name
+		switch q.cfg.Repeated {
+		case QuerystringRepeatedFirst:
+			extracted[key] = values[0]
+		case QuerystringRepeatedLast:
+			extracted[key] = values[len(values)-1]
+		default:
+			extracted[key] = values
+		}
+	}
+	if Debug {
+		level.Debug(q.logger).Log("msg", "extracted data debug in querystring stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// rawQuery returns the query string of a URL, or the input itself without the
+// leading `?` when it is not a URL. The fragment is removed.
+func rawQuery(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '?'); i != -1 {
+		return s[i+1:]
+	}
+	if strings.Contains(s, "://") || strings.HasPrefix(s, "/") {
+		// A URL or a path without a query string.
+		return ""
+	}
+	return s
+}
+
+// Name implements Stage
+func (q *querystringStage) Name() string {
+	return StageTypeQuerystring
+}
@@ -0,0 +1,156 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testQuerystringYaml = `
+pipeline_stages:
+- regex:
+    expression: '^\S+ (?P<url>\S+)'
+- querystring:
+    source: url
+    repeated: last
+`
+
+func TestPipeline_Querystring(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testQuerystringYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := "GET /search?q=loki+logs&page=1&page=2 HTTP/1.1"
+	out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{
+		"url":        "/search?q=loki+logs&page=1&page=2",
+		"query_q":    "loki logs",
+		"query_page": "2",
+	}, out.Extracted)
+}
+
+func TestQuerystringStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		repeated string
+		input    string
+		expected map[string]interface{}
+	}{
+		"raw query string": {
+			"",
+			"user=frank&lang=en",
+			map[string]interface{}{"query_user": "frank", "query_lang": "en"},
+		},
+		"leading question mark": {
+			"",
+			"?user=frank",
+			map[string]interface{}{"query_user": "frank"},
+		},
+		"full url": {
+			"",
+			"https://example.com/api/v1/users?id=42&sort=name#top",
+			map[string]interface{}{"query_id": "42", "query_sort": "name"},
+		},
+		"url encoded values": {
+			"",
+			"/login?redirect=%2Fhome%3Ftab%3D1&name=J%C3%A9r%C3%B4me&msg=hello+world",
+			map[string]interface{}{"query_redirect": "/home?tab=1", "query_name": "Jérôme", "query_msg": "hello world"},
+		},
+		"repeated first": {
+			"first",
+			"tag=a&tag=b&tag=c&id=1",
+			map[string]interface{}{"query_tag": "a", "query_id": "1"},
+		},
+		"repeated last": {
+			"last",
+			"tag=a&tag=b&tag=c&id=1",
+			map[string]interface{}{"query_tag": "c", "query_id": "1"},
+		},
+		"repeated list": {
+			"list",
+			"tag=a&tag=b&tag=c&id=1",
+			map[string]interface{}{"query_tag": []string{"a", "b", "c"}, "query_id": []string{"1"}},
+		},
+		"empty values and names": {
+			"",
+			"debug&verbose=&=orphan",
+			map[string]interface{}{"query_debug": "", "query_verbose": ""},
+		},
+		"url without query string": {
+			"",
+			"https://example.com/path",
+			map[string]interface{}{},
+		},
+		"invalid escape": {
+			"",
+			"q=100%zz&user=frank",
+			map[string]interface{}{},
+		},
+		"semicolon separator": {
+			"",
+			"a=1;b=2",
+			map[string]interface{}{},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newQuerystringStage(util_log.Logger, map[string]interface{}{"repeated": tt.repeated})
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.input, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+			assert.Equal(t, tt.input, out.Line)
+		})
+	}
+}
+
+func TestQuerystringConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyQuerystringStageSource),
+		},
+		"invalid repeated": {
+			map[string]interface{}{
+				"repeated": "all",
+			},
+			errors.Errorf(ErrQuerystringInvalidRepeated, "all"),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseQuerystringConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateQuerystringConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("QuerystringConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package stages
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyRenameStageConfig     = "empty rename stage configuration"
+	ErrRenameRequired             = "rename stage requires a `mapping` or an `expression`"
+	ErrRenameEmptyKey             = "rename stage cannot rename %q to an empty key"
+	ErrRenameReplaceRequired      = "rename stage `expression` requires a `replace`"
+	ErrRenameInvalidCollisionMode = "rename stage on_collision must be one of `overwrite`, `skip` or `error`, got %q"
+)
+
+const (
+	RenameCollisionOverwrite = "overwrite"
+	RenameCollisionSkip      = "skip"
+	RenameCollisionError     = "error"
+)
+
+// RenameConfig represents a Rename Stage configuration
+type RenameConfig struct {
+	// Mapping maps the extracted keys to their new name.
+	Mapping map[string]string `mapstructure:"mapping"`
+	// Expression renames the extracted keys it matches, which are not in the
+	// mapping, to Replace, in which `$1` or `${name}` are replaced by the
+	// captured groups, e.g. `^http_(.*)` and `$1`.
+	Expression *string `mapstructure:"expression"`
+	Replace    string  `mapstructure:"replace"`
+	// OnCollision is what happens when the new name is already extracted:
+	// `overwrite` the existing value, which is the default, `skip` renaming
+	// the key, or `error`, in which case no key of the entry is renamed.
+	OnCollision string `mapstructure:"on_collision"`
+}
+
+// validateRenameConfig validates a rename stage config and returns the compiled
+// expression, if any.
+func validateRenameConfig(c *RenameConfig) (*regexp.Regexp, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyRenameStageConfig)
+	}
+	if len(c.Mapping) == 0 && c.Expression == nil {
+		return nil, errors.New(ErrRenameRequired)
+	}
+	for from, to := range c.Mapping {
+		if to == "" {
+			return nil, errors.Errorf(ErrRenameEmptyKey, from)
+		}
+	}
+	switch c.OnCollision {
+	case "":
+		c.OnCollision = RenameCollisionOverwrite
+	case RenameCollisionOverwrite, RenameCollisionSkip, RenameCollisionError:
+	default:
+		return nil, errors.Errorf(ErrRenameInvalidCollisionMode, c.OnCollision)
+	}
+	if c.Expression == nil {
+		return nil, nil
+	}
+	if c.Replace == "" {
+		return nil, errors.New(ErrRenameReplaceRequired)
+	}
+	expr, err := regexp.Compile(*c.Expression)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	return expr, nil
+}
+
+// renameStage renames extracted keys
+type renameStage struct {
+	cfg        *RenameConfig
+	expression *regexp.Regexp
+	logger     log.Logger
+}
+
+// newRenameStage creates a new rename pipeline stage from a config.
+func newRenameStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseRenameConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expression, err := validateRenameConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&renameStage{
+		cfg:        cfg,
+		expression: expression,
+		logger:     log.With(logger, "component", "stage", "type", "rename"),
+	}), nil
+}
+
+func parseRenameConfig(config interface{}) (*RenameConfig, error) {
+	cfg := &RenameConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+type rename struct {
+	from, to string
+}
+
+// Process implements Stage
+func (r *renameStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	// The keys are renamed in a stable order: the mapping first, then the keys
+	// matching the expression. Renamed keys are not matched again.
+	renames := make([]rename, 0, len(r.cfg.Mapping))
+	for from, to := range r.cfg.Mapping {
+		if _, ok := extracted[from]; ok && from != to {
+			renames = append(renames, rename{from: from, to: to})
+		}
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].from < renames[j].from })
+	if r.expression != nil {
+		matched := len(renames)
+		for key := range extracted {
+			if _, ok := r.cfg.Mapping[key]; ok {
+				continue
+			}
+			m := r.expression.FindStringSubmatchIndex(key)
+			if m == nil {
+				continue
+			}
+			to := string(r.expression.ExpandString(nil, r.cfg.Replace, key, m))
+			if to != "" && to != key {
+				renames = append(renames, rename{from: key, to: to})
+			}
+		}
+		sort.Slice(renames[matched:], func(i, j int) bool { return renames[matched+i].from < renames[matched+j].from })
+	}
+
+	// The keys are moved at once so that, e.g., two keys can be swapped. A new
+	// name collides with the keys which are extracted and not renamed, or with
+	// the new name of a previous key.
+	moving := make(map[string]struct{}, len(renames))
+	for _, rn := range renames {
+		moving[rn.from] = struct{}{}
+	}
+	targets := make(map[string]struct{}, len(renames))
+	planned := renames[:0]
+	for _, rn := range renames {
+		_, exists := extracted[rn.to]
+		_, moved := moving[rn.to]
+		_, renamed := targets[rn.to]
+		if (exists && !moved) || renamed {
+			switch r.cfg.OnCollision {
+			case RenameCollisionError:
+				if Debug {
+					level.Debug(r.logger).Log("msg", "not renaming extracted keys, the new name is already extracted", "from", rn.from, "to", rn.to)
+				}
+				return
+			case RenameCollisionSkip:
+				if Debug {
+					level.Debug(r.logger).Log("msg", "skipping rename, the new name is already extracted", "from", rn.from, "to", rn.to)
+				}
+				delete(moving, rn.from)
+				continue
+			}
+		}
+		targets[rn.to] = struct{}{}
+		planned = append(planned, rn)
+	}
+
+	values := make([]interface{}, len(planned))
+	for i, rn := range planned {
+		values[i] = extracted[rn.from]
+		delete(extracted, rn.from)
+	}
+	for i, rn := range planned {
+		extracted[rn.to] = values[i]
+	}
+	if Debug {
+		level.Debug(r.logger).Log("msg", "extracted data debug in rename stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (r *renameStage) Name() string {
+	return StageTypeRename
+}
@@ -0,0 +1,182 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testRenameYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      lvl:
+      msg:
+- rename:
+    mapping:
+      lvl: level
+      msg: message
+`
+
+func TestPipeline_Rename(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testRenameYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, `{"lvl":"warn","msg":"disk full"}`, time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{"level": "warn", "message": "disk full"}, out.Extracted)
+}
+
+func TestRenameStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config    map[string]interface{}
+		extracted map[string]interface{}
+		expected  map[string]interface{}
+	}{
+		"mapping": {
+			map[string]interface{}{
+				"mapping": map[string]string{"lvl": "level", "missing": "other"},
+			},
+			map[string]interface{}{"lvl": "info", "status": 200},
+			map[string]interface{}{"level": "info", "status": 200},
+		},
+		"expression": {
+			map[string]interface{}{
+				"expression": `^http_(?P<name>.+)$`,
+				"replace":    "req_${name}",
+			},
+			map[string]interface{}{"http_method": "GET", "http_status": "200", "user": "frank"},
+			map[string]interface{}{"req_method": "GET", "req_status": "200", "user": "frank"},
+		},
+		"mapping takes precedence over the expression": {
+			map[string]interface{}{
+				"mapping":    map[string]string{"http_status": "status"},
+				"expression": `^http_(.+)$`,
+				"replace":    "$1",
+			},
+			map[string]interface{}{"http_method": "GET", "http_status": "200"},
+			map[string]interface{}{"method": "GET", "status": "200"},
+		},
+		"swap": {
+			map[string]interface{}{
+				"mapping": map[string]string{"a": "b", "b": "a"},
+			},
+			map[string]interface{}{"a": "1", "b": "2"},
+			map[string]interface{}{"a": "2", "b": "1"},
+		},
+		"collision overwrite": {
+			map[string]interface{}{
+				"mapping": map[string]string{"lvl": "level"},
+			},
+			map[string]interface{}{"lvl": "warn", "level": "info"},
+			map[string]interface{}{"level": "warn"},
+		},
+		"collision skip": {
+			map[string]interface{}{
+				"mapping":      map[string]string{"lvl": "level", "msg": "message"},
+				"on_collision": "skip",
+			},
+			map[string]interface{}{"lvl": "warn", "level": "info", "msg": "hello"},
+			map[string]interface{}{"lvl": "warn", "level": "info", "message": "hello"},
+		},
+		"collision error": {
+			map[string]interface{}{
+				"mapping":      map[string]string{"lvl": "level", "msg": "message"},
+				"on_collision": "error",
+			},
+			map[string]interface{}{"lvl": "warn", "level": "info", "msg": "hello"},
+			map[string]interface{}{"lvl": "warn", "level": "info", "msg": "hello"},
+		},
+		"collision between renames": {
+			map[string]interface{}{
+				"expression":   `^(?:src|source)_ip$`,
+				"replace":      "ip",
+				"on_collision": "skip",
+			},
+			map[string]interface{}{"source_ip": "10.0.0.2", "src_ip": "10.0.0.1"},
+			map[string]interface{}{"ip": "10.0.0.2", "src_ip": "10.0.0.1"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newRenameStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(tt.extracted, nil, "", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+		})
+	}
+}
+
+func TestRenameConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrRenameRequired),
+		},
+		"empty new name": {
+			map[string]interface{}{
+				"mapping": map[string]string{"lvl": ""},
+			},
+			errors.Errorf(ErrRenameEmptyKey, "lvl"),
+		},
+		"expression without replace": {
+			map[string]interface{}{
+				"expression": "^http_(.*)",
+			},
+			errors.New(ErrRenameReplaceRequired),
+		},
+		"invalid expression": {
+			map[string]interface{}{
+				"expression": "(",
+				"replace":    "$1",
+			},
+			errors.Wrap(errors.New("error parsing regexp: missing closing ): `(`"), ErrCouldNotCompileRegex),
+		},
+		"invalid collision mode": {
+			map[string]interface{}{
+				"mapping":      map[string]string{"lvl": "level"},
+				"on_collision": "merge",
+			},
+			errors.Errorf(ErrRenameInvalidCollisionMode, "merge"),
+		},
+		"valid": {
+			map[string]interface{}{
+				"mapping":      map[string]string{"lvl": "level"},
+				"on_collision": "skip",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseRenameConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateRenameConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("RenameConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
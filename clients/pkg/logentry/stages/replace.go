@@ -2,41 +2,306 @@ package stages
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"math/rand"
+	"net/url"
+	"path"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+	json "github.com/json-iterator/go"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/uber/jaeger-client-go/utils"
+
+	"github.com/grafana/loki/pkg/push"
+
+	"github.com/grafana/loki/v3/pkg/util"
 )
 
 // Config Errors
 const (
 	ErrEmptyReplaceStageConfig = "empty replace stage configuration"
 	ErrEmptyReplaceStageSource = "empty source in replace stage"
+	ErrReplaceDSLWithReplace   = "replace stage cannot define both `replace` and `dsl`"
+	ErrReplaceUnknownGroup     = "replace stage references unknown named capture group %q"
+	ErrReplaceUnknownLookup    = "replace stage references unknown lookup %q"
+	ErrReplaceInvalidNewlines  = "replace stage normalize_newlines must be one of `lf` or `crlf`, got %q"
+	ErrEmptyReplaceStageLabel  = "empty source_label in replace stage"
+	ErrReplaceSourceAndLabel   = "replace stage cannot define both `source` and `source_label`"
+	ErrReplaceJSONArraySource  = "replace stage `source_json_array` requires a `source`"
+	ErrEmptyReplaceMatchedRule = "empty matched_rule_key in replace stage"
+	ErrReplaceSourcePattern    = "replace stage cannot define `source_pattern` together with `source` or `source_label`"
+	ErrReplaceInvalidPattern   = "invalid source_pattern %q in replace stage"
+	ErrReplaceGroupIndexName   = "replace stage cannot define both `group_index` and `group_name`"
+	ErrReplaceGroupIndexRange  = "replace stage group_index %d is out of range, the expression has %d capture groups"
+	ErrReplaceInvalidSampling  = "replace stage debug_sample_rate must be between 0.0 and 1.0, received %f"
+	ErrReplaceTooComplex       = "replace stage expression exceeds the complexity budget: %s"
+	ErrReplaceInvalidKeep      = "replace stage keep_prefix and keep_suffix cannot be negative"
+	ErrReplaceExtractOnly      = "replace stage `extract_only` cannot be used with `replace`, `dsl` or `source_json_array`"
+	ErrReplaceConflictingFlag  = "replace stage expression clears the `%c` flag enabled by `%s`"
+	ErrReplaceRangeExpression  = "replace stage cannot define both `range` and `expression`"
+	ErrReplaceInvalidRange     = "replace stage range must be a start and an end offset with 0 <= start < end, got [%d, %d]"
+	ErrReplaceFromKeyTemplate  = "replace stage `replace_from_key` cannot be used with `replace` or `dsl`"
+	ErrEmptyReplaceFromKey     = "empty replace_from_key in replace stage"
+	ErrReplacePreserveName     = "replace stage preserve_original_as %q is not a valid structured metadata name"
+	ErrReplacePreservePattern  = "replace stage `preserve_original_as` cannot be used with `source_pattern`"
+	ErrReplacePerGroup         = "replace stage `per_group` cannot be used with `dsl`, `replace_from_key` or `extract_only`"
+	ErrReplaceInvalidMaxInput  = "replace stage max_input_bytes cannot be negative"
+	ErrReplaceBinary           = "replace stage `binary` cannot be used with `range`, `keep_prefix`, `keep_suffix`, `preserve_length` or `source_json_array`"
+	ErrReplaceMetricConfig     = "replace stage `metric_name` and `metric_label_from_group` must be defined together"
+	ErrReplaceInvalidMetric    = "replace stage metric_name %q is not a valid metric name"
+	ErrReplaceInvalidMaxLabels = "replace stage metric_max_label_values cannot be negative"
+	ErrReplaceDigitPlaceholder = "replace stage `digit_placeholder` cannot be used with `replace`, `dsl`, `replace_from_key`, `per_group` or `extract_only`"
+	ErrReplaceInvalidAnchor    = "replace stage anchor must be one of `start`, `end` or `both`, got %q"
+	ErrReplaceAnchorRange      = "replace stage `anchor` cannot be used with `range`"
+	ErrReplaceAlreadyAnchored  = "replace stage expression is already anchored at the %s, remove either the anchor or the `anchor` option"
+	ErrReplaceThenExtract      = "replace stage `then_extract` cannot be used with `extract_only` or `source_json_array`"
+	ErrReplaceThenExtractRegex = "invalid then_extract expression in replace stage"
+	ErrReplaceThenExtractNames = "replace stage then_extract expression has no named capture group"
+	ErrReplaceGapReplace       = "replace stage `gap_replace` requires `template_gaps`"
+	ErrReplaceTemplateGaps     = "replace stage `template_gaps` cannot be used with `extract_only`"
+	ErrReplaceResultMustMatch  = "replace stage `result_must_match` cannot be used with `extract_only`"
+	ErrReplaceResultPolicy     = "replace stage result_policy must be one of `revert` or `drop`, got %q"
+	ErrReplaceResultNoMatch    = "replace stage `result_policy` requires `result_must_match`"
+	ErrReplaceResultRegex      = "invalid result_must_match expression in replace stage"
+	ErrReplaceLineIndex        = "replace stage `line_index` cannot be used with `source_json_array`"
+	ErrReplaceInvalidHistogram = "replace stage capture_count_histogram %q is not a valid metric name"
+	ErrReplaceHistogramName    = "replace stage capture_count_histogram and metric_name cannot be the same"
 )
 
 // ReplaceConfig contains a regexStage configuration
 type ReplaceConfig struct {
 	Expression string  `mapstructure:"expression"`
 	Source     *string `mapstructure:"source"`
-	Replace    string  `mapstructure:"replace"`
+	// Replace is the template rendered for every captured group. Besides the
+	// extracted values, `.Value` holds the captured value, `.__line__` the
+	// whole input the expression was matched against, `.MatchIndex` the 0-based
+	// index of the current match and `.MatchCount` the number of matches.
+	Replace string `mapstructure:"replace"`
+	// SourceLabel applies the replacement to the value of a label instead of the
+	// entry or an extracted value.
+	SourceLabel *string `mapstructure:"source_label"`
+	// DSL is an alternative to Replace, see compileDSL for the supported syntax.
+	DSL *string `mapstructure:"dsl"`
+	// WholeMatch replaces the entire match when the expression has no capture groups.
+	WholeMatch bool `mapstructure:"whole_match"`
+	// Lookups are named dictionaries mapping a captured value to its replacement.
+	Lookups map[string]map[string]string `mapstructure:"lookups"`
+	// GroupLookups maps a named capture group to the lookup used to replace its
+	// value. Values missing from the lookup are rendered with the template.
+	GroupLookups map[string]string `mapstructure:"group_lookups"`
+	// NormalizeNewlines rewrites the line endings of the input and of the result
+	// to either `lf` or `crlf`.
+	NormalizeNewlines string `mapstructure:"normalize_newlines"`
+	// PromoteAllow restricts, per named capture group, which captured values are
+	// written to the extracted map. Other values are extracted as PromoteOther.
+	PromoteAllow map[string][]string `mapstructure:"promote_allow"`
+	// PromoteOther is the value extracted for captured values not allowed by
+	// PromoteAllow, `other` by default.
+	PromoteOther *string `mapstructure:"promote_other"`
+	// SourceJSONArray treats the source as a JSON array of strings: the replacement
+	// is applied to each element and the array is stored back as JSON.
+	SourceJSONArray bool `mapstructure:"source_json_array"`
+	// CollapseWhitespace collapses runs of whitespace of the result to a single
+	// space and trims its ends.
+	CollapseWhitespace bool `mapstructure:"collapse_whitespace"`
+	// MatchedRuleKey is the extracted key set to the rule of the expression which
+	// matched first. The rules are the top-level alternatives of the expression,
+	// identified by their named capture group, e.g. `ipv4` and `email` for
+	// `(?P<ipv4>...)|(?P<email>...)`, or by their index otherwise.
+	MatchedRuleKey *string `mapstructure:"matched_rule_key"`
+	// SetEmptyOnNoMatch sets every named capture group to an empty string in the
+	// extracted map when the expression does not match.
+	SetEmptyOnNoMatch bool `mapstructure:"set_empty_on_no_match"`
+	// SourcePattern applies the replacement to every extracted value whose key
+	// matches the glob, e.g. `user_*`, see path.Match for the syntax.
+	SourcePattern *string `mapstructure:"source_pattern"`
+	// GroupIndex applies the replacement to the capture group at this 1-based
+	// index only, the other groups are left untouched.
+	GroupIndex *int `mapstructure:"group_index"`
+	// GroupName is like GroupIndex for a named capture group.
+	GroupName *string `mapstructure:"group_name"`
+	// URLDecode percent-decodes the captured values before they are rendered.
+	URLDecode bool `mapstructure:"url_decode"`
+	// DebugSampleRate logs the replacement decision, the input and the result,
+	// for this fraction of the lines, whether or not debug logging is enabled.
+	DebugSampleRate float64 `mapstructure:"debug_sample_rate"`
+	// ExtractOnly only extracts the named capture groups, the input is left
+	// unmodified and no template is executed.
+	ExtractOnly bool `mapstructure:"extract_only"`
+	// PreserveLength resizes the rendered replacement to the length in runes of
+	// the captured value, e.g. `*` renders `****` for a 4 characters capture.
+	// Longer results are repeated to fill the length, or cut when too long.
+	PreserveLength bool `mapstructure:"preserve_length"`
+	// KeepPrefix and KeepSuffix are the number of leading and trailing runes of
+	// each captured value left as is, only the middle is rendered with the
+	// template, e.g. `4111********1111`. Values too short to keep both are
+	// rendered entirely.
+	KeepPrefix int `mapstructure:"keep_prefix"`
+	KeepSuffix int `mapstructure:"keep_suffix"`
+	// Multiline makes `^` and `$` match at the beginning and end of each line,
+	// like the `(?m)` flag.
+	Multiline bool `mapstructure:"multiline"`
+	// DotAll makes `.` match newlines, like the `(?s)` flag, e.g. to mask a
+	// stack trace spanning several lines.
+	DotAll bool `mapstructure:"dot_all"`
+	// Range is the [start, end) offsets in runes of the input replaced, when a
+	// regular expression is not needed, e.g. for a column of a fixed width
+	// format. It is clamped to the length of the input, and the template is
+	// rendered with the slice as the only, unnamed, captured group.
+	Range *[2]int `mapstructure:"range"`
+	// CollectAll extracts each named capture group as a slice of the values of
+	// every match, in order, instead of the value of the first match only. The
+	// replace templates only read the string values, the slices are formatted
+	// with Join in a template stage.
+	CollectAll bool `mapstructure:"collect_all"`
+	// ReplaceFromKey replaces the captured values with the value of this
+	// extracted key instead of the Replace template. The value is executed as a
+	// template when it contains actions, and the captured values are left
+	// unchanged when the key is missing.
+	ReplaceFromKey *string `mapstructure:"replace_from_key"`
+	// DropOnError drops the lines the template fails to render instead of
+	// sending them unchanged, and so possibly unmasked.
+	DropOnError bool `mapstructure:"drop_on_error"`
+	// WholeWord anchors the expression to word boundaries, wrapping it as
+	// `\b(?:expression)\b`, so that `admin` does not match in `administrator`.
+	// The boundaries apply to the whole match, whose first and last characters
+	// must then be word characters for it to match at all.
+	WholeWord bool `mapstructure:"whole_word"`
+	// PreserveOriginalAs is the structured metadata name the original value of
+	// the input is recorded under when it is replaced, so that it remains
+	// available out of the log line, e.g. for auditing.
+	PreserveOriginalAs *string `mapstructure:"preserve_original_as"`
+	// PerGroup maps named capture groups to the template rendered for their
+	// values instead of Replace. The other groups are rendered with Replace, or
+	// left unchanged when Replace is empty.
+	PerGroup map[string]string `mapstructure:"per_group"`
+	// Deterministic seeds the random template functions, `UUID`, `uuidv4`,
+	// `randInt`, `randAlpha`, `randNumeric`, `randAlphaNum`, `randAscii`,
+	// `randBytes` and `shuffle`, with the hash of the input and of the captured value, and decides whether
+	// DebugSampleRate logs a line from the hash of the input, so that identical
+	// lines are always replaced and sampled identically. The template is copied
+	// for every captured value, which makes the replacement slower.
+	Deterministic bool `mapstructure:"deterministic"`
+	// Binary accepts the extracted values holding raw bytes as source, they are
+	// matched as bytes and written back as bytes, the bytes outside of the
+	// replaced spans being preserved even when they are not valid UTF-8. The
+	// captured bytes are passed as is to the template as `.Value`, but the
+	// functions working on text, e.g. ToUpper, write the invalid bytes as
+	// U+FFFD, and a multibyte output is written as its UTF-8 encoding. The
+	// options counting runes cannot be used.
+	Binary bool `mapstructure:"binary"`
+	// MaxInputBytes leaves the inputs longer than this number of bytes
+	// unchanged, without matching them, to bound the latency of the stage. The
+	// inputs are not limited when 0.
+	MaxInputBytes int `mapstructure:"max_input_bytes"`
+	// MetricName is the name, prefixed with `promtail_custom_`, of a counter
+	// incremented for every match and labeled by the value captured by the
+	// MetricLabelFromGroup named capture group, e.g. a HTTP status. The label is
+	// named after the group.
+	MetricName           *string `mapstructure:"metric_name"`
+	MetricLabelFromGroup *string `mapstructure:"metric_label_from_group"`
+	// MetricLabelAllow restricts the label values to these captured values,
+	// the others are counted as `other`. Without it, the first
+	// MetricMaxLabelValues distinct captured values, 100 by default, are used as
+	// label values and the next ones are counted as `other`.
+	MetricLabelAllow     []string `mapstructure:"metric_label_allow"`
+	MetricMaxLabelValues int      `mapstructure:"metric_max_label_values"`
+	// DigitPlaceholder replaces each run of digits of the captured values with
+	// this placeholder instead of rendering a template, whatever the capture
+	// groups, e.g. `/users/:id/orders/:id` for `/users/12345/orders/67` with
+	// `:id`. Combined with WholeMatch, the whole matches of an expression
+	// without capture groups are templatized.
+	DigitPlaceholder *string `mapstructure:"digit_placeholder"`
+	// Anchor anchors the expression at the `start`, the `end` or `both` ends of
+	// the input, wrapping it as `^(?:expression)`, `(?:expression)$` or
+	// `^(?:expression)$`. With Multiline, the anchors match at every line.
+	Anchor string `mapstructure:"anchor"`
+	// ThenExtract is a second expression matched against the result of the
+	// replacement, whose named capture groups of the first match are written to
+	// the extracted map, e.g. to extract the segments of a normalized path.
+	ThenExtract *string `mapstructure:"then_extract"`
+	// TemplateGaps renders the GapReplace template for each segment of the
+	// input between the matches, before the first one and after the last one,
+	// instead of copying them as is, e.g. `{{ repeat (len .Gap) "*" }}` masks
+	// everything but the matches. `.Gap` holds the segment. The inputs without
+	// any match are left unchanged.
+	TemplateGaps bool   `mapstructure:"template_gaps"`
+	GapReplace   string `mapstructure:"gap_replace"`
+	// ResultMustMatch is an expression the result of the replacement must
+	// match, e.g. to check that a masked value keeps the shape expected
+	// downstream. The results which do not match are handled by ResultPolicy,
+	// either reverted to the original value, which is the default, or dropped.
+	ResultMustMatch *string `mapstructure:"result_must_match"`
+	ResultPolicy    string  `mapstructure:"result_policy"`
+	// LineIndex applies the replacement to this line of the input only,
+	// counting from 0, or from -1 at the last line when negative, e.g. to mask
+	// the header line of a stack trace. A trailing newline does not start a
+	// line, and the inputs without this line are left unchanged.
+	LineIndex *int `mapstructure:"line_index"`
+	// CaptureCountHistogram is the name, prefixed with `promtail_custom_`, of a
+	// histogram observing the number of matches of every line, e.g. to size the
+	// cost of masking or to spot the lines with an unusual number of tokens. The
+	// lines without any match are observed as 0.
+	CaptureCountHistogram *string `mapstructure:"capture_count_histogram"`
+	// CountBytes counts the bytes added and removed by the replacements of the
+	// lines matched, compared to their original value, in the
+	// `logentry_replace_bytes_added_total` and
+	// `logentry_replace_bytes_removed_total` counters, e.g. to estimate the
+	// effect of masking on the storage downstream.
+	CountBytes bool `mapstructure:"count_bytes"`
 }
 
+// replaceDropReason is the reason of the lines dropped with DropOnError.
+const replaceDropReason = "replace_template_error"
+
+// replaceResultDropReason is the reason of the lines dropped as their result
+// does not match ResultMustMatch.
+const replaceResultDropReason = "replace_result_mismatch"
+
+const (
+	ReplaceResultRevert = "revert"
+	ReplaceResultDrop   = "drop"
+)
+
+// errReplaceResultMismatch is returned by process for the results not matching
+// ResultMustMatch with the drop policy.
+var errReplaceResultMismatch = errors.New("replace result does not match result_must_match")
+
+// replaceRangeExpression is the expression of the replace stages configured with
+// a range, matching the whole input so that the range is the first group.
+const replaceRangeExpression = "(?s)(.*)"
+
 // validateReplaceConfig validates the config and return a regex
 func validateReplaceConfig(c *ReplaceConfig) (*regexp.Regexp, error) {
 	if c == nil {
 		return nil, errors.New(ErrEmptyReplaceStageConfig)
 	}
 
-	if c.Expression == "" {
+	if c.Range != nil {
+		if c.Expression != "" {
+			return nil, errors.New(ErrReplaceRangeExpression)
+		}
+		if c.Range[0] < 0 || c.Range[1] <= c.Range[0] {
+			return nil, errors.Errorf(ErrReplaceInvalidRange, c.Range[0], c.Range[1])
+		}
+	} else if c.Expression == "" {
 		return nil, errors.New(ErrExpressionRequired)
 	}
 
@@ -44,25 +309,384 @@ func validateReplaceConfig(c *ReplaceConfig) (*regexp.Regexp, error) {
 		return nil, errors.New(ErrEmptyReplaceStageSource)
 	}
 
-	expr, err := regexp.Compile(c.Expression)
+	switch c.Anchor {
+	case "", ReplaceAnchorStart, ReplaceAnchorEnd, ReplaceAnchorBoth:
+	default:
+		return nil, errors.Errorf(ErrReplaceInvalidAnchor, c.Anchor)
+	}
+	if c.Anchor != "" && c.Range != nil {
+		return nil, errors.New(ErrReplaceAnchorRange)
+	}
+
+	if c.SourceLabel != nil {
+		if *c.SourceLabel == "" {
+			return nil, errors.New(ErrEmptyReplaceStageLabel)
+		}
+		if c.Source != nil {
+			return nil, errors.New(ErrReplaceSourceAndLabel)
+		}
+	}
+
+	if c.SourcePattern != nil {
+		if c.Source != nil || c.SourceLabel != nil {
+			return nil, errors.New(ErrReplaceSourcePattern)
+		}
+		if _, err := path.Match(*c.SourcePattern, ""); err != nil {
+			return nil, errors.Errorf(ErrReplaceInvalidPattern, *c.SourcePattern)
+		}
+	}
+
+	if c.MatchedRuleKey != nil && *c.MatchedRuleKey == "" {
+		return nil, errors.New(ErrEmptyReplaceMatchedRule)
+	}
+
+	if c.SourceJSONArray && c.Source == nil {
+		return nil, errors.New(ErrReplaceJSONArraySource)
+	}
+
+	if c.DSL != nil && c.Replace != "" {
+		return nil, errors.New(ErrReplaceDSLWithReplace)
+	}
+
+	if c.ReplaceFromKey != nil {
+		if *c.ReplaceFromKey == "" {
+			return nil, errors.New(ErrEmptyReplaceFromKey)
+		}
+		if c.Replace != "" || c.DSL != nil {
+			return nil, errors.New(ErrReplaceFromKeyTemplate)
+		}
+	}
+
+	if c.PreserveOriginalAs != nil {
+		if !model.LabelName(*c.PreserveOriginalAs).IsValidLegacy() {
+			return nil, errors.Errorf(ErrReplacePreserveName, *c.PreserveOriginalAs)
+		}
+		if c.SourcePattern != nil {
+			return nil, errors.New(ErrReplacePreservePattern)
+		}
+	}
+
+	if len(c.PerGroup) > 0 && (c.DSL != nil || c.ReplaceFromKey != nil || c.ExtractOnly) {
+		return nil, errors.New(ErrReplacePerGroup)
+	}
+
+	if c.ThenExtract != nil && (c.ExtractOnly || c.SourceJSONArray) {
+		return nil, errors.New(ErrReplaceThenExtract)
+	}
+
+	if c.GapReplace != "" && !c.TemplateGaps {
+		return nil, errors.New(ErrReplaceGapReplace)
+	}
+	if c.TemplateGaps && c.ExtractOnly {
+		return nil, errors.New(ErrReplaceTemplateGaps)
+	}
+
+	if c.LineIndex != nil && c.SourceJSONArray {
+		return nil, errors.New(ErrReplaceLineIndex)
+	}
+
+	if c.ResultMustMatch != nil && c.ExtractOnly {
+		return nil, errors.New(ErrReplaceResultMustMatch)
+	}
+	switch c.ResultPolicy {
+	case "":
+	case ReplaceResultRevert, ReplaceResultDrop:
+		if c.ResultMustMatch == nil {
+			return nil, errors.New(ErrReplaceResultNoMatch)
+		}
+	default:
+		return nil, errors.Errorf(ErrReplaceResultPolicy, c.ResultPolicy)
+	}
+
+	if c.DigitPlaceholder != nil && (c.Replace != "" || c.DSL != nil || c.ReplaceFromKey != nil || len(c.PerGroup) > 0 || c.ExtractOnly) {
+		return nil, errors.New(ErrReplaceDigitPlaceholder)
+	}
+
+	if c.ExtractOnly && (c.Replace != "" || c.DSL != nil || c.SourceJSONArray) {
+		return nil, errors.New(ErrReplaceExtractOnly)
+	}
+
+	if c.Binary && (c.Range != nil || c.KeepPrefix != 0 || c.KeepSuffix != 0 || c.PreserveLength || c.SourceJSONArray) {
+		return nil, errors.New(ErrReplaceBinary)
+	}
+
+	if c.MaxInputBytes < 0 {
+		return nil, errors.New(ErrReplaceInvalidMaxInput)
+	}
+
+	if (c.MetricName == nil) != (c.MetricLabelFromGroup == nil) {
+		return nil, errors.New(ErrReplaceMetricConfig)
+	}
+	if c.MetricName != nil && !model.IsValidLegacyMetricName(replaceMetricPrefix+*c.MetricName) {
+		return nil, errors.Errorf(ErrReplaceInvalidMetric, *c.MetricName)
+	}
+	if c.MetricMaxLabelValues < 0 {
+		return nil, errors.New(ErrReplaceInvalidMaxLabels)
+	}
+	if c.CaptureCountHistogram != nil {
+		if !model.IsValidLegacyMetricName(replaceMetricPrefix + *c.CaptureCountHistogram) {
+			return nil, errors.Errorf(ErrReplaceInvalidHistogram, *c.CaptureCountHistogram)
+		}
+		if c.MetricName != nil && *c.MetricName == *c.CaptureCountHistogram {
+			return nil, errors.New(ErrReplaceHistogramName)
+		}
+	}
+
+	if c.KeepPrefix < 0 || c.KeepSuffix < 0 {
+		return nil, errors.New(ErrReplaceInvalidKeep)
+	}
+
+	if c.DebugSampleRate < 0.0 || c.DebugSampleRate > 1.0 {
+		return nil, errors.Errorf(ErrReplaceInvalidSampling, c.DebugSampleRate)
+	}
+
+	if c.GroupIndex != nil && c.GroupName != nil {
+		return nil, errors.New(ErrReplaceGroupIndexName)
+	}
+
+	switch c.NormalizeNewlines {
+	case "", "lf", "crlf":
+	default:
+		return nil, errors.Errorf(ErrReplaceInvalidNewlines, c.NormalizeNewlines)
+	}
+
+	if c.Multiline && clearsRegexFlag(c.Expression, 'm') {
+		return nil, errors.Errorf(ErrReplaceConflictingFlag, 'm', "multiline")
+	}
+	if c.DotAll && clearsRegexFlag(c.Expression, 's') {
+		return nil, errors.Errorf(ErrReplaceConflictingFlag, 's', "dot_all")
+	}
+
+	expr, err := regexp.Compile(replaceExpression(c))
 	if err != nil {
 		return nil, errors.Wrap(err, ErrCouldNotCompileRegex)
 	}
+	if c.Anchor != "" {
+		if err := checkReplaceAnchors(c.Expression, c.Anchor); err != nil {
+			return nil, err
+		}
+	}
+	if ReplaceComplexityCheck {
+		if err := checkReplaceComplexity(replaceExpression(c)); err != nil {
+			return nil, err
+		}
+	}
+
+	for group, lookup := range c.GroupLookups {
+		if expr.SubexpIndex(group) == -1 {
+			return nil, errors.Errorf(ErrReplaceUnknownGroup, group)
+		}
+		if _, ok := c.Lookups[lookup]; !ok {
+			return nil, errors.Errorf(ErrReplaceUnknownLookup, lookup)
+		}
+	}
+
+	for group := range c.PromoteAllow {
+		if expr.SubexpIndex(group) == -1 {
+			return nil, errors.Errorf(ErrReplaceUnknownGroup, group)
+		}
+	}
+
+	for group := range c.PerGroup {
+		if expr.SubexpIndex(group) == -1 {
+			return nil, errors.Errorf(ErrReplaceUnknownGroup, group)
+		}
+	}
+
+	if c.GroupIndex != nil && (*c.GroupIndex < 1 || *c.GroupIndex > expr.NumSubexp()) {
+		return nil, errors.Errorf(ErrReplaceGroupIndexRange, *c.GroupIndex, expr.NumSubexp())
+	}
+	if c.GroupName != nil && expr.SubexpIndex(*c.GroupName) == -1 {
+		return nil, errors.Errorf(ErrReplaceUnknownGroup, *c.GroupName)
+	}
+	if c.MetricLabelFromGroup != nil && expr.SubexpIndex(*c.MetricLabelFromGroup) == -1 {
+		return nil, errors.Errorf(ErrReplaceUnknownGroup, *c.MetricLabelFromGroup)
+	}
 	return expr, nil
 }
 
+// setReplaceDefaults sets the defaults of the options left unset. It is kept
+// apart from validateReplaceConfig, so that a config can be validated again.
+func setReplaceDefaults(c *ReplaceConfig) {
+	if c.ResultPolicy == "" && c.ResultMustMatch != nil {
+		c.ResultPolicy = ReplaceResultRevert
+	}
+	if c.PromoteOther == nil {
+		c.PromoteOther = &defaultPromoteOther
+	}
+	if c.MetricMaxLabelValues == 0 {
+		c.MetricMaxLabelValues = defaultReplaceMetricMaxLabelValues
+	}
+}
+
+var defaultPromoteOther = "other"
+
+const (
+	ReplaceAnchorStart = "start"
+	ReplaceAnchorEnd   = "end"
+	ReplaceAnchorBoth  = "both"
+)
+
+// checkReplaceAnchors rejects an expression already anchored where Anchor
+// anchors it, e.g. `^foo` with `start`, as one of the anchors is redundant.
+func checkReplaceAnchors(expression string, anchor string) error {
+	re, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	if anchor != ReplaceAnchorEnd && anchoredAt(re, true) {
+		return errors.Errorf(ErrReplaceAlreadyAnchored, ReplaceAnchorStart)
+	}
+	if anchor != ReplaceAnchorStart && anchoredAt(re, false) {
+		return errors.Errorf(ErrReplaceAlreadyAnchored, ReplaceAnchorEnd)
+	}
+	return nil
+}
+
+// anchoredAt reports whether the expression starts, or ends when start is
+// false, with an anchor, looking into the capture groups.
+func anchoredAt(re *syntax.Regexp, start bool) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpBeginText:
+		return start
+	case syntax.OpEndLine, syntax.OpEndText:
+		return !start
+	case syntax.OpCapture:
+		return anchoredAt(re.Sub[0], start)
+	case syntax.OpConcat:
+		if len(re.Sub) == 0 {
+			return false
+		}
+		if start {
+			return anchoredAt(re.Sub[0], start)
+		}
+		return anchoredAt(re.Sub[len(re.Sub)-1], start)
+	}
+	return false
+}
+
+const (
+	// replaceMetricPrefix prefixes MetricName like the metrics stage prefixes
+	// the custom metrics.
+	replaceMetricPrefix = "promtail_custom_"
+	// replaceMetricOther is the label value of the captured values which are not
+	// allowed or exceed MetricMaxLabelValues.
+	replaceMetricOther                 = "other"
+	defaultReplaceMetricMaxLabelValues = 100
+)
+
+var (
+	// ReplaceComplexityCheck rejects the replace expressions exceeding the budget
+	// below when the configuration is loaded. Go regular expressions never
+	// backtrack, but nested quantifiers and large repetitions inflate the compiled
+	// program and so the cost of matching every line. It is disabled by default
+	// so that existing configurations keep loading.
+	ReplaceComplexityCheck = false
+	// ReplaceMaxQuantifierNesting is the maximum depth of nested unbounded
+	// quantifiers, 1 rejects the classic `(a+)+` shape.
+	ReplaceMaxQuantifierNesting = 1
+	// ReplaceMaxProgramSize is the maximum number of instructions of the compiled
+	// expression.
+	ReplaceMaxProgramSize = 1000
+)
+
+// checkReplaceComplexity checks an expression against the complexity budget.
+func checkReplaceComplexity(expression string) error {
+	re, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	if depth := quantifierNesting(re); depth > ReplaceMaxQuantifierNesting {
+		return errors.Errorf(ErrReplaceTooComplex, fmt.Sprintf("%d nested quantifiers, the maximum is %d", depth, ReplaceMaxQuantifierNesting))
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return errors.Wrap(err, ErrCouldNotCompileRegex)
+	}
+	if size := len(prog.Inst); size > ReplaceMaxProgramSize {
+		return errors.Errorf(ErrReplaceTooComplex, fmt.Sprintf("%d instructions, the maximum is %d", size, ReplaceMaxProgramSize))
+	}
+	return nil
+}
+
+// quantifierNesting returns the maximum depth of nested quantifiers repeating
+// their operand more than once.
+func quantifierNesting(re *syntax.Regexp) int {
+	depth := 0
+	for _, sub := range re.Sub {
+		if d := quantifierNesting(sub); d > depth {
+			depth = d
+		}
+	}
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		return depth + 1
+	case syntax.OpRepeat:
+		if re.Max == -1 || re.Max > 1 {
+			return depth + 1
+		}
+	}
+	return depth
+}
+
+// replaceLineKey is the template data key holding the unmodified input. The
+// double underscores keep it apart from names produced by the extraction stages.
+const replaceLineKey = "__line__"
+
 // replaceStage sets extracted data using regular expressions
 type replaceStage struct {
 	cfg        *ReplaceConfig
 	expression *regexp.Regexp
-	template   *template.Template // 预编译模板，避免重复解析
-	logger     log.Logger
+	// template is parsed with the functions wrapped by recoverFunction, so that
+	// their panics are told apart from the other execution errors
+	template *template.Template // 预编译模板，避免重复解析
+	rules    *replaceRules
+	dsl      dslProgram
+	// groupLookups maps a capture group index to its lookup
+	groupLookups map[int]map[string]string
+	// groupTemplates maps a capture group index to its PerGroup template
+	groupTemplates map[int]*template.Template
+	// gapTemplate is the GapReplace template, nil without TemplateGaps
+	gapTemplate *template.Template
+	// promoteAllow maps a named capture group to its allowed values
+	promoteAllow map[string]map[string]struct{}
+	// thenExtract is the compiled ThenExtract expression
+	thenExtract *regexp.Regexp
+	// resultMustMatch is the compiled ResultMustMatch expression
+	resultMustMatch *regexp.Regexp
+	// group is the index of the only capture group replaced, 0 for all groups
+	group  int
+	logger log.Logger
+	panics prometheus.Counter
+	// templateErrors counts the lines left unchanged as rendering failed
+	templateErrors prometheus.Counter
+	// dropCount counts the lines dropped with DropOnError
+	dropCount *prometheus.CounterVec
+	// bytesAdded and bytesRemoved count the length differences of the replaced
+	// values, nil without CountBytes
+	bytesAdded   prometheus.Counter
+	bytesRemoved prometheus.Counter
+	// matches counts the matches by the value of the MetricLabelFromGroup group,
+	// whose index is metricGroup, nil without MetricName
+	matches     *prometheus.CounterVec
+	metricGroup int
+	// captureCounts observes the number of matches of each line, nil without
+	// CaptureCountHistogram
+	captureCounts prometheus.Histogram
+	// metricAllow holds MetricLabelAllow, metricValues the label values used so
+	// far when there is no allow-list
+	metricAllow  map[string]struct{}
+	metricMtx    sync.Mutex
+	metricValues map[string]struct{}
+	// sampler decides which lines are logged, nil when DebugSampleRate is 0
+	sampler *rand.Rand
 	// 对象池，减少内存分配
 	bufferPool sync.Pool
+	spansPool  sync.Pool
 }
 
 // newReplaceStage creates a newReplaceStage
-func newReplaceStage(logger log.Logger, config interface{}) (Stage, error) {
+func newReplaceStage(logger log.Logger, config interface{}, registerer prometheus.Registerer) (Stage, error) {
 	cfg, err := parseReplaceConfig(config)
 	if err != nil {
 		return nil, err
@@ -71,24 +695,349 @@ func newReplaceStage(logger log.Logger, config interface{}) (Stage, error) {
 	if err != nil {
 		return nil, err
 	}
+	setReplaceDefaults(cfg)
 
 	// 预编译模板，避免每次处理时重新解析
-	templ, err := template.New("pipeline_template").Funcs(functionMap).Parse(cfg.Replace)
+	templ, err := replaceTemplates.parse(cfg.Replace, getReplaceFunctions())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse replace template")
 	}
 
-	return toStage(&replaceStage{
-		cfg:        cfg,
-		expression: expression,
-		template:   templ,
-		logger:     log.With(logger, "component", "stage", "type", "replace"),
+	var dsl dslProgram
+	if cfg.DSL != nil {
+		dsl, err = compileDSL(*cfg.DSL)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse replace dsl")
+		}
+	}
+
+	var rules *replaceRules
+	if cfg.MatchedRuleKey != nil {
+		rules, err = compileReplaceRules(cfg)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrCouldNotCompileRegex)
+		}
+	}
+
+	var groupTemplates map[int]*template.Template
+	if len(cfg.PerGroup) > 0 {
+		groupTemplates = make(map[int]*template.Template, len(cfg.PerGroup))
+		for group, text := range cfg.PerGroup {
+			t, err := replaceTemplates.parse(text, getReplaceFunctions())
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse per_group template of %q", group)
+			}
+			groupTemplates[expression.SubexpIndex(group)] = t
+		}
+	}
+
+	var gapTemplate *template.Template
+	if cfg.TemplateGaps {
+		gapTemplate, err = replaceTemplates.parse(cfg.GapReplace, getReplaceFunctions())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse gap_replace template")
+		}
+	}
+
+	var thenExtract *regexp.Regexp
+	if cfg.ThenExtract != nil {
+		thenExtract, err = regexp.Compile(*cfg.ThenExtract)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrReplaceThenExtractRegex)
+		}
+		named := false
+		for _, name := range thenExtract.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return nil, errors.New(ErrReplaceThenExtractNames)
+		}
+	}
+
+	var groupLookups map[int]map[string]string
+	if len(cfg.GroupLookups) > 0 {
+		groupLookups = make(map[int]map[string]string, len(cfg.GroupLookups))
+		for group, lookup := range cfg.GroupLookups {
+			groupLookups[expression.SubexpIndex(group)] = cfg.Lookups[lookup]
+		}
+	}
+
+	var promoteAllow map[string]map[string]struct{}
+	if len(cfg.PromoteAllow) > 0 {
+		promoteAllow = make(map[string]map[string]struct{}, len(cfg.PromoteAllow))
+		for group, values := range cfg.PromoteAllow {
+			allowed := make(map[string]struct{}, len(values))
+			for _, v := range values {
+				allowed[v] = struct{}{}
+			}
+			promoteAllow[group] = allowed
+		}
+	}
+
+	var group int
+	switch {
+	case cfg.GroupIndex != nil:
+		group = *cfg.GroupIndex
+	case cfg.GroupName != nil:
+		group = expression.SubexpIndex(*cfg.GroupName)
+	}
+
+	var sampler *rand.Rand
+	if cfg.DebugSampleRate > 0 {
+		sampler = utils.NewRand(time.Now().UnixNano())
+	}
+
+	r := &replaceStage{
+		cfg:            cfg,
+		promoteAllow:   promoteAllow,
+		group:          group,
+		sampler:        sampler,
+		expression:     expression,
+		template:       templ,
+		groupTemplates: groupTemplates,
+		thenExtract:    thenExtract,
+		gapTemplate:    gapTemplate,
+		rules:          rules,
+		dsl:            dsl,
+		groupLookups:   groupLookups,
+		logger:         log.With(logger, "component", "stage", "type", "replace"),
+		panics:         getReplacePanicsMetric(registerer),
+		templateErrors: getReplaceTemplateErrorsMetric(registerer).WithLabelValues(replaceStageID(cfg)),
 		bufferPool: sync.Pool{
 			New: func() interface{} {
 				return &bytes.Buffer{}
 			},
 		},
-	}), nil
+		spansPool: sync.Pool{
+			New: func() interface{} {
+				spans := make([]replaceSpan, 0, 16)
+				return &spans
+			},
+		},
+	}
+	if cfg.ResultMustMatch != nil {
+		r.resultMustMatch, err = regexp.Compile(*cfg.ResultMustMatch)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrReplaceResultRegex)
+		}
+	}
+	if cfg.DropOnError || cfg.ResultPolicy == ReplaceResultDrop {
+		r.dropCount = getDropCountMetric(registerer)
+	}
+	if cfg.CountBytes {
+		r.bytesAdded, r.bytesRemoved = getReplaceBytesMetrics(registerer)
+	}
+	if cfg.CaptureCountHistogram != nil {
+		r.captureCounts = getReplaceCaptureCountMetric(registerer, replaceMetricPrefix+*cfg.CaptureCountHistogram)
+	}
+	if cfg.MetricName != nil {
+		r.matches = util.RegisterCounterVec(registerer, "", replaceMetricPrefix+*cfg.MetricName,
+			"A count of the matches of a replace stage, by captured value", []string{*cfg.MetricLabelFromGroup})
+		r.metricGroup = expression.SubexpIndex(*cfg.MetricLabelFromGroup)
+		if cfg.MetricLabelAllow != nil {
+			r.metricAllow = make(map[string]struct{}, len(cfg.MetricLabelAllow))
+			for _, v := range cfg.MetricLabelAllow {
+				r.metricAllow[v] = struct{}{}
+			}
+		} else {
+			r.metricValues = make(map[string]struct{})
+		}
+	}
+	if cfg.DropOnError || cfg.PreserveOriginalAs != nil || cfg.ResultPolicy == ReplaceResultDrop {
+		return r, nil
+	}
+	return toStage(r), nil
+}
+
+// getReplacePanicsMetric registers the count of template executions which
+// panicked, shared by the replace stages.
+func getReplacePanicsMetric(registerer prometheus.Registerer) prometheus.Counter {
+	return util.RegisterCounterVec(registerer, "loki_process", "replace_panics_total",
+		"A count of replace stage template executions that panicked", nil).WithLabelValues()
+}
+
+// getReplaceTemplateErrorsMetric registers the count of failed template
+// executions, by stage. The stages are identified by their expression.
+func getReplaceTemplateErrorsMetric(registerer prometheus.Registerer) *prometheus.CounterVec {
+	return util.RegisterCounterVec(registerer, "logentry", "replace_template_errors_total",
+		"A count of replace stage template executions that failed, leaving the line unchanged", []string{"expression"})
+}
+
+// replaceStageID identifies a replace stage in its metrics.
+func replaceStageID(c *ReplaceConfig) string {
+	if c.Range != nil {
+		return fmt.Sprintf("range[%d:%d]", c.Range[0], c.Range[1])
+	}
+	return c.Expression
+}
+
+// getReplaceBytesMetrics registers the counters of the bytes added and removed
+// by the replace stages with CountBytes, as masking can grow as well as shrink
+// the values.
+func getReplaceBytesMetrics(registerer prometheus.Registerer) (added prometheus.Counter, removed prometheus.Counter) {
+	added = util.RegisterCounterVec(registerer, "logentry", "replace_bytes_added_total",
+		"The number of bytes added by the replace stages", nil).WithLabelValues()
+	removed = util.RegisterCounterVec(registerer, "logentry", "replace_bytes_removed_total",
+		"The number of bytes removed by the replace stages", nil).WithLabelValues()
+	return added, removed
+}
+
+// replaceCaptureCountBuckets are the buckets of the CaptureCountHistogram
+// histograms, from 1 to 4096 matches per line.
+var replaceCaptureCountBuckets = prometheus.ExponentialBuckets(1, 4, 7)
+
+// getReplaceCaptureCountMetric registers the CaptureCountHistogram histogram of
+// the given name.
+func getReplaceCaptureCountMetric(registerer prometheus.Registerer, name string) prometheus.Histogram {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    "The number of matches per line of a replace stage",
+		Buckets: replaceCaptureCountBuckets,
+	})
+	if err := registerer.Register(histogram); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		histogram = existing.ExistingCollector.(prometheus.Histogram)
+	}
+	return histogram
+}
+
+var (
+	replaceFunctionsOnce sync.Once
+	replaceFunctions     template.FuncMap
+)
+
+// getReplaceFunctions returns the template functions wrapped by recoverFunction.
+// They are wrapped once the function map is complete.
+func getReplaceFunctions() template.FuncMap {
+	replaceFunctionsOnce.Do(func() {
+		replaceFunctions = make(template.FuncMap, len(functionMap))
+		for name, fn := range functionMap {
+			replaceFunctions[name] = recoverFunction(fn)
+		}
+	})
+	return replaceFunctions
+}
+
+var (
+	replaceFromKeyFunctionsOnce sync.Once
+	replaceFromKeyFunctions     template.FuncMap
+)
+
+// getReplaceFromKeyFunctions returns the replace template functions, without the
+// ones reading the environment, for the templates read from extracted values.
+func getReplaceFromKeyFunctions() template.FuncMap {
+	replaceFromKeyFunctionsOnce.Do(func() {
+		replaceFromKeyFunctions = make(template.FuncMap, len(getReplaceFunctions()))
+		for name, fn := range getReplaceFunctions() {
+			if name != "env" && name != "expandenv" {
+				replaceFromKeyFunctions[name] = fn
+			}
+		}
+	})
+	return replaceFromKeyFunctions
+}
+
+// templatePanic is the error a template function panicking is turned into.
+type templatePanic struct {
+	value interface{}
+}
+
+func (p *templatePanic) Error() string {
+	return fmt.Sprintf("template function panicked: %v", p.value)
+}
+
+// recoverFunction wraps a template function so that its panics are raised
+// again as a *templatePanic. text/template recovers panics of the functions it
+// calls and returns them as errors, the wrapping tells them apart from errors
+// returned by the functions.
+func recoverFunction(fn interface{}) interface{} {
+	// The common string functions are wrapped without reflection, which
+	// allocates on every call.
+	switch f := fn.(type) {
+	case func(string) string:
+		return func(s string) string {
+			defer repanic()
+			return f(s)
+		}
+	case func(string, string, string, int) string:
+		return func(s, old, new string, n int) string {
+			defer repanic()
+			return f(s, old, new, n)
+		}
+	}
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fn
+	}
+	variadic := v.Type().IsVariadic()
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		defer repanic()
+		if variadic {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
+// repanic raises a recovered panic again as a *templatePanic.
+func repanic() {
+	if p := recover(); p != nil {
+		if _, ok := p.(*templatePanic); !ok {
+			p = &templatePanic{value: p}
+		}
+		panic(p)
+	}
+}
+
+// replaceTemplates shares the parsed templates between replace stages.
+var replaceTemplates = newTemplateCache()
+
+type templateCacheKey struct {
+	text  string
+	funcs uintptr
+}
+
+// templateCache stores parsed templates keyed by their text and function map, so
+// stages with identical templates reuse the same parsed tree. This is safe since
+// a parsed template can be executed concurrently.
+type templateCache struct {
+	mtx       sync.Mutex
+	templates map[templateCacheKey]*template.Template
+	// disabled makes parse always return a new template, used in tests.
+	disabled bool
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: map[templateCacheKey]*template.Template{}}
+}
+
+// parse returns the template parsed from text with the given functions.
+func (c *templateCache) parse(text string, funcs template.FuncMap) (*template.Template, error) {
+	if c.disabled {
+		return newReplaceTemplate(text, funcs)
+	}
+	key := templateCacheKey{text: text, funcs: reflect.ValueOf(funcs).Pointer()}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if t, ok := c.templates[key]; ok {
+		return t, nil
+	}
+	t, err := newReplaceTemplate(text, funcs)
+	if err != nil {
+		return nil, err
+	}
+	c.templates[key] = t
+	return t, nil
+}
+
+// newReplaceTemplate parses a replace template. Missing keys render as empty
+// strings rather than `<no value>`, so they can be handled with Default.
+func newReplaceTemplate(text string, funcs template.FuncMap) (*template.Template, error) {
+	return template.New("pipeline_template").Option("missingkey=zero").Funcs(funcs).Parse(text)
 }
 
 // parseReplaceConfig processes an incoming configuration into a ReplaceConfig
@@ -102,7 +1051,41 @@ func parseReplaceConfig(config interface{}) (*ReplaceConfig, error) {
 }
 
 // Process implements Stage
-func (r *replaceStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+func (r *replaceStage) Process(labels model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	_ = r.process(labels, extracted, entry, nil)
+}
+
+// Run implements Stage, it is only used with DropOnError, PreserveOriginalAs or
+// the drop ResultPolicy as a Processor can neither drop the lines nor set their
+// structured metadata.
+func (r *replaceStage) Run(in chan Entry) chan Entry {
+	return RunWithSkip(in, func(e Entry) (Entry, bool) {
+		err := r.process(e.Labels, e.Extracted, &e.Line, &e.StructuredMetadata)
+		switch {
+		case errors.Is(err, errReplaceResultMismatch):
+			r.dropCount.WithLabelValues(replaceResultDropReason).Inc()
+			return e, true
+		case err != nil && r.cfg.DropOnError:
+			r.dropCount.WithLabelValues(replaceDropReason).Inc()
+			return e, true
+		}
+		return e, false
+	})
+}
+
+// Cleanup implements Stage.
+func (*replaceStage) Cleanup() {
+	// no-op
+}
+
+// process returns the error of the template execution which left the input
+// unchanged, if any. The original value of the input is appended to metadata,
+// when not nil, with PreserveOriginalAs.
+func (r *replaceStage) process(labels model.LabelSet, extracted map[string]interface{}, entry *string, metadata *push.LabelsAdapter) error {
+	if r.cfg.SourcePattern != nil {
+		return r.processPattern(labels, extracted, entry)
+	}
+
 	// If a source key is provided, the replace stage should process it
 	// from the extracted map, otherwise should fallback to the entry
 	input := entry
@@ -112,62 +1095,292 @@ func (r *replaceStage) Process(_ model.LabelSet, extracted map[string]interface{
 			if Debug {
 				level.Debug(r.logger).Log("msg", "source does not exist in the set of extracted values", "source", *r.cfg.Source)
 			}
-			return
+			return nil
 		}
 
-		value, err := getString(extracted[*r.cfg.Source])
+		value, err := r.sourceString(extracted[*r.cfg.Source])
 		if err != nil {
 			if Debug {
 				level.Debug(r.logger).Log("msg", "failed to convert source value to string", "source", *r.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*r.cfg.Source]))
 			}
-			return
+			return nil
 		}
 
 		input = &value
 	}
 
+	if r.cfg.SourceLabel != nil {
+		value, ok := labels[model.LabelName(*r.cfg.SourceLabel)]
+		if !ok {
+			if Debug {
+				level.Debug(r.logger).Log("msg", "source label does not exist in the set of labels", "source_label", *r.cfg.SourceLabel)
+			}
+			return nil
+		}
+		s := string(value)
+		input = &s
+	}
+
 	if input == nil {
 		if Debug {
 			level.Debug(r.logger).Log("msg", "cannot parse a nil entry")
 		}
-		return
+		return nil
 	}
 
-	// Get string of matched captured groups. We will use this to extract all named captured groups
-	match := r.expression.FindStringSubmatch(*input)
-	matchAllIndex := r.expression.FindAllStringSubmatchIndex(*input, -1)
+	if r.cfg.SourceJSONArray {
+		return r.processJSONArray(extracted, *input, metadata)
+	}
+
+	return r.replace(labels, extracted, entry, r.cfg.Source, *input, metadata)
+}
+
+// processPattern applies the replacement to every extracted value whose key
+// matches the source pattern, writing the results back to the same keys.
+func (r *replaceStage) processPattern(labels model.LabelSet, extracted map[string]interface{}, entry *string) error {
+	keys := make([]string, 0, len(extracted))
+	for key := range extracted {
+		if ok, _ := path.Match(*r.cfg.SourcePattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	// Named captured groups written to the extracted map are not matched again,
+	// and the keys are processed in a stable order.
+	sort.Strings(keys)
+	// The keys after a failing one are still replaced, the first error is only
+	// returned for the line to be dropped.
+	var firstErr error
+	for _, key := range keys {
+		value, err := r.sourceString(extracted[key])
+		if err != nil {
+			if Debug {
+				level.Debug(r.logger).Log("msg", "failed to convert source value to string", "source", key, "err", err, "type", reflect.TypeOf(extracted[key]))
+			}
+			continue
+		}
+		if err := r.replace(labels, extracted, entry, &key, value, nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.cfg.DropOnError || r.cfg.ResultPolicy == ReplaceResultDrop {
+		return firstErr
+	}
+	return nil
+}
+
+// replace applies the replacement to the input and writes the result back to
+// the source, which is the entry when nil.
+func (r *replaceStage) replace(labels model.LabelSet, extracted map[string]interface{}, entry *string, source *string, input string, metadata *push.LabelsAdapter) error {
+	if r.tooLarge(input) {
+		return nil
+	}
+	original := input
+	// The normalized input is only written back on its own when nothing matched,
+	// so that a failed or reverted replacement keeps the original value.
+	normalized := input
+	if r.cfg.NormalizeNewlines != "" && !r.cfg.ExtractOnly {
+		normalized = normalizeNewlines(input, r.cfg.NormalizeNewlines)
+		input = normalized
+	}
+	var before, after string
+	if r.cfg.LineIndex != nil {
+		var ok bool
+		if before, input, after, ok = selectLine(input, *r.cfg.LineIndex); !ok {
+			if Debug {
+				level.Debug(r.logger).Log("msg", "input has no such line", "line_index", *r.cfg.LineIndex)
+			}
+			if normalized != original {
+				r.setResult(labels, extracted, entry, source, normalized)
+			}
+			return nil
+		}
+	}
+
+	// The indexes of every match are the only allocation made by the regexp package here:
+	// the standard library offers no API to match into a caller provided buffer, so the
+	// named captured groups are read from the first match instead of matching again.
+	matchAllIndex := r.match(input)
+	sampled := r.sampled(input)
+	if r.captureCounts != nil {
+		r.captureCounts.Observe(float64(len(matchAllIndex)))
+	}
 
 	if matchAllIndex == nil {
 		if Debug {
-			level.Debug(r.logger).Log("msg", "regex did not match", "input", *input, "regex", r.expression)
+			level.Debug(r.logger).Log("msg", "regex did not match", "input", input, "regex", r.expression)
 		}
-		return
+		if sampled {
+			level.Info(r.logger).Log("msg", "sampled replace decision", "matched", false, "before", input)
+		}
+		if r.cfg.SetEmptyOnNoMatch {
+			for i, name := range r.expression.SubexpNames() {
+				if i != 0 && name != "" {
+					extracted[name] = ""
+				}
+			}
+		}
+		if normalized != original {
+			r.setResult(labels, extracted, entry, source, normalized)
+		}
+		return nil
+	}
+	r.countMatches(matchAllIndex, input)
+
+	if r.cfg.ExtractOnly {
+		r.extract(extracted, matchAllIndex[0], input)
+		if r.cfg.CollectAll {
+			r.collect(extracted, matchAllIndex, input, nil)
+		}
+		if sampled {
+			level.Info(r.logger).Log("msg", "sampled replace decision", "matched", true, "before", input)
+		}
+		return nil
 	}
 
 	// All extracted values will be available for templating
 	td := r.getTemplateData(extracted)
 
-	result, capturedMap, err := r.getReplacedEntry(matchAllIndex, *input, td)
+	result, capturedMap, err := r.getReplacedEntry(matchAllIndex, input, td)
 	if err != nil {
 		if Debug {
 			level.Debug(r.logger).Log("msg", "failed to execute template on extracted value", "err", err)
 		}
-		return
+		return err
 	}
 
-	if r.cfg.Source != nil {
-		extracted[*r.cfg.Source] = result
-	} else {
-		*entry = result
+	if r.cfg.NormalizeNewlines != "" {
+		result = normalizeNewlines(result, r.cfg.NormalizeNewlines)
+	}
+	result = before + result + after
+	if !r.validResult(result) {
+		if r.cfg.ResultPolicy == ReplaceResultDrop {
+			return errReplaceResultMismatch
+		}
+		return nil
+	}
+	if result != original {
+		r.preserveOriginal(metadata, original)
+	}
+	r.setResult(labels, extracted, entry, source, result)
+	r.countBytes(len(result) - len(original))
+	if sampled {
+		level.Info(r.logger).Log("msg", "sampled replace decision", "matched", true, "before", input, "after", result)
 	}
 
-	// All the named captured group will be extracted
+	// All the named captured group of the first match will be extracted
+	firstMatch := matchAllIndex[0]
 	subexpNames := r.expression.SubexpNames()
 	for i, name := range subexpNames {
 		if i != 0 && name != "" {
-			if v, ok := capturedMap[match[i]]; ok {
-				extracted[name] = v
+			var captured string
+			if firstMatch[2*i] >= 0 {
+				captured = input[firstMatch[2*i]:firstMatch[2*i+1]]
+			}
+			if v, ok := capturedMap.get(captured); ok {
+				extracted[name] = r.promotedValue(name, captured, v)
+			}
+		}
+	}
+	if r.cfg.CollectAll {
+		r.collect(extracted, matchAllIndex, input, capturedMap.get)
+	}
+	if r.rules != nil {
+		if rule, ok := r.rules.match(input); ok {
+			extracted[*r.cfg.MatchedRuleKey] = rule
+		}
+	}
+	if r.thenExtract != nil {
+		r.extractFromResult(extracted, result)
+	}
+	if Debug {
+		level.Debug(r.logger).Log("msg", "extracted data debug in replace stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+	return nil
+}
+
+// extractFromResult sets the named capture groups of the first match of the
+// ThenExtract expression in the result in the extracted map.
+func (r *replaceStage) extractFromResult(extracted map[string]interface{}, result string) {
+	match := r.thenExtract.FindStringSubmatchIndex(result)
+	if match == nil {
+		if Debug {
+			level.Debug(r.logger).Log("msg", "then_extract regex did not match", "result", result, "regex", r.thenExtract)
+		}
+		return
+	}
+	for i, name := range r.thenExtract.SubexpNames() {
+		if i != 0 && name != "" && match[2*i] >= 0 {
+			extracted[name] = result[match[2*i]:match[2*i+1]]
+		}
+	}
+}
+
+// collect sets each named capture group to the values of every match. replaced
+// returns the replacement of a captured value, the values are collected as
+// captured when nil.
+func (r *replaceStage) collect(extracted map[string]interface{}, matchAllIndex [][]int, input string, replaced func(string) (string, bool)) {
+	for i, name := range r.expression.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		values := make([]string, 0, len(matchAllIndex))
+		for _, match := range matchAllIndex {
+			if match[2*i] < 0 {
+				continue
+			}
+			captured := input[match[2*i]:match[2*i+1]]
+			v := captured
+			if replaced != nil {
+				var ok bool
+				if v, ok = replaced(captured); !ok {
+					continue
+				}
 			}
+			values = append(values, r.promotedValue(name, captured, v))
+		}
+		if len(values) > 0 {
+			extracted[name] = values
+		}
+	}
+}
+
+// match returns the indexes of every match of the expression in the input. With
+// a range, the single match is the whole input with the range as first group.
+func (r *replaceStage) match(input string) [][]int {
+	if r.cfg.Range == nil {
+		return r.expression.FindAllStringSubmatchIndex(input, -1)
+	}
+	start, end := -1, len(input)
+	runes := 0
+	for i := range input {
+		if runes == r.cfg.Range[0] {
+			start = i
+		}
+		if runes == r.cfg.Range[1] {
+			end = i
+			break
+		}
+		runes++
+	}
+	if start == -1 {
+		// The input is too short for the range to include anything.
+		return nil
+	}
+	return [][]int{{0, len(input), start, end}}
+}
+
+// extract sets the named capture groups of the first match, as captured, in the
+// extracted map.
+func (r *replaceStage) extract(extracted map[string]interface{}, firstMatch []int, input string) {
+	for i, name := range r.expression.SubexpNames() {
+		if i != 0 && name != "" && firstMatch[2*i] >= 0 {
+			captured := input[firstMatch[2*i]:firstMatch[2*i+1]]
+			extracted[name] = r.promotedValue(name, captured, captured)
+		}
+	}
+	if r.rules != nil {
+		if rule, ok := r.rules.match(input); ok {
+			extracted[*r.cfg.MatchedRuleKey] = rule
 		}
 	}
 	if Debug {
@@ -175,54 +1388,916 @@ func (r *replaceStage) Process(_ model.LabelSet, extracted map[string]interface{
 	}
 }
 
-func (r *replaceStage) getReplacedEntry(matchAllIndex [][]int, input string, td map[string]string) (string, map[string]string, error) {
+// countMatches increments the MetricName counter for every match in which the
+// MetricLabelFromGroup group participated.
+func (r *replaceStage) countMatches(matchAllIndex [][]int, input string) {
+	if r.matches == nil {
+		return
+	}
+	for _, match := range matchAllIndex {
+		if match[2*r.metricGroup] < 0 {
+			continue
+		}
+		r.matches.WithLabelValues(r.metricLabelValue(input[match[2*r.metricGroup]:match[2*r.metricGroup+1]])).Inc()
+	}
+}
+
+// metricLabelValue returns the label value a captured value is counted under,
+// bounding the cardinality of the counter with MetricLabelAllow or
+// MetricMaxLabelValues.
+func (r *replaceStage) metricLabelValue(captured string) string {
+	if r.metricAllow != nil {
+		if _, ok := r.metricAllow[captured]; ok {
+			return captured
+		}
+		return replaceMetricOther
+	}
+	r.metricMtx.Lock()
+	defer r.metricMtx.Unlock()
+	if _, ok := r.metricValues[captured]; ok {
+		return captured
+	}
+	if len(r.metricValues) < r.cfg.MetricMaxLabelValues {
+		// The captured value is cloned so that it does not retain the input.
+		r.metricValues[strings.Clone(captured)] = struct{}{}
+		return captured
+	}
+	return replaceMetricOther
+}
+
+// validResult reports whether the result matches ResultMustMatch, if any.
+func (r *replaceStage) validResult(result string) bool {
+	if r.resultMustMatch == nil || r.resultMustMatch.MatchString(result) {
+		return true
+	}
+	if Debug {
+		level.Debug(r.logger).Log("msg", "replace result does not match result_must_match", "result", result, "regex", r.resultMustMatch, "policy", r.cfg.ResultPolicy)
+	}
+	return false
+}
+
+// tooLarge reports whether the input exceeds MaxInputBytes and is left unchanged.
+func (r *replaceStage) tooLarge(input string) bool {
+	if r.cfg.MaxInputBytes == 0 || len(input) <= r.cfg.MaxInputBytes {
+		return false
+	}
+	if Debug {
+		level.Debug(r.logger).Log("msg", "skipping input exceeding max_input_bytes", "bytes", len(input), "max_input_bytes", r.cfg.MaxInputBytes)
+	}
+	return true
+}
+
+// sampled reports whether the replacement decision of the current line is logged.
+func (r *replaceStage) sampled(input string) bool {
+	if r.sampler == nil {
+		return false
+	}
+	if r.cfg.Deterministic {
+		// The top 53 bits of the hash make a float in [0, 1) like Float64.
+		return float64(xxhash.Sum64String(input)>>11)/(1<<53) < r.cfg.DebugSampleRate
+	}
+	return r.sampler.Float64() < r.cfg.DebugSampleRate
+}
+
+// replaceRules finds which top-level alternative of an expression matched. Each
+// alternative is wrapped in a capture group of a separate expression so that the
+// alternative taken can be read from the groups of the first match, the leftmost
+// first semantics of the alternation being unchanged.
+type replaceRules struct {
+	expression *regexp.Regexp
+	// groups is the index of the capture group wrapping each rule
+	groups []int
+	names  []string
+}
+
+// replaceExpression returns the expression with the flags and word boundaries
+// enabled by the config.
+func replaceExpression(c *ReplaceConfig) string {
+	if c.Range != nil {
+		return replaceRangeExpression
+	}
+	return wrapReplaceExpression(c, c.Expression)
+}
+
+// wrapReplaceExpression wraps the expression, or one of its alternatives, in the
+// flags and word boundaries enabled by the config.
+func wrapReplaceExpression(c *ReplaceConfig, expression string) string {
+	if c.WholeWord {
+		expression = `\b(?:` + expression + `)\b`
+	}
+	switch c.Anchor {
+	case ReplaceAnchorStart:
+		expression = `^(?:` + expression + `)`
+	case ReplaceAnchorEnd:
+		expression = `(?:` + expression + `)$`
+	case ReplaceAnchorBoth:
+		expression = `^(?:` + expression + `)$`
+	}
+	var flags string
+	if c.Multiline {
+		flags += "m"
+	}
+	if c.DotAll {
+		flags += "s"
+	}
+	if flags == "" {
+		return expression
+	}
+	return "(?" + flags + ")" + expression
+}
+
+// clearsRegexFlag reports whether the expression has an inline flag group,
+// e.g. `(?-s)` or `(?i-s:...)`, clearing the flag.
+func clearsRegexFlag(expr string, flag byte) bool {
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\':
+			// Skip the escaped character, e.g. `\(?` is an optional parenthesis.
+			i++
+		case strings.HasPrefix(expr[i:], "(?"):
+			cleared := false
+			for j := i + 2; j < len(expr) && strings.IndexByte("imsU-", expr[j]) != -1; j++ {
+				switch expr[j] {
+				case '-':
+					cleared = true
+				case flag:
+					if cleared {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func compileReplaceRules(c *ReplaceConfig) (*replaceRules, error) {
+	alternatives := []string{replaceRangeExpression}
+	if c.Range == nil {
+		alternatives = splitAlternatives(c.Expression)
+	}
+
+	rules := &replaceRules{}
+	parts := make([]string, 0, len(alternatives))
+	group := 1
+	for i, alt := range alternatives {
+		name := strconv.Itoa(i)
+		if re, err := syntax.Parse(alt, syntax.Perl); err == nil && re.Op == syntax.OpCapture && re.Name != "" {
+			name = re.Name
+		}
+		if c.Range == nil {
+			alt = wrapReplaceExpression(c, alt)
+		}
+		rules.groups = append(rules.groups, group)
+		rules.names = append(rules.names, name)
+		parts = append(parts, "("+alt+")")
+
+		sub, err := regexp.Compile(alt)
+		if err != nil {
+			return nil, err
+		}
+		group += 1 + sub.NumSubexp()
+	}
+	var err error
+	rules.expression, err = regexp.Compile(strings.Join(parts, "|"))
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// regexFlagGroup matches a group setting flags for the rest of the current
+// group, e.g. `(?i)`.
+var regexFlagGroup = regexp.MustCompile(`^\(\?[imsU-]+\)`)
+
+// splitAlternatives splits the expression at its top-level `|`, skipping the
+// ones escaped or inside groups and character classes. The expression is split
+// as written, since the parsed tree factors out the prefixes the alternatives
+// share. The flags set at the top level, e.g. `(?i)`, are carried over to the
+// following alternatives.
+func splitAlternatives(expr string) []string {
+	var alternatives []string
+	var flags, prefix string
+	depth, start := 0, 0
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '\\':
+			if strings.HasPrefix(expr[i:], `\Q`) {
+				end := strings.Index(expr[i+2:], `\E`)
+				if end == -1 {
+					i = len(expr)
+					continue
+				}
+				i += end + 3
+				continue
+			}
+			i++
+		case '[':
+			i = classEnd(expr, i)
+		case '(':
+			if depth == 0 {
+				if f := regexFlagGroup.FindString(expr[i:]); f != "" {
+					flags += f
+					i += len(f) - 1
+					continue
+				}
+			}
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				alternatives = append(alternatives, prefix+expr[start:i])
+				prefix, start = flags, i+1
+			}
+		}
+	}
+	return append(alternatives, prefix+expr[start:])
+}
+
+// classEnd returns the index of the `]` closing the character class starting at
+// i, a `]` right after the opening bracket being part of the class.
+func classEnd(expr string, i int) int {
+	j := i + 1
+	if j < len(expr) && expr[j] == '^' {
+		j++
+	}
+	if j < len(expr) && expr[j] == ']' {
+		j++
+	}
+	for j < len(expr) {
+		switch {
+		case expr[j] == '\\':
+			j += 2
+		case strings.HasPrefix(expr[j:], "[:"):
+			end := strings.Index(expr[j+2:], ":]")
+			if end == -1 {
+				j++
+				continue
+			}
+			j += end + 4
+		case expr[j] == ']':
+			return j
+		default:
+			j++
+		}
+	}
+	return len(expr)
+}
+
+// match returns the name of the rule of the first match of the input.
+func (r *replaceRules) match(input string) (string, bool) {
+	m := r.expression.FindStringSubmatchIndex(input)
+	if m == nil {
+		return "", false
+	}
+	for i, group := range r.groups {
+		if m[2*group] >= 0 {
+			return r.names[i], true
+		}
+	}
+	return "", false
+}
+
+// processJSONArray applies the replacement to every string element of the JSON
+// array held by the source and stores the array back into the source as JSON.
+// Non-string elements are kept as they are.
+func (r *replaceStage) processJSONArray(extracted map[string]interface{}, input string, metadata *push.LabelsAdapter) error {
+	if r.tooLarge(input) {
+		return nil
+	}
+	var elements []interface{}
+	if err := json.UnmarshalFromString(input, &elements); err != nil {
+		if Debug {
+			level.Debug(r.logger).Log("msg", "failed to parse source as a JSON array", "source", *r.cfg.Source, "err", err)
+		}
+		return nil
+	}
+
+	td := r.getTemplateData(extracted)
+	delta, replaced, changed, matches := 0, false, false, 0
+	if r.captureCounts != nil {
+		// The matches of every element are observed together, for the line.
+		defer func() { r.captureCounts.Observe(float64(matches)) }()
+	}
+	for i, element := range elements {
+		value, ok := element.(string)
+		if !ok {
+			if Debug {
+				level.Debug(r.logger).Log("msg", "skipping non-string element of JSON array", "source", *r.cfg.Source, "index", i, "type", reflect.TypeOf(element))
+			}
+			continue
+		}
+		if r.cfg.NormalizeNewlines != "" {
+			value = normalizeNewlines(value, r.cfg.NormalizeNewlines)
+		}
+		changed = changed || value != element
+		matchAllIndex := r.match(value)
+		matches += len(matchAllIndex)
+		if matchAllIndex == nil {
+			elements[i] = value
+			continue
+		}
+		result, _, err := r.getReplacedEntry(matchAllIndex, value, td)
+		if err != nil {
+			if Debug {
+				level.Debug(r.logger).Log("msg", "failed to execute template on extracted value", "err", err)
+			}
+			return err
+		}
+		if r.cfg.NormalizeNewlines != "" {
+			result = normalizeNewlines(result, r.cfg.NormalizeNewlines)
+		}
+		if !r.validResult(result) {
+			if r.cfg.ResultPolicy == ReplaceResultDrop {
+				return errReplaceResultMismatch
+			}
+			elements[i] = value
+			continue
+		}
+		delta += len(result) - len(element.(string))
+		replaced = replaced || result != element
+		elements[i] = result
+	}
+	// The arrays left unchanged are not formatted again.
+	if !replaced && !changed {
+		return nil
+	}
+
+	result, err := jsonArrayAPI.MarshalToString(elements)
+	if err != nil {
+		if Debug {
+			level.Debug(r.logger).Log("msg", "failed to marshal JSON array back to string", "err", err)
+		}
+		return nil
+	}
+	if replaced {
+		r.preserveOriginal(metadata, input)
+	}
+	extracted[*r.cfg.Source] = result
+	r.countBytes(delta)
+	return nil
+}
+
+// jsonArrayAPI marshals the replaced JSON arrays, without escaping the HTML
+// characters the original array had as they are.
+var jsonArrayAPI = json.Config{
+	EscapeHTML:  false,
+	SortMapKeys: true,
+}.Froze()
+
+// countBytes adds the length difference of a replaced value to the bytes added
+// or removed with CountBytes.
+func (r *replaceStage) countBytes(delta int) {
+	if r.bytesAdded == nil {
+		return
+	}
+	switch {
+	case delta > 0:
+		r.bytesAdded.Add(float64(delta))
+	case delta < 0:
+		r.bytesRemoved.Add(float64(-delta))
+	}
+}
+
+// preserveOriginal appends the original value of the input to the structured
+// metadata when PreserveOriginalAs is set.
+func (r *replaceStage) preserveOriginal(metadata *push.LabelsAdapter, original string) {
+	if metadata == nil || r.cfg.PreserveOriginalAs == nil {
+		return
+	}
+	*metadata = append(*metadata, push.LabelAdapter{Name: *r.cfg.PreserveOriginalAs, Value: original})
+}
+
+// promotedValue returns the value extracted for a named capture group: the
+// replacement of the captured value, or the configured other value when the
+// captured value is not part of the group's allow list.
+func (r *replaceStage) promotedValue(name, captured, replacement string) string {
+	allowed, ok := r.promoteAllow[name]
+	if !ok {
+		return replacement
+	}
+	if _, ok := allowed[captured]; ok {
+		return replacement
+	}
+	return *r.cfg.PromoteOther
+}
+
+// sourceString returns the input of an extracted value, which holds raw bytes
+// with Binary.
+func (r *replaceStage) sourceString(v interface{}) (string, error) {
+	if b, ok := v.([]byte); ok && r.cfg.Binary {
+		return string(b), nil
+	}
+	return getString(v)
+}
+
+// setResult writes the replaced value back to the source label or source, or to
+// the entry when neither is set.
+func (r *replaceStage) setResult(labels model.LabelSet, extracted map[string]interface{}, entry *string, source *string, result string) {
+	switch {
+	case r.cfg.SourceLabel != nil:
+		labels[model.LabelName(*r.cfg.SourceLabel)] = model.LabelValue(result)
+	case source != nil:
+		if _, ok := extracted[*source].([]byte); ok && r.cfg.Binary {
+			extracted[*source] = []byte(result)
+			return
+		}
+		extracted[*source] = result
+	default:
+		*entry = result
+	}
+}
+
+// selectLine splits s around its line i, counted from the end when negative,
+// and returns false when s has no such line.
+func selectLine(s string, i int) (before, line, after string, ok bool) {
+	// A trailing newline ends the last line rather than starting an empty one.
+	trimmed := strings.TrimSuffix(s, "\n")
+	n := strings.Count(trimmed, "\n") + 1
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return "", "", "", false
+	}
+	start := 0
+	for ; i > 0; i-- {
+		start += strings.IndexByte(trimmed[start:], '\n') + 1
+	}
+	end := len(trimmed)
+	if j := strings.IndexByte(trimmed[start:], '\n'); j >= 0 {
+		end = start + j
+	}
+	return s[:start], s[start:end], s[end:], true
+}
+
+// normalizeNewlines rewrites every line ending of s, either CRLF or LF, to the
+// given mode.
+func normalizeNewlines(s string, mode string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if mode == "crlf" {
+		s = strings.ReplaceAll(s, "\n", "\r\n")
+	}
+	return s
+}
+
+// replaceSpan is a captured group span of the input together with its replacement.
+type replaceSpan struct {
+	start       int
+	end         int
+	replacement string
+}
+
+// replacements maps the captured values to their replacement. The single match
+// path only has one value which is kept inline instead of in a map.
+type replacements struct {
+	captured    string
+	replacement string
+	single      bool
+	m           map[string]string
+}
+
+func (r replacements) get(captured string) (string, bool) {
+	if r.single {
+		return r.replacement, r.captured == captured
+	}
+	st, ok := r.m[captured]
+	return st, ok
+}
+
+func (r *replaceStage) getReplacedEntry(matchAllIndex [][]int, input string, td map[string]string) (string, replacements, error) {
+	td[replaceLineKey] = input
+	// MatchIndex is updated for each match by replaceAll.
+	td["MatchIndex"] = "0"
+	td["MatchCount"] = strconv.Itoa(len(matchAllIndex))
+
+	var (
+		result   string
+		captured replacements
+		err      error
+	)
+	if len(matchAllIndex) == 1 && len(matchAllIndex[0]) == 4 && r.gapTemplate == nil {
+		result, captured, err = r.replaceSingle(matchAllIndex[0], input, td)
+	} else {
+		result, captured, err = r.replaceAll(matchAllIndex, input, td)
+	}
+	if err != nil {
+		r.templateErrors.Inc()
+		return "", replacements{}, err
+	}
+	if r.cfg.CollapseWhitespace {
+		result = strings.Join(strings.Fields(result), " ")
+	}
+	return result, captured, nil
+}
+
+// replaceSingle handles the common case of a single match of an expression with
+// a single capture group, without sorting spans or filling a map.
+func (r *replaceStage) replaceSingle(matchIndex []int, input string, td map[string]string) (string, replacements, error) {
+	start, end := matchIndex[2], matchIndex[3]
+	if start == -1 {
+		return input, replacements{}, nil
+	}
+	capturedString := input[start:end]
+
+	st, ok := r.lookup(1, capturedString)
+	if !ok {
+		buf := r.bufferPool.Get().(*bytes.Buffer)
+		defer func() {
+			buf.Reset()
+			r.bufferPool.Put(buf)
+		}()
+		var err error
+		st, err = r.render(buf, 1, capturedString, td)
+		if err != nil {
+			return "", replacements{}, err
+		}
+	}
+
 	var result strings.Builder
-	previousInputEndIndex := 0
+	result.Grow(len(input) - (end - start) + len(st))
+	result.WriteString(input[:start])
+	result.WriteString(st)
+	result.WriteString(input[end:])
+	return result.String(), replacements{captured: capturedString, replacement: st, single: true}, nil
+}
+
+// replaceAll handles any number of matches and capture groups.
+func (r *replaceStage) replaceAll(matchAllIndex [][]int, input string, td map[string]string) (string, replacements, error) {
 	capturedMap := make(map[string]string, len(matchAllIndex)*2)
-	
+
 	buf := r.bufferPool.Get().(*bytes.Buffer)
+	scratch := r.spansPool.Get().(*[]replaceSpan)
+	spans := (*scratch)[:0]
 	defer func() {
 		buf.Reset()
 		r.bufferPool.Put(buf)
+		// The spans only hold indexes and replacements which are copied into the
+		// result, so the backing array can safely be reused by another goroutine.
+		*scratch = spans[:0]
+		r.spansPool.Put(scratch)
 	}()
-	
+
 	// For a simple string like `11.11.11.11 - frank 12.12.12.12 - frank`
 	// if the regex is "(\\d{2}.\\d{2}.\\d{2}.\\d{2}) - (\\S+)"
 	// FindAllStringSubmatchIndex would return [[0 19 0 11 14 19] [20 37 20 31 34 37]].
 	// Each inner array's first two values will be the start and end index of the entire
 	// matched string and the next values will be start and end index of the matched
 	// captured group. Here 0-19 is "11.11.11.11 - frank",  0-11 is "11.11.11.11" and
-	// 14-19 is "frank". So, we advance by 2 index to get the next match
-	for _, matchIndex := range matchAllIndex {
-		for i := 2; i < len(matchIndex); i += 2 {
+	// 14-19 is "frank". So, we advance by 2 index to get the next match.
+	// When whole_match is enabled and the expression has no capture groups, the
+	// entire match (index 0-1) is used instead.
+	firstGroup := 2
+	if r.cfg.WholeMatch && r.expression.NumSubexp() == 0 {
+		firstGroup = 0
+	}
+	for m, matchIndex := range matchAllIndex {
+		td["MatchIndex"] = strconv.Itoa(m)
+		for i := firstGroup; i < len(matchIndex); i += 2 {
 			if matchIndex[i] == -1 {
 				continue
 			}
 			capturedString := input[matchIndex[i]:matchIndex[i+1]]
-			
-			buf.Reset()
-			td["Value"] = capturedString
-			err := r.template.Execute(buf, td)
-			if err != nil {
-				return "", nil, err
+			if r.group != 0 && i/2 != r.group {
+				// The group is kept as is but its value is still extracted.
+				if _, ok := capturedMap[capturedString]; !ok {
+					capturedMap[capturedString] = capturedString
+				}
+				continue
 			}
-			st := buf.String()
-			
-			if previousInputEndIndex == 0 || previousInputEndIndex <= matchIndex[i] {
-				result.WriteString(input[previousInputEndIndex:matchIndex[i]])
-				result.WriteString(st)
-				previousInputEndIndex = matchIndex[i+1]
+
+			st, ok := r.lookup(i/2, capturedString)
+			if !ok {
+				var err error
+				st, err = r.render(buf, i/2, capturedString, td)
+				if err != nil {
+					return "", replacements{}, err
+				}
 			}
+
+			spans = append(spans, replaceSpan{start: matchIndex[i], end: matchIndex[i+1], replacement: st})
 			capturedMap[capturedString] = st
 		}
 	}
-	
+	if r.gapTemplate != nil {
+		var err error
+		if spans, err = r.appendGaps(buf, spans, matchAllIndex, input, td); err != nil {
+			return "", replacements{}, err
+		}
+	}
+
+	return rebuildWithSpans(input, spans), replacements{m: capturedMap}, nil
+}
+
+// appendGaps appends the spans of the non empty segments of the input out of
+// the matches, replaced by the GapReplace template.
+func (r *replaceStage) appendGaps(buf *bytes.Buffer, spans []replaceSpan, matchAllIndex [][]int, input string, td map[string]string) ([]replaceSpan, error) {
+	start := 0
+	for i := 0; i <= len(matchAllIndex); i++ {
+		end := len(input)
+		if i < len(matchAllIndex) {
+			end = matchAllIndex[i][0]
+		}
+		if start < end {
+			buf.Reset()
+			td["Gap"] = input[start:end]
+			if err := r.execute(buf, r.gapTemplate, td); err != nil {
+				return nil, err
+			}
+			spans = append(spans, replaceSpan{start: start, end: end, replacement: buf.String()})
+		}
+		if i < len(matchAllIndex) {
+			start = matchAllIndex[i][1]
+		}
+	}
+	delete(td, "Gap")
+	return spans, nil
+}
+
+// rebuildWithSpans replaces the given spans of the input in a single pass.
+//
+// Spans are ordered by start index, and for equal starts the longest (outer) span
+// comes first, except empty spans which cannot overlap anything and come before
+// the others; remaining ties keep the match then group order. A span overlapping
+// an already written one is dropped, so for nested groups like `((a)b)` the outer
+// group wins and for overlapping siblings the left-most one wins. Every template is
+// still executed, so nested named groups are extracted with their own replacement.
+func rebuildWithSpans(input string, spans []replaceSpan) string {
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		if iEmpty, jEmpty := spans[i].start == spans[i].end, spans[j].start == spans[j].end; iEmpty != jEmpty {
+			return iEmpty
+		}
+		return spans[i].end > spans[j].end
+	})
+
+	var result strings.Builder
+	result.Grow(len(input))
+	previousInputEndIndex := 0
+	for _, span := range spans {
+		if span.start < previousInputEndIndex {
+			continue
+		}
+		result.WriteString(input[previousInputEndIndex:span.start])
+		result.WriteString(span.replacement)
+		previousInputEndIndex = span.end
+	}
 	result.WriteString(input[previousInputEndIndex:])
-	return result.String(), capturedMap, nil
+	return result.String()
+}
+
+// lookup returns the replacement of a captured value from the lookup configured
+// for its capture group, if any.
+func (r *replaceStage) lookup(group int, value string) (string, bool) {
+	dict, ok := r.groupLookups[group]
+	if !ok {
+		return "", false
+	}
+	st, ok := dict[value]
+	return st, ok
+}
+
+// render computes the replacement of a single captured value of a capture group,
+// using the dsl program, ReplaceFromKey or DigitPlaceholder when configured and
+// the replace template otherwise.
+func (r *replaceStage) render(buf *bytes.Buffer, group int, captured string, td map[string]string) (string, error) {
+	t, ok := r.groupTemplates[group]
+	if !ok {
+		if r.groupTemplates != nil && r.cfg.Replace == "" {
+			// Only the groups with their own template are replaced.
+			return captured, nil
+		}
+		t = r.template
+	}
+	prefix, value, suffix := r.splitKept(captured)
+	masked := value
+	if r.cfg.URLDecode {
+		// Values which are not validly encoded are rendered as captured.
+		if decoded, err := url.QueryUnescape(value); err == nil {
+			value = decoded
+		}
+	}
+	var result string
+	switch {
+	case r.dsl != nil:
+		result = r.dsl.Run(value)
+	case r.cfg.ReplaceFromKey != nil:
+		var err error
+		if result, err = r.replaceFromKey(buf, value, td); err != nil {
+			return "", err
+		}
+	case r.cfg.DigitPlaceholder != nil:
+		result = replaceDigits(value, *r.cfg.DigitPlaceholder)
+	default:
+		buf.Reset()
+		td["Value"] = value
+		if err := r.execute(buf, t, td); err != nil {
+			return "", err
+		}
+		result = buf.String()
+	}
+	if r.cfg.PreserveLength {
+		result = fillLength(result, utf8.RuneCountInString(masked))
+	}
+	if prefix == "" && suffix == "" {
+		return result, nil
+	}
+	return prefix + result + suffix, nil
+}
+
+// replaceDigits replaces each run of ASCII digits of s with the placeholder.
+func replaceDigits(s, placeholder string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inDigits := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < '0' || c > '9' {
+			b.WriteByte(c)
+			inDigits = false
+		} else if !inDigits {
+			b.WriteString(placeholder)
+			inDigits = true
+		}
+	}
+	return b.String()
+}
+
+// splitKept splits a captured value into the prefix and suffix kept as is and
+// the middle to render. Values too short to keep both are rendered entirely.
+func (r *replaceStage) splitKept(captured string) (prefix, middle, suffix string) {
+	if r.cfg.KeepPrefix == 0 && r.cfg.KeepSuffix == 0 {
+		return "", captured, ""
+	}
+	runes := utf8.RuneCountInString(captured)
+	if r.cfg.KeepPrefix+r.cfg.KeepSuffix >= runes {
+		return "", captured, ""
+	}
+	start, end := 0, len(captured)
+	for i := 0; i < r.cfg.KeepPrefix; i++ {
+		_, size := utf8.DecodeRuneInString(captured[start:])
+		start += size
+	}
+	for i := 0; i < r.cfg.KeepSuffix; i++ {
+		_, size := utf8.DecodeLastRuneInString(captured[:end])
+		end -= size
+	}
+	return captured[:start], captured[start:end], captured[end:]
+}
+
+// fillLength repeats the runes of s, cutting the last repetition, until the
+// result is n runes long. An empty s is returned as is.
+func fillLength(s string, n int) string {
+	if s == "" {
+		return s
+	}
+	runes := utf8.RuneCountInString(s)
+	if runes == n {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s) * (n/runes + 1))
+	for written := 0; written < n; {
+		for _, c := range s {
+			if written == n {
+				break
+			}
+			b.WriteRune(c)
+			written++
+		}
+	}
+	return b.String()
+}
+
+// replaceFromKey returns the value of the ReplaceFromKey extracted key, executed
+// as a template when it contains actions, or the captured value when the key is
+// missing.
+func (r *replaceStage) replaceFromKey(buf *bytes.Buffer, value string, td map[string]string) (string, error) {
+	text, ok := td[*r.cfg.ReplaceFromKey]
+	if !ok {
+		return value, nil
+	}
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	// The text comes from the log line, so the template is not cached and
+	// cannot read the environment.
+	t, err := newReplaceTemplate(text, getReplaceFromKeyFunctions())
+	if err != nil {
+		return "", err
+	}
+	buf.Reset()
+	td["Value"] = value
+	if err := t.Execute(buf, td); err != nil {
+		var p *templatePanic
+		if errors.As(err, &p) {
+			r.panics.Inc()
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// execute runs the replace template, converting a panic into an error so that
+// a misbehaving template function does not crash the pipeline.
+func (r *replaceStage) execute(buf *bytes.Buffer, t *template.Template, td map[string]string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.panics.Inc()
+			err = &templatePanic{value: p}
+		}
+	}()
+	tmpl := t
+	if r.cfg.Deterministic {
+		if tmpl, err = deterministicTemplate(tmpl, td); err != nil {
+			return err
+		}
+	}
+	if err = tmpl.Execute(buf, td); err != nil {
+		var p *templatePanic
+		if errors.As(err, &p) {
+			r.panics.Inc()
+		}
+	}
+	return err
+}
+
+// deterministicTemplate returns a copy of the template whose random functions
+// are seeded with the hash of the input and of the captured value.
+func deterministicTemplate(t *template.Template, td map[string]string) (*template.Template, error) {
+	c, err := t.Clone()
+	if err != nil {
+		return nil, err
+	}
+	seed := xxhash.Sum64String(td[replaceLineKey] + "\x00" + td["Value"])
+	funcs := deterministicFunctions(rand.New(rand.NewSource(int64(seed))))
+	for name, fn := range funcs {
+		funcs[name] = recoverFunction(fn)
+	}
+	return c.Funcs(funcs), nil
+}
+
+const (
+	alphaChars   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	numericChars = "0123456789"
+)
+
+// deterministicFunctions are the random template functions drawing from rng
+// instead of a global source, see ReplaceConfig.Deterministic.
+func deterministicFunctions(rng *rand.Rand) template.FuncMap {
+	randUUID := func() string {
+		u, err := uuid.NewRandomFromReader(rng)
+		if err != nil {
+			return ""
+		}
+		return u.String()
+	}
+	randString := func(chars string) func(int) string {
+		return func(count int) string {
+			b := make([]byte, count)
+			for i := range b {
+				b[i] = chars[rng.Intn(len(chars))]
+			}
+			return string(b)
+		}
+	}
+	ascii := make([]byte, 0, '~'-' '+1)
+	for c := byte(' '); c <= '~'; c++ {
+		ascii = append(ascii, c)
+	}
+	return template.FuncMap{
+		"UUID":   randUUID,
+		"uuidv4": randUUID,
+		"randInt": func(lo, hi int) int {
+			return lo + rng.Intn(hi-lo)
+		},
+		"randAlpha":    randString(alphaChars),
+		"randNumeric":  randString(numericChars),
+		"randAlphaNum": randString(alphaChars + numericChars),
+		"randAscii":    randString(string(ascii)),
+		"randBytes": func(count int) (string, error) {
+			b := make([]byte, count)
+			if _, err := rng.Read(b); err != nil {
+				return "", err
+			}
+			return base64.StdEncoding.EncodeToString(b), nil
+		},
+		"shuffle": func(s string) string {
+			r := []rune(s)
+			rng.Shuffle(len(r), func(i, j int) { r[i], r[j] = r[j], r[i] })
+			return string(r)
+		},
+	}
 }
 
 func (r *replaceStage) getTemplateData(extracted map[string]interface{}) map[string]string {
-	td := make(map[string]string, len(extracted))
+	// Leave room for the Value, __line__, MatchIndex and MatchCount keys.
+	td := make(map[string]string, len(extracted)+4)
 	for k, v := range extracted {
 		s, err := getString(v)
 		if err != nil {
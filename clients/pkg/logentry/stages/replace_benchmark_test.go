@@ -16,6 +16,8 @@ var benchmarkTestCases = []struct {
 	config      string
 	entry       string
 	description string
+	// replace stage 单次 Process 允许的最大内存分配次数
+	maxAllocs float64
 }{
 	{
 		name: "SimpleReplace",
@@ -27,6 +29,7 @@ pipeline_stages:
 `,
 		entry:       `11.11.11.11 - frank [25/Jan/2000:14:00:01 -0500] "GET /1986.js HTTP/1.1" 200 932 "-" "Mozilla/5.0"`,
 		description: "简单替换测试",
+		maxAllocs:   25,
 	},
 	{
 		name: "ComplexRegex",
@@ -38,6 +41,7 @@ pipeline_stages:
 `,
 		entry:       `11.11.11.11 - frank [25/Jan/2000:14:00:01 -0500] "GET /1986.js HTTP/1.1" 200 932 "-" "Mozilla/5.0"`,
 		description: "复杂正则表达式测试",
+		maxAllocs:   276,
 	},
 	{
 		name: "MultipleMatches",
@@ -49,6 +53,7 @@ pipeline_stages:
 `,
 		entry:       `11.11.11.11 - frank 12.12.12.12 - john 13.13.13.13 - mary`,
 		description: "多次匹配测试",
+		maxAllocs:   73,
 	},
 	{
 		name: "TemplateWithSource",
@@ -65,6 +70,7 @@ pipeline_stages:
 `,
 		entry:       `{"time":"2019-01-01T01:00:00.000000001Z", "level": "info", "msg": "11.11.11.11 - \"POST /loki/api/v1/push/ HTTP/1.1\" 200 932"}`,
 		description: "带源字段的模板测试",
+		maxAllocs:   9,
 	},
 }
 
@@ -105,12 +111,18 @@ func BenchmarkReplaceStage_Memory(b *testing.B) {
 				b.Fatal(err)
 			}
 
+			// 锁定 replace stage 的内存分配次数，防止优化回退
+			if allocs := replaceProcessAllocs(b, tc.config, tc.entry); allocs > tc.maxAllocs {
+				b.Fatalf("replace stage Process allocated %v times per run, expected at most %v", allocs, tc.maxAllocs)
+			}
+
 			// 预热
 			for i := 0; i < 100; i++ {
 				processEntries(pl, newEntry(nil, nil, tc.entry, time.Now()))
 			}
 
 			// 重置计时器
+			b.ReportAllocs()
 			b.ResetTimer()
 
 			// 基准测试
@@ -123,6 +135,57 @@ func BenchmarkReplaceStage_Memory(b *testing.B) {
 	}
 }
 
+// replaceProcessAllocs 统计配置中最后一个 replace stage 单次 Process 的平均内存分配次数，
+// 不包含 pipeline 本身 channel 和 goroutine 的开销
+func replaceProcessAllocs(b *testing.B, config string, entry string) float64 {
+	stages := loadConfig(config)
+	cfg := stages[len(stages)-1].(map[interface{}]interface{})[StageTypeReplace]
+	st, err := newReplaceStage(util_log.Logger, cfg, prometheus.DefaultRegisterer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	processor := st.(*stageProcessor).Processor
+	ts := time.Now()
+	return testing.AllocsPerRun(100, func() {
+		line := entry
+		extracted := map[string]interface{}{"msg": entry}
+		processor.Process(nil, extracted, &ts, &line)
+	})
+}
+
+// BenchmarkReplaceStage_SingleMatch 单次匹配单个捕获组的快速路径与通用路径对比
+func BenchmarkReplaceStage_SingleMatch(b *testing.B) {
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `11.11.11.11 - (\S+) .*`,
+		"replace":    "{{ .Value | ToUpper }}",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := st.(*stageProcessor).Processor.(*replaceStage)
+	entry := benchmarkTestCases[0].entry
+	matchAllIndex := r.expression.FindAllStringSubmatchIndex(entry, -1)
+
+	paths := map[string]func([][]int, string, map[string]string) (string, replacements, error){
+		"single": func(m [][]int, input string, td map[string]string) (string, replacements, error) {
+			return r.replaceSingle(m[0], input, td)
+		},
+		"all": r.replaceAll,
+	}
+	for name, replace := range paths {
+		b.Run(name, func(b *testing.B) {
+			td := map[string]string{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := replace(matchAllIndex, entry, td); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 // BenchmarkReplaceStage_Concurrent 并发性能测试
 func BenchmarkReplaceStage_Concurrent(b *testing.B) {
 	for _, tc := range benchmarkTestCases {
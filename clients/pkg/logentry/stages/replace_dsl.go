@@ -0,0 +1,352 @@
+package stages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Config Errors
+const (
+	ErrReplaceDSLEmpty           = "replace dsl expression cannot be empty"
+	ErrReplaceDSLUnknownFunction = "unknown dsl function %q"
+	ErrReplaceDSLArgCount        = "dsl function %q expects %s, got %d"
+	ErrReplaceDSLArgType         = "dsl function %q argument %d must be %s"
+	ErrReplaceDSLUnexpectedToken = "unexpected %s at position %d"
+)
+
+// dslStep transforms the current value of a dsl chain.
+type dslStep func(value string) string
+
+// dslProgram is a compiled dsl expression. Steps are applied left to right,
+// each one receiving the output of the previous step.
+type dslProgram []dslStep
+
+// Run applies the program to the given value.
+func (p dslProgram) Run(value string) string {
+	for _, step := range p {
+		value = step(value)
+	}
+	return value
+}
+
+// dslArg is a literal argument of a dsl function call.
+type dslArg struct {
+	text     string
+	isNumber bool
+}
+
+// dslFunction describes a function available in the dsl. build binds the
+// literal arguments at compile time so that no parsing happens per line.
+type dslFunction struct {
+	minArgs int
+	maxArgs int
+	build   func(name string, args []dslArg) (dslStep, error)
+}
+
+var dslFunctions = map[string]dslFunction{
+	"upper": {0, 0, func(_ string, _ []dslArg) (dslStep, error) {
+		return strings.ToUpper, nil
+	}},
+	"lower": {0, 0, func(_ string, _ []dslArg) (dslStep, error) {
+		return strings.ToLower, nil
+	}},
+	"trim": {0, 1, func(_ string, args []dslArg) (dslStep, error) {
+		if len(args) == 0 {
+			return strings.TrimSpace, nil
+		}
+		cutset := args[0].text
+		return func(v string) string { return strings.Trim(v, cutset) }, nil
+	}},
+	"prefix": {1, 1, func(_ string, args []dslArg) (dslStep, error) {
+		p := args[0].text
+		return func(v string) string { return p + v }, nil
+	}},
+	"suffix": {1, 1, func(_ string, args []dslArg) (dslStep, error) {
+		s := args[0].text
+		return func(v string) string { return v + s }, nil
+	}},
+	"replace": {2, 2, func(_ string, args []dslArg) (dslStep, error) {
+		old, repl := args[0].text, args[1].text
+		return func(v string) string { return strings.ReplaceAll(v, old, repl) }, nil
+	}},
+	"hash": {0, 1, func(_ string, args []dslArg) (dslStep, error) {
+		salt := ""
+		if len(args) == 1 {
+			salt = args[0].text
+		}
+		return func(v string) string {
+			hash := sha256.Sum256([]byte(salt + v))
+			return hex.EncodeToString(hash[:])
+		}, nil
+	}},
+	"truncate": {1, 1, func(name string, args []dslArg) (dslStep, error) {
+		n, err := dslIntArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return func(v string) string {
+			if utf8.RuneCountInString(v) <= n {
+				return v
+			}
+			return string([]rune(v)[:n])
+		}, nil
+	}},
+	// mask replaces every rune but the last `keep` ones with the mask character (`*` by default).
+	"mask": {1, 2, func(name string, args []dslArg) (dslStep, error) {
+		keep, err := dslIntArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		maskChar := "*"
+		if len(args) == 2 {
+			maskChar = args[1].text
+		}
+		return func(v string) string {
+			runes := []rune(v)
+			if keep >= len(runes) {
+				return v
+			}
+			return strings.Repeat(maskChar, len(runes)-keep) + string(runes[len(runes)-keep:])
+		}, nil
+	}},
+}
+
+func dslIntArg(name string, args []dslArg, i int) (int, error) {
+	if !args[i].isNumber {
+		return 0, errors.Errorf(ErrReplaceDSLArgType, name, i+1, "a number")
+	}
+	n, err := strconv.Atoi(args[i].text)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf(ErrReplaceDSLArgType, name, i+1, "a non-negative integer")
+	}
+	return n, nil
+}
+
+// compileDSL compiles a replace dsl expression into a dslProgram.
+//
+// The grammar is a pipeline of steps separated by `|`. A step is either a
+// string literal, which replaces the current value, or a function call such
+// as `upper` or `mask(value, 4)`. The identifier `value` may be passed as the
+// first argument to make the implicit input explicit, e.g. `mask(value, 4) | upper`.
+func compileDSL(expr string) (dslProgram, error) {
+	tokens, err := lexDSL(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &dslParser{tokens: tokens}
+	if p.peek().kind == dslTokenEOF {
+		return nil, errors.New(ErrReplaceDSLEmpty)
+	}
+	var program dslProgram
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		program = append(program, step)
+		tok := p.next()
+		if tok.kind == dslTokenEOF {
+			return program, nil
+		}
+		if tok.kind != dslTokenPipe {
+			return nil, tok.unexpected()
+		}
+	}
+}
+
+type dslTokenKind int
+
+const (
+	dslTokenEOF dslTokenKind = iota
+	dslTokenIdent
+	dslTokenNumber
+	dslTokenString
+	dslTokenLParen
+	dslTokenRParen
+	dslTokenComma
+	dslTokenPipe
+)
+
+type dslToken struct {
+	kind dslTokenKind
+	text string
+	pos  int
+}
+
+func (t dslToken) unexpected() error {
+	if t.kind == dslTokenEOF {
+		return errors.Errorf(ErrReplaceDSLUnexpectedToken, "end of expression", t.pos)
+	}
+	return errors.Errorf(ErrReplaceDSLUnexpectedToken, fmt.Sprintf("%q", t.text), t.pos)
+}
+
+func lexDSL(expr string) ([]dslToken, error) {
+	var tokens []dslToken
+	punct := map[byte]dslTokenKind{'(': dslTokenLParen, ')': dslTokenRParen, ',': dslTokenComma, '|': dslTokenPipe}
+	for i := 0; i < len(expr); {
+		c, size := utf8.DecodeRuneInString(expr[i:])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c < utf8.RuneSelf && punct[byte(c)] != 0:
+			tokens = append(tokens, dslToken{kind: punct[byte(c)], text: string(c), pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(expr) && rune(expr[end]) != c {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, errors.Errorf("unterminated string starting at position %d", i)
+			}
+			raw := expr[i : end+1]
+			if c == '\'' {
+				raw = doubleQuoted(raw[1 : len(raw)-1])
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, errors.Errorf("invalid string at position %d", i)
+			}
+			tokens = append(tokens, dslToken{kind: dslTokenString, text: s, pos: i})
+			i = end + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(expr) && expr[end] >= '0' && expr[end] <= '9' {
+				end++
+			}
+			tokens = append(tokens, dslToken{kind: dslTokenNumber, text: expr[i:end], pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + size
+			for end < len(expr) {
+				r, n := utf8.DecodeRuneInString(expr[end:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += n
+			}
+			tokens = append(tokens, dslToken{kind: dslTokenIdent, text: expr[i:end], pos: i})
+			i = end
+		default:
+			return nil, errors.Errorf(ErrReplaceDSLUnexpectedToken, fmt.Sprintf("%q", string(c)), i)
+		}
+	}
+	return append(tokens, dslToken{kind: dslTokenEOF, pos: len(expr)}), nil
+}
+
+// doubleQuoted turns the content of a single-quoted string into a double-quoted
+// one for strconv.Unquote, unescaping \' and escaping the double quotes.
+func doubleQuoted(content string) string {
+	var b strings.Builder
+	b.Grow(len(content) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '\\' && i+1 < len(content):
+			i++
+			if content[i] != '\'' {
+				b.WriteByte(c)
+			}
+			b.WriteByte(content[i])
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+type dslParser struct {
+	tokens []dslToken
+	pos    int
+}
+
+func (p *dslParser) peek() dslToken {
+	return p.tokens[p.pos]
+}
+
+func (p *dslParser) next() dslToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != dslTokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *dslParser) parseStep() (dslStep, error) {
+	tok := p.next()
+	switch tok.kind {
+	case dslTokenString:
+		s := tok.text
+		return func(string) string { return s }, nil
+	case dslTokenIdent:
+	default:
+		return nil, tok.unexpected()
+	}
+
+	name := tok.text
+	fn, ok := dslFunctions[name]
+	if !ok {
+		return nil, errors.Errorf(ErrReplaceDSLUnknownFunction, name)
+	}
+
+	var args []dslArg
+	if p.peek().kind == dslTokenLParen {
+		p.next()
+		var err error
+		if args, err = p.parseArgs(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) < fn.minArgs || len(args) > fn.maxArgs {
+		expected := fmt.Sprintf("%d argument(s)", fn.minArgs)
+		if fn.minArgs != fn.maxArgs {
+			expected = fmt.Sprintf("%d to %d argument(s)", fn.minArgs, fn.maxArgs)
+		}
+		return nil, errors.Errorf(ErrReplaceDSLArgCount, name, expected, len(args))
+	}
+	return fn.build(name, args)
+}
+
+// parseArgs parses a comma separated list of literal arguments up to the closing
+// parenthesis. A leading `value` identifier is accepted and dropped since the
+// current value is always the implicit input of a step.
+func (p *dslParser) parseArgs() ([]dslArg, error) {
+	var args []dslArg
+	if p.peek().kind == dslTokenRParen {
+		p.next()
+		return args, nil
+	}
+	for i := 0; ; i++ {
+		tok := p.next()
+		switch {
+		case tok.kind == dslTokenIdent && tok.text == "value" && i == 0:
+		case tok.kind == dslTokenString:
+			args = append(args, dslArg{text: tok.text})
+		case tok.kind == dslTokenNumber:
+			args = append(args, dslArg{text: tok.text, isNumber: true})
+		default:
+			return nil, tok.unexpected()
+		}
+		tok = p.next()
+		if tok.kind == dslTokenRParen {
+			return args, nil
+		}
+		if tok.kind != dslTokenComma {
+			return nil, tok.unexpected()
+		}
+	}
+}
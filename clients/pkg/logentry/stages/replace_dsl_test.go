@@ -0,0 +1,113 @@
+package stages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileDSL(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expr     string
+		input    string
+		expected string
+		err      string
+	}{
+		"mask then upper": {
+			expr:     "mask(value, 4) | upper",
+			input:    "secretabcd",
+			expected: "******ABCD",
+		},
+		"implicit value": {
+			expr:     `mask(2, "#")`,
+			input:    "12345",
+			expected: "###45",
+		},
+		"mask shorter than keep": {
+			expr:     "mask(4)",
+			input:    "abc",
+			expected: "abc",
+		},
+		"string literal": {
+			expr:     `'[REDACTED]'`,
+			input:    "password",
+			expected: "[REDACTED]",
+		},
+		"escaped single quote": {
+			expr:     `prefix('it\'s "') | suffix('\\')`,
+			input:    "x",
+			expected: `it's "x\`,
+		},
+		"unicode string": {
+			expr:     `prefix('→ ')`,
+			input:    "x",
+			expected: "→ x",
+		},
+		"chain": {
+			expr:     `trim | lower | replace("-", "_") | prefix("id:") | truncate(8)`,
+			input:    "  AB-CD-EF ",
+			expected: "id:ab_cd",
+		},
+		"hash": {
+			expr:     `hash("salt")`,
+			input:    "this is PII data",
+			expected: "de33958efc1d63cd095a30e308a209d8b4e25cb281799494528505459ed6b2f2",
+		},
+		"empty": {
+			expr: "  ",
+			err:  ErrReplaceDSLEmpty,
+		},
+		"unknown function": {
+			expr: "upper | shout",
+			err:  `unknown dsl function "shout"`,
+		},
+		"unicode identifier": {
+			expr: "upper | größe",
+			err:  `unknown dsl function "größe"`,
+		},
+		"unicode symbol": {
+			expr: "upper → lower",
+			err:  `unexpected "→" at position 6`,
+		},
+		"wrong arity": {
+			expr: "mask",
+			err:  `dsl function "mask" expects 1 to 2 argument(s), got 0`,
+		},
+		"wrong argument type": {
+			expr: `truncate("4")`,
+			err:  `dsl function "truncate" argument 1 must be a number`,
+		},
+		"trailing pipe": {
+			expr: "upper |",
+			err:  "unexpected end of expression at position 7",
+		},
+		"missing pipe": {
+			expr: "upper lower",
+			err:  `unexpected "lower" at position 6`,
+		},
+		"unclosed call": {
+			expr: "mask(4",
+			err:  "unexpected end of expression at position 6",
+		},
+		"unterminated string": {
+			expr: `prefix("abc)`,
+			err:  "unterminated string starting at position 7",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			program, err := compileDSL(tt.expr)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, program.Run(tt.input))
+		})
+	}
+}
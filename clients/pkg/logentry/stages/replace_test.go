@@ -1,15 +1,28 @@
 package stages
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 
+	"github.com/go-kit/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go/utils"
 	"gopkg.in/yaml.v2"
 
+	"github.com/grafana/loki/pkg/push"
+
 	util_log "github.com/grafana/loki/v3/pkg/util/log"
 )
 
@@ -76,9 +89,38 @@ pipeline_stages:
       replace: ''
 `
 
+var testReplaceYamlWithDSL = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "password=(\\S+)"
+      dsl: "mask(value, 2) | upper"
+`
+
+var testReplaceYamlWithWholeMatch = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "password=\\S+"
+      replace: "password=****"
+      whole_match: true
+`
+
+var testReplaceYamlWithoutWholeMatch = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "password=\\S+"
+      replace: "password=****"
+`
+
 var testReplaceLogLine = `11.11.11.11 - frank [25/Jan/2000:14:00:01 -0500] "GET /1986.js HTTP/1.1" 200 932 "-" "Mozilla/5.0 (Windows; U; Windows NT 5.1; de; rv:1.9.1.7) Gecko/20091221 Firefox/3.5.7 GTB6"`
 var testReplaceLogJSONLine = `{"time":"2019-01-01T01:00:00.000000001Z", "level": "info", "msg": "11.11.11.11 - \"POST /loki/api/push/ HTTP/1.1\" 200 932 \"-\" \"Mozilla/5.0 (Windows; U; Windows NT 5.1; de; rv:1.9.1.7) Gecko/20091221 Firefox/3.5.7 GTB6\""}`
 var testReplaceLogLineAdjacentCaptureGroups = `abc`
+var testReplaceLogLineWithPassword = `user=frank password=hunter2ab`
 
 func TestPipeline_Replace(t *testing.T) {
 	t.Parallel()
@@ -158,6 +200,24 @@ func TestPipeline_Replace(t *testing.T) {
 			map[string]interface{}{},
 			``,
 		},
+		"successfully run a pipeline with a dsl replacement": {
+			testReplaceYamlWithDSL,
+			testReplaceLogLineWithPassword,
+			map[string]interface{}{},
+			`user=frank password=*******AB`,
+		},
+		"successfully run a pipeline with whole match and no capture groups": {
+			testReplaceYamlWithWholeMatch,
+			testReplaceLogLineWithPassword,
+			map[string]interface{}{},
+			`user=frank password=****`,
+		},
+		"no capture groups without whole match leaves the line unchanged": {
+			testReplaceYamlWithoutWholeMatch,
+			testReplaceLogLineWithPassword,
+			map[string]interface{}{},
+			testReplaceLogLineWithPassword,
+		},
 	}
 
 	for testName, testData := range tests {
@@ -240,6 +300,397 @@ func TestReplaceConfig_validate(t *testing.T) {
 			},
 			nil,
 		},
+		"dsl and replace": {
+			map[string]interface{}{
+				"expression": "(?P<ts>[0-9]+).*",
+				"replace":    "test",
+				"dsl":        "upper",
+			},
+			errors.New(ErrReplaceDSLWithReplace),
+		},
+		"valid with dsl": {
+			map[string]interface{}{
+				"expression": "(?P<ts>[0-9]+).*",
+				"dsl":        "upper",
+			},
+			nil,
+		},
+		"group lookup with unknown group": {
+			map[string]interface{}{
+				"expression":    "(?P<status>[0-9]+)",
+				"lookups":       map[string]interface{}{"codes": map[string]interface{}{"200": "OK"}},
+				"group_lookups": map[string]interface{}{"code": "codes"},
+			},
+			errors.New(`replace stage references unknown named capture group "code"`),
+		},
+		"group lookup with unknown lookup": {
+			map[string]interface{}{
+				"expression":    "(?P<status>[0-9]+)",
+				"lookups":       map[string]interface{}{"codes": map[string]interface{}{"200": "OK"}},
+				"group_lookups": map[string]interface{}{"status": "statuses"},
+			},
+			errors.New(`replace stage references unknown lookup "statuses"`),
+		},
+		"invalid normalize_newlines": {
+			map[string]interface{}{
+				"expression":         "(?P<ts>[0-9]+).*",
+				"normalize_newlines": "cr",
+			},
+			errors.New("replace stage normalize_newlines must be one of `lf` or `crlf`, got \"cr\""),
+		},
+		"empty source_label": {
+			map[string]interface{}{
+				"expression":   "(?P<ts>[0-9]+).*",
+				"source_label": "",
+			},
+			errors.New(ErrEmptyReplaceStageLabel),
+		},
+		"source and source_label": {
+			map[string]interface{}{
+				"expression":   "(?P<ts>[0-9]+).*",
+				"source":       "log",
+				"source_label": "pod",
+			},
+			errors.New(ErrReplaceSourceAndLabel),
+		},
+		"promote_allow with unknown group": {
+			map[string]interface{}{
+				"expression":    "(?P<status>[0-9]+)",
+				"promote_allow": map[string]interface{}{"code": []string{"200"}},
+			},
+			errors.New(`replace stage references unknown named capture group "code"`),
+		},
+		"source_pattern with source": {
+			map[string]interface{}{
+				"expression":     "(\\d+)",
+				"source_pattern": "user_*",
+				"source":         "user",
+			},
+			errors.New(ErrReplaceSourcePattern),
+		},
+		"invalid source_pattern": {
+			map[string]interface{}{
+				"expression":     "(\\d+)",
+				"source_pattern": "user_[",
+			},
+			errors.Errorf(ErrReplaceInvalidPattern, "user_["),
+		},
+		"empty matched_rule_key": {
+			map[string]interface{}{
+				"expression":       "(\\d+)",
+				"matched_rule_key": "",
+			},
+			errors.New(ErrEmptyReplaceMatchedRule),
+		},
+		"extract_only with replace": {
+			map[string]interface{}{
+				"expression":   "(?P<id>\\d+)",
+				"replace":      "****",
+				"extract_only": true,
+			},
+			errors.New(ErrReplaceExtractOnly),
+		},
+		"dot_all cleared inline": {
+			map[string]interface{}{
+				"expression": "a(?-s:.)b",
+				"dot_all":    true,
+			},
+			errors.Errorf(ErrReplaceConflictingFlag, 's', "dot_all"),
+		},
+		"multiline cleared inline": {
+			map[string]interface{}{
+				"expression": "(?i-m)^error",
+				"multiline":  true,
+			},
+			errors.Errorf(ErrReplaceConflictingFlag, 'm', "multiline"),
+		},
+		"multiline with redundant inline flag": {
+			map[string]interface{}{
+				"expression": "(?m)^(?P<name>a-m)$",
+				"multiline":  true,
+				"dot_all":    true,
+			},
+			nil,
+		},
+		"range with expression": {
+			map[string]interface{}{
+				"expression": "(\\d+)",
+				"range":      []int{0, 4},
+			},
+			errors.New(ErrReplaceRangeExpression),
+		},
+		"empty range": {
+			map[string]interface{}{
+				"range": []int{4, 4},
+			},
+			errors.Errorf(ErrReplaceInvalidRange, 4, 4),
+		},
+		"negative range": {
+			map[string]interface{}{
+				"range": []int{-1, 4},
+			},
+			errors.Errorf(ErrReplaceInvalidRange, -1, 4),
+		},
+		"valid range": {
+			map[string]interface{}{
+				"range":   []int{10, 20},
+				"replace": "*",
+			},
+			nil,
+		},
+		"replace_from_key with replace": {
+			map[string]interface{}{
+				"expression":       "(\\d+)",
+				"replace":          "*",
+				"replace_from_key": "name",
+			},
+			errors.New(ErrReplaceFromKeyTemplate),
+		},
+		"empty replace_from_key": {
+			map[string]interface{}{
+				"expression":       "(\\d+)",
+				"replace_from_key": "",
+			},
+			errors.New(ErrEmptyReplaceFromKey),
+		},
+		"negative max_input_bytes": {
+			map[string]interface{}{
+				"expression":      "(\\d+)",
+				"replace":         "*",
+				"max_input_bytes": -1,
+			},
+			errors.New(ErrReplaceInvalidMaxInput),
+		},
+		"metric_name without metric_label_from_group": {
+			map[string]interface{}{
+				"expression":  "status=(?P<status>\\d+)",
+				"metric_name": "http_statuses_total",
+			},
+			errors.New(ErrReplaceMetricConfig),
+		},
+		"invalid metric_name": {
+			map[string]interface{}{
+				"expression":              "status=(?P<status>\\d+)",
+				"metric_name":             "http-statuses",
+				"metric_label_from_group": "status",
+			},
+			errors.Errorf(ErrReplaceInvalidMetric, "http-statuses"),
+		},
+		"unknown metric_label_from_group": {
+			map[string]interface{}{
+				"expression":              "status=(?P<status>\\d+)",
+				"metric_name":             "http_statuses_total",
+				"metric_label_from_group": "code",
+			},
+			errors.Errorf(ErrReplaceUnknownGroup, "code"),
+		},
+		"negative metric_max_label_values": {
+			map[string]interface{}{
+				"expression":              "status=(?P<status>\\d+)",
+				"metric_name":             "http_statuses_total",
+				"metric_label_from_group": "status",
+				"metric_max_label_values": -1,
+			},
+			errors.New(ErrReplaceInvalidMaxLabels),
+		},
+		"digit_placeholder with replace": {
+			map[string]interface{}{
+				"expression":        "(\\d+)",
+				"replace":           "*",
+				"digit_placeholder": ":id",
+			},
+			errors.New(ErrReplaceDigitPlaceholder),
+		},
+		"invalid anchor": {
+			map[string]interface{}{
+				"expression": "(\\d+)",
+				"anchor":     "middle",
+			},
+			errors.Errorf(ErrReplaceInvalidAnchor, "middle"),
+		},
+		"anchor with range": {
+			map[string]interface{}{
+				"range":  []int{0, 4},
+				"anchor": "start",
+			},
+			errors.New(ErrReplaceAnchorRange),
+		},
+		"anchor start already anchored": {
+			map[string]interface{}{
+				"expression": "^(\\d+)",
+				"anchor":     "start",
+			},
+			errors.Errorf(ErrReplaceAlreadyAnchored, "start"),
+		},
+		"anchor both already anchored at the end": {
+			map[string]interface{}{
+				"expression": "(\\d+\\z)",
+				"anchor":     "both",
+			},
+			errors.Errorf(ErrReplaceAlreadyAnchored, "end"),
+		},
+		"then_extract with extract_only": {
+			map[string]interface{}{
+				"expression":   "(?P<id>\\d+)",
+				"extract_only": true,
+				"then_extract": "(?P<digit>\\d)",
+			},
+			errors.New(ErrReplaceThenExtract),
+		},
+		"gap_replace without template_gaps": {
+			map[string]interface{}{
+				"expression":  "(\\d+)",
+				"gap_replace": "*",
+			},
+			errors.New(ErrReplaceGapReplace),
+		},
+		"template_gaps with extract_only": {
+			map[string]interface{}{
+				"expression":    "(?P<id>\\d+)",
+				"extract_only":  true,
+				"template_gaps": true,
+			},
+			errors.New(ErrReplaceTemplateGaps),
+		},
+		"invalid capture_count_histogram": {
+			map[string]interface{}{
+				"expression":              "(\\d+)",
+				"capture_count_histogram": "tokens-per-line",
+			},
+			errors.Errorf(ErrReplaceInvalidHistogram, "tokens-per-line"),
+		},
+		"capture_count_histogram named like metric_name": {
+			map[string]interface{}{
+				"expression":              "(?P<status>\\d+)",
+				"metric_name":             "tokens",
+				"metric_label_from_group": "status",
+				"capture_count_histogram": "tokens",
+			},
+			errors.New(ErrReplaceHistogramName),
+		},
+		"line_index with source_json_array": {
+			map[string]interface{}{
+				"expression":        "(\\d+)",
+				"source":            "ids",
+				"source_json_array": true,
+				"line_index":        0,
+			},
+			errors.New(ErrReplaceLineIndex),
+		},
+		"invalid result_policy": {
+			map[string]interface{}{
+				"expression":        "(\\d+)",
+				"result_must_match": "^\\d+$",
+				"result_policy":     "ignore",
+			},
+			errors.Errorf(ErrReplaceResultPolicy, "ignore"),
+		},
+		"result_policy without result_must_match": {
+			map[string]interface{}{
+				"expression":    "(\\d+)",
+				"result_policy": "drop",
+			},
+			errors.New(ErrReplaceResultNoMatch),
+		},
+		"result_must_match with extract_only": {
+			map[string]interface{}{
+				"expression":        "(?P<id>\\d+)",
+				"extract_only":      true,
+				"result_must_match": "^\\d+$",
+			},
+			errors.New(ErrReplaceResultMustMatch),
+		},
+		"anchor end with a start anchor": {
+			map[string]interface{}{
+				"expression": "^(\\d+)",
+				"anchor":     "end",
+			},
+			nil,
+		},
+		"binary with keep_prefix": {
+			map[string]interface{}{
+				"expression":  "(\\d+)",
+				"replace":     "*",
+				"binary":      true,
+				"keep_prefix": 2,
+			},
+			errors.New(ErrReplaceBinary),
+		},
+		"per_group with dsl": {
+			map[string]interface{}{
+				"expression": "(?P<ip>\\S+)",
+				"dsl":        "mask()",
+				"per_group":  map[string]string{"ip": "*"},
+			},
+			errors.New(ErrReplacePerGroup),
+		},
+		"per_group unknown group": {
+			map[string]interface{}{
+				"expression": "(?P<ip>\\S+)",
+				"per_group":  map[string]string{"user": "*"},
+			},
+			errors.Errorf(ErrReplaceUnknownGroup, "user"),
+		},
+		"invalid preserve_original_as": {
+			map[string]interface{}{
+				"expression":           "(\\d+)",
+				"replace":              "*",
+				"preserve_original_as": "original-value",
+			},
+			errors.Errorf(ErrReplacePreserveName, "original-value"),
+		},
+		"preserve_original_as with source_pattern": {
+			map[string]interface{}{
+				"expression":           "(\\d+)",
+				"replace":              "*",
+				"source_pattern":       "user_*",
+				"preserve_original_as": "original",
+			},
+			errors.New(ErrReplacePreservePattern),
+		},
+		"negative keep_prefix": {
+			map[string]interface{}{
+				"expression":  "(\\d+)",
+				"keep_prefix": -1,
+			},
+			errors.New(ErrReplaceInvalidKeep),
+		},
+		"invalid debug_sample_rate": {
+			map[string]interface{}{
+				"expression":        "(\\d+)",
+				"debug_sample_rate": 1.5,
+			},
+			errors.Errorf(ErrReplaceInvalidSampling, 1.5),
+		},
+		"group_index and group_name": {
+			map[string]interface{}{
+				"expression":  "(?P<user>\\w+)",
+				"group_index": 1,
+				"group_name":  "user",
+			},
+			errors.New(ErrReplaceGroupIndexName),
+		},
+		"group_index out of range": {
+			map[string]interface{}{
+				"expression":  "(\\w+)=(\\w+)",
+				"group_index": 3,
+			},
+			errors.Errorf(ErrReplaceGroupIndexRange, 3, 2),
+		},
+		"group_name unknown": {
+			map[string]interface{}{
+				"expression": "(?P<user>\\w+)",
+				"group_name": "email",
+			},
+			errors.Errorf(ErrReplaceUnknownGroup, "email"),
+		},
+		"source_json_array without source": {
+			map[string]interface{}{
+				"expression":        "(\\d+)",
+				"source_json_array": true,
+			},
+			errors.New(ErrReplaceJSONArraySource),
+		},
 		"valid with source": {
 			map[string]interface{}{
 				"expression": "(?P<ts>[0-9]+).*",
@@ -264,6 +715,2449 @@ func TestReplaceConfig_validate(t *testing.T) {
 				t.Errorf("ReplaceConfig.validate() expected error = %v, actual error = %v", tt.err, err)
 				return
 			}
+			if err == nil {
+				// The config stays valid once the defaults are set.
+				setReplaceDefaults(c)
+				_, err = validateReplaceConfig(c)
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReplaceStage_GroupResolutionOrder(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expression string
+		entry      string
+		expected   string
+	}{
+		"nested groups prefer the outer group": {
+			expression: "((a)b)",
+			entry:      "ab xab",
+			expected:   "[ab] x[ab]",
+		},
+		"deeply nested groups prefer the outer group": {
+			expression: "(((a)b)c)",
+			entry:      "abc",
+			expected:   "[abc]",
+		},
+		"adjacent groups are all replaced": {
+			expression: "(a)(b)",
+			entry:      "ab ab",
+			expected:   "[a][b] [a][b]",
+		},
+		"groups captured out of order are all replaced": {
+			expression: "(?:(a)|(b))+",
+			entry:      "ba",
+			expected:   "[b][a]",
+		},
+		"empty group at the start of the line": {
+			expression: "(x*)(a)",
+			entry:      "ab",
+			expected:   "[][a]b",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression": tt.expression,
+				"replace":    "[{{ .Value }}]",
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+var testReplaceYamlWithGroupLookups = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "^(?P<method>\\S+) (?P<status>\\d{3}) (?P<size>\\d+)$"
+      replace: "{{ .Value | ToLower }}"
+      lookups:
+        statuses:
+          "200": OK
+          "404": NotFound
+      group_lookups:
+        status: statuses
+`
+
+func TestReplaceStage_GroupLookups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry             string
+		expectedEntry     string
+		expectedExtracted map[string]interface{}
+	}{
+		"lookup hit": {
+			entry:         "GET 404 200",
+			expectedEntry: "get NotFound 200",
+			expectedExtracted: map[string]interface{}{
+				"method": "get",
+				"status": "NotFound",
+				"size":   "200",
+			},
+		},
+		"lookup miss falls back to the template": {
+			entry:         "POST 500 12",
+			expectedEntry: "post 500 12",
+			expectedExtracted: map[string]interface{}{
+				"method": "post",
+				"status": "500",
+				"size":   "12",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithGroupLookups), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedEntry, out.Line)
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+}
+
+func TestReplaceStage_NormalizeNewlines(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		mode       string
+		expression string
+		entry      string
+		expected   string
+	}{
+		"crlf to lf": {
+			mode:       "lf",
+			expression: "(?m)^password=(\\S+)$",
+			entry:      "user=frank\r\npassword=secret\r\nlevel=info",
+			expected:   "user=frank\npassword=****\nlevel=info",
+		},
+		"lf to crlf": {
+			mode:       "crlf",
+			expression: "password=(\\S+)",
+			entry:      "user=frank\npassword=secret\r\nlevel=info",
+			expected:   "user=frank\r\npassword=****\r\nlevel=info",
+		},
+		"normalized without a match": {
+			mode:       "lf",
+			expression: "token=(\\S+)",
+			entry:      "user=frank\r\nlevel=info",
+			expected:   "user=frank\nlevel=info",
+		},
+		"disabled by default": {
+			expression: "password=(\\S+)",
+			entry:      "user=frank\r\npassword=secret",
+			expected:   "user=frank\r\npassword=****",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":         tt.expression,
+				"replace":            "****",
+				"normalize_newlines": tt.mode,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
 		})
 	}
+
+	// A reverted or failed replacement keeps the line endings of the original.
+	for name, config := range map[string]map[string]interface{}{
+		"reverted": {"replace": "****", "result_must_match": "^never$"},
+		"failed":   {"replace": `{{ template "missing" }}`},
+	} {
+		config["expression"] = "password=(\\S+)"
+		config["normalize_newlines"] = "lf"
+		st, err := newReplaceStage(util_log.Logger, config, prometheus.DefaultRegisterer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := "user=frank\r\npassword=secret\r\n"
+		out := processEntries(st, newEntry(nil, nil, entry, time.Now()))[0]
+		assert.Equal(t, entry, out.Line, name)
+	}
+}
+
+func TestReplaceStage_SourceLabel(t *testing.T) {
+	t.Parallel()
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":   "^\\S+?(-[a-z0-9]{5})$",
+		"source_label": "pod",
+		"replace":      "",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := "pod loki-7d9f8-x7k2p started"
+	lbls := model.LabelSet{"pod": "loki-7d9f8-x7k2p", "app": "loki"}
+	out := processEntries(st, newEntry(nil, lbls, entry, time.Now()))[0]
+	assert.Equal(t, model.LabelSet{"pod": "loki-7d9f8", "app": "loki"}, out.Labels)
+	assert.Equal(t, entry, out.Line)
+
+	// A missing label leaves everything untouched.
+	out = processEntries(st, newEntry(nil, model.LabelSet{"app": "loki"}, entry, time.Now()))[0]
+	assert.Equal(t, model.LabelSet{"app": "loki"}, out.Labels)
+	assert.Equal(t, entry, out.Line)
+}
+
+var testReplaceYamlWithPromoteAllow = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "^(?P<method>\\S+) (?P<status>\\d{3})"
+      replace: "{{ .Value }}"
+      promote_allow:
+        method: [GET, POST]
+        status: ["200", "404", "500"]
+      promote_other: unknown
+`
+
+func TestReplaceStage_PromoteAllow(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"allowed values": {
+			entry: "GET 404 /index.html",
+			expectedExtracted: map[string]interface{}{
+				"method": "GET",
+				"status": "404",
+			},
+		},
+		"disallowed values": {
+			entry: "PROPFIND 207 /dav",
+			expectedExtracted: map[string]interface{}{
+				"method": "unknown",
+				"status": "unknown",
+			},
+		},
+		"mixed values": {
+			entry: "POST 201 /api",
+			expectedExtracted: map[string]interface{}{
+				"method": "POST",
+				"status": "unknown",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithPromoteAllow), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.entry, out.Line)
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":    "^(?P<status>\\d{3})",
+		"replace":       "{{ .Value }}",
+		"promote_allow": map[string]interface{}{"status": []string{"200"}},
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(nil, nil, "302", time.Now()))[0]
+	assert.Equal(t, map[string]interface{}{"status": "other"}, out.Extracted)
+}
+
+var testReplaceYamlWithSourceJSONArray = `
+---
+pipeline_stages:
+  -
+    json:
+      expressions:
+        hosts:
+  -
+    replace:
+      expression: "^(\\w+)\\."
+      source: hosts
+      source_json_array: true
+      replace: "{{ .Value | ToUpper }}"
+`
+
+func TestReplaceStage_SourceJSONArray(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry         string
+		expectedHosts interface{}
+	}{
+		"array of strings": {
+			entry:         `{"hosts": ["ingester.svc", "querier.svc", "localhost"]}`,
+			expectedHosts: `["INGESTER.svc","QUERIER.svc","localhost"]`,
+		},
+		"array of mixed types": {
+			entry:         `{"hosts": ["distributor.svc", 42, null, {"name": "ruler.svc"}, true]}`,
+			expectedHosts: `["DISTRIBUTOR.svc",42,null,{"name":"ruler.svc"},true]`,
+		},
+		"html characters kept": {
+			entry:         `{"hosts": ["ingester.svc", "<a>", "b&c"]}`,
+			expectedHosts: `["INGESTER.svc","<a>","b&c"]`,
+		},
+		"not an array": {
+			entry:         `{"hosts": "compactor.svc"}`,
+			expectedHosts: "compactor.svc",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithSourceJSONArray), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.entry, out.Line)
+			assert.Equal(t, tt.expectedHosts, out.Extracted["hosts"])
+		})
+	}
+
+	// An array without any match is left as it is.
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":        `^(\w+)\.`,
+		"source":            "hosts",
+		"source_json_array": true,
+		"replace":           "{{ .Value | ToUpper }}",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := `["<a>", "b&c"]`
+	out := processEntries(st, newEntry(map[string]interface{}{"hosts": hosts}, nil, "", time.Now()))[0]
+	assert.Equal(t, hosts, out.Extracted["hosts"])
+}
+
+var testReplaceYamlWithLineTemplate = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: "token=(\\S+)"
+      replace: '{{ if contains "Authorization" .__line__ }}****{{ else }}{{ .Value }}{{ end }}'
+`
+
+func TestReplaceStage_LineTemplateData(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry    string
+		expected string
+	}{
+		"line with authorization header is redacted": {
+			entry:    "GET /api Authorization: Bearer token=abc123",
+			expected: "GET /api Authorization: Bearer token=****",
+		},
+		"other lines are untouched": {
+			entry:    "GET /api?token=abc123",
+			expected: "GET /api?token=abc123",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithLineTemplate), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+			assert.NotContains(t, out.Extracted, replaceLineKey)
+		})
+	}
+}
+
+func TestReplaceStage_SharedTemplate(t *testing.T) {
+	t.Parallel()
+
+	config := map[string]interface{}{
+		"expression": "user=(\\S+)",
+		"replace":    "{{ .Value | ToUpper }}-{{ .tenant }}",
+	}
+	var stages []*replaceStage
+	for i := 0; i < 2; i++ {
+		st, err := newReplaceStage(util_log.Logger, config, prometheus.DefaultRegisterer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stages = append(stages, st.(*stageProcessor).Processor.(*replaceStage))
+	}
+	assert.Same(t, stages[0].template, stages[1].template)
+	assert.Same(t, stages[0].template.Tree, stages[1].template.Tree)
+
+	out := processEntries(toStage(stages[0]), newEntry(map[string]interface{}{"tenant": "a"}, nil, "user=frank", time.Now()))[0]
+	assert.Equal(t, "user=FRANK-a", out.Line)
+	out = processEntries(toStage(stages[1]), newEntry(map[string]interface{}{"tenant": "b"}, nil, "user=john", time.Now()))[0]
+	assert.Equal(t, "user=JOHN-b", out.Line)
+
+	// A different template or function map gets its own parsed template.
+	cache := newTemplateCache()
+	t1, err := cache.parse("{{ .Value }}", functionMap)
+	assert.NoError(t, err)
+	t2, err := cache.parse("{{ .Value }}", extraFunctionMap)
+	assert.NoError(t, err)
+	t3, err := cache.parse("{{ .Value }}!", functionMap)
+	assert.NoError(t, err)
+	assert.NotSame(t, t1, t2)
+	assert.NotSame(t, t1, t3)
+
+	// Parse errors are not cached.
+	_, err = cache.parse("{{ .Value ", functionMap)
+	assert.Error(t, err)
+	assert.Len(t, cache.templates, 3)
+
+	cache = &templateCache{disabled: true}
+	t1, err = cache.parse("{{ .Value }}", functionMap)
+	assert.NoError(t, err)
+	t2, err = cache.parse("{{ .Value }}", functionMap)
+	assert.NoError(t, err)
+	assert.NotSame(t, t1, t2)
+}
+
+func TestReplaceStage_TemplatePanic(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": "user=(\\S+)",
+		"replace":    "{{ .Value }}",
+	}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := st.(*stageProcessor).Processor.(*replaceStage)
+	boom := func(s string) string {
+		if s == "frank" {
+			panic("boom")
+		}
+		return s
+	}
+	rs.template = template.Must(template.New("pipeline_template").Funcs(template.FuncMap{"Boom": recoverFunction(boom)}).Parse("{{ Boom .Value }}"))
+
+	// The panicking line is left unchanged and the pipeline keeps processing.
+	out := processEntries(st,
+		newEntry(nil, nil, "user=frank", time.Now()),
+		newEntry(nil, nil, "user=john", time.Now()),
+	)
+	assert.Equal(t, "user=frank", out[0].Line)
+	assert.Equal(t, "user=john", out[1].Line)
+	assert.Equal(t, float64(1), testutil.ToFloat64(rs.panics))
+
+	// Errors returned by template functions are not counted as panics.
+	rs.template = template.Must(template.New("pipeline_template").Funcs(getReplaceFunctions()).Parse(`{{ fail "nope" }}`))
+	out = processEntries(st, newEntry(nil, nil, "user=frank", time.Now()))
+	assert.Equal(t, "user=frank", out[0].Line)
+	assert.Equal(t, float64(1), testutil.ToFloat64(rs.panics))
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP loki_process_replace_panics_total A count of replace stage template executions that panicked
+# TYPE loki_process_replace_panics_total counter
+loki_process_replace_panics_total 1
+`), "loki_process_replace_panics_total"))
+}
+
+func TestReplaceStage_CollapseWhitespace(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		collapse bool
+		entry    string
+		expected string
+	}{
+		"collapsed": {
+			collapse: true,
+			entry:    "  user frank  logged in from\t10.0.0.1 token abc ",
+			expected: "user logged in from token",
+		},
+		"default keeps whitespace": {
+			entry:    "  user frank  logged in from\t10.0.0.1 token abc ",
+			expected: "  user   logged in from\t token  ",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":          `(?:user (frank)|(10\.0\.0\.1)|token (abc))`,
+				"replace":             "",
+				"collapse_whitespace": tt.collapse,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+var testReplaceYamlWithMatchedRule = `
+---
+pipeline_stages:
+  -
+    replace:
+      expression: '(?P<ipv4>\d+\.\d+\.\d+\.\d+)|(?P<email>[\w.]+@[\w.]+)|token=(\S+)|(?i)password=\S+'
+      replace: "***"
+      whole_match: true
+      matched_rule_key: rule
+`
+
+func TestReplaceStage_MatchedRuleKey(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry        string
+		expectedLine string
+		expectedRule interface{}
+	}{
+		"named rule": {
+			entry:        "connection from 10.0.0.1 refused",
+			expectedLine: "connection from *** refused",
+			expectedRule: "ipv4",
+		},
+		"other named rule": {
+			entry:        "mail sent to frank@example.com",
+			expectedLine: "mail sent to ***",
+			expectedRule: "email",
+		},
+		"unnamed rule": {
+			entry:        "login token=abc123",
+			expectedLine: "login token=***",
+			expectedRule: "2",
+		},
+		"rule without capture group": {
+			entry:        "login PASSWORD=hunter2",
+			expectedLine: "login PASSWORD=hunter2",
+			expectedRule: "3",
+		},
+		"first match wins": {
+			entry:        "frank@example.com from 10.0.0.1",
+			expectedLine: "*** from ***",
+			expectedRule: "email",
+		},
+		"no match": {
+			entry:        "nothing to see",
+			expectedLine: "nothing to see",
+			expectedRule: nil,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithMatchedRule), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedLine, out.Line)
+			assert.Equal(t, tt.expectedRule, out.Extracted["rule"])
+		})
+	}
+}
+
+func TestReplaceStage_MatchedRuleKeyAlternatives(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"shared prefix": {
+			map[string]interface{}{},
+			map[string]interface{}{"user=bob": "0", "uid=42": "1", "[user|uid]=7": "2"},
+		},
+		"shared prefix whole word": {
+			map[string]interface{}{"whole_word": true},
+			map[string]interface{}{"user=bob": "0", "uid=42": "1", "xuid=42": nil},
+		},
+		"shared prefix anchor": {
+			map[string]interface{}{"anchor": ReplaceAnchorStart},
+			map[string]interface{}{"user=bob": "0", "uid=42": "1", "id uid=42": nil},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{
+				"expression":       `user=(\S+)|uid=(\d+)|\[user\|uid\]=(\d+)`,
+				"replace":          "***",
+				"matched_rule_key": "rule",
+			}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			st, err := newReplaceStage(util_log.Logger, config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for entry, expected := range tt.expected {
+				out := processEntries(st, newEntry(nil, nil, entry, time.Now()))[0]
+				assert.Equal(t, expected, out.Extracted["rule"], entry)
+			}
+		})
+	}
+}
+
+func TestSplitAlternatives(t *testing.T) {
+	t.Parallel()
+
+	for expr, expected := range map[string][]string{
+		`user=(\S+)|uid=(\d+)`:      {`user=(\S+)`, `uid=(\d+)`},
+		`(a|b)|[|(]|\||\Q|\E`:       {`(a|b)`, `[|(]`, `\|`, `\Q|\E`},
+		`[]|]|[^]|]|[[:alpha:]|]|x`: {`[]|]`, `[^]|]`, `[[:alpha:]|]`, `x`},
+		`(?i)token=\S+|password`:    {`(?i)token=\S+`, `(?i)password`},
+		`a`:                         {`a`},
+	} {
+		assert.Equal(t, expected, splitAlternatives(expr), expr)
+	}
+}
+
+func TestReplaceStage_SetEmptyOnNoMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		setEmpty          bool
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"no match with flag": {
+			setEmpty: true,
+			entry:    "healthcheck ok",
+			expectedExtracted: map[string]interface{}{
+				"user": "",
+				"ip":   "",
+			},
+		},
+		"no match without flag": {
+			entry:             "healthcheck ok",
+			expectedExtracted: map[string]interface{}{},
+		},
+		"match with flag": {
+			setEmpty: true,
+			entry:    "user=frank ip=10.0.0.1",
+			expectedExtracted: map[string]interface{}{
+				"user": "***",
+				"ip":   "***",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":            `user=(?P<user>\S+) (?:ip=(?P<ip>\S+))`,
+				"replace":               "***",
+				"set_empty_on_no_match": tt.setEmpty,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+}
+
+func TestReplaceStage_SingleMatchPath(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config map[string]interface{}
+		entry  string
+	}{
+		"template": {
+			map[string]interface{}{"expression": `user=(\S+)`, "replace": "{{ .Value | ToUpper }}"},
+			"login user=frank ok",
+		},
+		"named group": {
+			map[string]interface{}{"expression": `user=(?P<user>\S+)`, "replace": "***"},
+			"login user=frank ok",
+		},
+		"empty group": {
+			map[string]interface{}{"expression": `user=(\S*)`, "replace": "anonymous"},
+			"login user= ok",
+		},
+		"non participating group": {
+			map[string]interface{}{"expression": `login(?: user=(\S+))?`, "replace": "***"},
+			"login ok",
+		},
+		"lookup": {
+			map[string]interface{}{
+				"expression":    `status=(?P<status>\d+)`,
+				"replace":       "{{ .Value }}",
+				"lookups":       map[string]interface{}{"codes": map[string]interface{}{"200": "OK"}},
+				"group_lookups": map[string]interface{}{"status": "codes"},
+			},
+			"GET / status=200",
+		},
+		"collapse whitespace": {
+			map[string]interface{}{"expression": `token=(\S+)`, "replace": "", "collapse_whitespace": true},
+			"  login  token=abc  ok ",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := st.(*stageProcessor).Processor.(*replaceStage)
+			matchAllIndex := r.expression.FindAllStringSubmatchIndex(tt.entry, -1)
+			assert.Len(t, matchAllIndex, 1)
+
+			single, singleReplacements, err := r.getReplacedEntry(matchAllIndex, tt.entry, map[string]string{})
+			assert.NoError(t, err)
+			assert.Equal(t, matchAllIndex[0][2] >= 0, singleReplacements.single)
+
+			all, allReplacements, err := r.replaceAll(matchAllIndex, tt.entry, map[string]string{})
+			assert.NoError(t, err)
+			if r.cfg.CollapseWhitespace {
+				all = strings.Join(strings.Fields(all), " ")
+			}
+			assert.Equal(t, all, single)
+
+			assert.Equal(t, len(allReplacements.m) == 1, singleReplacements.single)
+			for captured, replacement := range allReplacements.m {
+				st, ok := singleReplacements.get(captured)
+				assert.True(t, ok)
+				assert.Equal(t, replacement, st)
+			}
+		})
+	}
+}
+
+var testReplaceYamlWithSourcePattern = `
+---
+pipeline_stages:
+  -
+    json:
+      expressions:
+        user_email:
+        user_phone:
+        user_address:
+        request_id:
+  -
+    replace:
+      expression: "^(.+)$"
+      source_pattern: "user_*"
+      replace: '{{ .Value | Sha2Hash "salt" | trunc 8 }}'
+`
+
+func TestReplaceStage_SourcePattern(t *testing.T) {
+	t.Parallel()
+
+	entry := `{"user_email": "frank@example.com", "user_phone": "+33 6 12 34 56 78", "user_address": "1 rue de Rivoli", "request_id": "a1b2c3"}`
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithSourcePattern), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+
+	hash := func(s string) string {
+		h := sha256.Sum256([]byte("salt" + s))
+		return hex.EncodeToString(h[:])[:8]
+	}
+	assert.Equal(t, map[string]interface{}{
+		"user_email":   hash("frank@example.com"),
+		"user_phone":   hash("+33 6 12 34 56 78"),
+		"user_address": hash("1 rue de Rivoli"),
+		"request_id":   "a1b2c3",
+	}, out.Extracted)
+	assert.Equal(t, entry, out.Line)
+}
+
+func TestReplaceStage_SourcePatternError(t *testing.T) {
+	t.Parallel()
+
+	for name, dropOnError := range map[string]bool{
+		"passthrough by default": false,
+		"drop on error":          true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":     "^(.+)$",
+				"source_pattern": "user_*",
+				"replace":        `{{ if eq .Value "fail" }}{{ template "missing" }}{{ else }}****{{ end }}`,
+				"drop_on_error":  dropOnError,
+			}, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted := map[string]interface{}{"user_a": "fail", "user_b": "secret"}
+			out := processEntries(st, newEntry(extracted, nil, "line", time.Now()))
+			if dropOnError {
+				assert.Empty(t, out)
+				return
+			}
+			// The keys after the failing one are still replaced.
+			assert.Equal(t, map[string]interface{}{"user_a": "fail", "user_b": "****"}, out[0].Extracted)
+		})
+	}
+}
+
+func TestReplaceStage_SelectedGroup(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config map[string]interface{}
+	}{
+		"group_index": {
+			map[string]interface{}{
+				"expression":  `(\w+)@(\w+)\.(\w+)`,
+				"replace":     "****",
+				"group_index": 2,
+			},
+		},
+		"group_name": {
+			map[string]interface{}{
+				"expression": `(?P<user>\w+)@(?P<domain>\w+)\.(?P<tld>\w+)`,
+				"replace":    "****",
+				"group_name": "domain",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, "from frank@example.com to bob@grafana.com", time.Now()))[0]
+			assert.Equal(t, "from frank@****.com to bob@****.com", out.Line)
+		})
+	}
+
+	st, err := newReplaceStage(util_log.Logger, tests["group_name"].config, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(nil, nil, "frank@example.com", time.Now()))[0]
+	assert.Equal(t, "frank", out.Extracted["user"])
+	assert.Equal(t, "****", out.Extracted["domain"])
+	assert.Equal(t, "com", out.Extracted["tld"])
+}
+
+func TestReplaceStage_URLDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entry    string
+		expected string
+	}{
+		"encoded spaces and slashes": {
+			`GET /search%20results?q=a%2Fb HTTP/1.1`,
+			`GET [/search results?q=a/b] HTTP/1.1`,
+		},
+		"invalid sequence": {
+			`GET /files/100%zz HTTP/1.1`,
+			`GET [/files/100%zz] HTTP/1.1`,
+		},
+		"not encoded": {
+			`GET /index.html HTTP/1.1`,
+			`GET [/index.html] HTTP/1.1`,
+		},
+	}
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `^GET (\S+)`,
+		"replace":    "[{{ .Value }}]",
+		"url_decode": true,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_DebugSampleRate(t *testing.T) {
+	t.Parallel()
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":        `user=(\S+)`,
+		"replace":           "****",
+		"debug_sample_rate": 0.1,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := st.(*stageProcessor).Processor.(*replaceStage)
+	var buf bytes.Buffer
+	rs.logger = log.NewLogfmtLogger(&buf)
+	rs.sampler = utils.NewRand(42)
+
+	const lines = 10000
+	entries := make([]Entry, 0, lines)
+	for i := 0; i < lines; i++ {
+		line := "user=frank"
+		if i%2 == 0 {
+			line = "anonymous"
+		}
+		entries = append(entries, newEntry(nil, nil, line, time.Now()))
+	}
+	processEntries(st, entries...)
+
+	// Debug may be enabled by other tests, only the sampled decisions are counted.
+	logged := strings.Count(buf.String(), `msg="sampled replace decision"`)
+	assert.InDelta(t, lines/10, logged, lines/100)
+	assert.Contains(t, buf.String(), `matched=true before="user=frank" after="user=****"`)
+	assert.Contains(t, buf.String(), `matched=false before=anonymous`)
+
+	st, err = newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `user=(\S+)`,
+		"replace":    "****",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, st.(*stageProcessor).Processor.(*replaceStage).sampler)
+}
+
+func TestReplaceStage_CountBytes(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":         `secret=(\S+)`,
+		"replace":            "*****",
+		"normalize_newlines": "lf",
+		"count_bytes":        true,
+	}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := st.(*stageProcessor).Processor.(*replaceStage)
+
+	// Shrinks by 9 bytes.
+	processEntries(st, newEntry(nil, nil, "secret=hunter2hunter2", time.Now()))
+	assert.Equal(t, float64(0), testutil.ToFloat64(r.bytesAdded))
+	assert.Equal(t, float64(9), testutil.ToFloat64(r.bytesRemoved))
+
+	// Grows by 3 bytes.
+	processEntries(st, newEntry(nil, nil, "secret=ab", time.Now()))
+	assert.Equal(t, float64(3), testutil.ToFloat64(r.bytesAdded))
+	assert.Equal(t, float64(9), testutil.ToFloat64(r.bytesRemoved))
+
+	// Compared to the original line, the normalized newline removes a byte and
+	// the mask adds 3.
+	processEntries(st, newEntry(nil, nil, "secret=ab\r\n", time.Now()))
+	assert.Equal(t, float64(5), testutil.ToFloat64(r.bytesAdded))
+	assert.Equal(t, float64(9), testutil.ToFloat64(r.bytesRemoved))
+
+	// Lines which do not match are not accounted for.
+	processEntries(st, newEntry(nil, nil, "nothing to see\r\n", time.Now()))
+	assert.Equal(t, float64(5), testutil.ToFloat64(r.bytesAdded))
+	assert.Equal(t, float64(9), testutil.ToFloat64(r.bytesRemoved))
+
+	// The counters are only registered with count_bytes.
+	disabled, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `secret=(\S+)`,
+		"replace":    "*****",
+	}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, disabled.(*stageProcessor).Processor.(*replaceStage).bytesAdded)
+}
+
+func TestReplaceStage_TemplateErrors(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	newStage := func(expression, replace string) Stage {
+		st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+			"expression": expression,
+			"replace":    replace,
+		}, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	broken := newStage(`secret=(\S+)`, `{{ template "missing" }}`)
+	working := newStage(`token=(\S+)`, "*****")
+
+	entry := "secret=hunter2 token=abc"
+	out := processEntries(broken, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, entry, out.Line)
+	processEntries(broken, newEntry(nil, nil, entry, time.Now()))
+	processEntries(broken, newEntry(nil, nil, "nothing to see", time.Now()))
+	out = processEntries(working, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, "secret=hunter2 token=*****", out.Line)
+
+	errs := getReplaceTemplateErrorsMetric(registry)
+	assert.Equal(t, float64(2), testutil.ToFloat64(errs.WithLabelValues(`secret=(\S+)`)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(errs.WithLabelValues(`token=(\S+)`)))
+}
+
+func TestReplaceStage_DropOnError(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		dropOnError bool
+		expected    []string
+		dropped     float64
+	}{
+		"drop on error": {
+			true,
+			[]string{"nothing to see"},
+			1,
+		},
+		"passthrough by default": {
+			false,
+			[]string{"secret=hunter2", "nothing to see"},
+			0,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			registry := prometheus.NewRegistry()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":    `secret=(\S+)`,
+				"replace":       `{{ template "missing" }}`,
+				"drop_on_error": tt.dropOnError,
+			}, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st,
+				newEntry(nil, nil, "secret=hunter2", time.Now()),
+				newEntry(nil, nil, "nothing to see", time.Now()),
+			)
+			lines := make([]string, 0, len(out))
+			for _, e := range out {
+				lines = append(lines, e.Line)
+			}
+			assert.Equal(t, tt.expected, lines)
+			assert.Equal(t, tt.dropped, testutil.ToFloat64(getDropCountMetric(registry).WithLabelValues(replaceDropReason)))
+		})
+	}
+
+	// Lines which render are kept.
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":    `secret=(\S+)`,
+		"replace":       "****",
+		"drop_on_error": true,
+	}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(nil, nil, "secret=hunter2", time.Now()))
+	assert.Equal(t, "secret=****", out[0].Line)
+}
+
+func TestReplaceStage_ExtractOnly(t *testing.T) {
+	t.Parallel()
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":         `(?P<method>GET|POST) (?P<path>\S+)\r\n`,
+		"extract_only":       true,
+		"normalize_newlines": "lf",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := "POST /api/v1/push\r\n"
+	out := processEntries(st, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, entry, out.Line)
+	assert.Equal(t, map[string]interface{}{
+		"method": "POST",
+		"path":   "/api/v1/push",
+	}, out.Extracted)
+}
+
+func TestReplaceStage_PreserveLength(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		replace  string
+		entry    string
+		expected string
+	}{
+		"4 characters": {
+			"*",
+			"token=abcd end",
+			"token=**** end",
+		},
+		"6 characters": {
+			"*",
+			"token=abcdef end",
+			"token=****** end",
+		},
+		"multibyte capture": {
+			"#",
+			"token=日本語 end",
+			"token=### end",
+		},
+		"longer result is repeated": {
+			"xy",
+			"token=abcde end",
+			"token=xyxyx end",
+		},
+		"longer result is cut": {
+			"REDACTED",
+			"token=abc end",
+			"token=RED end",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":      `token=(\S+)`,
+				"replace":         tt.replace,
+				"preserve_length": true,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_MatchIndex(t *testing.T) {
+	t.Parallel()
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `(?:card|cvv)=(\d+)`,
+		"replace":    "redacted_{{ add1 .MatchIndex }}of{{ .MatchCount }}",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st,
+		newEntry(nil, nil, "card=4111 card=4222 cvv=123", time.Now()),
+		newEntry(nil, nil, "cvv=999", time.Now()),
+	)
+	assert.Equal(t, "card=redacted_1of3 card=redacted_2of3 cvv=redacted_3of3", out[0].Line)
+	assert.Equal(t, "cvv=redacted_1of1", out[1].Line)
+
+	// The index is the one of the match, not of the capture group.
+	st, err = newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `(\w+)@(\w+)`,
+		"replace":    "{{ .MatchIndex }}",
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = processEntries(st, newEntry(nil, nil, "frank@grafana bob@loki", time.Now()))
+	assert.Equal(t, "0@0 1@1", out[0].Line)
+}
+
+func TestReplaceStage_MissingKeys(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		extracted map[string]interface{}
+		replace   string
+		expected  string
+	}{
+		"present": {
+			map[string]interface{}{"user": "frank"},
+			`{{ .user | Default "n/a" }}`,
+			"user=frank",
+		},
+		"empty": {
+			map[string]interface{}{"user": ""},
+			`{{ .user | Default "n/a" }}`,
+			"user=n/a",
+		},
+		"missing": {
+			map[string]interface{}{},
+			`{{ .user | Default "n/a" }}`,
+			"user=n/a",
+		},
+		"missing without default": {
+			map[string]interface{}{},
+			`{{ .user }}`,
+			"user=",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression": `user=(\S+)`,
+				"replace":    tt.replace,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(tt.extracted, nil, "user=-", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_KeepPrefixSuffix(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		keepPrefix int
+		keepSuffix int
+		entry      string
+		expected   string
+	}{
+		"long token": {
+			4, 4,
+			"card=4111222233331111",
+			"card=4111********1111",
+		},
+		"short token": {
+			4, 4,
+			"card=4111222",
+			"card=*******",
+		},
+		"exactly prefix and suffix": {
+			2, 2,
+			"card=4111",
+			"card=****",
+		},
+		"prefix only": {
+			2, 0,
+			"card=abcdef",
+			"card=ab****",
+		},
+		"multibyte": {
+			1, 1,
+			"card=日本語です",
+			"card=日***す",
+		},
+		"zero keep values": {
+			0, 0,
+			"card=4111",
+			"card=****",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":      `card=(\S+)`,
+				"replace":         "*",
+				"preserve_length": true,
+				"keep_prefix":     tt.keepPrefix,
+				"keep_suffix":     tt.keepSuffix,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+
+	// The template only receives the middle of the value.
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":  `token=(\S+)`,
+		"replace":     "[{{ .Value }}]",
+		"keep_prefix": 2,
+		"keep_suffix": 1,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(nil, nil, "token=abcdef", time.Now()))[0]
+	assert.Equal(t, "token=ab[cde]f", out.Line)
+}
+
+func TestReplaceStage_MultilineDotAll(t *testing.T) {
+	t.Parallel()
+
+	entry := "panic: secret=abc\ndef end\ngoroutine 1"
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected string
+	}{
+		"dot_all spans lines": {
+			map[string]interface{}{
+				"expression": `secret=(.*)end`,
+				"replace":    "***",
+				"dot_all":    true,
+			},
+			"panic: secret=***end\ngoroutine 1",
+		},
+		"without dot_all": {
+			map[string]interface{}{
+				"expression": `secret=(.*)end`,
+				"replace":    "***",
+			},
+			entry,
+		},
+		"multiline anchors": {
+			map[string]interface{}{
+				"expression": `^(goroutine) \d+$`,
+				"replace":    "thread",
+				"multiline":  true,
+			},
+			"panic: secret=abc\ndef end\nthread 1",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+var testReplaceYamlWithRange = `
+pipeline_stages:
+- replace:
+    range: [4, 8]
+    replace: '[{{ .Value }}]'
+`
+
+func TestReplaceStage_Range(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rng      []int
+		replace  string
+		entry    string
+		expected string
+	}{
+		"in bounds": {
+			[]int{4, 8},
+			"****",
+			"001 4111 OK",
+			"001 **** OK",
+		},
+		"end out of bounds": {
+			[]int{4, 20},
+			"XXXX",
+			"001 4111",
+			"001 XXXX",
+		},
+		"start out of bounds": {
+			[]int{12, 20},
+			"****",
+			"001 4111",
+			"001 4111",
+		},
+		"multibyte": {
+			[]int{2, 4},
+			"{{ .Value | ToUpper }}",
+			"日本straße",
+			"日本STraße",
+		},
+		"multibyte slice": {
+			[]int{1, 3},
+			"--",
+			"日本語です",
+			"日--です",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"range":   tt.rng,
+				"replace": tt.replace,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithRange), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, "001 4111 OK", time.Now()))[0]
+	assert.Equal(t, "001 [4111] OK", out.Line)
+}
+
+func TestReplaceStage_CollectAll(t *testing.T) {
+	t.Parallel()
+
+	entry := "ip=10.0.0.1 ip=10.0.0.2 user=frank ip=10.0.0.1"
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected map[string]interface{}
+	}{
+		"collect all": {
+			map[string]interface{}{
+				"expression":  `ip=(?P<ip>\S+)`,
+				"replace":     "{{ .Value | Hash \"salt\" | trunc 6 }}",
+				"collect_all": true,
+			},
+			map[string]interface{}{
+				"ip": []string{"ef1b64", "a17ee2", "ef1b64"},
+			},
+		},
+		"collect all extract only": {
+			map[string]interface{}{
+				"expression":   `ip=(?P<ip>\S+)|user=(?P<user>\S+)`,
+				"extract_only": true,
+				"collect_all":  true,
+			},
+			map[string]interface{}{
+				"ip":   []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"},
+				"user": []string{"frank"},
+			},
+		},
+		"first match by default": {
+			map[string]interface{}{
+				"expression":   `ip=(?P<ip>\S+)`,
+				"extract_only": true,
+			},
+			map[string]interface{}{
+				"ip": "10.0.0.1",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+		})
+	}
+}
+
+var testReplaceYamlWithCollectAll = `
+pipeline_stages:
+- replace:
+    expression: 'ip=(?P<ip>\S+)'
+    extract_only: true
+    collect_all: true
+- replace:
+    expression: '(user=\S+)'
+    replace: '{{ .Value }} ips=[{{ .ip }}]'
+- template:
+    source: ips
+    template: '{{ Join "," .ip }}'
+`
+
+func TestPipeline_ReplaceCollectAll(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithCollectAll), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, "ip=10.0.0.1 ip=10.0.0.2 user=frank", time.Now()))[0]
+	// The collected slices are not read by the replace templates.
+	assert.Equal(t, "ip=10.0.0.1 ip=10.0.0.2 user=frank ips=[]", out.Line)
+	assert.Equal(t, "10.0.0.1,10.0.0.2", out.Extracted["ips"])
+}
+
+var testReplaceYamlWithReplaceFromKey = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      name:
+- replace:
+    expression: 'code=(\w+)'
+    replace_from_key: name
+`
+
+func TestReplaceStage_ReplaceFromKey(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		extracted map[string]interface{}
+		entry     string
+		expected  string
+	}{
+		"value": {
+			map[string]interface{}{"name": "not_found"},
+			"code=E404 path=/",
+			"code=not_found path=/",
+		},
+		"template": {
+			map[string]interface{}{"name": "{{ .Value | ToLower }}-{{ .service }}", "service": "api"},
+			"code=E404 path=/",
+			"code=e404-api path=/",
+		},
+		"environment is not readable": {
+			map[string]interface{}{"name": `{{ env "HOME" }}`},
+			"code=E404 path=/",
+			"code=E404 path=/",
+		},
+		"missing key": {
+			map[string]interface{}{},
+			"code=E404 path=/",
+			"code=E404 path=/",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":       `code=(\w+)`,
+				"replace_from_key": "name",
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(tt.extracted, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithReplaceFromKey), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, "code=u123 name=frank", time.Now()))[0]
+	assert.Equal(t, "code=frank name=frank", out.Line)
+}
+
+func TestReplaceStage_WholeWord(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expression string
+		wholeWord  bool
+		entry      string
+		expected   string
+	}{
+		"whole word": {
+			`(admin)`,
+			true,
+			"user admin logged in as administrator, admin.",
+			"user ***** logged in as administrator, *****.",
+		},
+		"substring by default": {
+			`(admin)`,
+			false,
+			"user admin logged in as administrator",
+			"user ***** logged in as *****istrator",
+		},
+		"alternation": {
+			`(root|admin)`,
+			true,
+			"root admin rooted badmin",
+			"***** ***** rooted badmin",
+		},
+		"non word characters at the edges never match": {
+			`(-admin)`,
+			true,
+			"user -admin",
+			"user -admin",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression": tt.expression,
+				"replace":    "*****",
+				"whole_word": tt.wholeWord,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestCheckReplaceComplexity(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		expression string
+		err        error
+	}{
+		"benign": {
+			`^(?P<ip>\d+\.\d+\.\d+\.\d+) - (?P<user>\S+)`,
+			nil,
+		},
+		"optional group": {
+			`(\w+)?@(\w+)`,
+			nil,
+		},
+		"nested quantifiers": {
+			`^(a+)+$`,
+			errors.Errorf(ErrReplaceTooComplex, "2 nested quantifiers, the maximum is 1"),
+		},
+		"nested repetition": {
+			`((ab){2,5})*`,
+			errors.Errorf(ErrReplaceTooComplex, "2 nested quantifiers, the maximum is 1"),
+		},
+		"large repetition": {
+			`\w{1000}`,
+			errors.Errorf(ErrReplaceTooComplex, "1002 instructions, the maximum is 1000"),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			err := checkReplaceComplexity(tt.expression)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
+
+// TestReplaceComplexityCheck is not parallel as it toggles the package-level
+// flag, parallel tests only resume once it is done.
+func TestReplaceComplexityCheck(t *testing.T) {
+	config := &ReplaceConfig{Expression: `^(a+)+$`}
+	_, err := validateReplaceConfig(config)
+	assert.NoError(t, err, "the check is opt-in")
+
+	ReplaceComplexityCheck = true
+	defer func() { ReplaceComplexityCheck = false }()
+	_, err = validateReplaceConfig(config)
+	assert.Error(t, err)
+}
+
+var testReplaceYamlWithPreserveOriginal = `
+pipeline_stages:
+- json:
+    expressions:
+      card:
+- replace:
+    expression: "(\\d{12})\\d{4}"
+    replace: '************'
+    preserve_original_as: raw_line
+- replace:
+    expression: "(.*)"
+    source: card
+    replace: 'redacted'
+    preserve_original_as: raw_card
+`
+
+func TestReplaceStage_PreserveOriginalAs(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithPreserveOriginal), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := `{"card":"4111111111111111"}`
+	out := processEntries(pl,
+		newEntry(nil, nil, line, time.Now()),
+		newEntry(nil, nil, `{"msg":"no card"}`, time.Now()),
+	)
+	assert.Equal(t, `{"card":"************1111"}`, out[0].Line)
+	assert.Equal(t, "redacted", out[0].Extracted["card"])
+	assert.Equal(t, push.LabelsAdapter{
+		{Name: "raw_line", Value: line},
+		{Name: "raw_card", Value: "4111111111111111"},
+	}, out[0].StructuredMetadata)
+
+	// Nothing is recorded when nothing is replaced.
+	assert.Equal(t, `{"msg":"no card"}`, out[1].Line)
+	assert.Empty(t, out[1].StructuredMetadata)
+}
+
+var testReplaceYamlWithPerGroup = `
+pipeline_stages:
+- replace:
+    expression: "^(?P<ip>\\S+) - (?P<user>\\S+) \\[(?P<time>[^\\]]+)\\]"
+    per_group:
+      ip: '{{ regexReplaceAll "\\d+$" .Value "0" }}'
+      user: '{{ .Value | ToUpper }}'
+`
+
+func TestReplaceStage_PerGroup(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testReplaceYamlWithPerGroup), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, "11.11.11.11 - frank [25/Jan/2000:14:00:01 -0500]", time.Now()))[0]
+	assert.Equal(t, "11.11.11.0 - FRANK [25/Jan/2000:14:00:01 -0500]", out.Line)
+	assert.Equal(t, map[string]interface{}{"ip": "11.11.11.0", "user": "FRANK", "time": "25/Jan/2000:14:00:01 -0500"}, out.Extracted)
+
+	// The groups without their own template are rendered with Replace.
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `(?P<ip>\d+\.\d+\.\d+\.\d+)|user=(?P<user>\w+)|id=(?P<id>\d+)`,
+		"replace":    "*",
+		"per_group":  map[string]string{"ip": "<ip>", "user": "<user>"},
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = processEntries(st, newEntry(nil, nil, "10.0.0.1 user=frank id=42", time.Now()))[0]
+	assert.Equal(t, "<ip> user=<user> id=*", out.Line)
+
+	// Invalid templates are rejected when the stage is created.
+	_, err = newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `(?P<ip>\S+)`,
+		"per_group":  map[string]string{"ip": "{{ .Value"},
+	}, prometheus.DefaultRegisterer)
+	assert.ErrorContains(t, err, `failed to parse per_group template of "ip"`)
+}
+
+func TestReplaceStage_GetRejected(t *testing.T) {
+	t.Parallel()
+
+	// Get reads the extracted values in the template stage only.
+	_, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `(?P<ip>\S+)`,
+		"replace":    `{{ Get "user.name" }}`,
+	}, prometheus.DefaultRegisterer)
+	assert.ErrorContains(t, err, `function "Get" not defined`)
+}
+
+func TestReplaceStage_Deterministic(t *testing.T) {
+	t.Parallel()
+
+	newStage := func(deterministic bool) Stage {
+		st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+			"expression":    `user=(\S+)`,
+			"replace":       `{{ UUID }}/{{ randAlphaNum 8 }}/{{ randInt 0 1000000 }}/{{ randBytes 8 }}/{{ shuffle "abcdefghijklmnop" }}`,
+			"deterministic": deterministic,
+		}, prometheus.DefaultRegisterer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	replace := func(st Stage, line string) string {
+		return processEntries(st, newEntry(nil, nil, line, time.Now()))[0].Line
+	}
+
+	// Identical lines are replaced identically, whichever goroutine replaces them.
+	st := newStage(true)
+	const line = "user=frank logged in, user=alice logged out"
+	results := make([]string, 16)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = replace(st, line)
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		assert.Equal(t, results[0], result)
+	}
+	assert.Equal(t, results[0], replace(newStage(true), line))
+	assert.NotContains(t, results[0], "frank")
+
+	// Different values or lines are replaced differently.
+	values := strings.Split(strings.TrimPrefix(results[0], "user="), " logged in, user=")
+	assert.NotEqual(t, values[0], strings.TrimSuffix(values[1], " logged out"))
+	assert.NotEqual(t, results[0], replace(st, "user=frank logged in, user=bob logged out"))
+
+	// The functions draw from the global source otherwise.
+	st = newStage(false)
+	assert.NotEqual(t, replace(st, line), replace(st, line))
+}
+
+func TestReplaceStage_DeterministicSampling(t *testing.T) {
+	t.Parallel()
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":        `(\d+)`,
+		"replace":           "*",
+		"debug_sample_rate": 0.5,
+		"deterministic":     true,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := st.(*stageProcessor).Processor.(*replaceStage)
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		line := "request " + strconv.Itoa(i)
+		decision := r.sampled(line)
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, decision, r.sampled(line))
+		}
+		if decision {
+			sampled++
+		}
+	}
+	// The hash spreads the decisions over the lines at about the rate.
+	assert.InDelta(t, 500, sampled, 100)
+}
+
+func TestReplaceStage_Binary(t *testing.T) {
+	t.Parallel()
+
+	newStage := func(binary bool) Stage {
+		st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+			"expression": `secret=(\w+)`,
+			"source":     "payload",
+			"replace":    "{{ .Value | ToUpper }}",
+			"binary":     binary,
+		}, prometheus.DefaultRegisterer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	payload := []byte("\x00\xff\xfesecret=abc \x80\xc3")
+
+	// The bytes around the replaced span, not valid UTF-8, are preserved.
+	out := processEntries(newStage(true), newEntry(map[string]interface{}{"payload": payload}, nil, "", time.Now()))[0]
+	assert.Equal(t, []byte("\x00\xff\xfesecret=ABC \x80\xc3"), out.Extracted["payload"])
+
+	// String values are written back as strings.
+	out = processEntries(newStage(true), newEntry(map[string]interface{}{"payload": string(payload)}, nil, "", time.Now()))[0]
+	assert.Equal(t, "\x00\xff\xfesecret=ABC \x80\xc3", out.Extracted["payload"])
+
+	// Bytes cannot be converted to a string otherwise.
+	out = processEntries(newStage(false), newEntry(map[string]interface{}{"payload": payload}, nil, "", time.Now()))[0]
+	assert.Equal(t, payload, out.Extracted["payload"])
+}
+
+func TestReplaceStage_MaxInputBytes(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		maxInputBytes int
+		entry         string
+		expected      string
+	}{
+		"under the limit": {
+			16,
+			"user=frank id=1",
+			"user=*** id=1",
+		},
+		"at the limit": {
+			15,
+			"user=frank id=1",
+			"user=*** id=1",
+		},
+		"over the limit": {
+			14,
+			"user=frank id=1",
+			"user=frank id=1",
+		},
+		"large line over the limit": {
+			1024,
+			strings.Repeat("user=frank ", 1000),
+			strings.Repeat("user=frank ", 1000),
+		},
+		"no limit": {
+			0,
+			strings.Repeat("user=frank ", 1000),
+			strings.Repeat("user=*** ", 1000),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression":      `user=(\w+)`,
+				"replace":         "***",
+				"max_input_bytes": tt.maxInputBytes,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_Metric(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		expected map[string]float64
+	}{
+		"every value": {
+			map[string]interface{}{},
+			map[string]float64{"200": 3, "404": 1, "500": 2},
+		},
+		"allow-list": {
+			map[string]interface{}{"metric_label_allow": []string{"200", "500"}},
+			map[string]float64{"200": 3, "500": 2, "other": 1},
+		},
+		"cap": {
+			map[string]interface{}{"metric_max_label_values": 2},
+			map[string]float64{"200": 3, "404": 1, "other": 2},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{
+				"expression":              `status=(?P<status>\d+)`,
+				"replace":                 "{{ .Value }}",
+				"metric_name":             "http_statuses_total",
+				"metric_label_from_group": "status",
+			}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			registry := prometheus.NewRegistry()
+			st, err := newReplaceStage(util_log.Logger, config, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			processEntries(st,
+				newEntry(nil, nil, "status=200 status=404", time.Now()),
+				newEntry(nil, nil, "status=200", time.Now()),
+				newEntry(nil, nil, "no status", time.Now()),
+				newEntry(nil, nil, "status=500 status=200 status=500", time.Now()),
+			)
+			counter := st.(*stageProcessor).Processor.(*replaceStage).matches
+			assert.Equal(t, len(tt.expected), testutil.CollectAndCount(counter))
+			for value, count := range tt.expected {
+				assert.Equal(t, count, testutil.ToFloat64(counter.WithLabelValues(value)), value)
+			}
+		})
+	}
+}
+
+func TestReplaceStage_DigitPlaceholder(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		entry    string
+		expected string
+	}{
+		"capture group": {
+			map[string]interface{}{"expression": `^\S+ (\S+)`},
+			"GET /users/12345/orders/67 HTTP/1.1",
+			"GET /users/:id/orders/:id HTTP/1.1",
+		},
+		"whole match": {
+			map[string]interface{}{"expression": `/users/\d+(?:/\w+/\d+)*`, "whole_match": true},
+			"GET /users/12345/orders/67/items/8 HTTP/1.1",
+			"GET /users/:id/orders/:id/items/:id HTTP/1.1",
+		},
+		"mixed segments": {
+			map[string]interface{}{"expression": `path=(\S+)`},
+			"path=/api/v2/tenants/42a7/report-2024-05.csv",
+			"path=/api/v:id/tenants/:ida:id/report-:id-:id.csv",
+		},
+		"every match": {
+			map[string]interface{}{"expression": `id=(\S+)`},
+			"id=1001 user=frank id=1002",
+			"id=:id user=frank id=:id",
+		},
+		"no digits": {
+			map[string]interface{}{"expression": `^\S+ (\S+)`},
+			"GET /users/me HTTP/1.1",
+			"GET /users/me HTTP/1.1",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tt.config["digit_placeholder"] = ":id"
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_Anchor(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		entry    string
+		expected string
+	}{
+		"none": {
+			map[string]interface{}{},
+			"42 items in 7 boxes",
+			"* items in * boxes",
+		},
+		"start": {
+			map[string]interface{}{"anchor": "start"},
+			"42 items in 7 boxes",
+			"* items in 7 boxes",
+		},
+		"start not matching": {
+			map[string]interface{}{"anchor": "start"},
+			"items: 42",
+			"items: 42",
+		},
+		"end": {
+			map[string]interface{}{"anchor": "end"},
+			"order 42 shipped in 7",
+			"order 42 shipped in *",
+		},
+		"both": {
+			map[string]interface{}{"anchor": "both"},
+			"42",
+			"*",
+		},
+		"both not matching": {
+			map[string]interface{}{"anchor": "both"},
+			"42 items",
+			"42 items",
+		},
+		"alternation": {
+			map[string]interface{}{"expression": `(\d+)|(\w+)`, "anchor": "start"},
+			"frank 42",
+			"* 42",
+		},
+		"multiline": {
+			map[string]interface{}{"anchor": "start", "multiline": true},
+			"1 first\n2 second",
+			"* first\n* second",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{"expression": `(\d+)`, "replace": "*"}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			st, err := newReplaceStage(util_log.Logger, config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_ThenExtract(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config    map[string]interface{}
+		entry     string
+		extracted map[string]interface{}
+		line      string
+	}{
+		"normalized path segments": {
+			map[string]interface{}{
+				"expression":   `^\S+ (\S+)`,
+				"replace":      `{{ .Value | ToLower | trimSuffix "/" }}`,
+				"then_extract": `^\S+ /api/(?P<version>v\d+)/(?P<resource>\w+)(?:/(?P<id>[^/\s]+))?`,
+			},
+			"GET /API/V2/Users/Frank/ HTTP/1.1",
+			map[string]interface{}{"version": "v2", "resource": "users", "id": "frank"},
+			"GET /api/v2/users/frank HTTP/1.1",
+		},
+		"optional segment missing": {
+			map[string]interface{}{
+				"expression":   `^\S+ (\S+)`,
+				"replace":      `{{ .Value | ToLower | trimSuffix "/" }}`,
+				"then_extract": `^\S+ /api/(?P<version>v\d+)/(?P<resource>\w+)(?:/(?P<id>[^/\s]+))?`,
+			},
+			"GET /API/V2/Users HTTP/1.1",
+			map[string]interface{}{"version": "v2", "resource": "users"},
+			"GET /api/v2/users HTTP/1.1",
+		},
+		"templatized route": {
+			map[string]interface{}{
+				"expression":        `^\S+ (\S+)`,
+				"digit_placeholder": ":id",
+				"then_extract":      `^(?P<method>\S+) (?P<route>\S+)`,
+			},
+			"DELETE /users/12345/orders/67 HTTP/1.1",
+			map[string]interface{}{"method": "DELETE", "route": "/users/:id/orders/:id"},
+			"DELETE /users/:id/orders/:id HTTP/1.1",
+		},
+		"follow-up not matching": {
+			map[string]interface{}{
+				"expression":   `^\S+ (\S+)`,
+				"replace":      `{{ .Value | ToLower }}`,
+				"then_extract": `^\S+ /api/(?P<version>v\d+)`,
+			},
+			"GET /Health HTTP/1.1",
+			map[string]interface{}{},
+			"GET /health HTTP/1.1",
+		},
+		"expression not matching": {
+			map[string]interface{}{
+				"expression":   `^GET (\S+)`,
+				"replace":      `{{ .Value | ToLower }}`,
+				"then_extract": `(?P<path>/\S+)`,
+			},
+			"POST /Login HTTP/1.1",
+			map[string]interface{}{},
+			"POST /Login HTTP/1.1",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, tt.config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.extracted, out.Extracted)
+			assert.Equal(t, tt.line, out.Line)
+		})
+	}
+
+	// The follow-up expression is compiled when the stage is created.
+	_, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":   `(\S+)`,
+		"then_extract": `(?P<id>\d+`,
+	}, prometheus.DefaultRegisterer)
+	assert.ErrorContains(t, err, ErrReplaceThenExtractRegex)
+	_, err = newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":   `(\S+)`,
+		"then_extract": `(\d+)`,
+	}, prometheus.DefaultRegisterer)
+	assert.EqualError(t, err, ErrReplaceThenExtractNames)
+}
+
+func TestReplaceStage_TemplateGaps(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		entry    string
+		expected string
+	}{
+		"mask gaps": {
+			map[string]interface{}{"gap_replace": `{{ repeat (len .Gap) "*" }}`},
+			"client 10.0.0.1 -> 10.0.0.2 ok",
+			"*******10.0.0.1****10.0.0.2***",
+		},
+		"matches at both ends": {
+			map[string]interface{}{"gap_replace": "|"},
+			"10.0.0.1 and 10.0.0.2",
+			"10.0.0.1|10.0.0.2",
+		},
+		"single match": {
+			map[string]interface{}{"gap_replace": "[{{ .Gap | trim }}]"},
+			"from 10.0.0.1 ",
+			"[from]10.0.0.1[]",
+		},
+		"replaced matches": {
+			map[string]interface{}{"replace": "<ip>", "gap_replace": "{{ .Gap | ToUpper }}"},
+			"client 10.0.0.1 -> 10.0.0.2 ok",
+			"CLIENT <ip> -> <ip> OK",
+		},
+		"dropped gaps": {
+			map[string]interface{}{"replace": "{{ .Value }};"},
+			"client 10.0.0.1 -> 10.0.0.2 ok",
+			"10.0.0.1;10.0.0.2;",
+		},
+		"no match": {
+			map[string]interface{}{"gap_replace": "*"},
+			"no address here",
+			"no address here",
+		},
+		"verbatim by default": {
+			map[string]interface{}{"template_gaps": false},
+			"client 10.0.0.1 -> 10.0.0.2 ok",
+			"client 10.0.0.1 -> 10.0.0.2 ok",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{
+				"expression":    `(\d+\.\d+\.\d+\.\d+)`,
+				"replace":       "{{ .Value }}",
+				"template_gaps": true,
+			}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			st, err := newReplaceStage(util_log.Logger, config, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_ResultMustMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		policy   string
+		expected []string
+		dropped  float64
+	}{
+		"revert": {
+			"revert",
+			[]string{"ip=10.1.2.0", "ip=fe80::1", "user=frank"},
+			0,
+		},
+		"revert by default": {
+			"",
+			[]string{"ip=10.1.2.0", "ip=fe80::1", "user=frank"},
+			0,
+		},
+		"drop": {
+			"drop",
+			[]string{"ip=10.1.2.0", "user=frank"},
+			1,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			registry := prometheus.NewRegistry()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				// Zeroes the last group of digits, which only keeps IPv4
+				// addresses valid.
+				"expression":        `ip=(\S+)`,
+				"replace":           `{{ regexReplaceAll "[0-9]+$" .Value "0" }}`,
+				"result_must_match": `^ip=\d+\.\d+\.\d+\.\d+$`,
+				"result_policy":     tt.policy,
+			}, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st,
+				newEntry(nil, nil, "ip=10.1.2.3", time.Now()),
+				newEntry(nil, nil, "ip=fe80::1", time.Now()),
+				newEntry(nil, nil, "user=frank", time.Now()),
+			)
+			lines := make([]string, 0, len(out))
+			for _, e := range out {
+				lines = append(lines, e.Line)
+			}
+			assert.Equal(t, tt.expected, lines)
+			assert.Equal(t, tt.dropped, testutil.ToFloat64(getDropCountMetric(registry).WithLabelValues(replaceResultDropReason)))
+		})
+	}
+
+	// The elements of a JSON array are reverted individually.
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":        `^(\S+)$`,
+		"replace":           `{{ regexReplaceAll "[0-9]+$" .Value "0" }}`,
+		"source":            "ips",
+		"source_json_array": true,
+		"result_must_match": `^\d+\.\d+\.\d+\.\d+$`,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"ips": `["10.1.2.3","fe80::1"]`}, nil, "", time.Now()))[0]
+	assert.Equal(t, `["10.1.2.0","fe80::1"]`, out.Extracted["ips"])
+
+	_, err = newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":        `(\S+)`,
+		"result_must_match": `(\d+`,
+	}, prometheus.DefaultRegisterer)
+	assert.ErrorContains(t, err, ErrReplaceResultRegex)
+}
+
+func TestReplaceStage_LineIndex(t *testing.T) {
+	t.Parallel()
+
+	trace := "java.lang.IllegalStateException: token=abc123\n\tat com.acme.Auth.check(Auth.java:42)\n\tat com.acme.Main.main(Main.java:7)"
+	tests := map[string]struct {
+		lineIndex int
+		entry     string
+		expected  string
+	}{
+		"first line": {
+			0,
+			trace,
+			"java.lang.IllegalStateException: token=****\n\tat com.acme.Auth.check(Auth.java:42)\n\tat com.acme.Main.main(Main.java:7)",
+		},
+		"middle line": {
+			1,
+			"token=a\ntoken=b\ntoken=c",
+			"token=a\ntoken=****\ntoken=c",
+		},
+		"last line": {
+			-1,
+			"token=a\ntoken=b\ntoken=c",
+			"token=a\ntoken=b\ntoken=****",
+		},
+		"last line before trailing newline": {
+			-1,
+			"token=a\ntoken=b\n",
+			"token=a\ntoken=****\n",
+		},
+		"single line": {
+			-1,
+			"token=a",
+			"token=****",
+		},
+		"out of range": {
+			3,
+			"token=a\ntoken=b\ntoken=c",
+			"token=a\ntoken=b\ntoken=c",
+		},
+		"negative out of range": {
+			-4,
+			"token=a\ntoken=b\ntoken=c",
+			"token=a\ntoken=b\ntoken=c",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression": `token=(\w+)`,
+				"replace":    "****",
+				"line_index": tt.lineIndex,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_SprigFunctions(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		replace  string
+		expected string
+	}{
+		"upper": {
+			`{{ .Value | upper }}`,
+			"user=FRANK",
+		},
+		"trunc": {
+			`{{ .Value | sha256sum | trunc 8 }}`,
+			"user=77646f5a",
+		},
+		"b64enc": {
+			`{{ .Value | b64enc }}`,
+			"user=ZnJhbms=",
+		},
+		"list and join": {
+			`{{ list "x" .Value | join "-" }}`,
+			"user=x-frank",
+		},
+		"ternary": {
+			`{{ eq .Value "frank" | ternary "admin" "guest" }}`,
+			"user=admin",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+				"expression": `user=(\w+)`,
+				"replace":    tt.replace,
+			}, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, nil, "user=frank", time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Line)
+		})
+	}
+}
+
+func TestReplaceStage_CaptureCountHistogram(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":              `token=(\w+)`,
+		"replace":                 "****",
+		"capture_count_histogram": "replace_tokens_per_line",
+	}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processEntries(st,
+		newEntry(nil, nil, "token=a", time.Now()),
+		newEntry(nil, nil, "token=a token=b token=c", time.Now()),
+		newEntry(nil, nil, "no token", time.Now()),
+		newEntry(nil, nil, strings.Repeat("token=a ", 20), time.Now()),
+	)
+
+	// The elements of a JSON array are observed as a single line.
+	arraySt, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression":              `token=(\w+)`,
+		"replace":                 "****",
+		"source":                  "tokens",
+		"source_json_array":       true,
+		"capture_count_histogram": "replace_tokens_per_line",
+	}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processEntries(arraySt, newEntry(map[string]interface{}{"tokens": `["token=a","token=b token=c"]`}, nil, "", time.Now()))
+
+	expected := `
+# HELP promtail_custom_replace_tokens_per_line The number of matches per line of a replace stage
+# TYPE promtail_custom_replace_tokens_per_line histogram
+promtail_custom_replace_tokens_per_line_bucket{le="1"} 2
+promtail_custom_replace_tokens_per_line_bucket{le="4"} 4
+promtail_custom_replace_tokens_per_line_bucket{le="16"} 4
+promtail_custom_replace_tokens_per_line_bucket{le="64"} 5
+promtail_custom_replace_tokens_per_line_bucket{le="256"} 5
+promtail_custom_replace_tokens_per_line_bucket{le="1024"} 5
+promtail_custom_replace_tokens_per_line_bucket{le="4096"} 5
+promtail_custom_replace_tokens_per_line_bucket{le="+Inf"} 5
+promtail_custom_replace_tokens_per_line_sum 27
+promtail_custom_replace_tokens_per_line_count 5
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "promtail_custom_replace_tokens_per_line"))
 }
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
@@ -14,6 +15,7 @@ import (
 
 const (
 	ErrSamplingStageInvalidRate = "sampling stage failed to parse rate,Sampling Rate must be between 0.0 and 1.0, received %f"
+	ErrSamplingStageEmptySource = "empty source in sampling stage"
 )
 const maxRandomNumber = ^(uint64(1) << 63) // i.e. 0x7fffffffffffffff
 
@@ -26,6 +28,10 @@ type SamplingConfig struct {
 	DropReason *string `mapstructure:"drop_counter_reason"`
 	//
 	SamplingRate float64 `mapstructure:"rate"`
+	// Source is the extracted key, e.g. a trace or session identifier, whose
+	// hash decides whether a line is kept, so that the lines with the same value
+	// are kept or dropped together. The lines without it are sampled randomly.
+	Source *string `mapstructure:"source"`
 }
 
 // validateSamplingConfig validates the SamplingConfig for the sampleStage
@@ -36,6 +42,9 @@ func validateSamplingConfig(cfg *SamplingConfig) error {
 	if cfg.SamplingRate < 0.0 || cfg.SamplingRate > 1.0 {
 		return errors.Errorf(ErrSamplingStageInvalidRate, cfg.SamplingRate)
 	}
+	if cfg.Source != nil && *cfg.Source == "" {
+		return errors.New(ErrSamplingStageEmptySource)
+	}
 
 	return nil
 }
@@ -80,7 +89,7 @@ func (m *samplingStage) Run(in chan Entry) chan Entry {
 	go func() {
 		defer close(out)
 		for e := range in {
-			if m.isSampled() {
+			if m.isSampled(e.Extracted) {
 				out <- e
 				continue
 			}
@@ -93,9 +102,35 @@ func (m *samplingStage) Run(in chan Entry) chan Entry {
 // code from jaeger project.
 // github.com/uber/jaeger-client-go@v2.30.0+incompatible/sampler.go:144
 // func (s *ProbabilisticSampler) IsSampled(id TraceID, operation string) (bool, []Tag)
-func (m *samplingStage) isSampled() bool {
+func (m *samplingStage) isSampled(extracted map[string]interface{}) bool {
+	if id, ok := m.sourceID(extracted); ok {
+		return m.samplingBoundary >= id
+	}
 	return m.samplingBoundary >= m.randomID()&maxRandomNumber
 }
+
+// sourceID returns the identifier derived from the hash of the source value, if
+// it is extracted.
+func (m *samplingStage) sourceID(extracted map[string]interface{}) (uint64, bool) {
+	if m.cfg.Source == nil {
+		return 0, false
+	}
+	v, ok := extracted[*m.cfg.Source]
+	if !ok {
+		return 0, false
+	}
+	s, err := getString(v)
+	if err != nil {
+		return 0, false
+	}
+	// Like the random identifiers, 0 is avoided so that a 0 rate drops every line.
+	id := xxhash.Sum64String(s) & maxRandomNumber
+	if id == 0 {
+		id = 1
+	}
+	return id, true
+}
+
 func (m *samplingStage) randomID() uint64 {
 	val := m.randomNumber()
 	for val == 0 {
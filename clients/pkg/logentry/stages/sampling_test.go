@@ -38,6 +38,57 @@ func TestSamplingPipeline(t *testing.T) {
 
 }
 
+var testSamplingYamlWithSource = `
+pipeline_stages:
+- logfmt:
+    mapping:
+      trace_id:
+- sampling:
+    rate: 0.25
+    source: trace_id
+`
+
+func TestSamplingPipeline_Source(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testSamplingYamlWithSource), &plName, registry)
+	require.NoError(t, err)
+
+	// Every trace has 4 lines, with other lines in between.
+	entries := make([]Entry, 0)
+	for i := 0; i < 4; i++ {
+		for trace := 0; trace < 1000; trace++ {
+			entries = append(entries, newEntry(nil, nil, fmt.Sprintf("trace_id=%d step=%d", trace, i), time.Now()))
+		}
+	}
+	out := processEntries(pl, entries...)
+
+	kept := map[string]int{}
+	for _, e := range out {
+		kept[e.Extracted["trace_id"].(string)]++
+	}
+	// The lines of a trace are kept or dropped together.
+	for trace, lines := range kept {
+		assert.Equal(t, 4, lines, trace)
+	}
+	// rate = 0.25, 1000 traces, the theoretical number of traces kept is 250.
+	assert.GreaterOrEqual(t, len(kept), 200)
+	assert.LessOrEqual(t, len(kept), 300)
+
+	// The same traces are kept by another pipeline.
+	other, err := NewPipeline(util_log.Logger, loadConfig(testSamplingYamlWithSource), &plName, prometheus.NewRegistry())
+	require.NoError(t, err)
+	assert.Equal(t, len(out), len(processEntries(other, entries...)))
+
+	// The lines without the source are sampled randomly.
+	entries = entries[:0]
+	for i := 0; i < 100; i++ {
+		entries = append(entries, newEntry(nil, nil, "step=1", time.Now()))
+	}
+	out = processEntries(pl, entries...)
+	assert.Greater(t, len(out), 0)
+	assert.Less(t, len(out), 100)
+}
+
 func Test_validateSamplingConfig(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -51,6 +102,14 @@ func Test_validateSamplingConfig(t *testing.T) {
 			},
 			wantErr: fmt.Errorf(ErrSamplingStageInvalidRate, 12.0),
 		},
+		{
+			name: "Empty source",
+			config: &SamplingConfig{
+				SamplingRate: 0.5,
+				Source:       new(string),
+			},
+			wantErr: fmt.Errorf(ErrSamplingStageEmptySource),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,192 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	oaerrors "github.com/go-openapi/errors"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	json "github.com/json-iterator/go"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptySchemaStageConfig = "empty schema stage configuration"
+	ErrSchemaRequired         = "schema stage requires a `schema`"
+	ErrCouldNotParseSchema    = "could not parse JSON schema"
+	ErrEmptySchemaStageSource = "empty source"
+	ErrSchemaInvalidAction    = "schema stage action must be one of `drop` or `label`, got %q"
+)
+
+const (
+	SchemaActionDrop  = "drop"
+	SchemaActionLabel = "label"
+)
+
+var (
+	defaultSchemaDropReason = "schema_stage"
+	defaultSchemaErrorLabel = "schema_error"
+)
+
+// SchemaConfig contains the configuration for a schemaStage
+type SchemaConfig struct {
+	// Schema is a JSON Schema document the extracted values are validated against.
+	Schema string `mapstructure:"schema"`
+	// Source validates the object held by an extracted value, either a map or a
+	// JSON string, instead of the whole extracted map.
+	Source *string `mapstructure:"source"`
+	// Action taken on invalid lines, `drop` (default) or `label`.
+	Action     string  `mapstructure:"action"`
+	DropReason *string `mapstructure:"drop_counter_reason"`
+	// Label is set to `true` on invalid lines when the action is `label`.
+	Label *string `mapstructure:"label"`
+}
+
+// validateSchemaConfig validates the SchemaConfig and returns the compiled schema validator
+func validateSchemaConfig(cfg *SchemaConfig) (*validate.SchemaValidator, error) {
+	if cfg == nil {
+		return nil, errors.New(ErrEmptySchemaStageConfig)
+	}
+	if cfg.Schema == "" {
+		return nil, errors.New(ErrSchemaRequired)
+	}
+	if cfg.Source != nil && *cfg.Source == "" {
+		return nil, errors.New(ErrEmptySchemaStageSource)
+	}
+
+	switch cfg.Action {
+	case "":
+		cfg.Action = SchemaActionDrop
+	case SchemaActionDrop, SchemaActionLabel:
+	default:
+		return nil, errors.Errorf(ErrSchemaInvalidAction, cfg.Action)
+	}
+	if cfg.DropReason == nil || *cfg.DropReason == "" {
+		cfg.DropReason = &defaultSchemaDropReason
+	}
+	if cfg.Label == nil {
+		cfg.Label = &defaultSchemaErrorLabel
+	}
+	if !model.LabelName(*cfg.Label).IsValidLegacy() {
+		return nil, fmt.Errorf(ErrInvalidLabelName, *cfg.Label)
+	}
+
+	schema := &spec.Schema{}
+	if err := json.UnmarshalFromString(cfg.Schema, schema); err != nil {
+		return nil, errors.Wrap(err, ErrCouldNotParseSchema)
+	}
+	return validate.NewSchemaValidator(schema, schema, "", strfmt.Default), nil
+}
+
+// newSchemaStage creates a schemaStage from config
+func newSchemaStage(logger log.Logger, config interface{}, registerer prometheus.Registerer) (Stage, error) {
+	cfg, err := parseSchemaConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := validateSchemaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schemaStage{
+		logger:    log.With(logger, "component", "stage", "type", "schema"),
+		cfg:       cfg,
+		validator: validator,
+		dropCount: getDropCountMetric(registerer),
+	}, nil
+}
+
+func parseSchemaConfig(config interface{}) (*SchemaConfig, error) {
+	cfg := &SchemaConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// schemaStage validates the extracted values against a JSON Schema and drops or
+// labels the lines which do not conform.
+type schemaStage struct {
+	logger    log.Logger
+	cfg       *SchemaConfig
+	validator *validate.SchemaValidator
+	dropCount *prometheus.CounterVec
+}
+
+func (s *schemaStage) Run(in chan Entry) chan Entry {
+	out := make(chan Entry)
+	go func() {
+		defer close(out)
+		for e := range in {
+			if s.isValid(e) {
+				out <- e
+				continue
+			}
+			if s.cfg.Action == SchemaActionDrop {
+				s.dropCount.WithLabelValues(*s.cfg.DropReason).Inc()
+				continue
+			}
+			e.Labels[model.LabelName(*s.cfg.Label)] = "true"
+			out <- e
+		}
+	}()
+	return out
+}
+
+// isValid validates the document of the entry. Lines without the source are
+// left untouched.
+func (s *schemaStage) isValid(e Entry) bool {
+	var doc interface{} = e.Extracted
+	if s.cfg.Source != nil {
+		v, ok := e.Extracted[*s.cfg.Source]
+		if !ok || v == nil {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.cfg.Source)
+			}
+			return true
+		}
+		doc = v
+		if str, ok := v.(string); ok {
+			if err := json.UnmarshalFromString(str, &doc); err != nil {
+				if Debug {
+					level.Debug(s.logger).Log("msg", "failed to parse source as JSON", "source", *s.cfg.Source, "err", err)
+				}
+				return false
+			}
+		}
+	}
+
+	res := s.validator.Validate(doc)
+	if res.IsValid() {
+		return true
+	}
+	if Debug {
+		for _, err := range res.Errors {
+			field := ""
+			if v, ok := err.(*oaerrors.Validation); ok {
+				field = v.Name
+			}
+			level.Debug(s.logger).Log("msg", "line does not conform to the schema", "field", field, "err", err)
+		}
+	}
+	return false
+}
+
+// Name implements Stage
+func (s *schemaStage) Name() string {
+	return StageTypeSchema
+}
+
+// Cleanup implements Stage.
+func (*schemaStage) Cleanup() {
+	// no-op
+}
@@ -0,0 +1,181 @@
+package stages
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testSchemaYamlDrop = `
+pipeline_stages:
+- json:
+    expressions:
+      level:
+      status:
+- schema:
+    schema: |
+      {
+        "type": "object",
+        "required": ["level", "status"],
+        "properties": {
+          "level": {"type": "string", "enum": ["debug", "info", "warn", "error"]},
+          "status": {"type": "integer"}
+        }
+      }
+`
+
+var testSchemaYamlLabelWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      user:
+- schema:
+    source: user
+    action: label
+    label: invalid_user
+    schema: |
+      {
+        "type": "object",
+        "required": ["id"],
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"}
+        }
+      }
+`
+
+func TestPipeline_Schema(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config         string
+		entry          string
+		expectedLabels model.LabelSet
+		dropped        bool
+	}{
+		"passing document is kept": {
+			testSchemaYamlDrop,
+			`{"level": "info", "status": 200}`,
+			model.LabelSet{},
+			false,
+		},
+		"type mismatch is dropped": {
+			testSchemaYamlDrop,
+			`{"level": "info", "status": "OK"}`,
+			nil,
+			true,
+		},
+		"missing required field is dropped": {
+			testSchemaYamlDrop,
+			`{"level": "info"}`,
+			nil,
+			true,
+		},
+		"passing source is not labeled": {
+			testSchemaYamlLabelWithSource,
+			`{"user": {"id": 42, "name": "frank"}}`,
+			model.LabelSet{},
+			false,
+		},
+		"type mismatch in source is labeled": {
+			testSchemaYamlLabelWithSource,
+			`{"user": {"id": "42", "name": "frank"}}`,
+			model.LabelSet{"invalid_user": "true"},
+			false,
+		},
+		"missing source is kept": {
+			testSchemaYamlLabelWithSource,
+			`{"level": "info"}`,
+			model.LabelSet{},
+			false,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			t.Parallel()
+
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testData.config), nil, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, model.LabelSet{}, testData.entry, time.Now()))
+			if testData.dropped {
+				assert.Empty(t, out)
+				return
+			}
+			assert.Len(t, out, 1)
+			assert.Equal(t, testData.expectedLabels, out[0].Labels)
+		})
+	}
+}
+
+func TestSchemaConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrSchemaRequired),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"schema": `{"type": "object"}`,
+				"source": "",
+			},
+			errors.New(ErrEmptySchemaStageSource),
+		},
+		"invalid action": {
+			map[string]interface{}{
+				"schema": `{"type": "object"}`,
+				"action": "reject",
+			},
+			errors.Errorf(ErrSchemaInvalidAction, "reject"),
+		},
+		"invalid label": {
+			map[string]interface{}{
+				"schema": `{"type": "object"}`,
+				"action": "label",
+				"label":  "schema error",
+			},
+			fmt.Errorf(ErrInvalidLabelName, "schema error"),
+		},
+		"invalid schema": {
+			map[string]interface{}{
+				"schema": `{"type": `,
+			},
+			errors.New(ErrCouldNotParseSchema),
+		},
+		"valid": {
+			map[string]interface{}{
+				"schema": `{"type": "object", "properties": {"status": {"type": "integer"}}}`,
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseSchemaConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateSchemaConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SchemaConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Contains(t, err.Error(), tt.err.Error())
+			}
+		})
+	}
+}
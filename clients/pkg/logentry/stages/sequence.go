@@ -0,0 +1,119 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptySequenceStageConfig = "empty sequence stage configuration"
+	ErrEmptySequenceDestination = "empty destination in sequence stage"
+	ErrSequenceInvalidMaxStream = "sequence stage max_streams must be greater than 0, got %d"
+)
+
+const (
+	defaultSequenceDestination = "sequence"
+	defaultSequenceMaxStreams  = 10000
+)
+
+// SequenceConfig represents a Sequence Stage configuration
+type SequenceConfig struct {
+	// Destination is the extracted key the sequence number is written to,
+	// `sequence` by default.
+	Destination *string `mapstructure:"destination"`
+	// MaxStreams bounds the number of streams a sequence is kept for, the least
+	// recently seen stream being evicted, and its sequence restarted, past it.
+	MaxStreams int `mapstructure:"max_streams"`
+}
+
+// validateSequenceConfig validates a sequence stage config.
+func validateSequenceConfig(c *SequenceConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptySequenceStageConfig)
+	}
+	if c.Destination == nil {
+		destination := defaultSequenceDestination
+		c.Destination = &destination
+	}
+	if *c.Destination == "" {
+		return errors.New(ErrEmptySequenceDestination)
+	}
+	if c.MaxStreams == 0 {
+		c.MaxStreams = defaultSequenceMaxStreams
+	}
+	if c.MaxStreams < 0 {
+		return errors.Errorf(ErrSequenceInvalidMaxStream, c.MaxStreams)
+	}
+	return nil
+}
+
+// sequenceStage numbers the entries of each stream, i.e. each set of labels,
+// from 1, for gaps or reordering to be detected downstream.
+type sequenceStage struct {
+	cfg    *SequenceConfig
+	logger log.Logger
+
+	// mtx makes reading and incrementing the sequence of a stream atomic.
+	mtx sync.Mutex
+	// sequences are the last sequence number of each stream, by label set
+	// fingerprint.
+	sequences *lru.Cache[model.Fingerprint, uint64]
+}
+
+// newSequenceStage creates a new sequence pipeline stage from a config.
+func newSequenceStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseSequenceConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSequenceConfig(cfg); err != nil {
+		return nil, err
+	}
+	sequences, err := lru.New[model.Fingerprint, uint64](cfg.MaxStreams)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&sequenceStage{
+		cfg:       cfg,
+		logger:    log.With(logger, "component", "stage", "type", "sequence"),
+		sequences: sequences,
+	}), nil
+}
+
+func parseSequenceConfig(config interface{}) (*SequenceConfig, error) {
+	cfg := &SequenceConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (s *sequenceStage) Process(labels model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	fp := labels.Fingerprint()
+
+	s.mtx.Lock()
+	seq, _ := s.sequences.Get(fp)
+	seq++
+	s.sequences.Add(fp, seq)
+	s.mtx.Unlock()
+
+	extracted[*s.cfg.Destination] = seq
+	if Debug {
+		level.Debug(s.logger).Log("msg", "sequence number assigned", "labels", labels, "sequence", seq)
+	}
+}
+
+// Name implements Stage
+func (s *sequenceStage) Name() string {
+	return StageTypeSequence
+}
@@ -0,0 +1,130 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testSequenceYaml = `
+pipeline_stages:
+- sequence:
+    destination: seq
+- output:
+    source: seq
+`
+
+func TestPipeline_Sequence(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testSequenceYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbs := model.LabelSet{"job": "app"}
+	out := processEntries(pl,
+		newEntry(nil, lbs, "first", time.Now()),
+		newEntry(nil, lbs, "second", time.Now()),
+	)
+	assert.Equal(t, "1", out[0].Line)
+	assert.Equal(t, "2", out[1].Line)
+}
+
+func TestSequenceStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		streams  []model.LabelSet
+		expected []uint64
+	}{
+		"interleaved streams": {
+			nil,
+			[]model.LabelSet{
+				{"job": "app", "host": "web-1"},
+				{"job": "app", "host": "web-2"},
+				{"host": "web-1", "job": "app"},
+				{"job": "app", "host": "web-1"},
+				{"job": "app", "host": "web-2"},
+			},
+			[]uint64{1, 1, 2, 3, 2},
+		},
+		"least recently seen stream evicted": {
+			map[string]interface{}{"max_streams": 2},
+			[]model.LabelSet{
+				{"host": "web-1"},
+				{"host": "web-2"},
+				{"host": "web-1"},
+				{"host": "web-3"},
+				{"host": "web-1"},
+				{"host": "web-2"},
+			},
+			[]uint64{1, 1, 2, 1, 3, 1},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newSequenceStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := make([]Entry, 0, len(tt.streams))
+			for _, lbs := range tt.streams {
+				entries = append(entries, newEntry(nil, lbs, "line", time.Now()))
+			}
+			actual := make([]uint64, 0, len(tt.streams))
+			for _, e := range processEntries(st, entries...) {
+				actual = append(actual, e.Extracted[defaultSequenceDestination].(uint64))
+			}
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestSequenceConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty destination": {
+			map[string]interface{}{
+				"destination": "",
+			},
+			errors.New(ErrEmptySequenceDestination),
+		},
+		"negative max_streams": {
+			map[string]interface{}{
+				"max_streams": -1,
+			},
+			errors.Errorf(ErrSequenceInvalidMaxStream, -1),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseSequenceConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateSequenceConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SequenceConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
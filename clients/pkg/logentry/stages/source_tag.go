@@ -0,0 +1,151 @@
+package stages
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/push"
+)
+
+// Config Errors
+const (
+	ErrEmptySourceTagStageConfig = "empty source_tag stage configuration"
+	ErrEmptySourceTagName        = "empty tag name in source_tag stage"
+	ErrSourceTagInvalidTarget    = "source_tag stage target must be one of `extracted` or `structured_metadata`, got %q"
+)
+
+const (
+	SourceTagTargetExtracted          = "extracted"
+	SourceTagTargetStructuredMetadata = "structured_metadata"
+)
+
+// defaultSourceTags are the labels tagged when none is configured, the file
+// an entry was read from and its scrape job.
+var defaultSourceTags = []string{"filename", "job"}
+
+// SourceTagConfig represents a SourceTag Stage configuration
+type SourceTagConfig struct {
+	// Tags maps the name of each tag to the label it is read from, the label of
+	// the same name when empty, e.g. `{filename: "", source: "job"}`. The
+	// `filename` and `job` labels are tagged by default.
+	Tags map[string]*string `mapstructure:"tags"`
+	// Target is where the tags are written, the `extracted` map, which is the
+	// default, or the `structured_metadata` of the entries.
+	Target string `mapstructure:"target"`
+}
+
+// validateSourceTagConfig validates a source_tag stage config.
+func validateSourceTagConfig(c *SourceTagConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptySourceTagStageConfig)
+	}
+	switch c.Target {
+	case "":
+		c.Target = SourceTagTargetExtracted
+	case SourceTagTargetExtracted, SourceTagTargetStructuredMetadata:
+	default:
+		return errors.Errorf(ErrSourceTagInvalidTarget, c.Target)
+	}
+	if len(c.Tags) == 0 {
+		c.Tags = make(map[string]*string, len(defaultSourceTags))
+		for _, name := range defaultSourceTags {
+			c.Tags[name] = nil
+		}
+	}
+	for name, label := range c.Tags {
+		if name == "" {
+			return errors.New(ErrEmptySourceTagName)
+		}
+		if c.Target == SourceTagTargetStructuredMetadata && !model.LabelName(name).IsValidLegacy() {
+			return fmt.Errorf(ErrInvalidLabelName, name)
+		}
+		if label == nil || *label == "" {
+			lName := name
+			c.Tags[name] = &lName
+		}
+	}
+	return nil
+}
+
+// sourceTagStage copies labels identifying the source of the entries, such as
+// the file they were read from, to the extracted map, e.g. for the templates of
+// the next stages to depend on the source, or to their structured metadata.
+type sourceTagStage struct {
+	cfg *SourceTagConfig
+	// names are the names of the tags, sorted so that the structured metadata
+	// is appended in a stable order.
+	names  []string
+	logger log.Logger
+}
+
+// newSourceTagStage creates a new source_tag pipeline stage from a config.
+func newSourceTagStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseSourceTagConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSourceTagConfig(cfg); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cfg.Tags))
+	for name := range cfg.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &sourceTagStage{
+		cfg:    cfg,
+		names:  names,
+		logger: log.With(logger, "component", "stage", "type", "source_tag"),
+	}, nil
+}
+
+func parseSourceTagConfig(config interface{}) (*SourceTagConfig, error) {
+	cfg := &SourceTagConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Run implements Stage, the structured metadata of the entries cannot be set by
+// a Processor.
+func (s *sourceTagStage) Run(in chan Entry) chan Entry {
+	return RunWith(in, func(e Entry) Entry {
+		for _, name := range s.names {
+			label := *s.cfg.Tags[name]
+			value, ok := e.Labels[model.LabelName(label)]
+			if !ok {
+				if Debug {
+					level.Debug(s.logger).Log("msg", "label does not exist in the set of labels", "label", label)
+				}
+				continue
+			}
+			if s.cfg.Target == SourceTagTargetStructuredMetadata {
+				e.StructuredMetadata = append(e.StructuredMetadata, push.LabelAdapter{Name: name, Value: string(value)})
+				continue
+			}
+			e.Extracted[name] = string(value)
+		}
+		if Debug {
+			level.Debug(s.logger).Log("msg", "extracted data debug in source_tag stage", "extracted data", fmt.Sprintf("%v", e.Extracted))
+		}
+		return e
+	})
+}
+
+// Name implements Stage
+func (s *sourceTagStage) Name() string {
+	return StageTypeSourceTag
+}
+
+// Cleanup implements Stage.
+func (*sourceTagStage) Cleanup() {
+	// no-op
+}
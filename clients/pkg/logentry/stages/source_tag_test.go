@@ -0,0 +1,133 @@
+package stages
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/loki/pkg/push"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testSourceTagYaml = `
+pipeline_stages:
+- source_tag:
+- replace:
+    expression: 'password=(\S+)'
+    replace: '{{ if hasSuffix "audit.log" .filename }}{{ .Value }}{{ else }}****{{ end }}'
+`
+
+func TestPipeline_SourceTag(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testSourceTagYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, expected := range map[string]string{
+		"/var/log/app/audit.log":  "user=frank password=hunter2",
+		"/var/log/app/access.log": "user=frank password=****",
+	} {
+		out := processEntries(pl, newEntry(nil, model.LabelSet{"filename": model.LabelValue(filename), "job": "app"}, "user=frank password=hunter2", time.Now()))[0]
+		assert.Equal(t, expected, out.Line, filename)
+		assert.Equal(t, filename, out.Extracted["filename"])
+		assert.Equal(t, "app", out.Extracted["job"])
+	}
+}
+
+func TestSourceTagStage_Run(t *testing.T) {
+	t.Parallel()
+
+	labels := func() model.LabelSet {
+		return model.LabelSet{"filename": "/var/log/syslog", "job": "varlogs", "host": "web-1"}
+	}
+	tests := map[string]struct {
+		config             map[string]interface{}
+		extracted          map[string]interface{}
+		structuredMetadata push.LabelsAdapter
+	}{
+		"defaults": {
+			nil,
+			map[string]interface{}{"filename": "/var/log/syslog", "job": "varlogs"},
+			nil,
+		},
+		"renamed tags": {
+			map[string]interface{}{"tags": map[string]interface{}{"path": "filename", "host": nil, "missing": ""}},
+			map[string]interface{}{"path": "/var/log/syslog", "host": "web-1"},
+			nil,
+		},
+		"structured metadata": {
+			map[string]interface{}{"target": "structured_metadata", "tags": map[string]interface{}{"source_file": "filename", "job": ""}},
+			map[string]interface{}{},
+			push.LabelsAdapter{{Name: "job", Value: "varlogs"}, {Name: "source_file", Value: "/var/log/syslog"}},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newSourceTagStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(nil, labels(), "line", time.Now()))[0]
+			assert.Equal(t, tt.extracted, out.Extracted)
+			assert.Equal(t, tt.structuredMetadata, out.StructuredMetadata)
+			// The labels are left untouched.
+			assert.Equal(t, labels(), out.Labels)
+		})
+	}
+}
+
+func TestSourceTagConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"invalid target": {
+			map[string]interface{}{
+				"target": "labels",
+			},
+			errors.Errorf(ErrSourceTagInvalidTarget, "labels"),
+		},
+		"empty tag name": {
+			map[string]interface{}{
+				"tags": map[string]interface{}{"": "filename"},
+			},
+			errors.New(ErrEmptySourceTagName),
+		},
+		"invalid structured metadata name": {
+			map[string]interface{}{
+				"target": "structured_metadata",
+				"tags":   map[string]interface{}{"source-file": "filename"},
+			},
+			fmt.Errorf(ErrInvalidLabelName, "source-file"),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseSourceTagConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateSourceTagConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SourceTagConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
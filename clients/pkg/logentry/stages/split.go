@@ -0,0 +1,158 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptySplitStageConfig    = "empty split stage configuration"
+	ErrSplitKeysRequired        = "split stage requires at least one key"
+	ErrSplitSeparatorRequired   = "split stage separator cannot be empty"
+	ErrEmptySplitStageSource    = "empty source"
+	ErrSplitInvalidMaxSplits    = "split stage max_splits cannot be negative"
+	ErrSplitDuplicateKey        = "split stage key %q is used more than once"
+	ErrSplitOverflowKeyConflict = "split stage overflow_key %q is also used in keys"
+)
+
+// SplitConfig represents a Split Stage configuration
+type SplitConfig struct {
+	Source    *string  `mapstructure:"source"`
+	Separator string   `mapstructure:"separator"`
+	Keys      []string `mapstructure:"keys"`
+	// MaxSplits bounds the number of times the value is split, the last token
+	// holding the unsplit remainder. Zero means no limit.
+	MaxSplits int `mapstructure:"max_splits"`
+	// OverflowKey receives the tokens left over once every key has been assigned,
+	// joined back with the separator. Left over tokens are dropped when unset.
+	OverflowKey *string `mapstructure:"overflow_key"`
+}
+
+// validateSplitConfig validates a split stage config.
+func validateSplitConfig(c *SplitConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptySplitStageConfig)
+	}
+	if len(c.Keys) == 0 {
+		return errors.New(ErrSplitKeysRequired)
+	}
+	if c.Separator == "" {
+		return errors.New(ErrSplitSeparatorRequired)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptySplitStageSource)
+	}
+	if c.MaxSplits < 0 {
+		return errors.New(ErrSplitInvalidMaxSplits)
+	}
+	keys := make(map[string]struct{}, len(c.Keys))
+	for _, k := range c.Keys {
+		if _, ok := keys[k]; ok {
+			return errors.Errorf(ErrSplitDuplicateKey, k)
+		}
+		keys[k] = struct{}{}
+	}
+	if c.OverflowKey != nil {
+		if _, ok := keys[*c.OverflowKey]; ok {
+			return errors.Errorf(ErrSplitOverflowKeyConflict, *c.OverflowKey)
+		}
+	}
+	return nil
+}
+
+// splitStage splits a value into positional extracted keys
+type splitStage struct {
+	cfg    *SplitConfig
+	logger log.Logger
+}
+
+// newSplitStage creates a new split pipeline stage from a config.
+func newSplitStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseSplitConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSplitConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&splitStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "split"),
+	}), nil
+}
+
+func parseSplitConfig(config interface{}) (*SplitConfig, error) {
+	cfg := &SplitConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (s *splitStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the split stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if s.cfg.Source != nil {
+		if _, ok := extracted[*s.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*s.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "failed to convert source value to string", "source", *s.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*s.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "cannot split a nil entry")
+		}
+		return
+	}
+
+	n := -1
+	if s.cfg.MaxSplits > 0 {
+		n = s.cfg.MaxSplits + 1
+	}
+	tokens := strings.SplitN(*input, s.cfg.Separator, n)
+
+	// Keys without a matching token are left unset.
+	for i, key := range s.cfg.Keys {
+		if i >= len(tokens) {
+			break
+		}
+		extracted[key] = tokens[i]
+	}
+	if len(tokens) > len(s.cfg.Keys) && s.cfg.OverflowKey != nil {
+		extracted[*s.cfg.OverflowKey] = strings.Join(tokens[len(s.cfg.Keys):], s.cfg.Separator)
+	}
+	if Debug {
+		level.Debug(s.logger).Log("msg", "extracted data debug in split stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (s *splitStage) Name() string {
+	return StageTypeSplit
+}
@@ -0,0 +1,196 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testSplitYamlWithoutSource = `
+pipeline_stages:
+- split:
+    separator: ","
+    keys: [method, path, status]
+`
+
+var testSplitYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      fields:
+- split:
+    source: fields
+    separator: ";"
+    keys: [method, path]
+    overflow_key: rest
+`
+
+var testSplitYamlWithMaxSplits = `
+pipeline_stages:
+- split:
+    separator: " "
+    keys: [level, component, msg]
+    max_splits: 2
+`
+
+var testSplitYamlMissingSource = `
+pipeline_stages:
+- split:
+    source: missing
+    separator: ","
+    keys: [method]
+`
+
+func TestPipeline_Split(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config          string
+		entry           string
+		expectedExtract map[string]interface{}
+	}{
+		"exact number of tokens": {
+			testSplitYamlWithoutSource,
+			"GET,/api/v1/push,204",
+			map[string]interface{}{
+				"method": "GET",
+				"path":   "/api/v1/push",
+				"status": "204",
+			},
+		},
+		"fewer tokens than keys leaves the extra keys unset": {
+			testSplitYamlWithoutSource,
+			"GET,/api/v1/push",
+			map[string]interface{}{
+				"method": "GET",
+				"path":   "/api/v1/push",
+			},
+		},
+		"more tokens than keys without overflow key drops the rest": {
+			testSplitYamlWithoutSource,
+			"GET,/api/v1/push,204,12ms",
+			map[string]interface{}{
+				"method": "GET",
+				"path":   "/api/v1/push",
+				"status": "204",
+			},
+		},
+		"more tokens than keys with overflow key": {
+			testSplitYamlWithSource,
+			`{"fields": "POST;/loki/api/v1/push;500;12ms"}`,
+			map[string]interface{}{
+				"fields": "POST;/loki/api/v1/push;500;12ms",
+				"method": "POST",
+				"path":   "/loki/api/v1/push",
+				"rest":   "500;12ms",
+			},
+		},
+		"max splits keeps the remainder in the last key": {
+			testSplitYamlWithMaxSplits,
+			"info ingester flushing chunk to store",
+			map[string]interface{}{
+				"level":     "info",
+				"component": "ingester",
+				"msg":       "flushing chunk to store",
+			},
+		},
+		"missing source is skipped": {
+			testSplitYamlMissingSource,
+			"GET,/api/v1/push,204",
+			map[string]interface{}{},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			t.Parallel()
+
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testData.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, testData.entry, time.Now()))[0]
+			assert.Equal(t, testData.expectedExtract, out.Extracted)
+		})
+	}
+}
+
+func TestSplitConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrSplitKeysRequired),
+		},
+		"missing separator": {
+			map[string]interface{}{
+				"keys": []string{"a"},
+			},
+			errors.New(ErrSplitSeparatorRequired),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"keys":      []string{"a"},
+				"separator": ",",
+				"source":    "",
+			},
+			errors.New(ErrEmptySplitStageSource),
+		},
+		"negative max splits": {
+			map[string]interface{}{
+				"keys":       []string{"a"},
+				"separator":  ",",
+				"max_splits": -1,
+			},
+			errors.New(ErrSplitInvalidMaxSplits),
+		},
+		"duplicate key": {
+			map[string]interface{}{
+				"keys":      []string{"a", "a"},
+				"separator": ",",
+			},
+			errors.Errorf(ErrSplitDuplicateKey, "a"),
+		},
+		"overflow key used in keys": {
+			map[string]interface{}{
+				"keys":         []string{"a", "b"},
+				"separator":    ",",
+				"overflow_key": "b",
+			},
+			errors.Errorf(ErrSplitOverflowKeyConflict, "b"),
+		},
+		"valid": {
+			map[string]interface{}{
+				"keys":         []string{"a", "b"},
+				"separator":    ",",
+				"max_splits":   3,
+				"overflow_key": "rest",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseSplitConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateSplitConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SplitConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyStacktraceStageConfig    = "empty stacktrace stage configuration"
+	ErrEmptyStacktraceStageSource    = "empty source"
+	ErrStacktraceLanguageRequired    = "stacktrace stage requires a `language`"
+	ErrStacktraceInvalidLanguage     = "stacktrace stage language must be one of `java`, `go` or `python`, got %q"
+	ErrEmptyStacktraceStageSeparator = "empty separator in stacktrace stage"
+)
+
+const (
+	StacktraceLanguageJava   = "java"
+	StacktraceLanguageGo     = "go"
+	StacktraceLanguagePython = "python"
+)
+
+// The keys extracted by the stacktrace stage.
+const (
+	stacktraceExceptionTypeKey    = "exception_type"
+	stacktraceExceptionMessageKey = "exception_message"
+	stacktraceKey                 = "stacktrace"
+)
+
+var defaultStacktraceSeparator = " | "
+
+// StacktraceConfig represents a Stacktrace Stage configuration
+type StacktraceConfig struct {
+	// Language is the language whose stack traces are detected, one of `java`,
+	// `go` or `python`.
+	Language string  `mapstructure:"language"`
+	Source   *string `mapstructure:"source"`
+	// Separator joins the lines of the stack trace collapsed into the
+	// `stacktrace` key, ` | ` by default.
+	Separator *string `mapstructure:"separator"`
+}
+
+// validateStacktraceConfig validates a stacktrace stage config.
+func validateStacktraceConfig(c *StacktraceConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyStacktraceStageConfig)
+	}
+	if c.Language == "" {
+		return errors.New(ErrStacktraceLanguageRequired)
+	}
+	c.Language = strings.ToLower(c.Language)
+	if _, ok := stacktraceParsers[c.Language]; !ok {
+		return errors.Errorf(ErrStacktraceInvalidLanguage, c.Language)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyStacktraceStageSource)
+	}
+	if c.Separator == nil {
+		c.Separator = &defaultStacktraceSeparator
+	} else if *c.Separator == "" {
+		return errors.New(ErrEmptyStacktraceStageSeparator)
+	}
+	return nil
+}
+
+// stackTrace is a stack trace found in an entry.
+type stackTrace struct {
+	exceptionType    string
+	exceptionMessage string
+	// lines are the lines of the stack trace, trimmed.
+	lines []string
+}
+
+// stacktraceParsers find the stack trace of a language in the lines of an entry.
+var stacktraceParsers = map[string]func(lines []string) (stackTrace, bool){
+	StacktraceLanguageJava:   parseJavaStackTrace,
+	StacktraceLanguageGo:     parseGoStackTrace,
+	StacktraceLanguagePython: parsePythonStackTrace,
+}
+
+// stacktraceStage extracts the exception of a stack trace, usually grouped into a
+// single entry by the multiline stage, as `exception_type` and
+// `exception_message`, and the stack trace collapsed into a single line as
+// `stacktrace`.
+type stacktraceStage struct {
+	cfg    *StacktraceConfig
+	parse  func(lines []string) (stackTrace, bool)
+	logger log.Logger
+}
+
+// newStacktraceStage creates a new stacktrace pipeline stage from a config.
+func newStacktraceStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseStacktraceConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateStacktraceConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&stacktraceStage{
+		cfg:    cfg,
+		parse:  stacktraceParsers[cfg.Language],
+		logger: log.With(logger, "component", "stage", "type", "stacktrace"),
+	}), nil
+}
+
+func parseStacktraceConfig(config interface{}) (*StacktraceConfig, error) {
+	cfg := &StacktraceConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (s *stacktraceStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the stacktrace stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if s.cfg.Source != nil {
+		if _, ok := extracted[*s.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*s.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "failed to convert source value to string", "source", *s.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*s.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	trace, ok := s.parse(strings.Split(strings.ReplaceAll(*input, "\r\n", "\n"), "\n"))
+	if !ok {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "no stack trace found", "language", s.cfg.Language)
+		}
+		return
+	}
+	extracted[stacktraceExceptionTypeKey] = trace.exceptionType
+	if trace.exceptionMessage != "" {
+		extracted[stacktraceExceptionMessageKey] = trace.exceptionMessage
+	}
+	extracted[stacktraceKey] = strings.Join(trace.lines, *s.cfg.Separator)
+	if Debug {
+		level.Debug(s.logger).Log("msg", "extracted data debug in stacktrace stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+var (
+	javaAtFrameRegexp   = regexp.MustCompile(`^\s+at \S`)
+	javaFrameRegexp     = regexp.MustCompile(`^\s+at \S|^\s*\.\.\. \d+ (?:more|common frames omitted)$|^\s*(?:Caused by|Suppressed): \S`)
+	javaExceptionRegexp = regexp.MustCompile(`^(?:Exception in thread "[^"]*"\s+)?([A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*)(?::\s*(.*))?$`)
+)
+
+// parseJavaStackTrace finds the exception whose line precedes the first `at`
+// frame, e.g. `java.lang.IllegalStateException: boom`, optionally prefixed by
+// `Exception in thread "main"`. The stack trace runs until the last frame,
+// including the `Caused by:` exceptions.
+func parseJavaStackTrace(lines []string) (stackTrace, bool) {
+	for i := 1; i < len(lines); i++ {
+		if !javaAtFrameRegexp.MatchString(lines[i]) {
+			continue
+		}
+		header := strings.TrimSpace(lines[i-1])
+		m := javaExceptionRegexp.FindStringSubmatch(header)
+		if m == nil {
+			return stackTrace{}, false
+		}
+		trace := stackTrace{exceptionType: m[1], exceptionMessage: m[2], lines: []string{header}}
+		for ; i < len(lines) && javaFrameRegexp.MatchString(lines[i]); i++ {
+			trace.lines = append(trace.lines, strings.TrimSpace(lines[i]))
+		}
+		return trace, true
+	}
+	return stackTrace{}, false
+}
+
+var (
+	goPanicRegexp     = regexp.MustCompile(`^(panic|fatal error): (.*)$`)
+	goGoroutineRegexp = regexp.MustCompile(`^goroutine \d+ \[`)
+)
+
+// parseGoStackTrace finds a panic or a fatal error, e.g. `panic: boom`, followed
+// by the stack of a goroutine. The type is either `panic` or `fatal error`, and
+// the stack trace runs until the end of the entry or the `exit status` line.
+func parseGoStackTrace(lines []string) (stackTrace, bool) {
+	for i, line := range lines {
+		m := goPanicRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		trace := stackTrace{exceptionType: m[1], exceptionMessage: m[2]}
+		goroutine := false
+		for _, l := range lines[i:] {
+			l = strings.TrimSpace(l)
+			if strings.HasPrefix(l, "exit status ") {
+				break
+			}
+			if l == "" {
+				continue
+			}
+			goroutine = goroutine || goGoroutineRegexp.MatchString(l)
+			trace.lines = append(trace.lines, l)
+		}
+		if !goroutine {
+			return stackTrace{}, false
+		}
+		return trace, true
+	}
+	return stackTrace{}, false
+}
+
+var pythonExceptionRegexp = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::\s*(.*))?$`)
+
+// parsePythonStackTrace finds the exception ending a traceback, e.g.
+// `ValueError: bad value`. The exception of chained tracebacks is the last one,
+// which was raised.
+func parsePythonStackTrace(lines []string) (stackTrace, bool) {
+	start := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "Traceback (most recent call last):" {
+			start = i
+		}
+	}
+	if start == -1 {
+		return stackTrace{}, false
+	}
+	trace := stackTrace{lines: []string{strings.TrimSpace(lines[start])}}
+	for _, line := range lines[start+1:] {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		trace.lines = append(trace.lines, trimmed)
+		if line[0] == ' ' || line[0] == '\t' {
+			// Frames are indented, the exception is not.
+			continue
+		}
+		m := pythonExceptionRegexp.FindStringSubmatch(trimmed)
+		if m == nil {
+			return stackTrace{}, false
+		}
+		trace.exceptionType, trace.exceptionMessage = m[1], m[2]
+		return trace, true
+	}
+	return stackTrace{}, false
+}
+
+// Name implements Stage
+func (s *stacktraceStage) Name() string {
+	return StageTypeStacktrace
+}
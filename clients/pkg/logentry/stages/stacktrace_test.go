@@ -0,0 +1,194 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testStacktraceYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      error:
+- stacktrace:
+    language: java
+    source: error
+    separator: "\n"
+`
+
+func TestPipeline_Stacktrace(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testStacktraceYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := `{"error":"java.io.IOException: disk full\n\tat com.example.Store.write(Store.java:42)"}`
+	out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, "java.io.IOException", out.Extracted["exception_type"])
+	assert.Equal(t, "disk full", out.Extracted["exception_message"])
+	assert.Equal(t, "java.io.IOException: disk full\nat com.example.Store.write(Store.java:42)", out.Extracted["stacktrace"])
+}
+
+const javaStackTrace = `2024-05-01 12:00:00 ERROR [main] c.e.App - request failed
+Exception in thread "main" java.lang.IllegalStateException: connection pool exhausted
+	at com.example.db.Pool.acquire(Pool.java:87)
+	at com.example.App.main(App.java:12)
+Caused by: java.util.concurrent.TimeoutException
+	at com.example.db.Pool.wait(Pool.java:120)
+	... 2 more
+2024-05-01 12:00:01 INFO [main] c.e.App - shutting down`
+
+const goPanic = `panic: runtime error: index out of range [5] with length 3
+
+goroutine 1 [running]:
+main.lookup(...)
+	/app/main.go:14
+main.main()
+	/app/main.go:9 +0x1d
+exit status 2`
+
+const pythonTraceback = `Traceback (most recent call last):
+  File "app.py", line 3, in <module>
+    main()
+  File "app.py", line 2, in main
+    int("abc")
+ValueError: invalid literal for int() with base 10: 'abc'`
+
+func TestStacktraceStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		entry    string
+		expected map[string]interface{}
+	}{
+		"java exception": {
+			map[string]interface{}{"language": "java"},
+			javaStackTrace,
+			map[string]interface{}{
+				"exception_type":    "java.lang.IllegalStateException",
+				"exception_message": "connection pool exhausted",
+				"stacktrace": `Exception in thread "main" java.lang.IllegalStateException: connection pool exhausted | ` +
+					`at com.example.db.Pool.acquire(Pool.java:87) | at com.example.App.main(App.java:12) | ` +
+					`Caused by: java.util.concurrent.TimeoutException | at com.example.db.Pool.wait(Pool.java:120) | ... 2 more`,
+			},
+		},
+		"go panic": {
+			map[string]interface{}{"language": "go", "separator": "; "},
+			goPanic,
+			map[string]interface{}{
+				"exception_type":    "panic",
+				"exception_message": "runtime error: index out of range [5] with length 3",
+				"stacktrace": "panic: runtime error: index out of range [5] with length 3; goroutine 1 [running]:; " +
+					"main.lookup(...); /app/main.go:14; main.main(); /app/main.go:9 +0x1d",
+			},
+		},
+		"python traceback": {
+			map[string]interface{}{"language": "Python"},
+			pythonTraceback,
+			map[string]interface{}{
+				"exception_type":    "ValueError",
+				"exception_message": "invalid literal for int() with base 10: 'abc'",
+				"stacktrace": `Traceback (most recent call last): | File "app.py", line 3, in <module> | main() | ` +
+					`File "app.py", line 2, in main | int("abc") | ValueError: invalid literal for int() with base 10: 'abc'`,
+			},
+		},
+		"java exception without message": {
+			map[string]interface{}{"language": "java"},
+			"java.lang.NullPointerException\r\n\tat com.example.App.run(App.java:5)",
+			map[string]interface{}{
+				"exception_type": "java.lang.NullPointerException",
+				"stacktrace":     "java.lang.NullPointerException | at com.example.App.run(App.java:5)",
+			},
+		},
+		"go panic without goroutine": {
+			map[string]interface{}{"language": "go"},
+			"panic: boom",
+			map[string]interface{}{},
+		},
+		"other language": {
+			map[string]interface{}{"language": "java"},
+			goPanic,
+			map[string]interface{}{},
+		},
+		"plain line": {
+			map[string]interface{}{"language": "python"},
+			"ValueError: not a traceback",
+			map[string]interface{}{},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newStacktraceStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestStacktraceConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"missing language": {
+			nil,
+			errors.New(ErrStacktraceLanguageRequired),
+		},
+		"invalid language": {
+			map[string]interface{}{
+				"language": "rust",
+			},
+			errors.Errorf(ErrStacktraceInvalidLanguage, "rust"),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"language": "go",
+				"source":   "",
+			},
+			errors.New(ErrEmptyStacktraceStageSource),
+		},
+		"empty separator": {
+			map[string]interface{}{
+				"language":  "go",
+				"separator": "",
+			},
+			errors.New(ErrEmptyStacktraceStageSeparator),
+		},
+		"valid": {
+			map[string]interface{}{
+				"language": "JAVA",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseStacktraceConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateStacktraceConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("StacktraceConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -16,31 +16,60 @@ import (
 )
 
 const (
-	StageTypeJSON            = "json"
-	StageTypeLogfmt          = "logfmt"
-	StageTypeRegex           = "regex"
-	StageTypeReplace         = "replace"
-	StageTypeMetric          = "metrics"
-	StageTypeLabel           = "labels"
-	StageTypeLabelDrop       = "labeldrop"
-	StageTypeTimestamp       = "timestamp"
-	StageTypeOutput          = "output"
-	StageTypeDocker          = "docker"
-	StageTypeCRI             = "cri"
-	StageTypeMatch           = "match"
-	StageTypeTemplate        = "template"
-	StageTypePipeline        = "pipeline"
-	StageTypeTenant          = "tenant"
-	StageTypeDrop            = "drop"
-	StageTypeSampling        = "sampling"
-	StageTypeLimit           = "limit"
-	StageTypeMultiline       = "multiline"
-	StageTypePack            = "pack"
-	StageTypeLabelAllow      = "labelallow"
-	StageTypeStaticLabels    = "static_labels"
-	StageTypeDecolorize      = "decolorize"
-	StageTypeEventLogMessage = "eventlogmessage"
-	StageTypeGeoIP           = "geoip"
+	StageTypeJSON             = "json"
+	StageTypeLogfmt           = "logfmt"
+	StageTypeRegex            = "regex"
+	StageTypeReplace          = "replace"
+	StageTypeMetric           = "metrics"
+	StageTypeLabel            = "labels"
+	StageTypeLabelDrop        = "labeldrop"
+	StageTypeTimestamp        = "timestamp"
+	StageTypeOutput           = "output"
+	StageTypeDocker           = "docker"
+	StageTypeCRI              = "cri"
+	StageTypeMatch            = "match"
+	StageTypeTemplate         = "template"
+	StageTypePipeline         = "pipeline"
+	StageTypeTenant           = "tenant"
+	StageTypeDrop             = "drop"
+	StageTypeSampling         = "sampling"
+	StageTypeLimit            = "limit"
+	StageTypeMultiline        = "multiline"
+	StageTypePack             = "pack"
+	StageTypeLabelAllow       = "labelallow"
+	StageTypeStaticLabels     = "static_labels"
+	StageTypeDecolorize       = "decolorize"
+	StageTypeEventLogMessage  = "eventlogmessage"
+	StageTypeGeoIP            = "geoip"
+	StageTypeXML              = "xml"
+	StageTypeSplit            = "split"
+	StageTypeSchema           = "schema"
+	StageTypeURL              = "url"
+	StageTypeFingerprint      = "fingerprint"
+	StageTypeTruncate         = "truncate"
+	StageTypeKeyValue         = "keyvalue"
+	StageTypeNormalizeUnicode = "normalize_unicode"
+	StageTypeGunzip           = "gunzip"
+	StageTypeSyslog           = "syslog"
+	StageTypeLookup           = "lookup"
+	StageTypePIIScrub         = "pii_scrub"
+	StageTypeCoerce           = "coerce"
+	StageTypeAccessLog        = "accesslog"
+	StageTypeCEF              = "cef"
+	StageTypeRename           = "rename"
+	StageTypeFlatten          = "flatten"
+	StageTypeStacktrace       = "stacktrace"
+	StageTypeDropKeys         = "drop_keys"
+	StageTypeLevelDetect      = "level_detect"
+	StageTypeMath             = "math"
+	StageTypeQuerystring      = "querystring"
+	StageTypeHexDecode        = "hex_decode"
+	StageTypeWinEvt           = "winevt"
+	StageTypeBucketize        = "bucketize"
+	StageTypeSourceTag        = "source_tag"
+	StageTypeSequence         = "sequence"
+	StageTypeDedup            = "dedup"
+	StageTypeNginxError       = "nginx_error"
 	// Deprecated. Renamed to `structured_metadata`. Will be removed after the migration.
 	StageTypeNonIndexedLabels   = "non_indexed_labels"
 	StageTypeStructuredMetadata = "structured_metadata"
@@ -176,7 +205,7 @@ func initCreators() {
 			return newTenantStage(params.logger, params.config)
 		},
 		StageTypeReplace: func(params StageCreationParams) (Stage, error) {
-			return newReplaceStage(params.logger, params.config)
+			return newReplaceStage(params.logger, params.config, params.registerer)
 		},
 		StageTypeDrop: func(params StageCreationParams) (Stage, error) {
 			return newDropStage(params.logger, params.config, params.registerer)
@@ -208,6 +237,93 @@ func initCreators() {
 		StageTypeGeoIP: func(params StageCreationParams) (Stage, error) {
 			return newGeoIPStage(params.logger, params.config)
 		},
+		StageTypeXML: func(params StageCreationParams) (Stage, error) {
+			return newXMLStage(params.logger, params.config)
+		},
+		StageTypeSplit: func(params StageCreationParams) (Stage, error) {
+			return newSplitStage(params.logger, params.config)
+		},
+		StageTypeSchema: func(params StageCreationParams) (Stage, error) {
+			return newSchemaStage(params.logger, params.config, params.registerer)
+		},
+		StageTypeURL: func(params StageCreationParams) (Stage, error) {
+			return newURLStage(params.logger, params.config)
+		},
+		StageTypeFingerprint: func(params StageCreationParams) (Stage, error) {
+			return newFingerprintStage(params.logger, params.config)
+		},
+		StageTypeTruncate: func(params StageCreationParams) (Stage, error) {
+			return newTruncateStage(params.logger, params.config)
+		},
+		StageTypeKeyValue: func(params StageCreationParams) (Stage, error) {
+			return newKeyValueStage(params.logger, params.config)
+		},
+		StageTypeNormalizeUnicode: func(params StageCreationParams) (Stage, error) {
+			return newNormalizeUnicodeStage(params.logger, params.config)
+		},
+		StageTypeGunzip: func(params StageCreationParams) (Stage, error) {
+			return newGunzipStage(params.logger, params.config)
+		},
+		StageTypeSyslog: func(params StageCreationParams) (Stage, error) {
+			return newSyslogParseStage(params.logger, params.config)
+		},
+		StageTypeLookup: func(params StageCreationParams) (Stage, error) {
+			return newLookupStage(params.logger, params.config)
+		},
+		StageTypePIIScrub: func(params StageCreationParams) (Stage, error) {
+			return newPIIScrubStage(params.logger, params.config)
+		},
+		StageTypeCoerce: func(params StageCreationParams) (Stage, error) {
+			return newCoerceStage(params.logger, params.config)
+		},
+		StageTypeAccessLog: func(params StageCreationParams) (Stage, error) {
+			return newAccessLogStage(params.logger, params.config)
+		},
+		StageTypeCEF: func(params StageCreationParams) (Stage, error) {
+			return newCEFStage(params.logger, params.config)
+		},
+		StageTypeRename: func(params StageCreationParams) (Stage, error) {
+			return newRenameStage(params.logger, params.config)
+		},
+		StageTypeFlatten: func(params StageCreationParams) (Stage, error) {
+			return newFlattenStage(params.logger, params.config)
+		},
+		StageTypeStacktrace: func(params StageCreationParams) (Stage, error) {
+			return newStacktraceStage(params.logger, params.config)
+		},
+		StageTypeDropKeys: func(params StageCreationParams) (Stage, error) {
+			return newDropKeysStage(params.logger, params.config)
+		},
+		StageTypeLevelDetect: func(params StageCreationParams) (Stage, error) {
+			return newLevelDetectStage(params.logger, params.config)
+		},
+		StageTypeMath: func(params StageCreationParams) (Stage, error) {
+			return newMathStage(params.logger, params.config)
+		},
+		StageTypeQuerystring: func(params StageCreationParams) (Stage, error) {
+			return newQuerystringStage(params.logger, params.config)
+		},
+		StageTypeHexDecode: func(params StageCreationParams) (Stage, error) {
+			return newHexDecodeStage(params.logger, params.config)
+		},
+		StageTypeWinEvt: func(params StageCreationParams) (Stage, error) {
+			return newWinEvtStage(params.logger, params.config)
+		},
+		StageTypeBucketize: func(params StageCreationParams) (Stage, error) {
+			return newBucketizeStage(params.logger, params.config)
+		},
+		StageTypeSourceTag: func(params StageCreationParams) (Stage, error) {
+			return newSourceTagStage(params.logger, params.config)
+		},
+		StageTypeSequence: func(params StageCreationParams) (Stage, error) {
+			return newSequenceStage(params.logger, params.config)
+		},
+		StageTypeDedup: func(params StageCreationParams) (Stage, error) {
+			return newDedupStage(params.logger, params.config, params.registerer)
+		},
+		StageTypeNginxError: func(params StageCreationParams) (Stage, error) {
+			return newNginxErrorStage(params.logger, params.config)
+		},
 		StageTypeNonIndexedLabels:   newStructuredMetadataStage,
 		StageTypeStructuredMetadata: newStructuredMetadataStage,
 	}
@@ -230,7 +346,9 @@ func New(logger log.Logger, jobName *string, stageType string,
 	return creator(params)
 }
 
-// Cleanup implements Stage.
-func (*stageProcessor) Cleanup() {
-	// no-op
+// Cleanup implements Stage, it cleans up the Processor when it holds resources.
+func (s *stageProcessor) Cleanup() {
+	if c, ok := s.Processor.(interface{ Cleanup() }); ok {
+		c.Cleanup()
+	}
 }
@@ -0,0 +1,214 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/leodido/go-syslog/v4"
+	"github.com/leodido/go-syslog/v4/rfc3164"
+	"github.com/leodido/go-syslog/v4/rfc5424"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptySyslogStageConfig = "empty syslog stage configuration"
+	ErrEmptySyslogStageSource = "empty source"
+	ErrSyslogInvalidFormat    = "syslog stage format must be one of `rfc3164` or `rfc5424`, got %q"
+)
+
+const (
+	SyslogFormatRFC3164 = "rfc3164"
+	SyslogFormatRFC5424 = "rfc5424"
+)
+
+// SyslogConfig represents a Syslog Stage configuration
+type SyslogConfig struct {
+	Source *string `mapstructure:"source"`
+	// Format is `rfc3164` or `rfc5424`, it is detected from the version which
+	// follows the priority of RFC5424 messages when empty.
+	Format string `mapstructure:"format"`
+}
+
+// validateSyslogConfig validates a syslog stage config.
+func validateSyslogConfig(c *SyslogConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptySyslogStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptySyslogStageSource)
+	}
+	switch c.Format {
+	case "", SyslogFormatRFC3164, SyslogFormatRFC5424:
+	default:
+		return errors.Errorf(ErrSyslogInvalidFormat, c.Format)
+	}
+	return nil
+}
+
+// syslogParseStage extracts the fields of a syslog message. The fields are
+// extracted as `syslog_priority`, `syslog_facility`, `syslog_severity`,
+// `syslog_timestamp`, `syslog_hostname`, `syslog_app_name`, `syslog_proc_id`,
+// `syslog_msg_id` and `syslog_message`, and the structured data parameters of
+// RFC5424 messages as `syslog_sd_<id>_<name>`.
+type syslogParseStage struct {
+	cfg    *SyslogConfig
+	logger log.Logger
+}
+
+// newSyslogParseStage creates a new syslog pipeline stage from a config.
+func newSyslogParseStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseSyslogConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSyslogConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&syslogParseStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "syslog"),
+	}), nil
+}
+
+func parseSyslogConfig(config interface{}) (*SyslogConfig, error) {
+	cfg := &SyslogConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (s *syslogParseStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the syslog stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if s.cfg.Source != nil {
+		if _, ok := extracted[*s.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*s.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(s.logger).Log("msg", "failed to convert source value to string", "source", *s.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*s.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	format := s.cfg.Format
+	if format == "" {
+		format = detectSyslogFormat(*input)
+	}
+
+	// The parsers keep the state of the message being parsed, a new one is
+	// created for every line.
+	var parser syslog.Machine
+	if format == SyslogFormatRFC5424 {
+		parser = rfc5424.NewParser()
+	} else {
+		parser = rfc3164.NewParser(rfc3164.WithYear(rfc3164.CurrentYear{}))
+	}
+	msg, err := parser.Parse([]byte(*input))
+	if err != nil {
+		if Debug {
+			level.Debug(s.logger).Log("msg", "failed to parse syslog message", "format", format, "err", err)
+		}
+		return
+	}
+
+	switch m := msg.(type) {
+	case *rfc5424.SyslogMessage:
+		extractSyslogBase(extracted, &m.Base)
+		if m.StructuredData != nil {
+			for id, params := range *m.StructuredData {
+				id = strings.ReplaceAll(id, "@", "_")
+				for name, value := range params {
+					extracted["syslog_sd_"+id+"_"+name] = value
+				}
+			}
+		}
+	case *rfc3164.SyslogMessage:
+		extractSyslogBase(extracted, &m.Base)
+	}
+	if Debug {
+		level.Debug(s.logger).Log("msg", "extracted data debug in syslog stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// detectSyslogFormat tells RFC5424 messages, whose priority is followed by a
+// version, e.g. `<165>1 `, from RFC3164 ones.
+func detectSyslogFormat(line string) string {
+	end := strings.IndexByte(line, '>')
+	if end == -1 || end+2 >= len(line) {
+		return SyslogFormatRFC3164
+	}
+	rest := line[end+1:]
+	i := 0
+	for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+		i++
+	}
+	if i > 0 && i < len(rest) && rest[i] == ' ' {
+		return SyslogFormatRFC5424
+	}
+	return SyslogFormatRFC3164
+}
+
+// extractSyslogBase sets the fields common to both formats which are present.
+func extractSyslogBase(extracted map[string]interface{}, m *syslog.Base) {
+	if m.Priority != nil {
+		extracted["syslog_priority"] = strconv.Itoa(int(*m.Priority))
+	}
+	if v := m.FacilityLevel(); v != nil {
+		extracted["syslog_facility"] = *v
+	}
+	if v := m.SeverityLevel(); v != nil {
+		extracted["syslog_severity"] = *v
+	}
+	if m.Timestamp != nil {
+		extracted["syslog_timestamp"] = m.Timestamp.Format(time.RFC3339Nano)
+	}
+	if v := m.Hostname; v != nil {
+		extracted["syslog_hostname"] = *v
+	}
+	if v := m.Appname; v != nil {
+		extracted["syslog_app_name"] = *v
+	}
+	if v := m.ProcID; v != nil {
+		extracted["syslog_proc_id"] = *v
+	}
+	if v := m.MsgID; v != nil {
+		extracted["syslog_msg_id"] = *v
+	}
+	if v := m.Message; v != nil {
+		extracted["syslog_message"] = *v
+	}
+}
+
+// Name implements Stage
+func (s *syslogParseStage) Name() string {
+	return StageTypeSyslog
+}
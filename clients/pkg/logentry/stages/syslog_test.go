@@ -0,0 +1,173 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testSyslogYaml = `
+pipeline_stages:
+- syslog:
+`
+
+var testSyslogYamlRFC3164 = `
+pipeline_stages:
+- syslog:
+    format: rfc3164
+`
+
+var testSyslogYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      raw:
+- syslog:
+    source: raw
+    format: rfc5424
+`
+
+const (
+	testSyslogRFC5424 = `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event log entry`
+	testSyslogRFC3164 = `<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed for lonvick on /dev/pts/8`
+)
+
+func TestPipeline_Syslog(t *testing.T) {
+	t.Parallel()
+
+	rfc5424Extracted := map[string]interface{}{
+		"syslog_priority":                         "165",
+		"syslog_facility":                         "local4",
+		"syslog_severity":                         "notice",
+		"syslog_timestamp":                        "2003-10-11T22:14:15.003Z",
+		"syslog_hostname":                         "mymachine.example.com",
+		"syslog_app_name":                         "evntslog",
+		"syslog_proc_id":                          "1234",
+		"syslog_msg_id":                           "ID47",
+		"syslog_message":                          "An application event log entry",
+		"syslog_sd_exampleSDID_32473_iut":         "3",
+		"syslog_sd_exampleSDID_32473_eventSource": "Application",
+	}
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedExtracted map[string]interface{}
+	}{
+		"rfc5424 detected": {
+			testSyslogYaml,
+			testSyslogRFC5424,
+			rfc5424Extracted,
+		},
+		"rfc3164 detected": {
+			testSyslogYaml,
+			testSyslogRFC3164,
+			map[string]interface{}{
+				"syslog_priority": "34",
+				"syslog_facility": "auth",
+				"syslog_severity": "critical",
+				"syslog_hostname": "mymachine",
+				"syslog_app_name": "su",
+				"syslog_proc_id":  "42",
+				"syslog_message":  "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		"rfc5424 source": {
+			testSyslogYamlWithSource,
+			`{"raw":"<13>1 2024-01-02T03:04:05Z host app - - - hello"}`,
+			map[string]interface{}{
+				"raw":              "<13>1 2024-01-02T03:04:05Z host app - - - hello",
+				"syslog_priority":  "13",
+				"syslog_facility":  "user",
+				"syslog_severity":  "notice",
+				"syslog_timestamp": "2024-01-02T03:04:05Z",
+				"syslog_hostname":  "host",
+				"syslog_app_name":  "app",
+				"syslog_message":   "hello",
+			},
+		},
+		"malformed": {
+			testSyslogYamlRFC3164,
+			"not a syslog line",
+			map[string]interface{}{},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			// The year of RFC3164 timestamps is inferred.
+			if _, ok := tt.expectedExtracted["syslog_timestamp"]; !ok {
+				delete(out.Extracted, "syslog_timestamp")
+			}
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestDetectSyslogFormat(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, SyslogFormatRFC5424, detectSyslogFormat(testSyslogRFC5424))
+	assert.Equal(t, SyslogFormatRFC3164, detectSyslogFormat(testSyslogRFC3164))
+	assert.Equal(t, SyslogFormatRFC3164, detectSyslogFormat("<13>"))
+	assert.Equal(t, SyslogFormatRFC3164, detectSyslogFormat("no priority"))
+}
+
+func TestSyslogConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptySyslogStageSource),
+		},
+		"invalid format": {
+			map[string]interface{}{
+				"format": "rfc1234",
+			},
+			errors.Errorf(ErrSyslogInvalidFormat, "rfc1234"),
+		},
+		"autodetect": {
+			nil,
+			nil,
+		},
+		"valid": {
+			map[string]interface{}{
+				"source": "raw",
+				"format": "rfc5424",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseSyslogConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateSyslogConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("SyslogConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
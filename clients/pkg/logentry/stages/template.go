@@ -3,21 +3,35 @@ package stages
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"math"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"text/template/parse"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/cespare/xxhash/v2"
+	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
+	json "github.com/json-iterator/go"
 	"github.com/mitchellh/mapstructure"
 	"github.com/prometheus/common/model"
 
 	"golang.org/x/crypto/sha3"
+
+	logql "github.com/grafana/loki/v3/pkg/logql/log"
 )
 
 // Config Errors
@@ -36,6 +50,8 @@ var extraFunctionMap = template.FuncMap{
 	"TrimPrefix": strings.TrimPrefix,
 	"TrimSuffix": strings.TrimSuffix,
 	"TrimSpace":  strings.TrimSpace,
+	"Capitalize": capitalize,
+	"Decolorize": decolorize,
 	"Hash": func(salt string, input string) string {
 		hash := sha3.Sum256([]byte(salt + input))
 		return hex.EncodeToString(hash[:])
@@ -52,8 +68,150 @@ var extraFunctionMap = template.FuncMap{
 		r := regexp.MustCompile(regex)
 		return r.ReplaceAllLiteralString(s, repl)
 	},
+	"RollingWindow": func(value string, window string, count string) string {
+		return rollingWindow(templateNow(), value, window, count)
+	},
+	"ReformatTime": func(inLayout string, outLayout string, value string) string {
+		ts, err := convertDateLayout(inLayout, nil)(value)
+		if err != nil {
+			return value
+		}
+		if layout, ok := namedTimeLayouts[outLayout]; ok {
+			outLayout = layout
+		}
+		return ts.Format(outLayout)
+	},
+	"ParseTimeUnix": func(layout string, value string) string {
+		ts, err := convertDateLayout(layout, nil)(value)
+		if err != nil {
+			return value
+		}
+		return strconv.FormatInt(ts.Unix(), 10)
+	},
+	"Rendezvous":  rendezvous,
+	"Trunc":       truncate,
+	"StatusClass": statusClass,
+	"MethodClass": methodClass,
+	"MaskEmails":  maskEmails,
+	"MaskUser":    maskUser,
+	"Lt": func(a, b string) bool {
+		return compareNumbers(a, b, func(x, y float64) bool { return x < y })
+	},
+	"Le": func(a, b string) bool {
+		return compareNumbers(a, b, func(x, y float64) bool { return x <= y })
+	},
+	"Gt": func(a, b string) bool {
+		return compareNumbers(a, b, func(x, y float64) bool { return x > y })
+	},
+	"Ge": func(a, b string) bool {
+		return compareNumbers(a, b, func(x, y float64) bool { return x >= y })
+	},
+	"Base32Encode": func(s string) string {
+		return base32.StdEncoding.EncodeToString([]byte(s))
+	},
+	"Base32Decode": func(s string) string {
+		b, err := base32.StdEncoding.DecodeString(s)
+		if err != nil {
+			// Secrets such as TOTP keys are commonly shared without padding.
+			b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+			if err != nil {
+				return s
+			}
+		}
+		return string(b)
+	},
+	"Base64Encode": func(args ...string) string {
+		value, enc, ok := base64Args(args)
+		if !ok {
+			return value
+		}
+		return enc.EncodeToString([]byte(value))
+	},
+	"Base64Decode": func(args ...string) string {
+		value, enc, ok := base64Args(args)
+		if !ok {
+			return value
+		}
+		b, err := enc.DecodeString(value)
+		if err != nil {
+			// Padding is often stripped, e.g. from JWT segments.
+			b, err = enc.WithPadding(base64.NoPadding).DecodeString(value)
+			if err != nil {
+				return value
+			}
+		}
+		return string(b)
+	},
+	"JSONPath": jsonPath,
+	"Default":  defaultValue,
+	"Atoi":     atoi,
+	"ParseInt": parseInt,
+	"Commaize": commaize,
+	// UUID returns a random identifier, the output of a template using it differs
+	// on every line which defeats caching or deduplication downstream.
+	"UUID": func() string {
+		return uuid.NewString()
+	},
+	"UUIDv5":           uuidV5,
+	"Matches":          matches,
+	"Join":             joinList,
+	"SplitList":        splitList,
+	"HumanizeDuration": humanizeDuration,
+	"HumanizeBytes": func(value string) string {
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return value
+		}
+		return humanize.IBytes(n)
+	},
+	"PadLeft": func(width int, char string, value interface{}) string {
+		return pad(width, char, value, true)
+	},
+	"PadRight": func(width int, char string, value interface{}) string {
+		return pad(width, char, value, false)
+	},
+	"DeltaBytes": func(old string, new string) string {
+		o, err := strconv.ParseInt(strings.TrimSpace(old), 10, 64)
+		if err != nil {
+			return ""
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(new), 10, 64)
+		if err != nil {
+			return ""
+		}
+		switch {
+		case n > o:
+			return "+" + humanize.IBytes(uint64(n-o))
+		case n < o:
+			return "-" + humanize.IBytes(uint64(o-n))
+		default:
+			return humanize.IBytes(0)
+		}
+	},
+}
+
+// namedTimeLayouts are the pre-defined layouts accepted as output layout of ReformatTime,
+// input layouts accept the same names as the timestamp stage.
+var namedTimeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
 }
 
+// templateNow returns the current time used by time relative template functions,
+// it can be overridden in tests.
+var templateNow = time.Now
+
+// functionMap holds the functions of the template and replace stages: every
+// function of Sprig, see https://masterminds.github.io/sprig/, and the extra
+// functions, which take precedence over the Sprig functions of the same name.
 var functionMap = sprig.TxtFuncMap()
 
 func init() {
@@ -62,6 +220,473 @@ func init() {
 	}
 }
 
+// rollingWindow returns which of the last `count` windows of size `window`, aligned
+// on window boundaries, the timestamp `value` falls into: `current`, `previous`,
+// then `previous_2`, `previous_3` and so on. Timestamps outside of the tracked
+// windows return `older` or `future`. The timestamp can be RFC3339 or unix seconds.
+// An empty string is returned if any argument cannot be parsed.
+func rollingWindow(now time.Time, value string, window string, count string) string {
+	ts, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return ""
+		}
+		ts = time.Unix(secs, 0)
+	}
+	w, err := time.ParseDuration(window)
+	if err != nil || w <= 0 {
+		return ""
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return ""
+	}
+
+	current := now.Truncate(w)
+	if ts.Before(current) {
+		idx := int64(current.Sub(ts.Truncate(w)) / w)
+		switch {
+		case idx >= int64(n):
+			return "older"
+		case idx == 1:
+			return "previous"
+		default:
+			return "previous_" + strconv.FormatInt(idx, 10)
+		}
+	}
+	if !ts.Before(current.Add(w)) {
+		return "future"
+	}
+	return "current"
+}
+
+// rendezvous picks the node of the comma separated `nodes` list with the highest
+// hash of node and key (highest random weight hashing). Adding or removing a node
+// only moves the keys assigned to that node.
+func rendezvous(key string, nodes string) string {
+	var (
+		best      string
+		bestScore uint64
+	)
+	for _, node := range strings.Split(nodes, ",") {
+		node = strings.TrimSpace(node)
+		if node == "" {
+			continue
+		}
+		score := xxhash.Sum64String(node + "\x00" + key)
+		if best == "" || score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+// truncate limits the value to `length` runes. It is called either as
+// `Trunc 10 .Value` or `Trunc 10 "..." .Value`, in which case the suffix is
+// appended to truncated values and counted in the limit. Non-positive lengths
+// leave the value unchanged.
+func truncate(length int, args ...string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	value, suffix := args[len(args)-1], ""
+	if len(args) > 1 {
+		suffix = args[0]
+	}
+	if length <= 0 || utf8.RuneCountInString(value) <= length {
+		return value
+	}
+	keep := length - utf8.RuneCountInString(suffix)
+	if keep <= 0 {
+		keep, suffix = length, ""
+	}
+	// Find the byte offset of the first rune past the limit.
+	i := 0
+	for n := range value {
+		if i == keep {
+			return value[:n] + suffix
+		}
+		i++
+	}
+	return value
+}
+
+// statusClass groups an HTTP status code into its class, e.g. `2xx` for `204`.
+// Anything else than a code between 100 and 599 returns `unknown`.
+func statusClass(code string) string {
+	c, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil || c < 100 || c > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(c/100) + "xx"
+}
+
+// methodClass groups an HTTP method into `read` for safe methods and `write`
+// for the ones modifying resources. Other methods return `unknown`.
+func methodClass(method string) string {
+	switch strings.ToUpper(strings.TrimSpace(method)) {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return "read"
+	case "POST", "PUT", "PATCH", "DELETE":
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+var emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)+`)
+
+// maskEmails masks every email address of s, keeping the first character of the
+// local part and of each domain label as well as the top level domain, e.g.
+// `john@mail.example.com` becomes `j***@m***.e******.com`. The length and the
+// text around the addresses are preserved.
+func maskEmails(s string) string {
+	return emailRegexp.ReplaceAllStringFunc(s, func(email string) string {
+		at := strings.LastIndexByte(email, '@')
+		labels := strings.Split(email[at+1:], ".")
+		for i := 0; i < len(labels)-1; i++ {
+			labels[i] = maskKeepFirst(labels[i])
+		}
+		return maskKeepFirst(email[:at]) + "@" + strings.Join(labels, ".")
+	})
+}
+
+func maskKeepFirst(s string) string {
+	if len(s) <= 1 {
+		return s
+	}
+	return s[:1] + strings.Repeat("*", len(s)-1)
+}
+
+// maskUser anonymizes a username deterministically. For `user@domain` forms the
+// local part is replaced with the first 16 hex characters of its SHA-256 hash
+// and the domain is kept, bare usernames keep only their first and last
+// characters. Values that are empty or contain whitespace are returned as is.
+func maskUser(s string) string {
+	if s == "" || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return s
+	}
+	if at := strings.LastIndexByte(s, '@'); at >= 0 {
+		if at == 0 || at == len(s)-1 {
+			return s
+		}
+		hash := sha256.Sum256([]byte(s[:at]))
+		return hex.EncodeToString(hash[:])[:16] + s[at:]
+	}
+	runes := []rune(s)
+	if len(runes) <= 2 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[0]) + strings.Repeat("*", len(runes)-2) + string(runes[len(runes)-1])
+}
+
+// base64Args splits the arguments of Base64Encode and Base64Decode, called
+// either as `Base64Encode .Value` or `Base64Encode "url" .Value`. The variant is
+// `std` (the default) or `url`, ok is false for unknown variants.
+func base64Args(args []string) (value string, enc *base64.Encoding, ok bool) {
+	if len(args) == 0 {
+		return "", nil, false
+	}
+	value = args[len(args)-1]
+	if len(args) == 1 {
+		return value, base64.StdEncoding, true
+	}
+	switch args[0] {
+	case "std":
+		return value, base64.StdEncoding, true
+	case "url":
+		return value, base64.URLEncoding, true
+	default:
+		return value, nil, false
+	}
+}
+
+// jsonPath returns the value at a dot separated path, e.g. `user.roles.0`, of a
+// JSON document. Strings are returned unquoted, objects and arrays as JSON. An
+// empty string is returned when the document is malformed or the path missing.
+func jsonPath(path string, value string) string {
+	var keys []interface{}
+	if path != "" {
+		keys = make([]interface{}, 0, strings.Count(path, ".")+1)
+		for rest, more := path, true; more; {
+			var key string
+			key, rest, more = strings.Cut(rest, ".")
+			if i, err := strconv.Atoi(key); err == nil {
+				keys = append(keys, i)
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	v := json.Get([]byte(value), keys...)
+	if v.LastError() != nil {
+		return ""
+	}
+	return v.ToString()
+}
+
+// defaultValue returns def when the value is missing or empty, as in
+// `{{ .maybe | Default "n/a" }}`.
+func defaultValue(def string, value interface{}) string {
+	if value == nil {
+		return def
+	}
+	s, err := getString(value)
+	if err != nil || s == "" {
+		return def
+	}
+	return s
+}
+
+// capitalize title-cases the first rune of s and leaves the others unchanged,
+// e.g. `error` into `Error`, unlike ToTitle which changes every rune.
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+	title := unicode.ToTitle(r)
+	if title == r {
+		return s
+	}
+	return string(title) + s[size:]
+}
+
+// decolorize strips the ANSI escape sequences of s, e.g. for a captured value
+// to be colorless when the rest of the line is not decolorized. It uses the
+// decolorizer of the decolorize stage.
+func decolorize(s string) string {
+	line, _ := logql.Decolorizer{}.Process(0, []byte(s), nil)
+	return string(line)
+}
+
+// atoi returns the decimal integer of the value, or def when it is not one, as
+// in `{{ if gt (.status | Atoi 0) 499 }}`.
+func atoi(def int, value string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// parseInt returns the integer of the value in the base, or def when it is not
+// one, as in `{{ .flags | ParseInt 16 0 }}`. The base is between 2 and 36, or 0
+// to infer it from the prefix of the value, e.g. `0x`; the `0x` prefix is also
+// accepted with base 16.
+func parseInt(base int, def int64, value string) int64 {
+	value = strings.TrimSpace(value)
+	if base == 16 {
+		if unsigned := strings.TrimLeft(value, "+-"); strings.HasPrefix(unsigned, "0x") || strings.HasPrefix(unsigned, "0X") {
+			value = value[:len(value)-len(unsigned)] + unsigned[2:]
+		}
+	}
+	n, err := strconv.ParseInt(value, base, 64)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// commaize groups the digits of the integer part of a number by thousands with
+// the separator, e.g. `1234567.891` into `1,234,567.891` with `,`, as in
+// `{{ .bytes | Commaize "," }}`. The fractional part is left unchanged, and the
+// values which are not decimal numbers are returned as is.
+func commaize(sep string, value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return value
+	}
+	digits := strings.TrimLeft(value, "+-")
+	sign := value[:len(value)-len(digits)]
+	fraction := ""
+	if i := strings.IndexAny(digits, ".eE"); i >= 0 {
+		digits, fraction = digits[:i], digits[i:]
+	}
+	for _, r := range digits {
+		// Inf, NaN or a hexadecimal float.
+		if r < '0' || r > '9' {
+			return value
+		}
+	}
+	if len(digits) <= 3 {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value) + len(digits)/3*len(sep))
+	b.WriteString(sign)
+	head := len(digits) % 3
+	if head == 0 {
+		head = 3
+	}
+	b.WriteString(digits[:head])
+	for i := head; i < len(digits); i += 3 {
+		b.WriteString(sep)
+		b.WriteString(digits[i : i+3])
+	}
+	b.WriteString(fraction)
+	return b.String()
+}
+
+// uuidV5 returns the deterministic UUID of name in the namespace, so the same
+// value is always pseudonymized with the same identifier. The namespace is
+// either a UUID or any string, from which a namespace UUID is derived.
+func uuidV5(namespace string, name string) string {
+	ns, err := uuid.Parse(namespace)
+	if err != nil {
+		ns = uuid.NewSHA1(uuid.NameSpaceOID, []byte(namespace))
+	}
+	return uuid.NewSHA1(ns, []byte(name)).String()
+}
+
+// joinList joins the elements of a list, e.g. the values collected from every
+// match, as in `{{ Join "," .ips }}`. Elements which cannot be converted to
+// strings are skipped and a single string is returned as is.
+func joinList(delimiter string, list interface{}) string {
+	switch l := list.(type) {
+	case []string:
+		return strings.Join(l, delimiter)
+	case []interface{}:
+		elements := make([]string, 0, len(l))
+		for _, e := range l {
+			if s, err := getString(e); err == nil {
+				elements = append(elements, s)
+			}
+		}
+		return strings.Join(elements, delimiter)
+	case string:
+		return l
+	}
+	return ""
+}
+
+// splitList splits a value into the list of its elements, which is empty for an
+// empty value, as in `{{ range SplitList "," .ips }}`.
+func splitList(delimiter string, value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, delimiter)
+}
+
+// getPath returns the extracted value at a dotted path, as in
+// `{{ Get "http.request.path" }}`, resolved through the nested maps and arrays,
+// or their JSON encoding as extracted by the json stage. A key holding the
+// whole path is returned first, and nested values are returned as JSON. Missing
+// paths return an empty string.
+func getPath(extracted map[string]interface{}, path string) string {
+	v, ok := extracted[path]
+	if !ok {
+		var cur interface{} = extracted
+		for _, key := range strings.Split(path, ".") {
+			if nested, ok := parseNested(cur); ok {
+				cur = nested
+			}
+			switch t := cur.(type) {
+			case map[string]interface{}:
+				if cur, ok = t[key]; !ok {
+					return ""
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(t) {
+					return ""
+				}
+				cur = t[i]
+			default:
+				return ""
+			}
+		}
+		v = cur
+	}
+	if isNested(v) {
+		return marshalFlattened(v)
+	}
+	s, err := getString(v)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// matchesPatterns caches the expressions compiled by Matches, by pattern. The
+// invalid patterns are cached as nil.
+var matchesPatterns sync.Map
+
+// matches reports whether the value matches the pattern, as in
+// `{{ if Matches .Value "^\\d+$" }}`. Invalid patterns never match.
+func matches(value string, pattern string) bool {
+	cached, ok := matchesPatterns.Load(pattern)
+	if !ok {
+		// Compile returns a nil expression for invalid patterns.
+		re, _ := regexp.Compile(pattern)
+		cached, _ = matchesPatterns.LoadOrStore(pattern, re)
+	}
+	re := cached.(*regexp.Regexp)
+	return re != nil && re.MatchString(value)
+}
+
+// humanizeDuration formats a number of seconds or a duration string, e.g. `7380`
+// or `123m`, as a duration without its zero trailing units, `2h3m`. Invalid
+// values are returned unchanged.
+func humanizeDuration(value string) string {
+	v := strings.TrimSpace(value)
+	var d time.Duration
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) || math.Abs(seconds) > math.MaxInt64/float64(time.Second) {
+			return value
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	} else if d, err = time.ParseDuration(v); err != nil {
+		return value
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// pad pads the value with the first rune of char, a space when char is empty,
+// to width runes, e.g. `{{ .status | PadLeft 5 "0" }}` renders `00200`. Values
+// already as long as the width are left unchanged.
+func pad(width int, char string, value interface{}, left bool) string {
+	s, err := getString(value)
+	if err != nil {
+		return ""
+	}
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s
+	}
+	r, _ := utf8.DecodeRuneInString(char)
+	if char == "" {
+		r = ' '
+	}
+	padding := strings.Repeat(string(r), n)
+	if left {
+		return padding + s
+	}
+	return s + padding
+}
+
+// compareNumbers parses both operands as float64 and compares them. A non-numeric
+// operand makes the comparison false, so that a template keeps rendering.
+func compareNumbers(a, b string, cmp func(x, y float64) bool) bool {
+	x, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if err != nil {
+		return false
+	}
+	return cmp(x, y)
+}
+
 // TemplateConfig configures template value extraction
 type TemplateConfig struct {
 	Source   string `mapstructure:"source"`
@@ -77,7 +702,71 @@ func validateTemplateConfig(cfg *TemplateConfig) (*template.Template, error) {
 		return nil, errors.New(ErrTemplateSourceRequired)
 	}
 
-	return template.New("pipeline_template").Funcs(functionMap).Parse(cfg.Template)
+	// Get is only declared here, the template stage binds it to the extracted
+	// values of each entry, see getPath.
+	return template.New("pipeline_template").Funcs(functionMap).Funcs(template.FuncMap{
+		"Get": func(string) string { return "" },
+	}).Parse(cfg.Template)
+}
+
+// callsGet reports whether the template, or one of its associated templates,
+// calls the Get function.
+func callsGet(t *template.Template) bool {
+	for _, t := range t.Templates() {
+		if t.Tree != nil && nodeCallsGet(t.Tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeCallsGet walks the parse tree looking for a call to the Get function.
+func nodeCallsGet(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, n := range n.Nodes {
+			if nodeCallsGet(n) {
+				return true
+			}
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeCallsGet(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeCallsGet(arg) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeCallsGet(n.Pipe)
+	case *parse.TemplateNode:
+		return nodeCallsGet(n.Pipe)
+	case *parse.ChainNode:
+		return nodeCallsGet(n.Node)
+	case *parse.IfNode:
+		return branchCallsGet(&n.BranchNode)
+	case *parse.RangeNode:
+		return branchCallsGet(&n.BranchNode)
+	case *parse.WithNode:
+		return branchCallsGet(&n.BranchNode)
+	case *parse.IdentifierNode:
+		return n.Ident == "Get"
+	}
+	return false
+}
+
+func branchCallsGet(n *parse.BranchNode) bool {
+	return nodeCallsGet(n.Pipe) || nodeCallsGet(n.List) || nodeCallsGet(n.ElseList)
 }
 
 // newTemplateStage creates a new templateStage
@@ -96,6 +785,7 @@ func newTemplateStage(logger log.Logger, config interface{}) (Stage, error) {
 		cfgs:     cfg,
 		logger:   logger,
 		template: t,
+		usesGet:  callsGet(t),
 	}), nil
 }
 
@@ -104,6 +794,9 @@ type templateStage struct {
 	cfgs     *TemplateConfig
 	logger   log.Logger
 	template *template.Template
+	// usesGet is set when the template calls Get, which is then bound to the
+	// extracted values of each entry.
+	usesGet bool
 }
 
 // Process implements Stage
@@ -115,6 +808,15 @@ func (o *templateStage) Process(_ model.LabelSet, extracted map[string]interface
 	for k, v := range extracted {
 		s, err := getString(v)
 		if err != nil {
+			switch v.(type) {
+			case []string, []interface{}:
+				// Lists are kept as is for the functions like Join.
+				td[k] = v
+				if k == o.cfgs.Source {
+					td["Value"] = v
+				}
+				continue
+			}
 			if Debug {
 				level.Debug(o.logger).Log("msg", "extracted template could not be converted to a string", "err", err, "type", reflect.TypeOf(v))
 			}
@@ -127,8 +829,24 @@ func (o *templateStage) Process(_ model.LabelSet, extracted map[string]interface
 	}
 	td["Entry"] = *entry
 
+	tmpl := o.template
+	if o.usesGet {
+		var err error
+		if tmpl, err = o.template.Clone(); err != nil {
+			if Debug {
+				level.Debug(o.logger).Log("msg", "failed to clone template", "err", err)
+			}
+			return
+		}
+		tmpl.Funcs(template.FuncMap{
+			"Get": func(path string) string {
+				return getPath(extracted, path)
+			},
+		})
+	}
+
 	buf := &bytes.Buffer{}
-	err := o.template.Execute(buf, td)
+	err := tmpl.Execute(buf, td)
 	if err != nil {
 		if Debug {
 			level.Debug(o.logger).Log("msg", "failed to execute template on extracted value", "err", err)
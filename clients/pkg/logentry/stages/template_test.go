@@ -3,11 +3,14 @@ package stages
 import (
 	"bytes"
 	"errors"
+	"strconv"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
@@ -372,6 +375,193 @@ func TestTemplateStage_Process(t *testing.T) {
 				"testval": "0807ea24e992127128b38e4930f7155013786a4999c73a25910318a793847658",
 			},
 		},
+		"ReformatTime": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: `{{ ReformatTime "02/Jan/2006:15:04:05 -0700" "RFC3339" .Value }}`,
+			},
+			map[string]interface{}{
+				"testval": "25/Jan/2000:14:00:01 -0500",
+			},
+			map[string]interface{}{
+				"testval": "2000-01-25T14:00:01-05:00",
+			},
+		},
+		"ReformatTime custom output": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: `{{ .Value | ReformatTime "RFC3339" "2006-01-02" }}`,
+			},
+			map[string]interface{}{
+				"testval": "2019-01-01T01:00:00.000000001Z",
+			},
+			map[string]interface{}{
+				"testval": "2019-01-01",
+			},
+		},
+		"ReformatTime malformed": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: `{{ ReformatTime "RFC3339" "2006-01-02" .Value }}`,
+			},
+			map[string]interface{}{
+				"testval": "not a time",
+			},
+			map[string]interface{}{
+				"testval": "not a time",
+			},
+		},
+		"ParseTimeUnix": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: `{{ .Value | ParseTimeUnix "RFC3339" }}`,
+			},
+			map[string]interface{}{
+				"testval": "2019-01-01T01:00:00Z",
+			},
+			map[string]interface{}{
+				"testval": "1546304400",
+			},
+		},
+		"ParseTimeUnix malformed": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: `{{ ParseTimeUnix "RFC3339" .Value }}`,
+			},
+			map[string]interface{}{
+				"testval": "2019-13-01",
+			},
+			map[string]interface{}{
+				"testval": "2019-13-01",
+			},
+		},
+		"DeltaBytes growth": {
+			TemplateConfig{
+				Source:   "delta",
+				Template: `{{ DeltaBytes .old .new }}`,
+			},
+			map[string]interface{}{
+				"old": "1048576",
+				"new": "2306867",
+			},
+			map[string]interface{}{
+				"old":   "1048576",
+				"new":   "2306867",
+				"delta": "+1.2 MiB",
+			},
+		},
+		"DeltaBytes shrink": {
+			TemplateConfig{
+				Source:   "delta",
+				Template: `{{ DeltaBytes .old .new }}`,
+			},
+			map[string]interface{}{
+				"old": 4096,
+				"new": 1024,
+			},
+			map[string]interface{}{
+				"old":   4096,
+				"new":   1024,
+				"delta": "-3.0 KiB",
+			},
+		},
+		"DeltaBytes equal": {
+			TemplateConfig{
+				Source:   "delta",
+				Template: `{{ DeltaBytes .old .new }}`,
+			},
+			map[string]interface{}{
+				"old": "512",
+				"new": "512",
+			},
+			map[string]interface{}{
+				"old":   "512",
+				"new":   "512",
+				"delta": "0 B",
+			},
+		},
+		"DeltaBytes invalid": {
+			TemplateConfig{
+				Source:   "delta",
+				Template: `{{ DeltaBytes "12" "a lot" }}`,
+			},
+			map[string]interface{}{
+				"delta": "previous",
+			},
+			map[string]interface{}{},
+		},
+		"Base32Encode": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: "{{ Base32Encode .Value }}",
+			},
+			map[string]interface{}{
+				"testval": "loki",
+			},
+			map[string]interface{}{
+				"testval": "NRXWW2I=",
+			},
+		},
+		"Base32 round trip": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: "{{ .Value | Base32Encode | Base32Decode }}",
+			},
+			map[string]interface{}{
+				"testval": "this is PII data",
+			},
+			map[string]interface{}{
+				"testval": "this is PII data",
+			},
+		},
+		"Base32Decode without padding": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: "{{ Base32Decode .Value }}",
+			},
+			map[string]interface{}{
+				"testval": "NRXWW2I",
+			},
+			map[string]interface{}{
+				"testval": "loki",
+			},
+		},
+		"Base32Decode malformed": {
+			TemplateConfig{
+				Source:   "testval",
+				Template: "{{ Base32Decode .Value }}",
+			},
+			map[string]interface{}{
+				"testval": "not base32!",
+			},
+			map[string]interface{}{
+				"testval": "not base32!",
+			},
+		},
+		"Join collected values": {
+			TemplateConfig{
+				Source:   "ips",
+				Template: `{{ Join "," .Value }}`,
+			},
+			map[string]interface{}{
+				"ips": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			},
+			map[string]interface{}{
+				"ips": "10.0.0.1,10.0.0.2,10.0.0.3",
+			},
+		},
+		"SplitList": {
+			TemplateConfig{
+				Source:   "ips",
+				Template: `{{ range $i, $ip := SplitList "," .Value }}{{ if $i }} {{ end }}[{{ $ip }}]{{ end }}`,
+			},
+			map[string]interface{}{
+				"ips": "10.0.0.1,10.0.0.2",
+			},
+			map[string]interface{}{
+				"ips": "[10.0.0.1] [10.0.0.2]",
+			},
+		},
 	}
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -381,8 +571,697 @@ func TestTemplateStage_Process(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			out := processEntries(st, newEntry(test.expectedExtracted, nil, "not important for this test", time.Time{}))[0]
+			out := processEntries(st, newEntry(test.extracted, nil, "not important for this test", time.Time{}))[0]
 			assert.Equal(t, test.expectedExtracted, out.Extracted)
 		})
 	}
 }
+
+func TestRollingWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	tests := map[string]struct {
+		value    string
+		window   string
+		count    string
+		expected string
+	}{
+		"current window start":   {"2024-05-01T10:00:00Z", "1h", "3", "current"},
+		"current window end":     {"2024-05-01T10:59:59Z", "1h", "3", "current"},
+		"previous window end":    {"2024-05-01T09:59:59Z", "1h", "3", "previous"},
+		"previous window start":  {"2024-05-01T09:00:00Z", "1h", "3", "previous"},
+		"second previous window": {"2024-05-01T08:15:00Z", "1h", "3", "previous_2"},
+		"older than count":       {"2024-05-01T07:59:59Z", "1h", "3", "older"},
+		"future":                 {"2024-05-01T11:00:00Z", "1h", "3", "future"},
+		"unix seconds":           {"1714554000", "1h", "3", "previous"},
+		"invalid timestamp":      {"yesterday", "1h", "3", ""},
+		"invalid window":         {"2024-05-01T10:00:00Z", "1x", "3", ""},
+		"invalid count":          {"2024-05-01T10:00:00Z", "1h", "0", ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rollingWindow(now, tt.value, tt.window, tt.count))
+		})
+	}
+
+	defer func(f func() time.Time) { templateNow = f }(templateNow)
+	templateNow = func() time.Time { return now }
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "ts",
+		Template: `{{ RollingWindow .Value "1h" "2" }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"ts": "2024-05-01T09:30:00Z"}, nil, "", time.Time{}))[0]
+	assert.Equal(t, "previous", out.Extracted["ts"])
+}
+
+func TestRendezvous(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "", rendezvous("key", ""))
+	assert.Equal(t, "a", rendezvous("key", " a ,"))
+	assert.Equal(t, rendezvous("key", "a,b,c,d"), rendezvous("key", "d,c,b,a"), "order of nodes must not matter")
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		before := rendezvous(key, "a,b,c,d")
+		assert.Equal(t, before, rendezvous(key, "a,b,c,d"), "assignment must be stable")
+		after := rendezvous(key, "a,b,d")
+		if before != "c" {
+			assert.Equal(t, before, after, "only keys of the removed node may move")
+			continue
+		}
+		moved++
+	}
+	// Roughly a quarter of the keys were assigned to the removed node.
+	assert.InDelta(t, 250, moved, 75)
+}
+
+func TestTrunc(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		length   int
+		args     []string
+		expected string
+	}{
+		"ascii":                 {5, []string{"hello world"}, "hello"},
+		"ascii with suffix":     {8, []string{"...", "hello world"}, "hello..."},
+		"shorter than length":   {20, []string{"...", "hello world"}, "hello world"},
+		"exact length":          {11, []string{"hello world"}, "hello world"},
+		"multibyte":             {3, []string{"日本語テキスト"}, "日本語"},
+		"multibyte with suffix": {4, []string{"…", "日本語テキスト"}, "日本語…"},
+		"suffix longer":         {2, []string{"...", "hello"}, "he"},
+		"zero length":           {0, []string{"hello"}, "hello"},
+		"negative length":       {-3, []string{"hello"}, "hello"},
+		"no value":              {3, nil, ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, truncate(tt.length, tt.args...))
+		})
+	}
+
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "msg",
+		Template: `{{ .Value | Trunc 6 "…" }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"msg": "java.lang.NullPointerException"}, nil, "", time.Time{}))[0]
+	assert.Equal(t, "java.…", out.Extracted["msg"])
+}
+
+func TestStatusClass(t *testing.T) {
+	t.Parallel()
+
+	for code, expected := range map[string]string{
+		"100":  "1xx",
+		"200":  "2xx",
+		"204":  "2xx",
+		"301":  "3xx",
+		"404":  "4xx",
+		"429":  "4xx",
+		"500":  "5xx",
+		"599":  "5xx",
+		" 503": "5xx",
+		"600":  "unknown",
+		"99":   "unknown",
+		"-200": "unknown",
+		"2xx":  "unknown",
+		"":     "unknown",
+	} {
+		assert.Equal(t, expected, statusClass(code), "code %q", code)
+	}
+}
+
+func TestMethodClass(t *testing.T) {
+	t.Parallel()
+
+	for method, expected := range map[string]string{
+		"GET":      "read",
+		"get":      "read",
+		"HEAD":     "read",
+		"OPTIONS":  "read",
+		"TRACE":    "read",
+		"POST":     "write",
+		"put":      "write",
+		"PATCH":    "write",
+		"DELETE":   "write",
+		"CONNECT":  "unknown",
+		"PROPFIND": "unknown",
+		"":         "unknown",
+	} {
+		assert.Equal(t, expected, methodClass(method), "method %q", method)
+	}
+
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "route",
+		Template: `{{ MethodClass .method }}_{{ StatusClass .status }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"method": "POST", "status": "201"}, nil, "", time.Time{}))[0]
+	assert.Equal(t, "write_2xx", out.Extracted["route"])
+}
+
+func TestMaskEmails(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		input    string
+		expected string
+	}{
+		"single":             {"john@example.com", "j***@e******.com"},
+		"subdomain":          {"john.doe@mail.example.co.uk", "j*******@m***.e******.c*.uk"},
+		"csv":                {"a@b.io,jane+loki@grafana.com; bob@corp.net", "a@b.io,j********@g******.com; b**@c***.net"},
+		"surrounding text":   {"sent to <alice@example.org> and alice@example.org.", "sent to <a****@e******.org> and a****@e******.org."},
+		"no email":           {"user frank logged in", "user frank logged in"},
+		"incomplete address": {"frank@localhost", "frank@localhost"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, maskEmails(tt.input))
+		})
+	}
+}
+
+func TestMaskUser(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		input    string
+		expected string
+	}{
+		"email":              {"frank@example.com", "77646f5a4f316663@example.com"},
+		"same local part":    {"frank@grafana.com", "77646f5a4f316663@grafana.com"},
+		"bare username":      {"frank", "f***k"},
+		"multibyte username": {"ユーザー名", "ユ***名"},
+		"short username":     {"fr", "**"},
+		"empty":              {"", ""},
+		"sentence":           {"user frank logged in", "user frank logged in"},
+		"missing local part": {"@example.com", "@example.com"},
+		"missing domain":     {"frank@", "frank@"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, maskUser(tt.input))
+		})
+	}
+}
+
+func TestNumericComparisons(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		a, b           string
+		lt, le, gt, ge bool
+	}{
+		"less":             {"200", "400", true, true, false, false},
+		"equal":            {"400", "400", false, true, false, true},
+		"greater":          {"503", "400", false, false, true, true},
+		"floats":           {"0.25", "1e-1", false, false, true, true},
+		"not numeric":      {"OK", "400", false, false, false, false},
+		"not numeric rhs":  {"400", "-", false, false, false, false},
+		"empty":            {"", "0", false, false, false, false},
+		"padded":           {" 404 ", "400", false, false, true, true},
+		"NaN never equals": {"NaN", "NaN", false, false, false, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for fn, expected := range map[string]bool{"Lt": tt.lt, "Le": tt.le, "Gt": tt.gt, "Ge": tt.ge} {
+				actual := extraFunctionMap[fn].(func(string, string) bool)(tt.a, tt.b)
+				assert.Equal(t, expected, actual, "%s %q %q", fn, tt.a, tt.b)
+			}
+		})
+	}
+
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "status",
+		Template: `{{ if Ge .Value "500" }}error{{ else if Ge .Value "400" }}warn{{ else }}ok{{ end }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for status, expected := range map[string]string{"200": "ok", "404": "warn", "503": "error", "-": "ok"} {
+		out := processEntries(st, newEntry(map[string]interface{}{"status": status}, nil, "", time.Time{}))[0]
+		assert.Equal(t, expected, out.Extracted["status"], "status %q", status)
+	}
+}
+
+func TestBase64(t *testing.T) {
+	t.Parallel()
+
+	encode := extraFunctionMap["Base64Encode"].(func(...string) string)
+	decode := extraFunctionMap["Base64Decode"].(func(...string) string)
+
+	for _, value := range []string{"", "loki", "logs?and>more", "日本語", "\x00\xff\xfe"} {
+		assert.Equal(t, value, decode(encode(value)), "std round trip of %q", value)
+		assert.Equal(t, value, decode("std", encode("std", value)), "std round trip of %q", value)
+		assert.Equal(t, value, decode("url", encode("url", value)), "url round trip of %q", value)
+	}
+
+	assert.Equal(t, "bG9ncz9hbmQ+bW9yZQ==", encode("logs?and>more"))
+	assert.Equal(t, "bG9ncz9hbmQ-bW9yZQ==", encode("url", "logs?and>more"))
+	assert.Equal(t, "loki", decode("bG9raQ"), "missing padding")
+	assert.Equal(t, "logs?and>more", decode("url", "bG9ncz9hbmQ-bW9yZQ"), "missing padding")
+
+	// Decode failures and unknown variants return the original string.
+	assert.Equal(t, "not base64!", decode("not base64!"))
+	assert.Equal(t, "bG9ncz9hbmQ-bW9yZQ==", decode("bG9ncz9hbmQ-bW9yZQ=="), "url alphabet with std variant")
+	assert.Equal(t, "loki", encode("hex", "loki"))
+	assert.Equal(t, "bG9raQ==", decode("hex", "bG9raQ=="))
+	assert.Equal(t, "", encode())
+
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "blob",
+		Template: `{{ .Value | Base64Encode "url" }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(map[string]interface{}{"blob": "logs?and>more"}, nil, "", time.Time{}))[0]
+	assert.Equal(t, "bG9ncz9hbmQ-bW9yZQ==", out.Extracted["blob"])
+}
+
+func TestJSONPath(t *testing.T) {
+	t.Parallel()
+
+	doc := `{"user":{"name":"frank","roles":["admin","dev"],"age":42,"meta":{"active":true}}}`
+	tests := map[string]struct {
+		path     string
+		value    string
+		expected string
+	}{
+		"nested string":  {"user.name", doc, "frank"},
+		"array index":    {"user.roles.1", doc, "dev"},
+		"number":         {"user.age", doc, "42"},
+		"bool":           {"user.meta.active", doc, "true"},
+		"object":         {"user.meta", doc, `{"active":true}`},
+		"missing key":    {"user.email", doc, ""},
+		"out of range":   {"user.roles.5", doc, ""},
+		"malformed json": {"user.name", `{"user":`, ""},
+		"not json":       {"user", `user=frank`, ""},
+		"empty value":    {"user", "", ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, jsonPath(tt.path, tt.value))
+		})
+	}
+
+	st, err := newReplaceStage(util_log.Logger, map[string]interface{}{
+		"expression": `payload=(\{.*\})`,
+		"replace":    `{{ .Value | JSONPath "user.name" }}`,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(st, newEntry(nil, nil, "level=info payload="+doc, time.Time{}))[0]
+	assert.Equal(t, "level=info payload=frank", out.Line)
+}
+
+func TestDefault(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "frank", defaultValue("n/a", "frank"))
+	assert.Equal(t, "n/a", defaultValue("n/a", ""))
+	assert.Equal(t, "n/a", defaultValue("n/a", nil))
+	assert.Equal(t, "42", defaultValue("n/a", 42))
+}
+
+func TestCapitalize(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]string{
+		"error":       "Error",
+		"Error":       "Error",
+		"wARN":        "WARN",
+		"info level":  "Info level",
+		"élevé":       "Élevé",
+		"ǆungla":      "ǅungla",
+		"日本":          "日本",
+		"42 warnings": "42 warnings",
+		"":            "",
+		"\xffinvalid": "\xffinvalid",
+	} {
+		assert.Equal(t, expected, capitalize(value), value)
+	}
+
+	tmpl, err := template.New("capitalize").Funcs(extraFunctionMap).Parse(`{{ .level | Capitalize }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, map[string]string{"level": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Debug", buf.String())
+}
+
+func TestDecolorize(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]string{
+		"\x1b[31merror\x1b[0m":            "error",
+		"\x1b[1;33mWARN\x1b[0m disk full": "WARN disk full",
+		"\x1b[38;5;208mamber\x1b[m":       "amber",
+		"plain text":                      "plain text",
+		"":                                "",
+	} {
+		assert.Equal(t, expected, decolorize(value), value)
+	}
+
+	tmpl, err := template.New("decolorize").Funcs(extraFunctionMap).Parse(`level={{ .level | Decolorize | ToLower }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, map[string]string{"level": "\x1b[32mINFO\x1b[0m"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "level=info", buf.String())
+}
+
+func TestCommaize(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		sep, value, expected string
+	}{
+		{",", "1234567", "1,234,567"},
+		{",", "123456", "123,456"},
+		{",", "1234", "1,234"},
+		{",", "999", "999"},
+		{",", "0", "0"},
+		{",", "-1234567", "-1,234,567"},
+		{",", "+1234", "+1,234"},
+		{",", "1234567.891", "1,234,567.891"},
+		{",", "-0.5", "-0.5"},
+		{",", "1234e3", "1,234e3"},
+		{".", "1234567", "1.234.567"},
+		{" ", "1234567", "1 234 567"},
+		{"'", "1234567", "1'234'567"},
+		{",", "", ""},
+		{",", "n/a", "n/a"},
+		{",", "12ab34", "12ab34"},
+		{",", "Inf", "Inf"},
+		{",", "NaN", "NaN"},
+		{",", "0x1p10", "0x1p10"},
+		{",", " 1234", " 1234"},
+	} {
+		assert.Equal(t, tt.expected, commaize(tt.sep, tt.value), tt.value)
+	}
+
+	tmpl, err := template.New("commaize").Funcs(extraFunctionMap).Parse(`sent {{ .bytes | Commaize "," }} bytes`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, map[string]string{"bytes": "73400320"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sent 73,400,320 bytes", buf.String())
+}
+
+func TestParseInt(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 503, atoi(0, "503"))
+	assert.Equal(t, -12, atoi(0, " -12 "))
+	assert.Equal(t, -1, atoi(-1, "5xx"))
+	assert.Equal(t, -1, atoi(-1, "1.5"))
+	assert.Equal(t, -1, atoi(-1, ""))
+
+	assert.Equal(t, int64(255), parseInt(10, 0, "255"))
+	assert.Equal(t, int64(255), parseInt(16, 0, "ff"))
+	assert.Equal(t, int64(255), parseInt(16, 0, "FF"))
+	assert.Equal(t, int64(255), parseInt(16, 0, "0xff"))
+	assert.Equal(t, int64(-255), parseInt(16, 0, "-0XFF"))
+	assert.Equal(t, int64(5), parseInt(2, 0, "101"))
+	assert.Equal(t, int64(8), parseInt(0, 0, "0o10"))
+	assert.Equal(t, int64(-1), parseInt(16, -1, "0xzz"))
+	assert.Equal(t, int64(-1), parseInt(10, -1, "ff"))
+	assert.Equal(t, int64(-1), parseInt(10, -1, "99999999999999999999"))
+	assert.Equal(t, int64(-1), parseInt(99, -1, "1"))
+
+	st, err := newTemplateStage(util_log.Logger, TemplateConfig{
+		Source:   "class",
+		Template: `{{ if ge (.status | Atoi 0) 500 }}error{{ else if eq (.flags | ParseInt 16 0) 16 }}flagged{{ else }}ok{{ end }}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		status, flags, expected string
+	}{
+		{"503", "0x00", "error"},
+		{"200", "0x10", "flagged"},
+		{"200", "10", "flagged"},
+		{"-", "bad", "ok"},
+		// Compared as integers, 60 is below 500 although "60" sorts after "500".
+		{"60", "0", "ok"},
+	} {
+		out := processEntries(st, newEntry(map[string]interface{}{"status": tt.status, "flags": tt.flags}, nil, "", time.Time{}))[0]
+		assert.Equal(t, tt.expected, out.Extracted["class"], tt.status+" "+tt.flags)
+	}
+}
+
+func TestPad(t *testing.T) {
+	t.Parallel()
+
+	padLeft := extraFunctionMap["PadLeft"].(func(int, string, interface{}) string)
+	padRight := extraFunctionMap["PadRight"].(func(int, string, interface{}) string)
+
+	assert.Equal(t, "00200", padLeft(5, "0", "200"))
+	assert.Equal(t, "00042", padLeft(5, "0", 42))
+	assert.Equal(t, "ab   ", padRight(5, "", "ab"))
+	assert.Equal(t, "ab...", padRight(5, ".-", "ab"))
+	// Values already as long as the width are unchanged.
+	assert.Equal(t, "123456", padLeft(5, "0", "123456"))
+	assert.Equal(t, "abc", padRight(0, "*", "abc"))
+	assert.Equal(t, "abc", padRight(-1, "*", "abc"))
+	// The width is counted in runes.
+	assert.Equal(t, "··日本", padLeft(4, "·", "日本"))
+	assert.Equal(t, "日本語■■", padRight(5, "■", "日本語"))
+
+	tmpl, err := template.New("pad").Funcs(extraFunctionMap).Parse(`[{{ .user | PadRight 6 " " }}|{{ .code | PadLeft 4 "0" }}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, map[string]string{"user": "bob", "code": "7"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "[bob   |0007]", buf.String())
+}
+
+func TestHumanize(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string]string{
+		"7380":     "2h3m",
+		"7200":     "2h",
+		"90.5":     "1m30.5s",
+		"0.25":     "250ms",
+		"0":        "0s",
+		"-60":      "-1m",
+		"123m":     "2h3m",
+		"1h0m30s":  "1h0m30s",
+		" 45s ":    "45s",
+		"tomorrow": "tomorrow",
+		"1e300":    "1e300",
+		"NaN":      "NaN",
+		"":         "",
+	} {
+		assert.Equal(t, expected, humanizeDuration(value), value)
+	}
+
+	humanizeBytes := extraFunctionMap["HumanizeBytes"].(func(string) string)
+	for value, expected := range map[string]string{
+		"0":          "0 B",
+		"1023":       "1023 B",
+		"1536":       "1.5 KiB",
+		"1073741824": "1.0 GiB",
+		"-1":         "-1",
+		"1.5":        "1.5",
+		"lots":       "lots",
+	} {
+		assert.Equal(t, expected, humanizeBytes(value), value)
+	}
+}
+
+func TestUUID(t *testing.T) {
+	t.Parallel()
+
+	random := extraFunctionMap["UUID"].(func() string)
+	seen := map[string]struct{}{}
+	for i := 0; i < 100; i++ {
+		id := random()
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uuid.Version(4), parsed.Version())
+		seen[id] = struct{}{}
+	}
+	assert.Len(t, seen, 100)
+
+	// RFC 4122 test vector.
+	assert.Equal(t, "886313e1-3b8a-5372-9b90-0c9aee199e5d", uuidV5(uuid.NameSpaceDNS.String(), "python.org"))
+	assert.Equal(t, uuidV5("users", "frank"), uuidV5("users", "frank"))
+	assert.NotEqual(t, uuidV5("users", "frank"), uuidV5("users", "john"))
+	assert.NotEqual(t, uuidV5("users", "frank"), uuidV5("accounts", "frank"))
+	parsed, err := uuid.Parse(uuidV5("users", "frank"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uuid.Version(5), parsed.Version())
+}
+
+func TestMatches(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, matches("12345", `^\d+$`))
+	assert.False(t, matches("123a5", `^\d+$`))
+	assert.True(t, matches("user=frank", `frank`))
+	// Invalid patterns never match, also once cached.
+	assert.False(t, matches("(", `(`))
+	assert.False(t, matches("(", `(`))
+
+	tmpl, err := template.New("matches").Funcs(extraFunctionMap).Parse(`{{ if Matches .Value "^\\d+$" }}****{{ else }}{{ .Value }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value, expected := range map[string]string{
+		"4111":  "****",
+		"frank": "frank",
+	} {
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, map[string]string{"Value": value}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, buf.String())
+	}
+}
+
+func TestJoinSplitList(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "a,b,c", joinList(",", []string{"a", "b", "c"}))
+	assert.Equal(t, "a;1;true", joinList(";", []interface{}{"a", float64(1), nil, true}))
+	assert.Equal(t, "single", joinList(",", "single"))
+	assert.Equal(t, "", joinList(",", []string{}))
+	assert.Equal(t, "", joinList(",", []interface{}{}))
+	assert.Equal(t, "", joinList(",", nil))
+
+	assert.Equal(t, []string{"a", "b", "c"}, splitList(",", "a,b,c"))
+	assert.Equal(t, []string{"a", "", "c"}, splitList(",", "a,,c"))
+	assert.Equal(t, []string{"abc"}, splitList(",", "abc"))
+	assert.Equal(t, []string{}, splitList(",", ""))
+
+	tmpl, err := template.New("list").Funcs(extraFunctionMap).Parse(`{{ SplitList " " .Value | Join "," }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, map[string]string{"Value": "x y z"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "x,y,z", buf.String())
+}
+
+var testTemplateYamlWithGet = `
+pipeline_stages:
+- json:
+    expressions:
+      http:
+- template:
+    source: path
+    template: '{{ Get "http.request.path" }} {{ Get "http.request.missing.key" }}{{ Get "http.status" }}'
+`
+
+func TestPipeline_TemplateGet(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testTemplateYamlWithGet), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := processEntries(pl, newEntry(nil, nil, `{"http":{"status":404,"request":{"path":"/api/v1/push"}}}`, time.Now()))[0]
+	assert.Equal(t, "/api/v1/push 404", out.Extracted["path"])
+}
+
+func TestGetPath(t *testing.T) {
+	t.Parallel()
+
+	extracted := map[string]interface{}{
+		"user": map[string]interface{}{
+			"name":  "frank",
+			"roles": []interface{}{"admin", map[string]interface{}{"scope": "read"}},
+		},
+		"http":        `{"request":{"path":"/healthz","headers":{"host":"example.com"}}}`,
+		"level":       "info",
+		"flat.key":    "flattened",
+		"empty":       "",
+		"not_nested":  "{not json",
+		"status_code": float64(200),
+	}
+	for path, expected := range map[string]string{
+		"level":                     "info",
+		"status_code":               "200",
+		"user.name":                 "frank",
+		"user.roles.0":              "admin",
+		"user.roles.1.scope":        "read",
+		"user.roles":                `["admin",{"scope":"read"}]`,
+		"http.request.path":         "/healthz",
+		"http.request.headers.host": "example.com",
+		"http.request.headers":      `{"host":"example.com"}`,
+		"flat.key":                  "flattened",
+		"missing":                   "",
+		"user.missing":              "",
+		"user.missing.name":         "",
+		"user.roles.2":              "",
+		"user.roles.first":          "",
+		"level.value":               "",
+		"not_nested.key":            "",
+		"empty.key":                 "",
+	} {
+		assert.Equal(t, expected, getPath(extracted, path), path)
+	}
+}
+
+func TestCallsGet(t *testing.T) {
+	t.Parallel()
+
+	for text, expected := range map[string]bool{
+		`{{ Get "level" }}`:                                   true,
+		`{{ Get "level" | ToUpper }}`:                         true,
+		`{{ if .Value }}{{ else }}{{ Get "a.b" }}{{ end }}`:   true,
+		`{{ range .List }}{{ (Get .).Len }}{{ end }}`:         true,
+		`{{ define "t" }}{{ Get "a" }}{{ end }}`:              true,
+		`{{ with .Value }}{{ printf "%s" (Get .) }}{{ end }}`: true,
+		`Get {{ .Value }}`:                                    false,
+		`{{ "Get" }}`:                                         false,
+		`{{ .Get }}`:                                          false,
+		`{{ GetFoo }}`:                                        false,
+	} {
+		tmpl, err := template.New("get").Funcs(functionMap).Funcs(template.FuncMap{
+			"Get":    func(string) string { return "" },
+			"GetFoo": func() string { return "" },
+		}).Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, callsGet(tmpl), text)
+	}
+}
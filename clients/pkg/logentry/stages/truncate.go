@@ -0,0 +1,145 @@
+package stages
+
+import (
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyTruncateStageConfig = "empty truncate stage configuration"
+	ErrTruncateInvalidMaxLength = "truncate stage max_length must be greater than 0"
+	ErrEmptyTruncateStageSource = "empty source"
+	ErrTruncateSuffixTooLong    = "truncate stage suffix cannot be longer than max_length"
+	ErrEmptyTruncatedKey        = "empty truncated_key in truncate stage"
+)
+
+var defaultTruncatedKey = "truncated"
+
+// TruncateConfig represents a Truncate Stage configuration
+type TruncateConfig struct {
+	// MaxLength is the maximum number of characters (runes) of the value,
+	// including the suffix.
+	MaxLength int `mapstructure:"max_length"`
+	// Suffix is appended to truncated values, e.g. `...`.
+	Suffix string  `mapstructure:"suffix"`
+	Source *string `mapstructure:"source"`
+	// TruncatedKey is the extracted key set to whether the value was truncated,
+	// `truncated` by default.
+	TruncatedKey *string `mapstructure:"truncated_key"`
+}
+
+// validateTruncateConfig validates a truncate stage config.
+func validateTruncateConfig(c *TruncateConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyTruncateStageConfig)
+	}
+	if c.MaxLength <= 0 {
+		return errors.New(ErrTruncateInvalidMaxLength)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyTruncateStageSource)
+	}
+	if utf8.RuneCountInString(c.Suffix) > c.MaxLength {
+		return errors.New(ErrTruncateSuffixTooLong)
+	}
+	if c.TruncatedKey == nil {
+		c.TruncatedKey = &defaultTruncatedKey
+	}
+	if *c.TruncatedKey == "" {
+		return errors.New(ErrEmptyTruncatedKey)
+	}
+	return nil
+}
+
+// truncateStage truncates the entry or an extracted value to a maximum length
+type truncateStage struct {
+	cfg    *TruncateConfig
+	logger log.Logger
+}
+
+// newTruncateStage creates a new truncate pipeline stage from a config.
+func newTruncateStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseTruncateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTruncateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&truncateStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "truncate"),
+	}), nil
+}
+
+func parseTruncateConfig(config interface{}) (*TruncateConfig, error) {
+	cfg := &TruncateConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (t *truncateStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	if t.cfg.Source == nil {
+		if entry == nil {
+			if Debug {
+				level.Debug(t.logger).Log("msg", "cannot truncate a nil entry")
+			}
+			return
+		}
+		result, truncated := t.truncate(*entry)
+		*entry = result
+		extracted[*t.cfg.TruncatedKey] = truncated
+		return
+	}
+
+	v, ok := extracted[*t.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(t.logger).Log("msg", "source does not exist in the set of extracted values", "source", *t.cfg.Source)
+		}
+		return
+	}
+	value, err := getString(v)
+	if err != nil {
+		if Debug {
+			level.Debug(t.logger).Log("msg", "failed to convert source value to string", "source", *t.cfg.Source, "err", err, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+	result, truncated := t.truncate(value)
+	extracted[*t.cfg.Source] = result
+	extracted[*t.cfg.TruncatedKey] = truncated
+}
+
+// truncate cuts s on a rune boundary so that, suffix included, it is at most
+// MaxLength runes long.
+func (t *truncateStage) truncate(s string) (string, bool) {
+	// Every rune takes at least one byte, shorter strings are under the limit.
+	if len(s) <= t.cfg.MaxLength || utf8.RuneCountInString(s) <= t.cfg.MaxLength {
+		return s, false
+	}
+	keep := t.cfg.MaxLength - utf8.RuneCountInString(t.cfg.Suffix)
+	end := 0
+	for i := 0; i < keep; i++ {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		end += size
+	}
+	return s[:end] + t.cfg.Suffix, true
+}
+
+// Name implements Stage
+func (t *truncateStage) Name() string {
+	return StageTypeTruncate
+}
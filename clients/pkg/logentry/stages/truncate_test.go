@@ -0,0 +1,142 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testTruncateYaml = `
+pipeline_stages:
+- truncate:
+    max_length: 8
+    suffix: "…"
+`
+
+var testTruncateYamlWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      msg:
+- truncate:
+    source: msg
+    max_length: 5
+    truncated_key: msg_truncated
+`
+
+func TestPipeline_Truncate(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config            string
+		entry             string
+		expectedEntry     string
+		expectedExtracted map[string]interface{}
+	}{
+		"under the limit": {
+			testTruncateYaml,
+			"héllo",
+			"héllo",
+			map[string]interface{}{"truncated": false},
+		},
+		"at the limit": {
+			testTruncateYaml,
+			"日本語のテキスト",
+			"日本語のテキスト",
+			map[string]interface{}{"truncated": false},
+		},
+		"over the limit": {
+			testTruncateYaml,
+			"日本語のテキストです",
+			"日本語のテキス…",
+			map[string]interface{}{"truncated": true},
+		},
+		"source over the limit": {
+			testTruncateYamlWithSource,
+			`{"msg":"données"}`,
+			`{"msg":"données"}`,
+			map[string]interface{}{"msg": "donné", "msg_truncated": true},
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			pl, err := NewPipeline(util_log.Logger, loadConfig(tt.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expectedEntry, out.Line)
+			assert.Equal(t, tt.expectedExtracted, out.Extracted)
+		})
+	}
+}
+
+func TestTruncateConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrTruncateInvalidMaxLength),
+		},
+		"negative max_length": {
+			map[string]interface{}{
+				"max_length": -1,
+			},
+			errors.New(ErrTruncateInvalidMaxLength),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"max_length": 10,
+				"source":     "",
+			},
+			errors.New(ErrEmptyTruncateStageSource),
+		},
+		"suffix too long": {
+			map[string]interface{}{
+				"max_length": 2,
+				"suffix":     "...",
+			},
+			errors.New(ErrTruncateSuffixTooLong),
+		},
+		"empty truncated_key": {
+			map[string]interface{}{
+				"max_length":    10,
+				"truncated_key": "",
+			},
+			errors.New(ErrEmptyTruncatedKey),
+		},
+		"valid": {
+			map[string]interface{}{
+				"max_length": 10,
+				"suffix":     "...",
+				"source":     "msg",
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseTruncateConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateTruncateConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("TruncateConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package stages
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyURLStageConfig = "empty url stage configuration"
+	ErrURLSourceRequired   = "url stage source value is required"
+)
+
+// URLConfig represents a URL Stage configuration
+type URLConfig struct {
+	Source string `mapstructure:"source"`
+	// QueryParams also extracts each query parameter as `url_query_<name>`,
+	// using its first value.
+	QueryParams bool `mapstructure:"query_params"`
+}
+
+// validateURLConfig validates a url stage config.
+func validateURLConfig(c *URLConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyURLStageConfig)
+	}
+	if c.Source == "" {
+		return errors.New(ErrURLSourceRequired)
+	}
+	return nil
+}
+
+// urlStage extracts the components of a URL
+type urlStage struct {
+	cfg    *URLConfig
+	logger log.Logger
+}
+
+// newURLStage creates a new url pipeline stage from a config.
+func newURLStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseURLConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateURLConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&urlStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "url"),
+	}), nil
+}
+
+func parseURLConfig(config interface{}) (*URLConfig, error) {
+	cfg := &URLConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (u *urlStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, _ *string) {
+	v, ok := extracted[u.cfg.Source]
+	if !ok {
+		if Debug {
+			level.Debug(u.logger).Log("msg", "source does not exist in the set of extracted values", "source", u.cfg.Source)
+		}
+		return
+	}
+
+	value, err := getString(v)
+	if err != nil {
+		if Debug {
+			level.Debug(u.logger).Log("msg", "failed to convert source value to string", "source", u.cfg.Source, "err", err, "type", reflect.TypeOf(v))
+		}
+		return
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		if Debug {
+			level.Debug(u.logger).Log("msg", "failed to parse url", "source", u.cfg.Source, "err", err)
+		}
+		return
+	}
+
+	extracted["url_scheme"] = parsed.Scheme
+	extracted["url_host"] = parsed.Host
+	extracted["url_path"] = parsed.Path
+	extracted["url_query"] = parsed.RawQuery
+	// Only the username is extracted, a password must not end up in the logs.
+	if parsed.User != nil {
+		extracted["url_user"] = parsed.User.Username()
+	}
+	if u.cfg.QueryParams {
+		for name, values := range parsed.Query() {
+			extracted["url_query_"+name] = values[0]
+		}
+	}
+	if Debug {
+		level.Debug(u.logger).Log("msg", "extracted data debug in url stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (u *urlStage) Name() string {
+	return StageTypeURL
+}
@@ -0,0 +1,189 @@
+package stages
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrEmptyWinEvtStageConfig = "empty winevt stage configuration"
+	ErrEmptyWinEvtStageSource = "empty source"
+)
+
+// The keys extracted from the System element of the events.
+const (
+	winevtEventIDKey  = "event_id"
+	winevtProviderKey = "provider"
+	winevtLevelKey    = "level"
+	winevtChannelKey  = "channel"
+	winevtComputerKey = "computer"
+)
+
+// WinEvtConfig represents a WinEvt Stage configuration
+type WinEvtConfig struct {
+	Source *string `mapstructure:"source"`
+	// DataPrefix prefixes the names of the EventData values in the extracted
+	// map, e.g. `data_` for `data_TargetUserName`, there is no prefix by default.
+	// The unnamed values are extracted as the prefix followed by their index,
+	// `data_<index>` without a prefix.
+	DataPrefix string `mapstructure:"data_prefix"`
+}
+
+// validateWinEvtConfig validates a winevt stage config.
+func validateWinEvtConfig(c *WinEvtConfig) error {
+	if c == nil {
+		return errors.New(ErrEmptyWinEvtStageConfig)
+	}
+	if c.Source != nil && *c.Source == "" {
+		return errors.New(ErrEmptyWinEvtStageSource)
+	}
+	return nil
+}
+
+// winevtEvent holds the fields extracted from the XML rendering of a Windows
+// event. The element names are matched in any namespace.
+type winevtEvent struct {
+	XMLName xml.Name `xml:"Event"`
+	System  struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID  string `xml:"EventID"`
+		Level    string `xml:"Level"`
+		Channel  string `xml:"Channel"`
+		Computer string `xml:"Computer"`
+	} `xml:"System"`
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"EventData"`
+}
+
+// winevtStage extracts the common fields of a Windows event rendered as XML, as
+// forwarded by the Windows agents: the `event_id`, `provider`, `level`,
+// `channel` and `computer` of the System element, and the values of the
+// EventData element under their name, or `data_<index>` when unnamed. The
+// EventData values named like one of the System fields extracted are skipped.
+type winevtStage struct {
+	cfg    *WinEvtConfig
+	logger log.Logger
+}
+
+// newWinEvtStage creates a new winevt pipeline stage from a config.
+func newWinEvtStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseWinEvtConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateWinEvtConfig(cfg); err != nil {
+		return nil, err
+	}
+	return toStage(&winevtStage{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "stage", "type", "winevt"),
+	}), nil
+}
+
+func parseWinEvtConfig(config interface{}) (*WinEvtConfig, error) {
+	cfg := &WinEvtConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (w *winevtStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the winevt stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if w.cfg.Source != nil {
+		if _, ok := extracted[*w.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(w.logger).Log("msg", "source does not exist in the set of extracted values", "source", *w.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*w.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(w.logger).Log("msg", "failed to convert source value to string", "source", *w.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*w.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(w.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	var event winevtEvent
+	if err := xml.Unmarshal([]byte(*input), &event); err != nil {
+		if Debug {
+			level.Debug(w.logger).Log("msg", "failed to unmarshal windows event", "err", err)
+		}
+		return
+	}
+
+	system := map[string]string{
+		winevtEventIDKey:  event.System.EventID,
+		winevtProviderKey: event.System.Provider.Name,
+		winevtLevelKey:    event.System.Level,
+		winevtChannelKey:  event.System.Channel,
+		winevtComputerKey: event.System.Computer,
+	}
+	for key, value := range system {
+		if value = strings.TrimSpace(value); value != "" {
+			extracted[key] = value
+		} else {
+			delete(system, key)
+		}
+	}
+	for i, data := range event.EventData.Data {
+		key := w.cfg.DataPrefix + data.Name
+		if data.Name == "" {
+			prefix := w.cfg.DataPrefix
+			if prefix == "" {
+				prefix = "data_"
+			}
+			key = prefix + strconv.Itoa(i)
+		}
+		// The System fields take precedence over the EventData values.
+		if _, ok := system[key]; ok {
+			if Debug {
+				level.Debug(w.logger).Log("msg", "skipping EventData value named like a System field", "key", key)
+			}
+			continue
+		}
+		extracted[key] = strings.TrimSpace(data.Value)
+	}
+	if Debug {
+		level.Debug(w.logger).Log("msg", "extracted data debug in winevt stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (w *winevtStage) Name() string {
+	return StageTypeWinEvt
+}
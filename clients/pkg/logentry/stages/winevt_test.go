@@ -0,0 +1,187 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+const securityEventXML = `<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'>
+  <System>
+    <Provider Name='Microsoft-Windows-Security-Auditing' Guid='{54849625-5478-4994-a5ba-3e3b0328c30d}'/>
+    <EventID>4625</EventID>
+    <Version>0</Version>
+    <Level>0</Level>
+    <Task>12544</Task>
+    <Opcode>0</Opcode>
+    <Keywords>0x8010000000000000</Keywords>
+    <TimeCreated SystemTime='2024-05-01T12:00:00.000000000Z'/>
+    <EventRecordID>102934</EventRecordID>
+    <Execution ProcessID='636' ThreadID='2384'/>
+    <Channel>Security</Channel>
+    <Computer>DC01.contoso.local</Computer>
+    <Security/>
+  </System>
+  <EventData>
+    <Data Name='SubjectUserSid'>S-1-5-18</Data>
+    <Data Name='TargetUserName'>frank</Data>
+    <Data Name='TargetDomainName'>CONTOSO</Data>
+    <Data Name='Status'>0xc000006d</Data>
+    <Data Name='LogonType'>3</Data>
+    <Data Name='IpAddress'>10.0.0.42</Data>
+    <Data Name='WorkstationName'>-</Data>
+  </EventData>
+</Event>`
+
+var testWinEvtYaml = `
+pipeline_stages:
+- json:
+    expressions:
+      xml:
+- winevt:
+    source: xml
+    data_prefix: data_
+`
+
+func TestPipeline_WinEvt(t *testing.T) {
+	t.Parallel()
+
+	pl, err := NewPipeline(util_log.Logger, loadConfig(testWinEvtYaml), nil, prometheus.DefaultRegisterer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := `{"xml":"<Event><System><Provider Name='App'/><EventID>1000</EventID><Level>2</Level></System><EventData><Data Name='Application'>app.exe</Data></EventData></Event>"}`
+	out := processEntries(pl, newEntry(nil, nil, entry, time.Now()))[0]
+	assert.Equal(t, "1000", out.Extracted["event_id"])
+	assert.Equal(t, "App", out.Extracted["provider"])
+	assert.Equal(t, "2", out.Extracted["level"])
+	assert.Equal(t, "app.exe", out.Extracted["data_Application"])
+}
+
+func TestWinEvtStage_Process(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config   map[string]interface{}
+		entry    string
+		expected map[string]interface{}
+	}{
+		"security event": {
+			nil,
+			securityEventXML,
+			map[string]interface{}{
+				"event_id":         "4625",
+				"provider":         "Microsoft-Windows-Security-Auditing",
+				"level":            "0",
+				"channel":          "Security",
+				"computer":         "DC01.contoso.local",
+				"SubjectUserSid":   "S-1-5-18",
+				"TargetUserName":   "frank",
+				"TargetDomainName": "CONTOSO",
+				"Status":           "0xc000006d",
+				"LogonType":        "3",
+				"IpAddress":        "10.0.0.42",
+				"WorkstationName":  "-",
+			},
+		},
+		"unnamed data": {
+			nil,
+			`<Event><System><EventID Qualifiers='16384'>7036</EventID><Computer>WS01</Computer></System>` +
+				`<EventData><Data>Windows Update</Data><Data>running</Data></EventData></Event>`,
+			map[string]interface{}{
+				"event_id": "7036",
+				"computer": "WS01",
+				"data_0":   "Windows Update",
+				"data_1":   "running",
+			},
+		},
+		"unnamed data with prefix": {
+			map[string]interface{}{"data_prefix": "data_"},
+			`<Event><System><EventID>7036</EventID></System>` +
+				`<EventData><Data>Windows Update</Data><Data Name='State'>running</Data></EventData></Event>`,
+			map[string]interface{}{
+				"event_id":   "7036",
+				"data_0":     "Windows Update",
+				"data_State": "running",
+			},
+		},
+		"data named like a system field": {
+			nil,
+			`<Event><System><EventID>1000</EventID><Level>2</Level></System>` +
+				`<EventData><Data Name='Level'>Critical</Data><Data Name='level'>debug</Data><Data Name='channel'>Custom</Data></EventData></Event>`,
+			map[string]interface{}{
+				"event_id": "1000",
+				"level":    "2",
+				"Level":    "Critical",
+				"channel":  "Custom",
+			},
+		},
+		"not an event": {
+			nil,
+			`<Record><EventID>1</EventID></Record>`,
+			map[string]interface{}{},
+		},
+		"invalid xml": {
+			nil,
+			`<Event><System><EventID>4625</System>`,
+			map[string]interface{}{},
+		},
+		"not xml": {
+			nil,
+			"level=info msg=started",
+			map[string]interface{}{},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			st, err := newWinEvtStage(util_log.Logger, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(st, newEntry(map[string]interface{}{}, nil, tt.entry, time.Now()))[0]
+			assert.Equal(t, tt.expected, out.Extracted)
+			assert.Equal(t, tt.entry, out.Line)
+		})
+	}
+}
+
+func TestWinEvtConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty source": {
+			map[string]interface{}{
+				"source": "",
+			},
+			errors.New(ErrEmptyWinEvtStageSource),
+		},
+		"defaults": {
+			nil,
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseWinEvtConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			err = validateWinEvtConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("WinEvtConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package stages
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Config Errors
+const (
+	ErrXPathExpressionsRequired = "XPath expression is required"
+	ErrCouldNotCompileXPath     = "could not compile XPath expression"
+	ErrEmptyXMLStageConfig      = "empty xml stage configuration"
+	ErrEmptyXMLStageSource      = "empty source"
+)
+
+// XMLConfig represents a XML Stage configuration
+type XMLConfig struct {
+	Expressions map[string]string `mapstructure:"expressions"`
+	Source      *string           `mapstructure:"source"`
+	// Namespaces maps the prefixes used in the expressions to namespace URIs.
+	Namespaces map[string]string `mapstructure:"namespaces"`
+}
+
+// validateXMLConfig validates a xml config and returns a map of compiled XPath expressions.
+func validateXMLConfig(c *XMLConfig) (map[string]*xpath.Expr, error) {
+	if c == nil {
+		return nil, errors.New(ErrEmptyXMLStageConfig)
+	}
+
+	if len(c.Expressions) == 0 {
+		return nil, errors.New(ErrXPathExpressionsRequired)
+	}
+
+	if c.Source != nil && *c.Source == "" {
+		return nil, errors.New(ErrEmptyXMLStageSource)
+	}
+
+	expressions := map[string]*xpath.Expr{}
+
+	for n, e := range c.Expressions {
+		var err error
+		query := e
+		// If there is no expression, select the first element with the same name.
+		if e == "" {
+			query = "//" + n
+		}
+		expressions[n], err = xpath.CompileWithNS(query, c.Namespaces)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrCouldNotCompileXPath)
+		}
+	}
+	return expressions, nil
+}
+
+// xmlStage sets extracted data using XPath expressions
+type xmlStage struct {
+	cfg         *XMLConfig
+	expressions map[string]*xpath.Expr
+	logger      log.Logger
+}
+
+// newXMLStage creates a new xml pipeline stage from a config.
+func newXMLStage(logger log.Logger, config interface{}) (Stage, error) {
+	cfg, err := parseXMLConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	expressions, err := validateXMLConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return toStage(&xmlStage{
+		cfg:         cfg,
+		expressions: expressions,
+		logger:      log.With(logger, "component", "stage", "type", "xml"),
+	}), nil
+}
+
+func parseXMLConfig(config interface{}) (*XMLConfig, error) {
+	cfg := &XMLConfig{}
+	err := mapstructure.Decode(config, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Process implements Stage
+func (x *xmlStage) Process(_ model.LabelSet, extracted map[string]interface{}, _ *time.Time, entry *string) {
+	// If a source key is provided, the xml stage should process it
+	// from the extracted map, otherwise should fallback to the entry
+	input := entry
+
+	if x.cfg.Source != nil {
+		if _, ok := extracted[*x.cfg.Source]; !ok {
+			if Debug {
+				level.Debug(x.logger).Log("msg", "source does not exist in the set of extracted values", "source", *x.cfg.Source)
+			}
+			return
+		}
+
+		value, err := getString(extracted[*x.cfg.Source])
+		if err != nil {
+			if Debug {
+				level.Debug(x.logger).Log("msg", "failed to convert source value to string", "source", *x.cfg.Source, "err", err, "type", reflect.TypeOf(extracted[*x.cfg.Source]))
+			}
+			return
+		}
+
+		input = &value
+	}
+
+	if input == nil {
+		if Debug {
+			level.Debug(x.logger).Log("msg", "cannot parse a nil entry")
+		}
+		return
+	}
+
+	doc, err := xmlquery.Parse(strings.NewReader(*input))
+	if err != nil {
+		if Debug {
+			level.Debug(x.logger).Log("msg", "failed to unmarshal log line", "err", err)
+		}
+		return
+	}
+
+	for n, e := range x.expressions {
+		r := e.Evaluate(xmlquery.CreateXPathNavigator(doc))
+		switch v := r.(type) {
+		case *xpath.NodeIterator:
+			if !v.MoveNext() {
+				continue
+			}
+			extracted[n] = v.Current().Value()
+		case float64:
+			extracted[n] = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			extracted[n] = v
+		case bool:
+			extracted[n] = strconv.FormatBool(v)
+		default:
+			if Debug {
+				level.Debug(x.logger).Log("msg", "unexpected XPath result type", "key", n, "type", reflect.TypeOf(r))
+			}
+		}
+	}
+	if Debug {
+		level.Debug(x.logger).Log("msg", "extracted data debug in xml stage", "extracted data", fmt.Sprintf("%v", extracted))
+	}
+}
+
+// Name implements Stage
+func (x *xmlStage) Name() string {
+	return StageTypeXML
+}
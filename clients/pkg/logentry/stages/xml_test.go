@@ -0,0 +1,149 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	util_log "github.com/grafana/loki/v3/pkg/util/log"
+)
+
+var testXMLYamlSingleStageWithoutSource = `
+pipeline_stages:
+- xml:
+    expressions:
+      app:   /event/@app
+      level: /event/level
+      msg:   /event/message
+      tags:  count(/event/tags/tag)
+      user:
+      unknown:
+`
+
+var testXMLYamlMultiStageWithSource = `
+pipeline_stages:
+- json:
+    expressions:
+      payload:
+- xml:
+    source: payload
+    namespaces:
+      s: http://schemas.xmlsoap.org/soap/envelope/
+      m: urn:example:orders
+    expressions:
+      order: //m:order/@id
+      status: /s:Envelope/s:Body/m:order/m:status
+`
+
+var testXMLLogLine = `<event app="loki">
+	<level>WARN</level>
+	<message>this is a log line</message>
+	<user>marco</user>
+	<tags><tag>a</tag><tag>b</tag></tags>
+</event>`
+
+var testXMLLogJSONLine = `{"payload": "<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\"><s:Body><o:order xmlns:o=\"urn:example:orders\" id=\"42\"><o:status>shipped</o:status></o:order></s:Body></s:Envelope>"}`
+
+func TestPipeline_XML(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config          string
+		entry           string
+		expectedExtract map[string]interface{}
+	}{
+		"successfully run a pipeline with 1 xml stage without source": {
+			testXMLYamlSingleStageWithoutSource,
+			testXMLLogLine,
+			map[string]interface{}{
+				"app":   "loki",
+				"level": "WARN",
+				"msg":   "this is a log line",
+				"tags":  "2",
+				"user":  "marco",
+			},
+		},
+		"successfully run a pipeline with xml stage with source and namespaces": {
+			testXMLYamlMultiStageWithSource,
+			testXMLLogJSONLine,
+			map[string]interface{}{
+				"payload": `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><o:order xmlns:o="urn:example:orders" id="42"><o:status>shipped</o:status></o:order></s:Body></s:Envelope>`,
+				"order":   "42",
+				"status":  "shipped",
+			},
+		},
+		"malformed xml is skipped": {
+			testXMLYamlSingleStageWithoutSource,
+			`<event app="loki"><level>WARN</level>`,
+			map[string]interface{}{},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			t.Parallel()
+
+			pl, err := NewPipeline(util_log.Logger, loadConfig(testData.config), nil, prometheus.DefaultRegisterer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := processEntries(pl, newEntry(nil, nil, testData.entry, time.Now()))[0]
+			assert.Equal(t, testData.expectedExtract, out.Extracted)
+		})
+	}
+}
+
+func TestXMLConfig_validate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		config interface{}
+		err    error
+	}{
+		"empty config": {
+			nil,
+			errors.New(ErrXPathExpressionsRequired),
+		},
+		"no expressions": {
+			map[string]interface{}{},
+			errors.New(ErrXPathExpressionsRequired),
+		},
+		"empty source": {
+			map[string]interface{}{
+				"expressions": map[string]string{"level": "/event/level"},
+				"source":      "",
+			},
+			errors.New(ErrEmptyXMLStageSource),
+		},
+		"invalid expression": {
+			map[string]interface{}{
+				"expressions": map[string]string{"level": "/event/[level"},
+			},
+			errors.New(ErrCouldNotCompileXPath + ": expression must evaluate to a node-set"),
+		},
+		"valid": {
+			map[string]interface{}{
+				"expressions": map[string]string{"level": "/event/level", "app": ""},
+			},
+			nil,
+		},
+	}
+	for tName, tt := range tests {
+		t.Run(tName, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseXMLConfig(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create config: %s", err)
+			}
+			_, err = validateXMLConfig(c)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("XMLConfig.validate() expected error = %v, actual error = %v", tt.err, err)
+			}
+			if err != nil {
+				assert.Equal(t, tt.err.Error(), err.Error())
+			}
+		})
+	}
+}